@@ -5,20 +5,26 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/adaptive"
+	"cloudeng.io/cmd/idu/internal/boolexpr"
 	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database/types"
 	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/cmd/idu/internal/ratelimit"
 	"cloudeng.io/cmdutil"
 	"cloudeng.io/errors"
 	"cloudeng.io/file"
@@ -39,6 +45,10 @@ type analyzeFlags struct {
 	Force     bool          `subcmd:"force,false,reanalyze even if the database is up to date"`
 	SlowScans time.Duration `subcmd:"slow-scan-duration,10s,duration at which scans are reported as slow"`
 	Defaults  bool          `subcmd:"show-defaults,false,display default scanning options and exit"`
+	Retry     bool          `subcmd:"retry-errors,false,'rescan only the prefixes and files that failed during a previous analyze, clearing the errors that are resolved'"`
+	All       bool          `subcmd:"all,false,'analyze all of the configured prefixes, in which case all arguments are treated as an expression'"`
+	DryRun    bool          `subcmd:"dry-run,false,'report the prefixes that are new, changed or deleted since the previous analyze without writing to the database, which is opened read-only'"`
+	Budget    int           `subcmd:"concurrency-budget,0,'when analyzing multiple prefixes, the total number of concurrent scans, as per the concurrent_scans configured for each prefix, that may be used by the analyses running at any one time; an analysis is started only if its concurrent scans fit within the remaining budget or if no other analysis is running, hence zero analyzes one prefix at a time'"`
 }
 
 type analyzeCmd struct{}
@@ -50,8 +60,6 @@ func (alz *analyzeCmd) analyze(ctx context.Context, values interface{}, args []s
 }
 
 func (alz *analyzeCmd) analyzeFS(ctx context.Context, fwfs filewalk.FS, af *analyzeFlags, args []string) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
 	if err := useMaxProcs(ctx); err != nil {
 		internal.Log(ctx, internal.LogError, "failed to set max procs", "error", err)
 	}
@@ -59,46 +67,146 @@ func (alz *analyzeCmd) analyzeFS(ctx context.Context, fwfs filewalk.FS, af *anal
 		showDefaults()
 		return nil
 	}
-	start := time.Now()
-	ctx, cfg, err := internal.LookupPrefix(ctx, globalConfig, args[0])
+	prefixes, expr, err := alz.prefixesAndExpression(ctx, fwfs, af, args)
 	if err != nil {
 		return err
 	}
+	if len(prefixes) == 1 {
+		_, err := alz.analyzePrefix(ctx, fwfs, af, prefixRun{
+			prefix:        prefixes[0],
+			progress:      af.Progress,
+			handleSignals: true,
+		}, expr)
+		return err
+	}
+	return alz.analyzePrefixes(ctx, fwfs, af, prefixes, expr)
+}
+
+// prefixRun specifies how a single prefix is to be analyzed when
+// analyze is invoked for one or more prefixes.
+type prefixRun struct {
+	prefix        string
+	nested        []string // other prefixes being analyzed that are within prefix.
+	progress      bool
+	handleSignals bool
+}
+
+func (alz *analyzeCmd) analyzePrefix(ctx context.Context, fwfs filewalk.FS, af *analyzeFlags, run prefixRun, expr []string) (anaylzeSummary, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := time.Now()
+	ctx, cfg, err := internal.LookupPrefix(ctx, globalConfig, run.prefix)
+	if err != nil {
+		return anaylzeSummary{}, err
+	}
+	if len(expr) == 0 && len(cfg.AnalyzeExpression) > 0 {
+		expr = []string{cfg.AnalyzeExpression}
+	}
+	prune, err := boolexpr.CreateMatcher(boolexpr.NewParser(ctx, fwfs),
+		boolexpr.WithFilewalkFS(fwfs),
+		boolexpr.WithEntryExpression(expr...))
+	if err != nil {
+		return anaylzeSummary{}, err
+	}
 	if cfg.SetMaxThreads > 0 {
 		debug.SetMaxThreads(cfg.SetMaxThreads)
 		internal.Log(ctx, internal.LogProgress, "set max threads", "max-threads", cfg.SetMaxThreads)
 	}
-	var sdb internal.ScanDB
-	sdb, err = internal.NewScanDB(ctx, cfg)
-	if err != nil {
-		return fmt.Errorf("open/create database: %v: %v", cfg.Database, err)
+	var ctrl *adaptive.Controller
+	if cfg.Adaptive.Enabled {
+		// The configured, or default, concurrency is used as an upper
+		// bound that the controller will not exceed.
+		ctrl = adaptive.New(cfg.Adaptive,
+			cmp.Or(cfg.ConcurrentScans, filewalk.DefaultConcurrentScans),
+			cmp.Or(cfg.ConcurrentStats, asyncstat.DefaultAsyncStats))
+		fwfs = ctrl.FS(fwfs)
+	}
+	var rl *ratelimit.Limiter
+	if cfg.RateLimit.Enabled() {
+		rl = ratelimit.New(cfg.RateLimit, ratelimit.WithOnChange(func(a ratelimit.Applied) {
+			internal.Log(ctx, internal.LogProgress, "rate limit",
+				"prefix", cfg.Prefix,
+				"ops-per-second", a.OpsPerSecond)
+		}))
+		// Wrap any adaptive controller so that time spent waiting for
+		// the rate limiter is not counted as filesystem latency.
+		fwfs = rl.FS(fwfs)
 	}
-	if err := sdb.DeleteErrors(ctx, args[0]); err != nil {
-		return fmt.Errorf("DeleteErrors: %v", err)
+	var sdb internal.ScanDB
+	var drdb *dryRunDB
+	if af.DryRun {
+		sdb, err = internal.NewReadOnlyScanDB(ctx, cfg)
+		if err != nil {
+			return anaylzeSummary{}, fmt.Errorf("open database: %v: %v", cfg.Database, err)
+		}
+		drdb = newDryRunDB(sdb, cfg.Separator)
+		sdb = drdb
+	} else {
+		if cfg.History.Enabled {
+			sdb, err = internal.NewHistoryScanDB(ctx, cfg, start)
+		} else {
+			sdb, err = internal.NewScanDB(ctx, cfg)
+		}
+		if err != nil {
+			return anaylzeSummary{}, fmt.Errorf("open/create database: %v: %v", cfg.Database, err)
+		}
 	}
 	defer sdb.Close(ctx)
 
-	// Close the database as quickly as possible.
-	signal.Reset(os.Interrupt, syscall.SIGTERM)
-	cmdutil.HandleSignals(func() {
-		cancel()
-		sdb.Close(ctx)
-		fmt.Printf("database closed, waiting for all filesystem operations to finish\n")
-	}, os.Interrupt, os.Kill)
+	roots := []string{run.prefix}
+	var retries *errorRetries
+	var attempts *errorAttempts
+	if af.Retry {
+		retries, err = newErrorRetries(ctx, sdb, fwfs, run.prefix, cfg.Separator)
+		if err != nil {
+			return anaylzeSummary{}, fmt.Errorf("VisitErrors: %v", err)
+		}
+		if len(retries.keys) == 0 {
+			fmt.Printf("no errors to retry for %v\n", run.prefix)
+			return anaylzeSummary{}, nil
+		}
+		roots = retries.roots()
+		fmt.Printf("retrying %v errors by rescanning %v prefixes\n", len(retries.keys), len(roots))
+	} else {
+		// Errors are deleted before the prefix is rescanned, but the
+		// number of attempts is retained for those that recur.
+		attempts, err = previousAttempts(ctx, sdb, run.prefix, cfg.Separator)
+		if err != nil {
+			return anaylzeSummary{}, fmt.Errorf("VisitErrors: %v", err)
+		}
+		if err := sdb.DeleteErrors(ctx, run.prefix); err != nil {
+			return anaylzeSummary{}, fmt.Errorf("DeleteErrors: %v", err)
+		}
+	}
+
+	if run.handleSignals {
+		// Close the database as quickly as possible.
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		cmdutil.HandleSignals(func() {
+			cancel()
+			sdb.Close(ctx)
+			fmt.Printf("database closed, waiting for all filesystem operations to finish\n")
+		}, os.Interrupt, os.Kill)
+	}
 
 	pctx, pcancel := context.WithCancel(ctx)
 	defer pcancel() // cancel progress tracker
 	var wg sync.WaitGroup
 	wg.Add(1)
-	pt := newProgressTracker(pctx, time.Second, af.Progress, true, &wg)
+	pt := newProgressTracker(pctx, time.Second, run.progress, true, &wg)
 
 	w := &walker{
 		cfg:       cfg,
 		db:        sdb,
 		fs:        fwfs,
 		pt:        pt,
+		prune:     prune,
 		slowScan:  af.SlowScans,
-		reAnalyze: af.Force,
+		reAnalyze: af.Force || af.Retry,
+		retries:   retries,
+		attempts:  attempts,
+		limiter:   rl,
+		nested:    run.nested,
 	}
 
 	w.lsi = asyncstat.New(fwfs,
@@ -118,14 +226,53 @@ func (alz *analyzeCmd) analyzeFS(ctx context.Context, fwfs filewalk.FS, af *anal
 	wc := walker.Configuration()
 	ic := w.lsi.Configuration()
 	fmt.Printf("configuration: scan size %v, concurrent scans %v, concurrent stats %v, concurrent stats threshold %v\n", wc.ScanSize, wc.ConcurrentScans, ic.AsyncStats, ic.AsyncThreshold)
+	if ctrl != nil {
+		scans, stats := ctrl.Concurrency()
+		fmt.Printf("adaptive concurrency: initial scans %v, initial stats %v, target latency %v, target iops %v, max error rate %v\n", scans, stats, cfg.Adaptive.TargetLatency, cfg.Adaptive.TargetIOPS, cfg.Adaptive.MaxErrorRate)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctrl.Run(pctx, func(ch adaptive.Change) {
+				w.logConcurrencyChange(ctx, ch)
+			})
+		}()
+	}
 
 	errs := errors.M{}
-	errs.Append(walker.Walk(ctx, args[0]))
+	errs.Append(walker.Walk(ctx, roots...))
 	pcancel() // cancel progress tracker.
 	wg.Wait()
 
-	errs.Append(alz.summarizeAndLog(ctx, sdb, pt, start))
-	return errs.Squash(context.Canceled)
+	if rl != nil {
+		pt.setRateLimits(rl.Applied())
+	}
+
+	if retries != nil && ctx.Err() == nil {
+		errs.Append(alz.clearResolvedErrors(ctx, sdb, pt, retries))
+	}
+
+	if drdb != nil {
+		changes := drdb.summary()
+		pt.setDryRun(&changes)
+	}
+
+	summary, err := alz.summarizeAndLog(ctx, sdb, pt, strings.Join(expr, " "), start)
+	errs.Append(err)
+	if summary.DryRun != nil {
+		summary.DryRun.print(os.Stdout, cfg.Database)
+	}
+	return summary, errs.Squash(context.Canceled)
+}
+
+func (alz *analyzeCmd) clearResolvedErrors(ctx context.Context, sdb internal.ScanDB, pt *progressTracker, retries *errorRetries) error {
+	resolved := retries.resolved()
+	for _, key := range resolved {
+		if err := sdb.DeleteError(ctx, key); err != nil {
+			return fmt.Errorf("DeleteError: %v: %v", key, err)
+		}
+	}
+	pt.setRetriedErrors(int64(len(retries.keys)), int64(len(resolved)))
+	return nil
 }
 
 func cl() string {
@@ -141,23 +288,21 @@ func cl() string {
 	return strings.TrimSpace(out.String())
 }
 
-func (alz *analyzeCmd) summarizeAndLog(ctx context.Context, sdb internal.ScanDB, pt *progressTracker, start time.Time) error {
+func (alz *analyzeCmd) summarizeAndLog(ctx context.Context, sdb internal.ScanDB, pt *progressTracker, expr string, start time.Time) (anaylzeSummary, error) {
 	defer pt.summary(ctx)
-	if sdb == nil {
-		return nil
-	}
 	s := pt.summarize()
 	s.Operation = "analyze"
 	s.Command = cl()
+	s.Expression = expr
 	s.Duration = time.Since(start)
+	if sdb == nil {
+		return s, nil
+	}
 	buf, err := json.Marshal(s)
 	if err != nil {
-		return err
-	}
-	if sdb == nil {
-		return nil
+		return s, err
 	}
-	return sdb.LogAndClose(ctx, start, time.Now(), buf)
+	return s, sdb.LogAndClose(ctx, start, time.Now(), buf)
 }
 
 type walker struct {
@@ -166,9 +311,14 @@ type walker struct {
 	fs        filewalk.FS
 	fw        *filewalk.Walker[prefixState]
 	pt        *progressTracker
+	prune     boolexpr.Matcher
 	slowScan  time.Duration
 	lsi       *asyncstat.T
 	reAnalyze bool
+	retries   *errorRetries
+	attempts  *errorAttempts
+	limiter   *ratelimit.Limiter
+	nested    []string
 }
 
 type prefixState struct {
@@ -183,17 +333,65 @@ type prefixState struct {
 	contentsStart   time.Time
 }
 
-func (w *walker) dbLogErr(ctx context.Context, prefix string, val []byte) {
-	_ = w.db.LogError(ctx, prefix, time.Now(), val)
+func (w *walker) dbLogErr(ctx context.Context, op, key string, err error) {
+	pl := types.ErrorPayload{
+		When:      time.Now(),
+		Key:       key,
+		Payload:   []byte(err.Error()),
+		Operation: op,
+		Category:  w.classifyError(err),
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		pl.Errno = int64(errno)
+	}
+	if prev := w.attempts.take(key); prev > 0 {
+		pl.Attempts = prev + 1
+		_ = w.db.SetError(ctx, pl)
+	} else {
+		_ = w.db.LogError(ctx, pl)
+	}
+	if w.retries != nil {
+		w.retries.logged(key)
+	}
 	w.pt.incErrors()
 }
 
+func (w *walker) logConcurrencyChange(ctx context.Context, ch adaptive.Change) {
+	internal.Log(ctx, internal.LogProgress, "concurrency change",
+		"prefix", w.cfg.Prefix,
+		"reason", ch.Reason,
+		"scans", ch.Scans,
+		"previous-scans", ch.PrevScans,
+		"stats", ch.Stats,
+		"previous-stats", ch.PrevStats,
+		"mean-stat-latency", ch.MeanStatLatency.String(),
+		"iops", int64(ch.IOPS),
+		"error-rate", ch.ErrorRate,
+		"interval", ch.ObservedInterval.String())
+	w.pt.incConcurrencyChanges()
+}
+
+func (w *walker) classifyError(err error) types.ErrorCategory {
+	switch {
+	case w.fs.IsPermissionError(err):
+		return types.ErrorPermission
+	case w.fs.IsNotExist(err):
+		return types.ErrorNotExist
+	case os.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded):
+		return types.ErrorTimeout
+	case errors.Is(err, syscall.EIO):
+		return types.ErrorIO
+	}
+	return types.ErrorOther
+}
+
 func (w *walker) logLStatError(ctx context.Context, filename string, err error) {
 	internal.Log(ctx,
 		internal.LogError, "stat error",
 		"file", filename,
 		"error", err)
-	w.dbLogErr(ctx, filename, []byte(err.Error()))
+	w.dbLogErr(ctx, types.OpLstat, filename, err)
 }
 
 func (w *walker) handlePrefix(ctx context.Context, state *prefixState, prefix string, info file.Info) (stop, unchanged bool, _ error) {
@@ -213,14 +411,21 @@ func (w *walker) handlePrefix(ctx context.Context, state *prefixState, prefix st
 	// level information such as uid, gid, dev, ino etc.
 	xattr, err := w.fs.XAttr(ctx, prefix, info)
 	if err != nil {
-		w.dbLogErr(ctx, prefix, []byte(err.Error()))
+		w.dbLogErr(ctx, types.OpXAttr, prefix, err)
 		internal.Log(ctx, internal.LogPrefix, "prefix xattr error",
 			"prefix", w.cfg.Prefix,
 			"path", prefix,
 			"error", err)
 	}
-	info.SetSys(xattr)
+	info.SetSys(w.sysInfo(ctx, prefix, info, xattr))
 	current := prefixinfo.New(prefix, info)
+	if w.prune.Prefix(prefix, &current) {
+		internal.Log(ctx, internal.LogPrefix, "prefix pruned",
+			"prefix", w.cfg.Prefix,
+			"path", prefix)
+		w.pt.addPruned(prefix)
+		return true, false, nil
+	}
 	state.current = current
 
 	ok, err := w.db.GetPrefixInfo(ctx, prefix, &state.existing)
@@ -233,7 +438,9 @@ func (w *walker) handlePrefix(ctx context.Context, state *prefixState, prefix st
 		return true, false, err
 	}
 
-	if !w.reAnalyze && state.existing.Unchanged(state.current) {
+	// Access times change without the prefix being modified and hence
+	// files must be restated whenever access times are being recorded.
+	if access, _, _ := w.cfg.TimesToRecord(); !w.reAnalyze && !access && state.existing.Unchanged(state.current) {
 		// Cam reuse all file entries, but will need to restat all
 		// prefixes/directories in any case.
 		state.current.SetInfoList(state.existing.FilesOnly())
@@ -249,7 +456,7 @@ func (w *walker) Prefix(ctx context.Context, state *prefixState, prefix string,
 			"prefix", w.cfg.Prefix,
 			"path", prefix,
 			"error", err)
-		w.dbLogErr(ctx, prefix, []byte(err.Error()))
+		w.dbLogErr(ctx, types.OpLstat, prefix, err)
 		if w.fs.IsPermissionError(err) || w.fs.IsNotExist(err) {
 			// Don't return these errors via the walker.
 			return true, nil, nil
@@ -264,6 +471,13 @@ func (w *walker) Prefix(ctx context.Context, state *prefixState, prefix string,
 		return true, nil, nil
 	}
 
+	if slices.Contains(w.nested, prefix) {
+		internal.Log(ctx, internal.LogPrefix, "nested prefix skipped",
+			"prefix", w.cfg.Prefix,
+			"path", prefix)
+		return true, nil, nil
+	}
+
 	state.start = time.Now()
 	state.contentsStart = state.start
 	internal.Log(ctx, internal.LogPrefix, "prefix start",
@@ -273,7 +487,7 @@ func (w *walker) Prefix(ctx context.Context, state *prefixState, prefix string,
 
 	stop, state.parentUnchanged, retErr = w.handlePrefix(ctx, state, prefix, info)
 	if retErr != nil {
-		w.dbLogErr(ctx, prefix, []byte(retErr.Error()))
+		w.dbLogErr(ctx, types.OpDB, prefix, retErr)
 		return true, nil, retErr
 	}
 	state.info = info
@@ -286,20 +500,58 @@ func (w *walker) Prefix(ctx context.Context, state *prefixState, prefix string,
 func (w *walker) processStats(ctx context.Context, prefix string, toStat []filewalk.Entry) (children, all file.InfoList, err error) {
 	children, all, err = w.lsi.Process(ctx, prefix, toStat)
 	if err != nil {
-		w.dbLogErr(ctx, prefix, []byte(err.Error()))
+		w.dbLogErr(ctx, types.OpLstat, prefix, err)
 		return nil, nil, err
 	}
 	for i, fi := range all {
 		filename := w.fs.Join(prefix, fi.Name())
 		xattr, _ := w.fs.XAttr(ctx, filename, fi)
 		// Regardless of any error, set the system information
-		// to be of type filewalk.XAttr since all other code
-		// assumes it so.
-		all[i].SetSys(xattr)
+		// to be of type filewalk.XAttr, or prefixinfo.XAttrAndTimes,
+		// since all other code assumes it so.
+		all[i].SetSys(w.sysInfo(ctx, filename, fi, xattr))
 	}
 	return children, all, nil
 }
 
+// sysInfo returns the system information to be stored for the supplied
+// file, including any file times and project ID that are configured to
+// be recorded. It must be called before the file's Sys() value is replaced.
+// The statx call needed for birth times and the ioctl needed for project
+// IDs bypass the filewalk.FS and hence are rate limited here.
+func (w *walker) sysInfo(ctx context.Context, filename string, fi file.Info, xattr file.XAttr) any {
+	access, change, birth := w.cfg.TimesToRecord()
+	if !access && !change && !birth && !w.cfg.ProjectIDs {
+		return xattr
+	}
+	sys := prefixinfo.XAttrAndTimes{XAttr: xattr}
+	if access || change || birth {
+		sys.Times = statTimes(filename, fi, birth && w.wait(ctx))
+	}
+	if !access {
+		sys.Times.Access = time.Time{}
+	}
+	if !change {
+		sys.Times.Change = time.Time{}
+	}
+	if !birth {
+		sys.Times.Birth = time.Time{}
+	}
+	if w.cfg.ProjectIDs && w.wait(ctx) {
+		sys.ProjectID = projectID(filename, fi)
+	}
+	return sys
+}
+
+// wait waits for the rate limiter, if any, and returns false if the
+// context was canceled whilst waiting.
+func (w *walker) wait(ctx context.Context) bool {
+	if w.limiter == nil {
+		return true
+	}
+	return w.limiter.Wait(ctx) == nil
+}
+
 func (w *walker) Contents(ctx context.Context, state *prefixState, prefix string, contents []filewalk.Entry) (file.InfoList, error) {
 	sinceLast := time.Since(state.contentsStart)
 	state.contentsStart = time.Now()
@@ -320,24 +572,29 @@ func (w *walker) Contents(ctx context.Context, state *prefixState, prefix string
 			}
 			toStat = append(toStat, entry)
 		}
-		children, all, err := w.processStats(ctx, prefix, toStat)
-		if err != nil {
-			w.dbLogErr(ctx, prefix, []byte(err.Error()))
-		}
+		// Any errors are logged by processStats.
+		children, all, _ := w.processStats(ctx, prefix, toStat)
 		state.current.AppendInfoList(all)
 		state.nfiles += int64(len(all) - len(children))
 		state.nchildren += int64(len(children))
-		return children, nil
+		return w.descend(prefix, children), nil
 	}
 
-	children, all, err := w.processStats(ctx, prefix, contents)
-	if err != nil {
-		w.dbLogErr(ctx, prefix, []byte(err.Error()))
-	}
+	children, all, _ := w.processStats(ctx, prefix, contents)
 	state.nfiles += int64(len(all) - len(children))
 	state.nchildren += int64(len(children))
 	state.current.AppendInfoList(all)
-	return children, nil
+	return w.descend(prefix, children), nil
+}
+
+// descend returns the children of prefix that are to be scanned, which
+// is all of them unless errors are being retried and only the files
+// within prefix need to be rescanned.
+func (w *walker) descend(prefix string, children file.InfoList) file.InfoList {
+	if w.retries != nil && !w.retries.descend(prefix) {
+		return nil
+	}
+	return children
 }
 
 func (w *walker) Done(ctx context.Context, state *prefixState, prefix string, err error) error {
@@ -346,7 +603,7 @@ func (w *walker) Done(ctx context.Context, state *prefixState, prefix string, er
 			"prefix", w.cfg.Prefix,
 			"path", prefix,
 			"error", err)
-		w.dbLogErr(ctx, prefix, []byte(err.Error()))
+		w.dbLogErr(ctx, types.OpReaddir, prefix, err)
 	}
 
 	defer func(state *prefixState) {
@@ -415,7 +672,7 @@ func (w *walker) handleDeletedOrChangedPrefixes(ctx context.Context, prefix stri
 		p := w.fs.Join(prefix, d)
 		if err := w.db.DeletePrefix(ctx, p); err != nil {
 			errs.Append(err)
-			w.dbLogErr(ctx, p, []byte(err.Error()))
+			w.dbLogErr(ctx, types.OpDB, p, err)
 		}
 		ndeleted++
 	}
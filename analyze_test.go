@@ -5,12 +5,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"slices"
 	"sort"
@@ -21,7 +24,10 @@ import (
 	"cloudeng.io/cmd/idu/internal"
 	"cloudeng.io/cmd/idu/internal/config"
 	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/types"
 	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/cmd/idu/internal/ratelimit"
+	"cloudeng.io/file"
 	"cloudeng.io/file/filewalk"
 	"cloudeng.io/file/localfs"
 )
@@ -130,8 +136,8 @@ func scanDB(ctx context.Context, t *testing.T, db database.DB, lfs filewalk.FS,
 func scanErrors(ctx context.Context, t *testing.T, db database.DB, _ filewalk.FS, arg0 string) []string {
 	errors := []string{}
 	err := db.VisitErrors(ctx, arg0,
-		func(_ context.Context, key string, _ time.Time, detail []byte) bool {
-			errors = append(errors, fmt.Sprintf("%s: %s", key, detail))
+		func(_ context.Context, pl types.ErrorPayload) bool {
+			errors = append(errors, fmt.Sprintf("%s: %s: %s", pl.Key, pl.Category, pl.Payload))
 			return true
 		})
 
@@ -176,6 +182,9 @@ func verifyDB(ctx context.Context, t *testing.T, cfg config.T, fs filewalk.FS, a
 		if !(strings.Contains(e, "permission denied") || strings.Contains(e, "Access is denied")) {
 			t.Errorf("line %v, unexpected error: %v", l, e)
 		}
+		if !strings.Contains(e, ": "+string(types.ErrorPermission)+": ") {
+			t.Errorf("line %v, unexpected error category: %v", l, e)
+		}
 	}
 
 	start, stop, summary := getLastLog(ctx, t, db)
@@ -336,3 +345,636 @@ func testAnalyze(ctx context.Context, t *testing.T) {
 		nAddedDirs,
 		nDirs)
 }
+
+func TestAnalyzePrune(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, tt := setupAnalyze(t)
+	defer func() {
+		if t.Failed() {
+			t.Logf("tmpDir: %v\n", tmpDir)
+			return
+		}
+		os.RemoveAll(tmpDir)
+	}()
+
+	pruned := string(filepath.Separator) + "d01-00"
+	scannable := []string{}
+	for _, p := range removeExclusions(tt.base()) {
+		if !strings.Contains(p, pruned) {
+			scannable = append(scannable, p)
+		}
+	}
+	sort.Strings(scannable)
+
+	cfg, err := config.ReadConfig(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	fs := localfs.New()
+	alz := &analyzeCmd{}
+	af := analyzeFlags{}
+	if err := alz.analyzeFS(ctx, fs, &af, []string{arg0, "name=d01-00"}); err != nil {
+		t.Fatal(err)
+	}
+	_, summary := verifyDB(ctx, t, cfg, fs, arg0, scannable)
+
+	// d01-00 appears once under each of the non-excluded top level
+	// directories.
+	expected := []string{}
+	for _, d := range []string{"d00-00", "d00-02", "d00-03", "d00-04"} {
+		expected = append(expected, filepath.Join(arg0, d, "d01-00"))
+	}
+	sort.Strings(summary.Pruned)
+	if got, want := summary.Pruned, expected; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := summary.PrefixesPruned, int64(len(expected)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := summary.Expression, "name=d01-00"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The expression may also be specified in the config file.
+	globalConfig.Prefixes[0].AnalyzeExpression = "name=d01-00"
+	af.Force = true
+	if err := alz.analyzeFS(ctx, fs, &af, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+	_, summary = verifyDB(ctx, t, cfg, fs, arg0, scannable)
+	if got, want := summary.PrefixesPruned, int64(len(expected)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAnalyzeFileTimes(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("file times are not supported on", runtime.GOOS)
+	}
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, _ := setupAnalyze(t)
+	defer os.RemoveAll(tmpDir)
+
+	buf, err := os.ReadFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = append(buf, []byte("  file_times: [access, change]\n")...)
+	cfg, err := config.ParseConfig(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	fs := localfs.New()
+	alz := &analyzeCmd{}
+	if err := alz.analyzeFS(ctx, fs, &analyzeFlags{}, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+
+	accessTimes := func() map[string]time.Time {
+		ctx, _, db, err := internal.OpenPrefixAndDatabase(ctx, cfg, arg0, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close(ctx)
+		access := map[string]time.Time{}
+		err = db.Scan(ctx, arg0, func(_ context.Context, k string, v []byte) bool {
+			var pi prefixinfo.T
+			if err := pi.UnmarshalBinary(v); err != nil {
+				t.Fatalf("failed to unmarshal value for %v: %v\n", k, err)
+			}
+			if times := pi.Times(); times.Access.IsZero() || times.Change.IsZero() || !times.Birth.IsZero() {
+				t.Errorf("%v: unexpected times: %v", k, times)
+			}
+			for _, fi := range pi.InfoList() {
+				times := pi.TimesInfo(fi)
+				if times.Access.IsZero() || times.Change.IsZero() || !times.Birth.IsZero() {
+					t.Errorf("%v: %v: unexpected times: %v", k, fi.Name(), times)
+				}
+				if !fi.IsDir() {
+					access[filepath.Join(k, fi.Name())] = times.Access
+				}
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return access
+	}
+	access := accessTimes()
+	if len(access) == 0 {
+		t.Fatalf("no files found")
+	}
+
+	// Changing the access time of a file does not modify its directory,
+	// but must still be recorded by the next analyze.
+	var filename string
+	var fi os.FileInfo
+	for _, f := range slices.Sorted(maps.Keys(access)) {
+		if fi, err = os.Lstat(f); err == nil && fi.Mode().IsRegular() {
+			filename = f
+			break
+		}
+	}
+	if len(filename) == 0 {
+		t.Fatalf("no regular files found")
+	}
+	accessed := time.Now().Add(-time.Hour * 24 * 365).Truncate(time.Second)
+	if err := os.Chtimes(filename, accessed, fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := alz.analyzeFS(ctx, fs, &analyzeFlags{}, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := accessTimes()[filename], accessed; !got.Equal(want) {
+		t.Errorf("%v: got %v, want %v", filename, got, want)
+	}
+}
+
+func TestAnalyzeRetryErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions cannot be restored on", runtime.GOOS)
+	}
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, _ := setupAnalyze(t)
+	defer os.RemoveAll(tmpDir)
+
+	cfg, err := config.ReadConfig(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	errorsAndSummary := func() ([]string, anaylzeSummary) {
+		ctx, _, db, err := internal.OpenPrefixAndDatabase(ctx, cfg, arg0, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close(ctx)
+		_, _, summary := getLastLog(ctx, t, db)
+		return scanErrors(ctx, t, db, nil, arg0), summary
+	}
+
+	fs := localfs.New()
+	alz := &analyzeCmd{}
+	if err := alz.analyzeFS(ctx, fs, &analyzeFlags{}, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+	initial, full := errorsAndSummary()
+	if len(initial) == 0 {
+		t.Fatalf("no errors were recorded")
+	}
+
+	// Retrying without fixing anything should leave all of the errors
+	// in place and only rescan the prefixes that failed.
+	af := &analyzeFlags{Retry: true}
+	if err := alz.analyzeFS(ctx, fs, af, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+	retried, summary := errorsAndSummary()
+	if got, want := len(retried), len(initial); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := summary.ErrorsRetried, int64(len(initial)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := summary.ErrorsResolved, int64(0); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, max := summary.PrefixesFinished, full.PrefixesFinished; got >= max {
+		t.Errorf("retry rescanned too many prefixes: %v >= %v", got, max)
+	}
+
+	// Fix one of the errors and retry, only that error should be cleared
+	// and the prefix and its contents should now be in the database.
+	fixed := filepath.Join(arg0, "d-inaccessible-dir")
+	if err := os.Chmod(fixed, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(fixed, "f"), []byte{'1'}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := alz.analyzeFS(ctx, fs, af, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+	remaining, summary := errorsAndSummary()
+	if got, want := len(remaining), len(initial)-1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, e := range remaining {
+		if strings.HasPrefix(e, fixed+":") {
+			t.Errorf("error for %v was not cleared", fixed)
+		}
+	}
+	if got, want := summary.ErrorsResolved, int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	ctx, _, db, err := internal.OpenPrefixAndDatabase(ctx, cfg, arg0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	if scanned := scanDB(ctx, t, db, fs, arg0); !slices.Contains(scanned, filepath.Join(fixed, "f")) {
+		t.Errorf("%v was not rescanned", fixed)
+	}
+}
+
+func TestAnalyzeErrorAttempts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions cannot be restored on", runtime.GOOS)
+	}
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, _ := setupAnalyze(t)
+	defer os.RemoveAll(tmpDir)
+
+	cfg, err := config.ReadConfig(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	attempts := func() map[string]int64 {
+		ctx, _, db, err := internal.OpenPrefixAndDatabase(ctx, cfg, arg0, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close(ctx)
+		attempts := map[string]int64{}
+		err = db.VisitErrors(ctx, arg0, func(_ context.Context, pl types.ErrorPayload) bool {
+			attempts[pl.Key] = pl.Attempts
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return attempts
+	}
+
+	fs := localfs.New()
+	alz := &analyzeCmd{}
+	// Errors that recur on a full analyze, as well as on a retry, must
+	// retain their attempt counts even though a full analyze deletes all
+	// of the existing errors before rescanning.
+	for i, af := range []*analyzeFlags{{}, {}, {Retry: true}} {
+		if err := alz.analyzeFS(ctx, fs, af, []string{arg0}); err != nil {
+			t.Fatal(err)
+		}
+		found := attempts()
+		if len(found) == 0 {
+			t.Fatalf("no errors were recorded")
+		}
+		for k, v := range found {
+			if got, want := v, int64(i+1); got != want {
+				t.Errorf("%v: got %v, want %v", k, got, want)
+			}
+		}
+	}
+}
+
+func TestAnalyzeAdaptive(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, tt := setupAnalyze(t)
+	defer os.RemoveAll(tmpDir)
+
+	buf, err := os.ReadFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = append(buf, []byte("  adaptive:\n    enabled: true\n    interval: 1ms\n")...)
+	cfg, err := config.ParseConfig(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	scannable := slices.Clone(tt.base())
+	sort.Strings(scannable)
+	scannable = removeExclusions(scannable)
+
+	fs := localfs.New()
+	alz := &analyzeCmd{}
+	if err := alz.analyzeFS(ctx, fs, &analyzeFlags{}, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+	scanned, summary := verifyDB(ctx, t, cfg, fs, arg0, scannable)
+	nDirs, nFiles := numDirsAndFiles(scanned)
+	compareSummary(t, summary, nDirs, nFiles, 0, 0, 0, nDirs+nFiles)
+}
+
+func TestAnalyzeRateLimit(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, tt := setupAnalyze(t)
+	defer os.RemoveAll(tmpDir)
+
+	buf, err := os.ReadFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = append(buf, []byte("  rate_limit:\n    ops_per_second: 2000\n    burst: 10\n")...)
+	cfg, err := config.ParseConfig(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	scannable := slices.Clone(tt.base())
+	sort.Strings(scannable)
+	scannable = removeExclusions(scannable)
+
+	fs := localfs.New()
+	alz := &analyzeCmd{}
+	start := time.Now()
+	if err := alz.analyzeFS(ctx, fs, &analyzeFlags{}, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+	took := time.Since(start)
+	scanned, summary := verifyDB(ctx, t, cfg, fs, arg0, scannable)
+	nDirs, nFiles := numDirsAndFiles(scanned)
+	compareSummary(t, summary, nDirs, nFiles, 0, 0, 0, nDirs+nFiles)
+
+	// Every file and directory is stat'ed at least once.
+	if min := time.Duration(nDirs+nFiles) * time.Second / 2000; took < min {
+		t.Errorf("analyze took %v, which is less than %v", took, min)
+	}
+	if got, want := len(summary.RateLimits), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := summary.RateLimits[0].OpsPerSecond, 2000.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSysInfoRateLimit(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(filename, []byte{'1'}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := localfs.New().Lstat(ctx, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The calls used to obtain birth times and project IDs are made
+	// directly rather than via the filewalk.FS and must be rate limited
+	// separately.
+	cfg, err := config.ParseConfig([]byte("- prefix: /\n  file_times: [birth]\n  project_ids: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &walker{
+		cfg:     cfg.Prefixes[0],
+		limiter: ratelimit.New(config.RateLimit{OpsPerSecond: 100, Burst: 1}),
+	}
+	start := time.Now()
+	for range 10 {
+		w.sysInfo(ctx, filename, fi, file.XAttr{})
+	}
+	// 20 operations at 100 per second with a burst of 1.
+	if took, min := time.Since(start), 190*time.Millisecond; took < min {
+		t.Errorf("took %v, which is less than %v", took, min)
+	}
+}
+
+func TestAnalyzeMultiple(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, tt := setupAnalyze(t)
+	defer os.RemoveAll(tmpDir)
+
+	nestedPrefix := filepath.Join(arg0, "d00-02")
+	buf, err := os.ReadFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = append(buf, []byte(fmt.Sprintf(`- prefix: %v
+  database: %v
+  concurrent_scans: 2
+`, nestedPrefix, filepath.Join(tmpDir, "database", "nested-db")))...)
+	cfg, err := config.ParseConfig(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	fs := localfs.New()
+	alz := &analyzeCmd{}
+
+	prefixes, expr, err := alz.prefixesAndExpression(ctx, fs, &analyzeFlags{}, []string{arg0, nestedPrefix, "name=foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := prefixes, []string{arg0, nestedPrefix}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := expr, []string{"name=foo"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := alz.analyzeFS(ctx, fs, &analyzeFlags{All: true, Budget: 4}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var outer, nested []string
+	for _, p := range removeExclusions(tt.base()) {
+		if within(p, nestedPrefix, string(filepath.Separator)) {
+			if p != nestedPrefix {
+				nested = append(nested, p)
+			}
+			continue
+		}
+		outer = append(outer, p)
+	}
+	sort.Strings(outer)
+	sort.Strings(nested)
+	// The nested prefix itself is recorded in its own database and is
+	// listed as a directory in the outer one.
+	nested = append([]string{nestedPrefix}, nested...)
+	verifyDB(ctx, t, cfg, fs, arg0, outer)
+	verifyDB(ctx, t, cfg, fs, nestedPrefix, nested)
+}
+
+func TestAnalyzeMultipleDefaultScans(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, _ := setupAnalyze(t)
+	defer os.RemoveAll(tmpDir)
+
+	// A zero concurrent_scans means that the default is used and
+	// hence that it must count against the budget.
+	nestedPrefix := filepath.Join(arg0, "d00-02")
+	buf, err := os.ReadFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = bytes.ReplaceAll(buf, []byte("  concurrent_scans: 2\n"), []byte("  concurrent_scans: 0\n"))
+	buf = append(buf, []byte(fmt.Sprintf(`- prefix: %v
+  database: %v
+  concurrent_scans: 0
+`, nestedPrefix, filepath.Join(tmpDir, "database", "nested-db")))...)
+	cfg, err := config.ParseConfig(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	fs := localfs.New()
+	alz := &analyzeCmd{}
+	if err := alz.analyzeFS(ctx, fs, &analyzeFlags{All: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	type interval struct{ start, stop time.Time }
+	var runs []interval
+	for _, prefix := range []string{arg0, nestedPrefix} {
+		ctx, _, db, err := internal.OpenPrefixAndDatabase(ctx, cfg, prefix, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, stop, _ := getLastLog(ctx, t, db)
+		db.Close(ctx)
+		runs = append(runs, interval{start, stop})
+	}
+	// A zero budget runs the analyses one at a time.
+	if a, b := runs[0], runs[1]; a.start.Before(b.stop) && b.start.Before(a.stop) {
+		t.Errorf("analyses ran concurrently: %v - %v and %v - %v", a.start, a.stop, b.start, b.stop)
+	}
+}
+
+func TestAnalyzeDryRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("read-only databases are not supported on", runtime.GOOS)
+	}
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, _ := setupAnalyze(t)
+	defer os.RemoveAll(tmpDir)
+
+	cfg, err := config.ReadConfig(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+	bytesPrinter = func(size int64) (float64, string) { return float64(size), "B" }
+
+	fs := localfs.New()
+	alz := &analyzeCmd{}
+	if err := alz.analyzeFS(ctx, fs, &analyzeFlags{}, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+
+	newDir := filepath.Join(arg0, "d-new")
+	changedDir := filepath.Join(arg0, "d00-02")
+	deletedDir := filepath.Join(arg0, "d00-03")
+	if err := os.Mkdir(newDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(newDir, "f"), make([]byte, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(changedDir, "f-new"), make([]byte, 50), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(deletedDir, "d-inaccessible-dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(deletedDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dry run must be able to run alongside other readers.
+	_, _, reader, err := internal.OpenPrefixAndDatabase(ctx, cfg, arg0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close(ctx)
+	stored := func() map[string]string {
+		values := map[string]string{}
+		err := reader.Scan(ctx, arg0, func(_ context.Context, k string, v []byte) bool {
+			values[k] = string(v)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return values
+	}
+	before := stored()
+	start, _, _ := getLastLog(ctx, t, reader)
+
+	var deleted int64
+	for p := range before {
+		if within(p, deletedDir, string(filepath.Separator)) {
+			deleted++
+		}
+	}
+
+	summary, err := alz.analyzePrefix(ctx, fs, &analyzeFlags{DryRun: true}, prefixRun{prefix: arg0}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := summary.DryRun
+	if changes == nil {
+		t.Fatal("no dry run changes were reported")
+	}
+	if got, want := changes.New, (dryRunPrefixes{Count: 1, Bytes: 100, Sample: []string{newDir}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := changes.Changed.Sample, []string{arg0, changedDir}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := changes.Deleted.Count, deleted; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := changes.Deleted.Sample, []string{deletedDir}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := changes.ByteDelta, 100+50-changes.Deleted.Bytes; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Nothing should have been written to the database.
+	if got, want := stored(), before; !reflect.DeepEqual(got, want) {
+		t.Errorf("the database was modified by a dry run")
+	}
+	if got, _, _ := getLastLog(ctx, t, reader); !got.Equal(start) {
+		t.Errorf("got %v, want %v", got, start)
+	}
+}
@@ -9,10 +9,12 @@
 //	files are processed.
 //
 //	expression-syntax - display the syntax for the expression language supported by commands such as analyze, find etc.
-//	          analyze - analyze the file system to build a database of directory and file metadata.
+//	          analyze - analyze the file system to build a database of directory and file metadata. Prefixes that match the optional expression are pruned and not analyzed. Multiple prefixes may be specified, or all configured prefixes via --all.
 //	             logs - list the log of past operations stored in the database.
-//	           errors - list the errors stored in the database
+//	           errors - list or summarize the errors stored in the database
 //	             find - find prefixes/files in the database that match the supplied expression.
+//	             hash - compute content hashes for the files in the database whose sizes are the same as that of another file, so that they can be checked for duplicates. Hashes are stored in the database and are reused until a file is modified.
+//	       duplicates - display the sets of duplicate files found using the hashes computed by the hash command, the storage wasted by them per user and group, and those that could be replaced by hard links.
 //	            stats - compute and display statistics from the database.
 //	          reports - generate and manage reports.
 //	           config - describe the current configuration.
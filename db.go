@@ -7,9 +7,20 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/badgerdb"
+	"cloudeng.io/cmd/idu/internal/encryption"
 )
 
 type dbCmd struct{}
@@ -28,14 +39,294 @@ func (db *dbCmd) locate(ctx context.Context, values interface{}, args []string)
 		fmt.Printf("%v\n", prefix.Database)
 		return nil
 	}
-	info, err := os.Stat(prefix.Database)
+	size, err := dirSize(prefix.Database)
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Printf("atabase for %v is at: %v\n", args[0], prefix.Database)
+			fmt.Printf("database for %v is at: %v\n", args[0], prefix.Database)
 			return nil
 		}
 		return err
 	}
-	fmt.Printf("database for %v is at: %v (%v)\n", args[0], prefix.Database, fmtSize(info.Size()))
+	fmt.Printf("database for %v is at: %v (%v)\n", args[0], prefix.Database, fmtSize(size))
+	return nil
+}
+
+// dirSize returns the total size of the files in dir, which need not be
+// a database that can be opened.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func printDBStats(out io.Writer, stats database.Stats) {
+	for _, name := range slices.Sorted(maps.Keys(stats.Sizes)) {
+		fmt.Fprintf(out, "%-7v: %v\n", name, fmtSize(stats.Sizes[name]))
+	}
+	fmt.Fprintf(out, "%-7v: %v\n", "total", fmtSize(stats.Size()))
+	fmt.Fprintf(out, "keys:\n")
+	for _, name := range slices.Sorted(maps.Keys(stats.Keys)) {
+		fmt.Fprintf(out, "  %-8v: %v\n", name, fmtCount(stats.Keys[name]))
+	}
+}
+
+func (db *dbCmd) info(ctx context.Context, _ interface{}, args []string) error {
+	ctx, cfg, sdb, err := internal.OpenPrefixAndDatabase(ctx, globalConfig, args[0], true)
+	if err != nil {
+		return err
+	}
+	defer sdb.Close(ctx)
+	version, err := internal.ReadSchemaVersion(ctx, sdb)
+	if err != nil {
+		return err
+	}
+	since, err := internal.HistorySince(ctx, sdb)
+	if err != nil {
+		return err
+	}
+	stats, err := sdb.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("database: %v (%v)\n", cfg.Database, cfg.DatabaseType)
+	fmt.Printf("schema : %v (current %v)\n", version, internal.SchemaVersion)
+	keys, _, err := internal.KeyEncoding(ctx, sdb)
+	if err != nil {
+		return err
+	}
+	if keys != cfg.KeyEncoding {
+		fmt.Printf("keys   : %v (configured %v, use database migrate to convert)\n", keys, cfg.KeyEncoding)
+	} else {
+		fmt.Printf("keys   : %v\n", keys)
+	}
+	if !since.IsZero() {
+		fmt.Printf("history: since %v\n", since.Format(time.RFC3339))
+	}
+	if cfg.Replica.Enabled {
+		location, published, err := internal.LatestReplica(cfg.Replica)
+		if err != nil {
+			return err
+		}
+		if len(location) > 0 {
+			fmt.Printf("replica: %v, published %v\n", location, published.Local().Format(time.RFC3339))
+		}
+	}
+	printDBStats(os.Stdout, stats)
+	return nil
+}
+
+// dbStats returns the stats for the database for prefix, opening it
+// read-only since a database opened for writing preallocates storage.
+func dbStats(ctx context.Context, prefix string) (config.Prefix, database.Stats, error) {
+	ctx, cfg, err := internal.LookupPrefix(ctx, globalConfig, prefix)
+	if err != nil {
+		return cfg, database.Stats{}, err
+	}
+	sdb, err := internal.OpenDatabase(ctx, cfg, true)
+	if err != nil {
+		return cfg, database.Stats{}, err
+	}
+	defer sdb.Close(ctx)
+	stats, err := sdb.Stats(ctx)
+	return cfg, stats, err
+}
+
+func (db *dbCmd) compact(ctx context.Context, _ interface{}, args []string) error {
+	before, after, err := compactDatabase(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	printDBStats(os.Stdout, after)
+	fmt.Printf("reclaimed: %v\n", fmtSize(before.Size()-after.Size()))
+	return nil
+}
+
+func compactDatabase(ctx context.Context, prefix string) (before, after database.Stats, err error) {
+	if _, before, err = dbStats(ctx, prefix); err != nil {
+		return
+	}
+	// The database is opened for writing and hence holds the exclusive
+	// lock for the duration of the compaction.
+	ctx, _, sdb, err := internal.OpenPrefixAndDatabase(ctx, globalConfig, prefix, false)
+	if err != nil {
+		return
+	}
+	if err = sdb.Compact(ctx); err != nil {
+		sdb.Close(ctx)
+		return
+	}
+	if err = sdb.Close(ctx); err != nil {
+		return
+	}
+	_, after, err = dbStats(ctx, prefix)
+	return
+}
+
+type migrateFlags struct {
+	BatchSize int `subcmd:"batch-size,1000,number of prefixes to read and update in each batch"`
+}
+
+func (db *dbCmd) migrate(ctx context.Context, values interface{}, args []string) error {
+	mf := values.(*migrateFlags)
+	ctx, cfg, sdb, err := internal.OpenPrefixAndDatabase(ctx, globalConfig, args[0], false)
+	if err != nil {
+		return err
+	}
+	progress := func(mp internal.MigrationProgress) {
+		fmt.Printf("%v: scanned %v, updated %v\r", mp.Migration.Description, fmtCount(mp.Scanned), fmtCount(mp.Updated))
+	}
+	from, to, err := internal.Migrate(ctx, sdb, mf.BatchSize, progress)
+	var fromKeys string
+	if err == nil {
+		if from == to {
+			fmt.Printf("%v: schema version %v is current\n", cfg.Database, to)
+		} else {
+			fmt.Printf("\n%v: migrated from schema version %v to %v\n", cfg.Database, from, to)
+		}
+		fromKeys, err = internal.MigrateKeyEncoding(ctx, sdb, cfg.KeyEncoding, cfg.Separator, mf.BatchSize, progress)
+	}
+	if cerr := sdb.Close(ctx); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %v", cfg.Database, err)
+	}
+	if fromKeys != cfg.KeyEncoding {
+		fmt.Printf("\n%v: migrated from %v to %v keys\n", cfg.Database, fromKeys, cfg.KeyEncoding)
+	}
+	return nil
+}
+
+type convertFlags struct {
+	Type string `subcmd:"type,bolt,'the type of database to convert to, either badger or bolt'"`
+}
+
+func (db *dbCmd) convert(ctx context.Context, values interface{}, args []string) error {
+	cf := values.(*convertFlags)
+	ctx, cfg, err := internal.LookupPrefix(ctx, globalConfig, args[0])
+	if err != nil {
+		return err
+	}
+	dstCfg := cfg
+	dstCfg.Database = os.ExpandEnv(args[1])
+	dstCfg.DatabaseType = strings.ToLower(cf.Type)
+	dstCfg.Replica.Enabled = false
+	if !slices.Contains(config.DatabaseTypes(), dstCfg.DatabaseType) {
+		return fmt.Errorf("unsupported database type: %q, must be one of %v", cf.Type, strings.Join(config.DatabaseTypes(), ", "))
+	}
+	if cfg.Encryption.Enabled() && dstCfg.DatabaseType != config.BadgerDatabase {
+		return fmt.Errorf("%v: encrypted databases can only be converted to %v databases", cfg.Database, config.BadgerDatabase)
+	}
+	if filepath.Clean(dstCfg.Database) == filepath.Clean(cfg.Database) {
+		return fmt.Errorf("%v: cannot convert a database in place", cfg.Database)
+	}
+	// The database itself, rather than any replica of it, is converted.
+	srcCfg := cfg
+	srcCfg.Replica.Enabled = false
+	src, err := internal.OpenDatabase(ctx, srcCfg, true)
+	if err != nil {
+		return err
+	}
+	defer src.Close(ctx)
+	// The destination uses the key encoding recorded for the source, which
+	// differs from the configured one until database migrate has been run,
+	// since the keys are copied as is.
+	encoding, separator, err := internal.KeyEncoding(ctx, src)
+	if err != nil {
+		return err
+	}
+	dstCfg.KeyEncoding = encoding
+	if encoding == config.CompactKeys {
+		dstCfg.Separator = separator
+	}
+	dst, err := internal.OpenDatabase(ctx, dstCfg, false)
+	if err != nil {
+		return err
+	}
+	if err := checkEmptyDatabase(ctx, dst, dstCfg.Database); err != nil {
+		dst.Close(ctx)
+		return err
+	}
+	counts, err := database.Copy(ctx, dst, src)
+	if cerr := dst.Close(ctx); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to convert %v to %v: %v", cfg.Database, dstCfg.Database, err)
+	}
+	for _, name := range database.Buckets {
+		fmt.Printf("%-8v: %v\n", name, fmtCount(counts[name]))
+	}
+	fmt.Printf("converted %v (%v) to %v (%v), update the database and database_type for %v in the configuration to use it\n", cfg.Database, cfg.DatabaseType, dstCfg.Database, dstCfg.DatabaseType, cfg.Prefix)
+	return nil
+}
+
+type rotateKeyFlags struct {
+	NewKeyFile    string `subcmd:"new-key-file,,'the file containing the new encryption key'"`
+	NewKeyCommand string `subcmd:"new-key-command,,'a command, run using sh -c, that writes the new encryption key to its standard output'"`
+}
+
+func (db *dbCmd) rotateKey(ctx context.Context, values interface{}, args []string) error {
+	rf := values.(*rotateKeyFlags)
+	ctx, cfg, err := internal.LookupPrefix(ctx, globalConfig, args[0])
+	if err != nil {
+		return err
+	}
+	if !cfg.Encryption.Enabled() {
+		return fmt.Errorf("%v: encryption is not enabled", cfg.Prefix)
+	}
+	newCfg := config.Encryption{
+		KeyFile:         os.ExpandEnv(rf.NewKeyFile),
+		KeyCommand:      rf.NewKeyCommand,
+		DataKeyRotation: cfg.Encryption.DataKeyRotation,
+	}
+	if len(newCfg.KeyFile) > 0 == (len(newCfg.KeyCommand) > 0) {
+		return fmt.Errorf("exactly one of --new-key-file or --new-key-command must be specified")
+	}
+	oldKey, err := encryption.Key(ctx, cfg.Encryption)
+	if err != nil {
+		return err
+	}
+	newKey, err := encryption.Key(ctx, newCfg)
+	if err != nil {
+		return err
+	}
+	rotate := func(location string) error {
+		if err := badgerdb.RotateKey(location, oldKey, newKey, cfg.Encryption.DataKeyRotation); err != nil {
+			return fmt.Errorf("failed to rotate key for %v: %v", location, err)
+		}
+		fmt.Printf("rotated key for %v\n", location)
+		return nil
+	}
+	// The database is rotated first since doing so waits for any running
+	// analyze to finish and hence to publish its replica.
+	if err := rotate(cfg.Database); err != nil {
+		return err
+	}
+	if cfg.Replica.Enabled {
+		replicas, err := internal.PublishedReplicas(cfg.Replica)
+		if err != nil {
+			return err
+		}
+		for _, location := range replicas {
+			if err := rotate(location); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Printf("update the encryption key_file or key_command for %v in the configuration to use the new key\n", cfg.Prefix)
+	fmt.Printf("add the old key to the encryption previous_key_files for %v to read stats files and export archives created before now\n", cfg.Prefix)
 	return nil
 }
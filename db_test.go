@@ -0,0 +1,293 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/types"
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/file/localfs"
+)
+
+func TestDatabaseCompact(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, _ := setupAnalyze(t)
+	defer os.RemoveAll(tmpDir)
+
+	cfg, err := config.ReadConfig(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	alz := &analyzeCmd{}
+	if err := alz.analyzeFS(ctx, localfs.New(), &analyzeFlags{}, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+	_, before, err := dbStats(ctx, arg0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := before.Keys["log"], int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if before.Keys["prefix"] == 0 || before.Keys["error"] == 0 {
+		t.Errorf("missing prefixes or errors: %v", before.Keys)
+	}
+
+	before, after, err := compactDatabase(ctx, arg0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bucket := range []string{"prefix", "log", "error"} {
+		if got, want := after.Keys[bucket], before.Keys[bucket]; got != want {
+			t.Errorf("%v: got %v, want %v", bucket, got, want)
+		}
+	}
+	if after.Size() == 0 {
+		t.Errorf("zero size database")
+	}
+}
+
+// dumpDatabase returns the contents of db in a form that can be compared
+// across databases, prefixes are decoded since their encoding is not
+// canonical.
+func dumpDatabase(ctx context.Context, t *testing.T, db database.DB) []string {
+	var dump []string
+	add := func(v any) bool {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dump = append(dump, string(buf))
+		return true
+	}
+	err := db.Scan(ctx, "", func(_ context.Context, k string, v []byte) bool {
+		var pi prefixinfo.T
+		if err := pi.UnmarshalBinary(v); err != nil {
+			t.Fatal(err)
+		}
+		return add(map[string]any{k: newExportedPrefix(&pi)})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.VisitLogs(ctx, time.Time{}, time.Now().Add(time.Hour), func(_ context.Context, start, stop time.Time, detail []byte) bool {
+		return add([]any{start.Unix(), stop.Unix(), detail})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.VisitErrors(ctx, "", func(_ context.Context, pl types.ErrorPayload) bool {
+		pl.When = pl.When.UTC()
+		return add(pl)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.VisitHashes(ctx, func(_ context.Context, key types.HashKey, hash []byte) bool {
+		return add([]any{key.Device, key.Inode, key.ModTime.UnixNano(), hash})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dump
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, _ := setupAnalyze(t)
+	defer os.RemoveAll(tmpDir)
+
+	cfg, err := config.ReadConfig(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	fs := localfs.New()
+	alz := &analyzeCmd{}
+	for i := 0; i < 2; i++ {
+		// Analyze twice so that errors are recorded more than once.
+		if err := alz.analyzeFS(ctx, fs, &analyzeFlags{Force: true}, []string{arg0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := (&hashCmds{}).hashFS(ctx, fs, &hashFlags{}, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, pcfg, db, err := internal.OpenPrefixAndDatabase(ctx, cfg, arg0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	var archive bytes.Buffer
+	counts, err := exportDatabase(ctx, db, pcfg, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range []string{"prefix", "log", "error", "hash"} {
+		if counts[typ] == 0 {
+			t.Errorf("no %v records were exported: %v", typ, counts)
+		}
+	}
+
+	icfg := pcfg
+	icfg.Database = filepath.Join(tmpDir, "imported")
+	idb, err := internal.OpenDatabase(ctx, icfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { idb.Close(ctx) }()
+
+	// Truncated archives must be detected.
+	_, err = importDatabase(ctx, idb, icfg, bytes.NewReader(archive.Bytes()[:archive.Len()/2]))
+	if err == nil {
+		t.Errorf("expected an error for a truncated archive")
+	}
+	if err := idb.Clear(ctx, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := idb.DeletePrefix(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := importDatabase(ctx, idb, icfg, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := imported, counts; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Close the database to flush any batched writes.
+	if err := idb.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if idb, err = internal.OpenDatabase(ctx, icfg, false); err != nil {
+		t.Fatal(err)
+	}
+	got, want := dumpDatabase(ctx, t, idb), dumpDatabase(ctx, t, db)
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got[i], want[i])
+		}
+	}
+
+	// Importing into a non-empty database, or for a different prefix,
+	// must fail.
+	if _, err := importDatabase(ctx, idb, icfg, bytes.NewReader(archive.Bytes())); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	icfg.Prefix = filepath.Join(arg0, "other")
+	icfg.Database = filepath.Join(tmpDir, "other")
+	odb, err := internal.OpenDatabase(ctx, icfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer odb.Close(ctx)
+	if _, err := importDatabase(ctx, odb, icfg, bytes.NewReader(archive.Bytes())); err == nil || !strings.Contains(err.Error(), "exported for prefix") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, _ := setupAnalyze(t)
+	defer os.RemoveAll(tmpDir)
+
+	cfg, err := config.ReadConfig(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	alz := &analyzeCmd{}
+	if err := alz.analyzeFS(ctx, localfs.New(), &analyzeFlags{}, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+
+	dump := func(cfg config.Prefix) []string {
+		db, err := internal.OpenDatabase(ctx, cfg, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close(ctx)
+		return dumpDatabase(ctx, t, db)
+	}
+
+	dbc := &dbCmd{}
+	_, src, err := internal.LookupPrefix(ctx, globalConfig, arg0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := src
+	dst.Database = filepath.Join(tmpDir, "converted")
+	dst.DatabaseType = config.BoltDatabase
+	if err := dbc.convert(ctx, &convertFlags{Type: "bolt"}, []string{arg0, dst.Database}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dump(dst), dump(src); !reflect.DeepEqual(got, want) || len(got) == 0 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The destination must be empty.
+	err = dbc.convert(ctx, &convertFlags{Type: "bolt"}, []string{arg0, dst.Database})
+	if err == nil || !strings.Contains(err.Error(), "database is not empty") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	err = dbc.convert(ctx, &convertFlags{Type: "sqlite"}, []string{arg0, filepath.Join(tmpDir, "other")})
+	if err == nil || !strings.Contains(err.Error(), "unsupported database type") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+
+	// Databases that have yet to be migrated to the configured key
+	// encoding are converted using the encoding recorded for them.
+	for i := range globalConfig.Prefixes {
+		globalConfig.Prefixes[i].KeyEncoding = config.CompactKeys
+	}
+	dst.Database = filepath.Join(tmpDir, "unmigrated")
+	if err := dbc.convert(ctx, &convertFlags{Type: "bolt"}, []string{arg0, dst.Database}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dump(dst), dump(src); !reflect.DeepEqual(got, want) || len(got) == 0 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	db, err := internal.OpenDatabase(ctx, dst, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	if encoding, _, err := internal.KeyEncoding(ctx, db); err != nil || encoding != config.PathKeys {
+		t.Errorf("got %v, want %v: %v", encoding, config.PathKeys, err)
+	}
+}
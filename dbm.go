@@ -62,17 +62,6 @@ func (dbm *databaseManager) Delete(ctx context.Context, separator, prefix string
 	return db.Delete(ctx, separator, prefixes, true)
 }
 
-func (dbm *databaseManager) Compact(ctx context.Context, prefix string) error {
-	dbm.Lock()
-	defer dbm.Unlock()
-	db, cfg, err := dbm.databaseForLocked(ctx, prefix)
-	if err != nil {
-		return err
-	}
-	delete(dbm.dbs, cfg.Prefix)
-	return db.CompactAndClose(ctx)
-}
-
 func (dbm *databaseManager) Close(ctx context.Context, prefix string) error {
 	dbm.Lock()
 	defer dbm.Unlock()
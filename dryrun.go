@@ -0,0 +1,187 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/database/types"
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+)
+
+// dryRunSamples is the number of new, changed and deleted prefixes
+// that are reported by a dry run.
+const dryRunSamples = 10
+
+// dryRunDB is used to analyze a prefix without writing to its database.
+// It wraps a read-only database and records the changes that would have
+// been made, rather than making them.
+type dryRunDB struct {
+	internal.ScanDB
+	sep string
+
+	mu      sync.Mutex
+	changes dryRunChanges
+}
+
+type dryRunPrefixes struct {
+	Count  int64    `json:"count"`
+	Bytes  int64    `json:"bytes"`
+	Sample []string `json:"sample,omitempty"`
+}
+
+// dryRunChanges summarizes the changes that a dry run found. The byte
+// counts are the sums of the sizes of the files in each prefix and the
+// delta is an estimate of how much the total size of the files stored in
+// the database would change.
+type dryRunChanges struct {
+	New       dryRunPrefixes `json:"new"`
+	Changed   dryRunPrefixes `json:"changed"`
+	Deleted   dryRunPrefixes `json:"deleted"`
+	Errors    int64          `json:"errors"`
+	ByteDelta int64          `json:"byte_delta"`
+}
+
+func newDryRunDB(sdb internal.ScanDB, sep string) *dryRunDB {
+	return &dryRunDB{ScanDB: sdb, sep: sep}
+}
+
+func fileBytes(pi *prefixinfo.T) int64 {
+	var size int64
+	for _, fi := range pi.FilesOnly() {
+		size += fi.Size()
+	}
+	return size
+}
+
+// sample adds prefix to the sample, retaining the lexicographically
+// smallest prefixes so that the sample does not depend on the order in
+// which prefixes are scanned.
+func (p *dryRunPrefixes) sample(prefix string) {
+	p.Sample = append(p.Sample, prefix)
+	slices.Sort(p.Sample)
+	if len(p.Sample) > dryRunSamples {
+		p.Sample = p.Sample[:dryRunSamples]
+	}
+}
+
+func (db *dryRunDB) SetPrefixInfo(ctx context.Context, key string, unchanged bool, pi *prefixinfo.T) error {
+	if unchanged {
+		return nil
+	}
+	var existing prefixinfo.T
+	ok, err := db.GetPrefixInfo(ctx, key, &existing)
+	if err != nil {
+		return err
+	}
+	size := fileBytes(pi)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch {
+	case !ok:
+		db.changes.New.Count++
+		db.changes.New.Bytes += size
+		db.changes.New.sample(key)
+		db.changes.ByteDelta += size
+	case !existing.Unchanged(*pi):
+		prev := fileBytes(&existing)
+		db.changes.Changed.Count++
+		db.changes.Changed.Bytes += size
+		db.changes.Changed.sample(key)
+		db.changes.ByteDelta += size - prev
+	}
+	return nil
+}
+
+// DeletePrefix records prefix, and all of the prefixes stored beneath
+// it, as deleted.
+func (db *dryRunDB) DeletePrefix(ctx context.Context, prefix string) error {
+	var count, size int64
+	err := db.VisitPrefixInfo(ctx, prefix, func(_ context.Context, key string, pi *prefixinfo.T) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if within(key, prefix, db.sep) {
+			count++
+			size += fileBytes(pi)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.changes.Deleted.Count += count
+	db.changes.Deleted.Bytes += size
+	db.changes.Deleted.sample(prefix)
+	db.changes.ByteDelta -= size
+	return nil
+}
+
+func (db *dryRunDB) LogError(_ context.Context, _ types.ErrorPayload) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.changes.Errors++
+	return nil
+}
+
+func (db *dryRunDB) SetError(ctx context.Context, pl types.ErrorPayload) error {
+	return db.LogError(ctx, pl)
+}
+
+func (db *dryRunDB) DeleteErrors(_ context.Context, _ string) error {
+	return nil
+}
+
+func (db *dryRunDB) DeleteError(_ context.Context, _ string) error {
+	return nil
+}
+
+func (db *dryRunDB) LogAndClose(ctx context.Context, _, _ time.Time, _ []byte) error {
+	return db.Close(ctx)
+}
+
+func (db *dryRunDB) summary() dryRunChanges {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.changes
+}
+
+func fmtSizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + strings.TrimSpace(fmtSize(-delta))
+	}
+	return "+" + strings.TrimSpace(fmtSize(delta))
+}
+
+func (dc dryRunChanges) print(out io.Writer, database string) {
+	fmt.Fprintf(out, "dry run: no changes were written to %v\n", database)
+	for _, p := range []struct {
+		name string
+		dryRunPrefixes
+	}{
+		{"new", dc.New},
+		{"changed", dc.Changed},
+		{"deleted", dc.Deleted},
+	} {
+		fmt.Fprintf(out, "%-8v prefixes: %v (%v)\n", p.name, fmtCount(p.Count), strings.TrimSpace(fmtSize(p.Bytes)))
+		for _, s := range p.Sample {
+			fmt.Fprintf(out, "  %v\n", s)
+		}
+		if n := p.Count - int64(len(p.Sample)); n > 0 && p.name != "deleted" {
+			fmt.Fprintf(out, "  ... and %v more\n", n)
+		}
+	}
+	fmt.Fprintf(out, "errors          : %v\n", fmtCount(dc.Errors))
+	fmt.Fprintf(out, "estimated change: %v\n", fmtSizeDelta(dc.ByteDelta))
+}
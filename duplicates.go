@@ -0,0 +1,290 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/boolexpr"
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/usernames"
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/file/localfs"
+)
+
+type duplicatesFlags struct {
+	TopN         int  `subcmd:"top,20,'number of duplicate sets, users and groups to display'"`
+	Hardlinkable bool `subcmd:"hardlinkable,false,'only display duplicate sets that contain files on the same device that could be replaced by hard links'"`
+	JSON         bool `subcmd:"json,false,'display the duplicates in json format'"`
+}
+
+type duplicatesCmds struct{}
+
+func (dc *duplicatesCmds) duplicates(ctx context.Context, values interface{}, args []string) error {
+	// TODO(cnicolaou): generalize this to other filesystems.
+	fs := localfs.New()
+	df := values.(*duplicatesFlags)
+	report, err := dc.duplicatesFS(ctx, fs, df, args)
+	if err != nil {
+		return err
+	}
+	report.finalize(df.TopN, df.Hardlinkable)
+	if df.JSON {
+		buf, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+		return nil
+	}
+	report.print(os.Stdout)
+	return nil
+}
+
+// duplicateSet represents a set of files with the same size and content.
+// Hard links to the same file are listed, but are not counted as
+// duplicates.
+type duplicateSet struct {
+	Size   int64    `json:"size"`
+	Hash   string   `json:"hash"`
+	Files  []string `json:"files"`
+	Copies int64    `json:"copies"` // the number of distinct files, ie. inodes.
+	// Wasted is the storage used by all but one of the copies.
+	Wasted int64 `json:"wasted"`
+	// Hardlinkable is the storage that could be saved by replacing
+	// the copies on the same device with hard links.
+	Hardlinkable int64 `json:"hardlinkable"`
+}
+
+type idWaste struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Files  int64  `json:"files"`
+	Wasted int64  `json:"wasted"`
+}
+
+// duplicatesReport summarizes the duplicate files within a prefix. The
+// storage wasted by each set of duplicates is attributed to the owners
+// of all but the first copy, in lexicographic order of path name.
+type duplicatesReport struct {
+	Sets             int64          `json:"sets"`
+	Files            int64          `json:"files"`
+	Wasted           int64          `json:"wasted"`
+	HardlinkableSets int64          `json:"hardlinkable_sets"`
+	Hardlinkable     int64          `json:"hardlinkable"`
+	Unhashed         int64          `json:"unhashed"`
+	UnhashedBytes    int64          `json:"unhashed_bytes"`
+	Duplicates       []duplicateSet `json:"duplicates"`
+	PerUser          []idWaste      `json:"per_user"`
+	PerGroup         []idWaste      `json:"per_group"`
+
+	perUser, perGroup map[int64]*idWaste
+}
+
+type duplicateKey struct {
+	size int64
+	hash string
+}
+
+type devIno struct {
+	dev, ino uint64
+}
+
+func (dc *duplicatesCmds) duplicatesFS(ctx context.Context, fwfs filewalk.FS, _ *duplicatesFlags, args []string) (*duplicatesReport, error) {
+	match, err := boolexpr.CreateMatcher(boolexpr.NewParser(ctx, fwfs),
+		boolexpr.WithEmptyEntryValue(true),
+		boolexpr.WithFilewalkFS(fwfs),
+		boolexpr.WithEntryExpression(args[1:]...))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cfg, db, err := internal.OpenPrefixAndDatabase(ctx, globalConfig, args[0], true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close(ctx)
+	return findDuplicates(ctx, db, args[0], cfg.Separator, match)
+}
+
+func findDuplicates(ctx context.Context, db database.DB, prefix, sep string, match boolexpr.Matcher) (*duplicatesReport, error) {
+	_, candidates, err := hashCandidates(ctx, db, prefix, sep, match)
+	if err != nil {
+		return nil, err
+	}
+	report := &duplicatesReport{
+		perUser:  map[int64]*idWaste{},
+		perGroup: map[int64]*idWaste{},
+	}
+	groups := map[duplicateKey][]hashCandidate{}
+	var buf bytes.Buffer
+	for _, c := range candidates {
+		buf.Reset()
+		if err := db.GetHash(ctx, c.key, &buf); err != nil {
+			return nil, err
+		}
+		if buf.Len() == 0 {
+			report.Unhashed++
+			report.UnhashedBytes += c.size
+			continue
+		}
+		hashes, err := unmarshalFileHashes(buf.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", c.path, err)
+		}
+		if hashes.full == nil {
+			// The file's sample differs from that of every other file of
+			// the same size.
+			continue
+		}
+		k := duplicateKey{size: c.size, hash: hex.EncodeToString(hashes.full)}
+		groups[k] = append(groups[k], c)
+	}
+	for k, files := range groups {
+		report.add(k, files)
+	}
+	return report, nil
+}
+
+func (dr *duplicatesReport) attribute(ids map[int64]*idWaste, id, size int64) {
+	w := ids[id]
+	if w == nil {
+		w = &idWaste{ID: id}
+		ids[id] = w
+	}
+	w.Files++
+	w.Wasted += size
+}
+
+func (dr *duplicatesReport) add(k duplicateKey, files []hashCandidate) {
+	slices.SortFunc(files, func(a, b hashCandidate) int {
+		return strings.Compare(a.path, b.path)
+	})
+	copies := map[devIno]bool{}
+	perDevice := map[uint64]int64{}
+	for _, f := range files {
+		di := devIno{f.key.Device, f.key.Inode}
+		if copies[di] {
+			continue
+		}
+		if len(copies) > 0 {
+			dr.attribute(dr.perUser, f.uid, f.size)
+			dr.attribute(dr.perGroup, f.gid, f.size)
+		}
+		copies[di] = true
+		perDevice[di.dev]++
+	}
+	if len(copies) < 2 {
+		// Hard links to the same file.
+		return
+	}
+	set := duplicateSet{
+		Size:   k.size,
+		Hash:   k.hash,
+		Copies: int64(len(copies)),
+		Wasted: k.size * int64(len(copies)-1),
+	}
+	for _, f := range files {
+		set.Files = append(set.Files, f.path)
+	}
+	for _, n := range perDevice {
+		set.Hardlinkable += k.size * (n - 1)
+	}
+	dr.Sets++
+	dr.Files += int64(len(files))
+	dr.Wasted += set.Wasted
+	if set.Hardlinkable > 0 {
+		dr.HardlinkableSets++
+		dr.Hardlinkable += set.Hardlinkable
+	}
+	dr.Duplicates = append(dr.Duplicates, set)
+}
+
+func sortedWaste(ids map[int64]*idWaste, nameForID func(int64) string, n int) []idWaste {
+	sorted := make([]idWaste, 0, len(ids))
+	for _, w := range ids {
+		w.Name = nameForID(w.ID)
+		sorted = append(sorted, *w)
+	}
+	slices.SortFunc(sorted, func(a, b idWaste) int {
+		if c := cmp.Compare(b.Wasted, a.Wasted); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	if n > 0 && len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// finalize orders the duplicate sets, users and groups by the storage
+// that they waste and retains the top n of each.
+func (dr *duplicatesReport) finalize(n int, hardlinkable bool) {
+	if hardlinkable {
+		dr.Duplicates = slices.DeleteFunc(dr.Duplicates, func(s duplicateSet) bool {
+			return s.Hardlinkable == 0
+		})
+	}
+	slices.SortFunc(dr.Duplicates, func(a, b duplicateSet) int {
+		if c := cmp.Compare(b.Wasted, a.Wasted); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Files[0], b.Files[0])
+	})
+	if n > 0 && len(dr.Duplicates) > n {
+		dr.Duplicates = dr.Duplicates[:n]
+	}
+	dr.PerUser = sortedWaste(dr.perUser, usernames.Manager.NameForUID, n)
+	dr.PerGroup = sortedWaste(dr.perGroup, usernames.Manager.NameForGID, n)
+}
+
+func (dr *duplicatesReport) print(out io.Writer) {
+	fmt.Fprintf(out, "duplicate sets    : %v\n", fmtCount(dr.Sets))
+	fmt.Fprintf(out, "duplicate files   : %v\n", fmtCount(dr.Files))
+	fmt.Fprintf(out, "wasted            : %v\n", fmtSize(dr.Wasted))
+	fmt.Fprintf(out, "hardlinkable sets : %v\n", fmtCount(dr.HardlinkableSets))
+	fmt.Fprintf(out, "hardlinkable      : %v\n", fmtSize(dr.Hardlinkable))
+	if dr.Unhashed > 0 {
+		fmt.Fprintf(out, "%v files (%v) may be duplicates but have not been hashed, use idu hash to hash them\n", dr.Unhashed, strings.TrimSpace(fmtSize(dr.UnhashedBytes)))
+	}
+	if len(dr.Duplicates) > 0 {
+		fmt.Fprintf(out, "\ntop %v duplicate sets by wasted storage:\n", len(dr.Duplicates))
+	}
+	for _, s := range dr.Duplicates {
+		fmt.Fprintf(out, "%v: %v copies of %v", strings.TrimSpace(fmtSize(s.Wasted)), s.Copies, strings.TrimSpace(fmtSize(s.Size)))
+		if s.Hardlinkable > 0 {
+			fmt.Fprintf(out, ", %v hardlinkable", strings.TrimSpace(fmtSize(s.Hardlinkable)))
+		}
+		fmt.Fprintln(out)
+		for _, f := range s.Files {
+			fmt.Fprintf(out, "  %v\n", f)
+		}
+	}
+	for _, ids := range []struct {
+		name  string
+		waste []idWaste
+	}{
+		{"users", dr.PerUser},
+		{"groups", dr.PerGroup},
+	} {
+		if len(ids.waste) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "\ntop %v %v by wasted storage:\n", len(ids.waste), ids.name)
+		for _, w := range ids.waste {
+			fmt.Fprintf(out, "%v %v files: %v\n", fmtSize(w.Wasted), fmtCount(w.Files), w.Name)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/file/localfs"
+)
+
+func TestDuplicates(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are not recorded on", runtime.GOOS)
+	}
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	root := filepath.Join(tmpDir, "tree")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, contents []byte) string {
+		p := filepath.Join(root, name)
+		if err := os.WriteFile(p, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	same := bytes.Repeat([]byte{'a'}, 100)
+	a := write("a", same)
+	b := write(filepath.Join("sub", "b"), same)
+	write("c", bytes.Repeat([]byte{'c'}, 100)) // same size, different contents.
+	write("d", []byte("unique"))
+	write("e", nil)
+	write("f", nil)
+	link := filepath.Join(root, "sub", "link")
+	if err := os.Link(a, link); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hashes are only written to the database itself and hence must be
+	// read from it rather than from the replica published by analyze.
+	cfg, err := config.ParseConfig([]byte(fmt.Sprintf(`- prefix: %v
+  database: %v
+  replica:
+    enabled: true
+`, root, filepath.Join(tmpDir, "db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	fs := localfs.New()
+	alz := &analyzeCmd{}
+	if err := alz.analyzeFS(ctx, fs, &analyzeFlags{}, []string{root}); err != nil {
+		t.Fatal(err)
+	}
+
+	dc := &duplicatesCmds{}
+	report, err := dc.duplicatesFS(ctx, fs, &duplicatesFlags{}, []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a, b, c and the link to a all have the same size.
+	if got, want := report.Unhashed, int64(4); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := report.Sets, int64(0); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	hc := &hashCmds{}
+	summary, err := hc.hashFS(ctx, fs, &hashFlags{}, []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The link need not be hashed separately.
+	if got, want := summary, (hashSummary{Files: 5, Candidates: 4, Hashed: 3, HashedBytes: 300}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// The hashes should be reused until a file is modified.
+	if err := os.WriteFile(filepath.Join(root, "c"), bytes.Repeat([]byte{'a'}, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := alz.analyzeFS(ctx, fs, &analyzeFlags{Force: true}, []string{root}); err != nil {
+		t.Fatal(err)
+	}
+	summary, err = hc.hashFS(ctx, fs, &hashFlags{}, []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The hash stored for c before it was modified is stale.
+	if got, want := summary, (hashSummary{Files: 5, Candidates: 4, Reused: 2, Hashed: 1, HashedBytes: 100, Pruned: 1}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	summary, err = hc.hashFS(ctx, fs, &hashFlags{}, []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := summary, (hashSummary{Files: 5, Candidates: 4, Reused: 3}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	report, err = dc.duplicatesFS(ctx, fs, &duplicatesFlags{}, []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.finalize(10, false)
+	if got, want := report.Sets, int64(1); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	set := report.Duplicates[0]
+	if got, want := set.Files, []string{a, filepath.Join(root, "c"), b, link}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := set.Copies, int64(3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := set.Wasted, int64(200); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := set.Hardlinkable, int64(200); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := report.Unhashed, int64(0); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	uid := int64(os.Getuid())
+	if got, want := len(report.PerUser), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := report.PerUser[0], (idWaste{ID: uid, Name: report.PerUser[0].Name, Files: 2, Wasted: 200}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestHashSamples(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	root := filepath.Join(tmpDir, "tree")
+	if err := os.MkdirAll(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	size := 3 * hashSampleSize
+	contents := make([]byte, size)
+	for i := range contents {
+		contents[i] = byte(i % 251)
+	}
+	// write writes contents with the bytes at each of the supplied offsets
+	// changed.
+	write := func(name string, changed ...int) {
+		buf := bytes.Clone(contents)
+		for _, at := range changed {
+			buf[at] = 0xff
+		}
+		if err := os.WriteFile(filepath.Join(root, name), buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a")
+	write("b")
+	write("c", size/2) // same sample as a and b, different contents.
+	write("d", 0)      // different sample.
+
+	cfg, err := config.ParseConfig([]byte(fmt.Sprintf(`- prefix: %v
+  database: %v
+`, root, filepath.Join(tmpDir, "db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = t.TempDir()
+	globalConfig = cfg
+
+	fs := localfs.New()
+	alz := &analyzeCmd{}
+	if err := alz.analyzeFS(ctx, fs, &analyzeFlags{}, []string{root}); err != nil {
+		t.Fatal(err)
+	}
+	hc := &hashCmds{}
+	summary, err := hc.hashFS(ctx, fs, &hashFlags{}, []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the files whose samples collide are hashed in their entirety.
+	if got, want := summary, (hashSummary{Files: 4, Candidates: 4, Sampled: 1, Hashed: 3, HashedBytes: 3 * int64(size)}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A new file whose sample is the same as one that was previously only
+	// sampled requires that both be hashed in their entirety.
+	write("e", 0, size/2)
+	if err := alz.analyzeFS(ctx, fs, &analyzeFlags{Force: true}, []string{root}); err != nil {
+		t.Fatal(err)
+	}
+	summary, err = hc.hashFS(ctx, fs, &hashFlags{}, []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := summary, (hashSummary{Files: 5, Candidates: 5, Reused: 3, Hashed: 2, HashedBytes: 2 * int64(size)}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	dc := &duplicatesCmds{}
+	report, err := dc.duplicatesFS(ctx, fs, &duplicatesFlags{}, []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.finalize(10, false)
+	if got, want := report.Sets, int64(1); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := report.Duplicates[0].Files, []string{filepath.Join(root, "a"), filepath.Join(root, "b")}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := report.Unhashed, int64(0); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
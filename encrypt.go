@@ -0,0 +1,82 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/encryption"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// encryptingWriter returns a writer that encrypts everything written to it
+// using the key specified by cfg before writing it to w, or one that writes
+// to w unchanged if encryption is not enabled. The returned writer must be
+// closed, but closing it does not close w.
+func encryptingWriter(ctx context.Context, cfg config.Encryption, w io.Writer) (io.WriteCloser, error) {
+	if !cfg.Enabled() {
+		return nopWriteCloser{w}, nil
+	}
+	key, err := encryption.Key(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return encryption.NewWriter(w, key)
+}
+
+// decryptingReader returns a reader for in that decrypts it if it is
+// encrypted. Since stats files and export archives do not record the
+// prefix they were created for in plain text, the keys for all prefixes
+// that have encryption enabled are tried, followed by any previous keys
+// configured for them. Stats files and export archives are not
+// re-encrypted when a database's key is rotated and hence previous keys
+// are needed to read those created before the rotation.
+func decryptingReader(ctx context.Context, in io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(in)
+	hdr, _ := br.Peek(len(encryption.Magic))
+	if !encryption.IsEncrypted(hdr) {
+		return br, nil
+	}
+	var keys, previous [][]byte
+	seen := map[string]bool{}
+	add := func(keys [][]byte, key []byte) [][]byte {
+		if seen[string(key)] {
+			return keys
+		}
+		seen[string(key)] = true
+		return append(keys, key)
+	}
+	for _, p := range globalConfig.Prefixes {
+		if !p.Encryption.Enabled() {
+			continue
+		}
+		key, err := encryption.Key(ctx, p.Encryption)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", p.Prefix, err)
+		}
+		keys = add(keys, key)
+		prev, err := encryption.PreviousKeys(p.Encryption)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", p.Prefix, err)
+		}
+		for _, key := range prev {
+			previous = add(previous, key)
+		}
+	}
+	keys = append(keys, previous...)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("the file is encrypted but no prefix has an encryption key configured")
+	}
+	return encryption.NewReaderForKeys(br, keys...)
+}
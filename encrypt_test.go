@@ -0,0 +1,129 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/encryption"
+	"cloudeng.io/cmd/idu/internal/synthfs"
+)
+
+func writeKey(t *testing.T, filename string) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte(hex.EncodeToString(key)), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	keyFile := filepath.Join(tmpDir, "key")
+	writeKey(t, keyFile)
+	sfs := synthfs.New("/synthetic", 1, synthfs.WithShape(2, 3, 10))
+	cfg, err := config.ParseConfig([]byte(fmt.Sprintf(`- prefix: %v
+  database: %v
+  encryption:
+    key_file: %v
+`, sfs.Root(), filepath.Join(tmpDir, "db"), keyFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = tmpDir
+	globalConfig = cfg
+	analyzeSynthetic(ctx, t, sfs)
+
+	// The database cannot be opened without the correct key.
+	pcfg := cfg.Prefixes[0]
+	wrongKey := pcfg
+	wrongKey.Encryption.KeyFile = filepath.Join(tmpDir, "wrong")
+	writeKey(t, wrongKey.Encryption.KeyFile)
+	if _, err := internal.OpenDatabase(ctx, wrongKey, true); err == nil || !strings.Contains(err.Error(), "key mismatch") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+
+	// Stats files are encrypted.
+	statsFile := filepath.Join(tmpDir, "stats")
+	if err := (&statsCmds{}).computeFS(ctx, sfs, &computeFlags{ComputeN: 10, StatsFile: statsFile}, []string{sfs.Root()}); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(statsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encryption.IsEncrypted(buf) {
+		t.Errorf("stats file is not encrypted")
+	}
+	stats, err := loadStats(ctx, statsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, files := sfs.Counts()
+	if got, want := stats.Stats.Prefix.TotalFiles+stats.Stats.Prefix.TotalPrefixes, files+dirs; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Export archives are encrypted and can be imported.
+	_, _, db, err := internal.OpenPrefixAndDatabase(ctx, cfg, sfs.Root(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	var archive bytes.Buffer
+	counts, err := exportDatabase(ctx, db, pcfg, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encryption.IsEncrypted(archive.Bytes()) {
+		t.Errorf("archive is not encrypted")
+	}
+	icfg := pcfg
+	icfg.Database = filepath.Join(tmpDir, "imported")
+	idb, err := internal.OpenDatabase(ctx, icfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idb.Close(ctx)
+	imported, err := importDatabase(ctx, idb, icfg, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := imported, counts; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Neither can be read without the key.
+	globalConfig.Prefixes[0].Encryption = wrongKey.Encryption
+	if _, err := loadStats(ctx, statsFile); err == nil || !strings.Contains(err.Error(), "key is incorrect") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	// Once the key has been rotated, files created using the old key
+	// can be read if it is configured as a previous key.
+	rotated := wrongKey.Encryption
+	rotated.PreviousKeyFiles = []string{keyFile}
+	globalConfig.Prefixes[0].Encryption = rotated
+	if _, err := loadStats(ctx, statsFile); err != nil {
+		t.Errorf("failed to read stats file using a previous key: %v", err)
+	}
+	globalConfig.Prefixes[0].Encryption = config.Encryption{}
+	if _, err := loadStats(ctx, statsFile); err == nil || !strings.Contains(err.Error(), "no prefix has an encryption key") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/database/types"
+)
+
+// errorRecord is the json representation of a types.ErrorPayload.
+type errorRecord struct {
+	When      time.Time           `json:"when"`
+	Key       string              `json:"key"`
+	Operation string              `json:"operation,omitempty"`
+	Category  types.ErrorCategory `json:"category"`
+	Errno     int64               `json:"errno,omitempty"`
+	Attempts  int64               `json:"attempts,omitempty"`
+	Error     string              `json:"error"`
+}
+
+func newErrorRecord(pl types.ErrorPayload) errorRecord {
+	category := pl.Category
+	if len(category) == 0 {
+		// Errors recorded before they were classified.
+		category = types.ErrorOther
+	}
+	return errorRecord{
+		When:      pl.When,
+		Key:       pl.Key,
+		Operation: pl.Operation,
+		Category:  category,
+		Errno:     pl.Errno,
+		Attempts:  pl.Attempts,
+		Error:     string(pl.Payload),
+	}
+}
+
+func (er errorRecord) String() string {
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "%s: %s", er.Key, er.Category)
+	if len(er.Operation) > 0 {
+		fmt.Fprintf(out, ": %s", er.Operation)
+	}
+	fmt.Fprintf(out, ": %s", er.Error)
+	if er.Attempts > 1 {
+		fmt.Fprintf(out, " (attempts: %v)", er.Attempts)
+	}
+	return out.String()
+}
+
+func parseErrorCategory(category string) (types.ErrorCategory, error) {
+	if len(category) == 0 {
+		return "", nil
+	}
+	for _, c := range types.ErrorCategories {
+		if string(c) == category {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported error category: %v, must be one of %v", category, types.ErrorCategories)
+}
+
+type errorCount struct {
+	Prefix string `json:"prefix"`
+	Errors int64  `json:"errors"`
+}
+
+// errorSummary summarizes errors by category, operation and by the
+// prefix that contains the file or prefix that the error refers to.
+type errorSummary struct {
+	Total       int64                         `json:"total"`
+	ByCategory  map[types.ErrorCategory]int64 `json:"by_category"`
+	ByOperation map[string]int64              `json:"by_operation"`
+	TopPrefixes []errorCount                  `json:"top_prefixes"`
+
+	separator string
+	byPrefix  map[string]int64
+}
+
+func newErrorSummary(separator string) *errorSummary {
+	return &errorSummary{
+		ByCategory:  map[types.ErrorCategory]int64{},
+		ByOperation: map[string]int64{},
+		separator:   separator,
+		byPrefix:    map[string]int64{},
+	}
+}
+
+func (es *errorSummary) add(er errorRecord) {
+	es.Total++
+	es.ByCategory[er.Category]++
+	op := er.Operation
+	if len(op) == 0 {
+		op = "unknown"
+	}
+	es.ByOperation[op]++
+	parent := er.Key
+	if idx := strings.LastIndex(parent, es.separator); idx > 0 {
+		parent = parent[:idx]
+	}
+	es.byPrefix[parent]++
+}
+
+// finalize computes the n prefixes with the most errors.
+func (es *errorSummary) finalize(n int) {
+	es.TopPrefixes = make([]errorCount, 0, len(es.byPrefix))
+	for p, c := range es.byPrefix {
+		es.TopPrefixes = append(es.TopPrefixes, errorCount{Prefix: p, Errors: c})
+	}
+	slices.SortFunc(es.TopPrefixes, func(a, b errorCount) int {
+		if c := cmp.Compare(b.Errors, a.Errors); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Prefix, b.Prefix)
+	})
+	if n > 0 && len(es.TopPrefixes) > n {
+		es.TopPrefixes = es.TopPrefixes[:n]
+	}
+}
+
+func (es *errorSummary) print(out io.Writer) {
+	fmt.Fprintf(out, "errors: %v\n", es.Total)
+	fmt.Fprintf(out, "by category:\n")
+	for _, c := range types.ErrorCategories {
+		if n := es.ByCategory[c]; n > 0 {
+			fmt.Fprintf(out, "  %-10v: %v\n", c, fmtCount(n))
+		}
+	}
+	fmt.Fprintf(out, "by operation:\n")
+	ops := make([]string, 0, len(es.ByOperation))
+	for op := range es.ByOperation {
+		ops = append(ops, op)
+	}
+	slices.Sort(ops)
+	for _, op := range ops {
+		fmt.Fprintf(out, "  %-10v: %v\n", op, fmtCount(es.ByOperation[op]))
+	}
+	fmt.Fprintf(out, "top %v prefixes by number of errors:\n", len(es.TopPrefixes))
+	for _, p := range es.TopPrefixes {
+		fmt.Fprintf(out, "  %v: %v\n", fmtCount(p.Errors), p.Prefix)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/database/types"
+)
+
+func TestErrorSummary(t *testing.T) {
+	es := newErrorSummary("/")
+	for _, pl := range []types.ErrorPayload{
+		{Key: "/a/b/0", Operation: types.OpLstat, Category: types.ErrorPermission},
+		{Key: "/a/b/1", Operation: types.OpLstat, Category: types.ErrorPermission},
+		{Key: "/a/b/2", Operation: types.OpReaddir, Category: types.ErrorPermission},
+		{Key: "/a/c/0", Operation: types.OpReaddir, Category: types.ErrorIO},
+		{Key: "/a/c/1", Operation: types.OpDB, Category: types.ErrorTimeout},
+		{Key: "/a/d/0"}, // recorded before errors were classified.
+	} {
+		es.add(newErrorRecord(pl))
+	}
+	es.finalize(2)
+	if got, want := es.Total, int64(6); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := es.ByCategory, map[types.ErrorCategory]int64{
+		types.ErrorPermission: 3,
+		types.ErrorIO:         1,
+		types.ErrorTimeout:    1,
+		types.ErrorOther:      1,
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := es.ByOperation, map[string]int64{
+		types.OpLstat:   2,
+		types.OpReaddir: 2,
+		types.OpDB:      1,
+		"unknown":       1,
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := es.TopPrefixes, []errorCount{{"/a/b", 3}, {"/a/c", 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := parseErrorCategory("not-a-category"); err == nil {
+		t.Errorf("expected an error")
+	}
+	if got, err := parseErrorCategory("io"); err != nil || got != types.ErrorIO {
+		t.Errorf("got %v, %v", got, err)
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/types"
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/file"
+)
+
+// An export archive contains every prefix, log, error and hash stored in
+// a database and is a gzip compressed stream of newline separated JSON
+// records. The first record is an exportHeader that describes the archive
+// and the last is an exportRecord of type "end" that contains the number
+// of records of each type so that truncated archives can be detected.
+// Prefixes are stored in decoded form rather than in the database's own
+// encoding so that archives can be imported by other versions of idu.
+// Archives exported from a prefix that has encryption enabled are
+// encrypted using its key, after compression.
+const (
+	exportFormat  = "idu-database-export"
+	exportVersion = 1
+)
+
+type exportHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	Prefix    string    `json:"prefix"`
+	Separator string    `json:"separator"`
+	Database  string    `json:"database"`
+	Host      string    `json:"host"`
+	Created   time.Time `json:"created"`
+}
+
+type exportRecord struct {
+	Type   string              `json:"type"` // prefix, log, error, hash or end.
+	Key    string              `json:"key,omitempty"`
+	Prefix *exportedPrefix     `json:"prefix,omitempty"`
+	Log    *types.LogPayload   `json:"log,omitempty"`
+	Error  *types.ErrorPayload `json:"error,omitempty"`
+	Hash   *exportedHash       `json:"hash,omitempty"`
+	Counts map[string]int64    `json:"counts,omitempty"`
+}
+
+type exportedFile struct {
+	Name      string            `json:"name,omitempty"`
+	Size      int64             `json:"size"`
+	Mode      fs.FileMode       `json:"mode"`
+	ModTime   time.Time         `json:"mod_time"`
+	UID       int64             `json:"uid"`
+	GID       int64             `json:"gid"`
+	Device    uint64            `json:"device"`
+	Inode     uint64            `json:"inode"`
+	Blocks    int64             `json:"blocks"`
+	Times     *prefixinfo.Times `json:"times,omitempty"`
+	ProjectID int64             `json:"project_id,omitempty"`
+}
+
+type exportedPrefix struct {
+	exportedFile
+	Entries []exportedFile `json:"entries"`
+}
+
+type exportedHash struct {
+	Device  uint64    `json:"device"`
+	Inode   uint64    `json:"inode"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+func newExportedFile(name string, size int64, mode fs.FileMode, modTime time.Time, xattr file.XAttr, times prefixinfo.Times, project int64) exportedFile {
+	ef := exportedFile{
+		Name:      name,
+		Size:      size,
+		Mode:      mode,
+		ModTime:   modTime,
+		UID:       xattr.UID,
+		GID:       xattr.GID,
+		Device:    xattr.Device,
+		Inode:     xattr.FileID,
+		Blocks:    xattr.Blocks,
+		ProjectID: project,
+	}
+	if !times.IsZero() {
+		ef.Times = &times
+	}
+	return ef
+}
+
+func newExportedPrefix(pi *prefixinfo.T) *exportedPrefix {
+	ep := &exportedPrefix{
+		exportedFile: newExportedFile("", pi.Size(), pi.Mode(), pi.ModTime(), pi.XAttr(), pi.Times(), pi.ProjectID()),
+	}
+	entries := pi.InfoList()
+	ep.Entries = make([]exportedFile, 0, len(entries))
+	for _, fi := range entries {
+		ep.Entries = append(ep.Entries, newExportedFile(fi.Name(), fi.Size(), fi.Mode(), fi.ModTime(), pi.XAttrInfo(fi), pi.TimesInfo(fi), pi.ProjectIDInfo(fi)))
+	}
+	return ep
+}
+
+func (ef exportedFile) info() file.Info {
+	sys := prefixinfo.XAttrAndTimes{
+		XAttr: file.XAttr{
+			UID:    ef.UID,
+			GID:    ef.GID,
+			Device: ef.Device,
+			FileID: ef.Inode,
+			Blocks: ef.Blocks,
+		},
+		ProjectID: ef.ProjectID,
+	}
+	if ef.Times != nil {
+		sys.Times = *ef.Times
+	}
+	return file.NewInfo(ef.Name, ef.Size, ef.Mode, ef.ModTime, sys)
+}
+
+func (ep *exportedPrefix) prefixInfo() prefixinfo.T {
+	pi := prefixinfo.New("", ep.info())
+	for _, e := range ep.Entries {
+		pi.AppendInfo(e.info())
+	}
+	return pi
+}
+
+type exportFlags struct {
+	Nested bool `subcmd:"nested,false,'also export the prefixes, errors and hashes stored in the databases of any configured prefixes nested within the specified prefix'"`
+}
+
+func (db *dbCmd) export(ctx context.Context, values interface{}, args []string) error {
+	ctx, cfg, sdb, err := openDatabaseAsOf(ctx, args[0], time.Time{}, values.(*exportFlags).Nested, false)
+	if err != nil {
+		return err
+	}
+	defer sdb.Close(ctx)
+	out := os.Stdout
+	if args[1] != "-" {
+		if out, err = os.Create(args[1]); err != nil {
+			return err
+		}
+	}
+	counts, err := exportDatabase(ctx, sdb, cfg, out)
+	if args[1] != "-" {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %v prefixes, %v logs, %v errors and %v hashes from %v\n",
+		counts["prefix"], counts["log"], counts["error"], counts["hash"], cfg.Database)
+	return nil
+}
+
+func exportDatabase(ctx context.Context, db database.DB, cfg config.Prefix, out io.Writer) (map[string]int64, error) {
+	ew, err := encryptingWriter(ctx, cfg.Encryption, out)
+	if err != nil {
+		return nil, err
+	}
+	zw := gzip.NewWriter(ew)
+	enc := json.NewEncoder(zw)
+	host, _ := os.Hostname()
+	err = enc.Encode(exportHeader{
+		Format:    exportFormat,
+		Version:   exportVersion,
+		Prefix:    cfg.Prefix,
+		Separator: cfg.Separator,
+		Database:  cfg.Database,
+		Host:      host,
+		Created:   time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	var encErr error
+	encode := func(rec exportRecord) bool {
+		if encErr = enc.Encode(rec); encErr != nil {
+			return false
+		}
+		counts[rec.Type]++
+		return true
+	}
+
+	err = db.Scan(ctx, "", func(_ context.Context, k string, v []byte) bool {
+		var pi prefixinfo.T
+		if encErr = pi.UnmarshalBinary(v); encErr != nil {
+			encErr = fmt.Errorf("failed to decode %v: %v, consider using idu database fsck", k, encErr)
+			return false
+		}
+		return encode(exportRecord{Type: "prefix", Key: k, Prefix: newExportedPrefix(&pi)})
+	})
+	if err != nil || encErr != nil {
+		return counts, firstError(err, encErr)
+	}
+	err = db.VisitLogs(ctx, time.Time{}, time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC),
+		func(_ context.Context, start, stop time.Time, detail []byte) bool {
+			return encode(exportRecord{Type: "log", Log: &types.LogPayload{Start: start, Stop: stop, Payload: detail}})
+		})
+	if err != nil || encErr != nil {
+		return counts, firstError(err, encErr)
+	}
+	err = db.VisitErrors(ctx, "", func(_ context.Context, pl types.ErrorPayload) bool {
+		return encode(exportRecord{Type: "error", Error: &pl})
+	})
+	if err != nil || encErr != nil {
+		return counts, firstError(err, encErr)
+	}
+	err = db.VisitHashes(ctx, func(_ context.Context, key types.HashKey, hash []byte) bool {
+		return encode(exportRecord{Type: "hash", Hash: &exportedHash{
+			Device:  key.Device,
+			Inode:   key.Inode,
+			ModTime: key.ModTime,
+			Hash:    hex.EncodeToString(hash),
+		}})
+	})
+	if err != nil || encErr != nil {
+		return counts, firstError(err, encErr)
+	}
+	if err := enc.Encode(exportRecord{Type: "end", Counts: counts}); err != nil {
+		return counts, err
+	}
+	if err := zw.Close(); err != nil {
+		return counts, err
+	}
+	return counts, ew.Close()
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *dbCmd) importArchive(ctx context.Context, _ interface{}, args []string) error {
+	in := os.Stdin
+	if args[1] != "-" {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	ctx, cfg, sdb, err := internal.OpenPrefixAndDatabase(ctx, globalConfig, args[0], false)
+	if err != nil {
+		return err
+	}
+	counts, err := importDatabase(ctx, sdb, cfg, in)
+	if cerr := sdb.Close(ctx); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %v prefixes, %v logs, %v errors and %v hashes into %v\n",
+		counts["prefix"], counts["log"], counts["error"], counts["hash"], cfg.Database)
+	return nil
+}
+
+// checkEmptyDatabase returns an error if db contains anything other
+// than metadata, which describes the database itself.
+func checkEmptyDatabase(ctx context.Context, db database.DB, location string) error {
+	stats, err := db.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	for bucket, n := range stats.Keys {
+		if n > 0 && bucket != "metadata" {
+			return fmt.Errorf("%v: database is not empty, it contains %v %v keys", location, n, bucket)
+		}
+	}
+	return nil
+}
+
+// importDatabase rebuilds a database from an archive created by
+// exportDatabase. The database must be empty and the archive must have
+// been exported using the same prefix and separator.
+func importDatabase(ctx context.Context, db database.DB, cfg config.Prefix, in io.Reader) (map[string]int64, error) {
+	if err := checkEmptyDatabase(ctx, db, cfg.Database); err != nil {
+		return nil, err
+	}
+	rd, err := decryptingReader(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(rd)
+	if err != nil {
+		return nil, fmt.Errorf("not an idu export archive: %v", err)
+	}
+	dec := json.NewDecoder(zr)
+	var hdr exportHeader
+	if err := dec.Decode(&hdr); err != nil || hdr.Format != exportFormat {
+		return nil, fmt.Errorf("not an idu export archive: %v", err)
+	}
+	if hdr.Version > exportVersion {
+		return nil, fmt.Errorf("unsupported export archive version %v, this version of idu supports up to version %v", hdr.Version, exportVersion)
+	}
+	if hdr.Prefix != cfg.Prefix || hdr.Separator != cfg.Separator {
+		return nil, fmt.Errorf("archive was exported for prefix %q with separator %q, not %q with separator %q", hdr.Prefix, hdr.Separator, cfg.Prefix, cfg.Separator)
+	}
+
+	counts := map[string]int64{}
+	for {
+		var rec exportRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("archive is truncated")
+			}
+			return counts, err
+		}
+		switch rec.Type {
+		case "prefix":
+			if rec.Prefix == nil {
+				return counts, fmt.Errorf("missing prefix for %v", rec.Key)
+			}
+			pi := rec.Prefix.prefixInfo()
+			var buf []byte
+			if buf, err = pi.MarshalBinary(); err != nil {
+				return counts, fmt.Errorf("failed to encode %v: %v", rec.Key, err)
+			}
+			err = db.Set(ctx, rec.Key, buf, true)
+		case "log":
+			if rec.Log == nil {
+				return counts, fmt.Errorf("missing log record")
+			}
+			err = db.Log(ctx, rec.Log.Start, rec.Log.Stop, rec.Log.Payload)
+		case "error":
+			if rec.Error == nil {
+				return counts, fmt.Errorf("missing error record")
+			}
+			err = db.SetError(ctx, *rec.Error)
+		case "hash":
+			if rec.Hash == nil {
+				return counts, fmt.Errorf("missing hash record")
+			}
+			var hash []byte
+			if hash, err = hex.DecodeString(rec.Hash.Hash); err == nil {
+				err = db.SetHash(ctx, types.HashKey{
+					Device:  rec.Hash.Device,
+					Inode:   rec.Hash.Inode,
+					ModTime: rec.Hash.ModTime,
+				}, hash)
+			}
+		case "end":
+			for typ, n := range rec.Counts {
+				if counts[typ] != n {
+					return counts, fmt.Errorf("archive is inconsistent: read %v %v records, expected %v", counts[typ], typ, n)
+				}
+			}
+			return counts, nil
+		default:
+			// Records of types introduced by later versions are
+			// counted, so that the archive can be checked, but are
+			// otherwise ignored.
+		}
+		if err != nil {
+			return counts, err
+		}
+		counts[rec.Type]++
+	}
+}
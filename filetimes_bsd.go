@@ -0,0 +1,29 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+//go:build darwin || freebsd || netbsd
+
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/file"
+)
+
+// statTimes obtains the access, change and birth times from the system
+// specific information returned by lstat.
+func statTimes(_ string, fi file.Info, _ bool) prefixinfo.Times {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return prefixinfo.Times{}
+	}
+	return prefixinfo.Times{
+		Access: time.Unix(st.Atimespec.Unix()),
+		Change: time.Unix(st.Ctimespec.Unix()),
+		Birth:  time.Unix(st.Birthtimespec.Unix()),
+	}
+}
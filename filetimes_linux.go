@@ -0,0 +1,39 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/file"
+	"golang.org/x/sys/unix"
+)
+
+// statTimes obtains the access and change times from the system
+// specific information returned by lstat. Birth times are not available
+// via lstat on Linux and require an additional statx call.
+func statTimes(filename string, fi file.Info, birth bool) prefixinfo.Times {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return prefixinfo.Times{}
+	}
+	times := prefixinfo.Times{
+		Access: time.Unix(st.Atim.Unix()),
+		Change: time.Unix(st.Ctim.Unix()),
+	}
+	if !birth {
+		return times
+	}
+	var stx unix.Statx_t
+	err := unix.Statx(unix.AT_FDCWD, filename, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx)
+	if err == nil && stx.Mask&unix.STATX_BTIME != 0 {
+		times.Birth = time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec))
+	}
+	return times
+}
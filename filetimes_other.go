@@ -0,0 +1,17 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd && !netbsd
+
+package main
+
+import (
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/file"
+)
+
+// statTimes is not supported on this system.
+func statTimes(string, file.Info, bool) prefixinfo.Times {
+	return prefixinfo.Times{}
+}
@@ -9,9 +9,12 @@ import (
 	"fmt"
 	"io/fs"
 	"strings"
+	"time"
 
 	"cloudeng.io/cmd/idu/internal"
 	"cloudeng.io/cmd/idu/internal/boolexpr"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database"
 	"cloudeng.io/cmd/idu/internal/prefixinfo"
 	"cloudeng.io/cmdutil/flags"
 	"cloudeng.io/errors"
@@ -23,10 +26,33 @@ import (
 type findFlags struct {
 	Long   bool            `subcmd:"l,false,'show long listing for each result'"`
 	Prefix flags.Repeating `subcmd:"prefix,,'prefix match expression'"`
+	AsOf   flags.Time      `subcmd:"as-of,,'find prefixes/files as they were at the specified time/date, this requires that history be enabled for the prefix'"`
+	Nested bool            `subcmd:"nested,true,'include the prefixes stored in the databases of any configured prefixes nested within the specified prefix'"`
 }
 
 type findCmds struct{}
 
+// asOf returns the time specified via an --as-of flag, or the zero time
+// if the flag was not specified.
+func asOf(f flags.Time) time.Time {
+	if f.IsDefault() {
+		return time.Time{}
+	}
+	return f.Get().(time.Time)
+}
+
+// openDatabaseAsOf opens the database for prefix, as of the specified
+// time, and, if nested is set, those of the configured prefixes nested
+// within it as a single logical tree. The most recently published
+// replicas are used, if enabled, when replica is set, which should only
+// be the case for commands that query the database.
+func openDatabaseAsOf(ctx context.Context, prefix string, when time.Time, nested, replica bool) (context.Context, config.Prefix, database.DB, error) {
+	if nested {
+		return internal.OpenNestedDatabases(ctx, globalConfig, prefix, when, replica)
+	}
+	return internal.OpenPrefixAndDatabaseAsOf(ctx, globalConfig, prefix, when, replica)
+}
+
 func (fc *findCmds) find(ctx context.Context, values interface{}, args []string) error {
 	// TODO(cnicolaou): generalize this to other filesystems.
 	fs := localfs.New()
@@ -64,7 +90,7 @@ func (fc *findCmds) findFS(ctx context.Context, fwfs filewalk.FS, ff *findFlags,
 		return err
 	}
 
-	ctx, cfg, db, err := internal.OpenPrefixAndDatabase(ctx, globalConfig, args[0], true)
+	ctx, cfg, db, err := openDatabaseAsOf(ctx, args[0], asOf(ff.AsOf), ff.Nested, true)
 	if err != nil {
 		return err
 	}
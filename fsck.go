@@ -0,0 +1,184 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+)
+
+type fsckFlags struct {
+	Repair bool `subcmd:"repair,false,'delete orphaned prefixes and records that cannot be decoded'"`
+}
+
+// fsckProblem represents a single problem found by fsck.
+type fsckProblem struct {
+	Kind   string // unreadable, orphan, error-record or log-record.
+	Key    string
+	Detail string
+}
+
+// fsckReport summarizes the results of checking a database.
+type fsckReport struct {
+	Prefixes int64
+	Orphans  int64 // the number of prefixes within orphaned subtrees.
+	Problems []fsckProblem
+	Repaired int64
+}
+
+func (fr *fsckReport) problem(kind, key, format string, args ...any) {
+	fr.Problems = append(fr.Problems, fsckProblem{Kind: kind, Key: key, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (fr *fsckReport) print(out io.Writer, repair bool) {
+	for _, p := range fr.Problems {
+		fmt.Fprintf(out, "%v: %v: %v\n", p.Kind, p.Key, p.Detail)
+	}
+	fmt.Fprintf(out, "prefixes        : %v\n", fmtCount(fr.Prefixes))
+	fmt.Fprintf(out, "orphaned        : %v\n", fmtCount(fr.Orphans))
+	fmt.Fprintf(out, "problems        : %v\n", fmtCount(int64(len(fr.Problems))))
+	if repair {
+		fmt.Fprintf(out, "records deleted : %v\n", fmtCount(fr.Repaired))
+	}
+}
+
+func (db *dbCmd) fsck(ctx context.Context, values interface{}, args []string) error {
+	ff := values.(*fsckFlags)
+	ctx, cfg, sdb, err := internal.OpenPrefixAndDatabase(ctx, globalConfig, args[0], !ff.Repair)
+	if err != nil {
+		return err
+	}
+	defer sdb.Close(ctx)
+	report, err := fsckDatabase(ctx, sdb, cfg, args[0], ff.Repair)
+	if err != nil {
+		return err
+	}
+	report.print(os.Stdout, ff.Repair)
+	if len(report.Problems) > 0 && !ff.Repair {
+		return fmt.Errorf("%v problems found in %v", len(report.Problems), cfg.Database)
+	}
+	return nil
+}
+
+// fsckDatabase checks every prefix within root, and every error and log
+// record, stored in db. Every prefix must be decodable and, other than
+// root itself, must be listed as a directory by its parent. Prefixes
+// that are not, or that are excluded by the current configuration, are
+// orphans that will never be updated by analyze, as are all of the
+// prefixes beneath them.
+func fsckDatabase(ctx context.Context, db database.DB, cfg config.Prefix, root string, repair bool) (*fsckReport, error) {
+	report := &fsckReport{}
+	sep := cfg.Separator
+	var keys, unreadable []string
+	stored, listed := map[string]bool{}, map[string]bool{}
+	err := db.Scan(ctx, root, func(_ context.Context, k string, v []byte) bool {
+		if !strings.HasPrefix(k, root) {
+			return false
+		}
+		if !within(k, root, sep) {
+			return true
+		}
+		report.Prefixes++
+		var pi prefixinfo.T
+		// UnmarshalBinary also validates the user, group and project id maps.
+		if err := pi.UnmarshalBinary(v); err != nil {
+			report.problem("unreadable", k, "%v", err)
+			unreadable = append(unreadable, k)
+			return true
+		}
+		keys = append(keys, k)
+		stored[k] = true
+		for _, fi := range pi.InfoList() {
+			if fi.IsDir() {
+				listed[strings.TrimSuffix(k, sep)+sep+fi.Name()] = true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A prefix is an orphan if it is excluded or if it is not listed by
+	// its parent, unless the parent itself cannot be read.
+	unreadableSet := map[string]bool{}
+	for _, k := range unreadable {
+		unreadableSet[k] = true
+	}
+	reasons := map[string]string{}
+	orphans := map[string]bool{}
+	for _, k := range keys {
+		parent := parentOf(k, sep)
+		switch {
+		case k == root:
+			continue
+		case cfg.Exclude(k):
+			reasons[k] = "excluded by the current configuration"
+		case unreadableSet[parent]:
+			continue
+		case !listed[k] && !stored[parent]:
+			reasons[k] = fmt.Sprintf("parent %v does not exist", parent)
+		case !listed[k]:
+			reasons[k] = fmt.Sprintf("not listed by its parent %v", parent)
+		default:
+			continue
+		}
+		orphans[k] = true
+	}
+	// Every prefix beneath an orphan is also an orphan and only the
+	// roots of orphaned subtrees are reported.
+	roots := collapsePrefixes(orphans, sep)
+	subtreeSizes := map[string]int64{}
+	for _, k := range keys {
+		if r, ok := withinAny(k, roots, sep); ok {
+			subtreeSizes[r]++
+			report.Orphans++
+		}
+	}
+	for _, r := range roots {
+		report.problem("orphan", r, "%v, %v prefixes", reasons[r], subtreeSizes[r])
+	}
+
+	err = db.CheckRecords(ctx, func(_ context.Context, kind, key string, err error) bool {
+		report.problem(kind+"-record", key, "%v", err)
+		if repair {
+			report.Repaired++
+		}
+		return repair
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !repair {
+		return report, nil
+	}
+	// The prefixes beneath an unreadable prefix are deleted along with
+	// it so that they do not appear to be orphans once it is gone; all
+	// of them will be rescanned by the next analyze.
+	remove := unreadable
+	subtrees := collapsePrefixes(unreadableSet, sep)
+	for _, k := range keys {
+		if _, ok := withinAny(k, roots, sep); ok {
+			remove = append(remove, k)
+		} else if _, ok := withinAny(k, subtrees, sep); ok {
+			remove = append(remove, k)
+		}
+	}
+	for _, k := range remove {
+		if err := db.Delete(ctx, k); err != nil {
+			return report, fmt.Errorf("failed to delete %v: %v", k, err)
+		}
+		report.Repaired++
+	}
+	return report, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database/badgerdb"
+	"cloudeng.io/file/localfs"
+	"github.com/dgraph-io/badger/v4"
+)
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, cfgFile, arg0, _ := setupAnalyze(t)
+	defer os.RemoveAll(tmpDir)
+
+	cfg, err := config.ReadConfig(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = cfg
+
+	alz := &analyzeCmd{}
+	if err := alz.analyzeFS(ctx, localfs.New(), &analyzeFlags{}, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, pcfg, db, err := internal.OpenPrefixAndDatabase(ctx, cfg, arg0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close(ctx) }()
+
+	report, err := fsckDatabase(ctx, db, pcfg, arg0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(report.Problems), 0; got != want {
+		t.Fatalf("got %v, want %v: %v", got, want, report.Problems)
+	}
+	prefixes := report.Prefixes
+
+	// Add a prefix that is not listed by its parent, along with one
+	// beneath it, and corrupt both a prefix that has sub-prefixes and
+	// an error record.
+	var buf bytes.Buffer
+	if err := db.Get(ctx, arg0, &buf); err != nil {
+		t.Fatal(err)
+	}
+	gone := filepath.Join(arg0, "d-gone")
+	for _, k := range []string{gone, filepath.Join(gone, "d-sub")} {
+		if err := db.Set(ctx, k, buf.Bytes(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt := filepath.Join(arg0, "d00-02")
+	if err := db.Set(ctx, corrupt, []byte("corrupt"), false); err != nil {
+		t.Fatal(err)
+	}
+	// 0xf3 is the error bucket.
+	err = db.(*badgerdb.Database).BadgerDB().Update(func(tx *badger.Txn) error {
+		return tx.Set([]byte("\xf3"+corrupt), []byte("corrupt"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exclude a prefix that has already been analyzed.
+	excluded := filepath.Join(arg0, "d00-03")
+	yml, err := os.ReadFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yml = append(yml, []byte("    - 'd-testtree[/\\\\]d00-03'\n")...)
+	ecfg, err := config.ParseConfig(yml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcfg, _ = ecfg.ForPrefix(arg0)
+
+	problems := func(report *fsckReport) []string {
+		var p []string
+		for _, pr := range report.Problems {
+			p = append(p, pr.Kind+":"+pr.Key)
+		}
+		return p
+	}
+
+	report, err = fsckDatabase(ctx, db, pcfg, arg0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := problems(report), []string{
+		"unreadable:" + corrupt,
+		"orphan:" + gone,
+		"orphan:" + excluded,
+		"error-record:" + corrupt,
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, p := range report.Problems {
+		if p.Key == excluded && !strings.Contains(p.Detail, "excluded") {
+			t.Errorf("unexpected detail: %v", p.Detail)
+		}
+	}
+	if got, want := report.Prefixes, prefixes+2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	report, err = fsckDatabase(ctx, db, pcfg, arg0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := report.Repaired, int64(len(report.Problems)); got <= want {
+		t.Errorf("got %v, want more than %v", got, want)
+	}
+
+	report, err = fsckDatabase(ctx, db, pcfg, arg0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(report.Problems), 0; got != want {
+		t.Errorf("got %v, want %v: %v", got, want, report.Problems)
+	}
+	for _, k := range []string{gone, corrupt, excluded} {
+		buf.Reset()
+		if err := db.Get(ctx, k, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%v was not deleted", k)
+		}
+	}
+
+	// The next analyze must restore the unreadable prefix and
+	// everything beneath it.
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := alz.analyzeFS(ctx, localfs.New(), &analyzeFlags{}, []string{arg0}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, db, err = internal.OpenPrefixAndDatabase(ctx, cfg, arg0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcfg, _ = cfg.ForPrefix(arg0)
+	report, err = fsckDatabase(ctx, db, pcfg, arg0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(report.Problems), 0; got != want {
+		t.Errorf("got %v, want %v: %v", got, want, report.Problems)
+	}
+	if got, want := report.Prefixes, prefixes; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -14,6 +14,8 @@ require (
 	cloudeng.io/text v0.0.11
 	github.com/dgraph-io/badger/v4 v4.5.0
 	github.com/dgraph-io/ristretto v0.2.0
+	github.com/google/btree v1.1.3
+	go.etcd.io/bbolt v1.3.11
 	golang.org/x/exp v0.0.0-20250106191152-7588d65b2ba8
 	golang.org/x/sys v0.29.0
 	golang.org/x/text v0.21.0
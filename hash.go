@@ -0,0 +1,418 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/boolexpr"
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/types"
+	"cloudeng.io/cmd/idu/internal/hardlinks"
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/errors"
+	"cloudeng.io/file"
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/file/localfs"
+)
+
+type hashFlags struct {
+	Concurrency int  `subcmd:"concurrency,0,'number of files to hash concurrently, zero for the number of CPUs'"`
+	Force       bool `subcmd:"force,false,'rehash files whose hashes are already stored in the database'"`
+}
+
+type hashCmds struct{}
+
+func (hc *hashCmds) hash(ctx context.Context, values interface{}, args []string) error {
+	// TODO(cnicolaou): generalize this to other filesystems.
+	fs := localfs.New()
+	summary, err := hc.hashFS(ctx, fs, values.(*hashFlags), args)
+	summary.print()
+	return err
+}
+
+// hashCandidate represents a file whose size is the same as that of at
+// least one other file, ignoring hard links to the same file, and hence
+// may have the same contents.
+type hashCandidate struct {
+	path     string
+	size     int64
+	uid, gid int64
+	key      types.HashKey
+}
+
+// hashCandidates returns all of the files within prefix that match the
+// supplied matcher and whose sizes collide with that of another file.
+// Empty files, and anything that is not a regular file, are ignored.
+func hashCandidates(ctx context.Context, db database.DB, prefix, sep string, match boolexpr.Matcher) (files int64, candidates []hashCandidate, err error) {
+	visit := func(fn func(k string, fi file.Info, xattr file.XAttr)) error {
+		errs := &errors.M{}
+		err := db.Scan(ctx, prefix, func(_ context.Context, k string, v []byte) bool {
+			if !strings.HasPrefix(k, prefix) {
+				return false
+			}
+			var pi prefixinfo.T
+			if err := pi.UnmarshalBinary(v); err != nil {
+				errs.Append(fmt.Errorf("failed to unmarshal value for %v: %v", k, err))
+				return false
+			}
+			for _, fi := range pi.InfoList() {
+				if !fi.Mode().IsRegular() || fi.Size() == 0 {
+					continue
+				}
+				if match.Entry(k, &pi, fi) {
+					fn(k, fi, pi.XAttrInfo(fi))
+				}
+			}
+			return true
+		})
+		errs.Append(err)
+		return errs.Err()
+	}
+
+	// The first pass determines which sizes collide, the second collects
+	// the files with those sizes, so that only the files that may be
+	// duplicates are held in memory.
+	sizes := map[int64]int{}
+	links := hardlinks.Incremental{}
+	err = visit(func(_ string, fi file.Info, xattr file.XAttr) {
+		files++
+		if !links.Ref(xattr.Device, xattr.FileID) {
+			sizes[fi.Size()]++
+		}
+	})
+	if err != nil {
+		return
+	}
+	err = visit(func(k string, fi file.Info, xattr file.XAttr) {
+		if sizes[fi.Size()] < 2 {
+			return
+		}
+		candidates = append(candidates, hashCandidate{
+			path: strings.TrimSuffix(k, sep) + sep + fi.Name(),
+			size: fi.Size(),
+			uid:  xattr.UID,
+			gid:  xattr.GID,
+			key: types.HashKey{
+				Device:  xattr.Device,
+				Inode:   xattr.FileID,
+				ModTime: fi.ModTime(),
+			},
+		})
+	})
+	return
+}
+
+// hashSummary summarizes the results of hashing the files within a prefix.
+type hashSummary struct {
+	Files       int64 // files considered.
+	Candidates  int64 // files whose sizes collide with that of another file.
+	Reused      int64 // files whose hashes were already stored.
+	Sampled     int64 // files for which only a sample was hashed.
+	Hashed      int64 // files whose entire contents were hashed.
+	HashedBytes int64
+	Errors      int64
+	Pruned      int64 // stale hashes that were deleted.
+}
+
+func (hs hashSummary) print() {
+	fmt.Printf("files             : %v\n", fmtCount(hs.Files))
+	fmt.Printf("same size         : %v\n", fmtCount(hs.Candidates))
+	fmt.Printf("previously hashed : %v\n", fmtCount(hs.Reused))
+	fmt.Printf("sampled           : %v\n", fmtCount(hs.Sampled))
+	fmt.Printf("hashed            : %v (%v)\n", fmtCount(hs.Hashed), strings.TrimSpace(fmtSize(hs.HashedBytes)))
+	fmt.Printf("errors            : %v\n", fmtCount(hs.Errors))
+	fmt.Printf("stale hashes      : %v\n", fmtCount(hs.Pruned))
+}
+
+// pruneHashes deletes the stored hashes of files that no longer appear,
+// with the same modification time, in any of the prefixes stored in db,
+// ie. those that have since been deleted or modified. Only the keys of
+// the stored hashes are held in memory.
+func pruneHashes(ctx context.Context, db database.DB) (int64, error) {
+	stale := map[string]types.HashKey{}
+	err := db.VisitHashes(ctx, func(_ context.Context, key types.HashKey, _ []byte) bool {
+		stale[string(key.Bytes())] = key
+		return true
+	})
+	if err != nil || len(stale) == 0 {
+		return 0, err
+	}
+	errs := &errors.M{}
+	err = db.Scan(ctx, "", func(_ context.Context, k string, v []byte) bool {
+		var pi prefixinfo.T
+		if err := pi.UnmarshalBinary(v); err != nil {
+			errs.Append(fmt.Errorf("failed to unmarshal value for %v: %v", k, err))
+			return false
+		}
+		for _, fi := range pi.InfoList() {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			xattr := pi.XAttrInfo(fi)
+			key := types.HashKey{Device: xattr.Device, Inode: xattr.FileID, ModTime: fi.ModTime()}
+			delete(stale, string(key.Bytes()))
+		}
+		return len(stale) > 0
+	})
+	errs.Append(err)
+	if err := errs.Err(); err != nil {
+		return 0, err
+	}
+	var pruned int64
+	for _, key := range stale {
+		if err := db.DeleteHash(ctx, key); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// hashSampleSize is the number of bytes, at each of the start and end of
+// a file, that are hashed to determine whether it may have the same
+// contents as another file of the same size. Files that are no larger
+// than twice this size are hashed in their entirety.
+const hashSampleSize = 64 * 1024
+
+// fileHashes are the hashes stored for a file: the SHA-256 hash of a
+// sample of its contents and, only if that sample is the same as that of
+// another file of the same size, the SHA-256 hash of its entire contents.
+// A cryptographic hash is used for the latter since the files that it
+// reports as duplicates may be replaced by hard links.
+type fileHashes struct {
+	sample, full []byte
+}
+
+func (fh fileHashes) marshal() []byte {
+	return append(bytes.Clone(fh.sample), fh.full...)
+}
+
+func unmarshalFileHashes(buf []byte) (fileHashes, error) {
+	switch len(buf) {
+	case sha256.Size:
+		return fileHashes{sample: bytes.Clone(buf)}, nil
+	case 2 * sha256.Size:
+		return fileHashes{sample: bytes.Clone(buf[:sha256.Size]), full: bytes.Clone(buf[sha256.Size:])}, nil
+	}
+	return fileHashes{}, fmt.Errorf("invalid stored hash: %x", buf)
+}
+
+// sampleHash hashes the first and last hashSampleSize bytes of the
+// specified file, or all of its contents, which are then also returned as
+// its full hash, if it is no larger than twice that.
+func sampleHash(ctx context.Context, fs file.FS, path string, size int64) (fileHashes, error) {
+	f, err := fs.OpenCtx(ctx, path)
+	if err != nil {
+		return fileHashes{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	ra, ok := f.(io.ReaderAt)
+	if !ok || size <= 2*hashSampleSize {
+		if _, err := io.Copy(h, f); err != nil {
+			return fileHashes{}, err
+		}
+		sum := h.Sum(nil)
+		return fileHashes{sample: sum, full: sum}, nil
+	}
+	for _, off := range []int64{0, size - hashSampleSize} {
+		if _, err := io.Copy(h, io.NewSectionReader(ra, off, hashSampleSize)); err != nil {
+			return fileHashes{}, err
+		}
+	}
+	return fileHashes{sample: h.Sum(nil)}, nil
+}
+
+// contentHash returns the SHA-256 hash of the contents of the specified
+// file.
+func contentHash(ctx context.Context, fs file.FS, path string) ([]byte, error) {
+	f, err := fs.OpenCtx(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// hashedFile is a hash candidate, other than a hard link to another
+// candidate, and the hashes stored, or computed, for it.
+type hashedFile struct {
+	hashCandidate
+	hashes  fileHashes
+	sampled bool // a sample of the file was hashed by this run.
+	hashed  bool // the entire file was hashed by this run.
+	failed  bool
+}
+
+// hashFiles calls hash for each of files using concurrency goroutines and
+// stores the resulting hashes. Errors are logged and the files for which
+// they occur are marked as failed.
+func hashFiles(ctx context.Context, db database.DB, prefix string, concurrency int, files []*hashedFile, hash func(*hashedFile) error) {
+	var (
+		wg sync.WaitGroup
+		ch = make(chan *hashedFile, concurrency)
+	)
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range ch {
+				err := hash(f)
+				if err == nil {
+					err = db.SetHash(ctx, f.key, f.hashes.marshal())
+				}
+				if err != nil {
+					internal.Log(ctx, internal.LogError, "hash error",
+						"prefix", prefix,
+						"path", f.path,
+						"error", err)
+					f.failed = true
+				}
+			}
+		}()
+	}
+	for _, f := range files {
+		select {
+		case ch <- f:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(ch)
+	wg.Wait()
+}
+
+func (hc *hashCmds) hashFS(ctx context.Context, fwfs filewalk.FS, hf *hashFlags, args []string) (hashSummary, error) {
+	var summary hashSummary
+	match, err := boolexpr.CreateMatcher(boolexpr.NewParser(ctx, fwfs),
+		boolexpr.WithEmptyEntryValue(true),
+		boolexpr.WithFilewalkFS(fwfs),
+		boolexpr.WithEntryExpression(args[1:]...))
+	if err != nil {
+		return summary, err
+	}
+	ctx, cfg, db, err := internal.OpenPrefixAndDatabase(ctx, globalConfig, args[0], false)
+	if err != nil {
+		return summary, err
+	}
+	defer db.Close(ctx)
+
+	var candidates []hashCandidate
+	summary.Files, candidates, err = hashCandidates(ctx, db, args[0], cfg.Separator, match)
+	if err != nil {
+		return summary, err
+	}
+	summary.Candidates = int64(len(candidates))
+
+	// Hard links to the same file need only be hashed once.
+	files := make([]*hashedFile, 0, len(candidates))
+	seen := map[types.HashKey]bool{}
+	var buf bytes.Buffer
+	for _, c := range candidates {
+		if seen[c.key] {
+			continue
+		}
+		seen[c.key] = true
+		f := &hashedFile{hashCandidate: c}
+		if !hf.Force {
+			buf.Reset()
+			if err := db.GetHash(ctx, c.key, &buf); err != nil {
+				return summary, err
+			}
+			if buf.Len() > 0 {
+				if f.hashes, err = unmarshalFileHashes(buf.Bytes()); err != nil {
+					return summary, fmt.Errorf("%v: %v", c.path, err)
+				}
+			}
+		}
+		files = append(files, f)
+	}
+
+	concurrency := hf.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	// Files are first distinguished by hashing a sample of their contents
+	// and only those whose samples are the same as that of another file
+	// of the same size are hashed in their entirety.
+	var toSample []*hashedFile
+	for _, f := range files {
+		if f.hashes.sample == nil {
+			toSample = append(toSample, f)
+		}
+	}
+	hashFiles(ctx, db, cfg.Prefix, concurrency, toSample, func(f *hashedFile) error {
+		hashes, err := sampleHash(ctx, fwfs, f.path, f.size)
+		if err != nil {
+			return err
+		}
+		f.hashes, f.sampled, f.hashed = hashes, true, hashes.full != nil
+		return nil
+	})
+	if err := ctx.Err(); err != nil {
+		return summary, err
+	}
+	type sampleKey struct {
+		size   int64
+		sample string
+	}
+	samples := map[sampleKey]int{}
+	for _, f := range files {
+		if !f.failed {
+			samples[sampleKey{f.size, string(f.hashes.sample)}]++
+		}
+	}
+	var toHash []*hashedFile
+	for _, f := range files {
+		if !f.failed && f.hashes.full == nil && samples[sampleKey{f.size, string(f.hashes.sample)}] > 1 {
+			toHash = append(toHash, f)
+		}
+	}
+	hashFiles(ctx, db, cfg.Prefix, concurrency, toHash, func(f *hashedFile) error {
+		sum, err := contentHash(ctx, fwfs, f.path)
+		if err != nil {
+			return err
+		}
+		f.hashes.full, f.hashed = sum, true
+		return nil
+	})
+	if err := ctx.Err(); err != nil {
+		return summary, err
+	}
+	for _, f := range files {
+		switch {
+		case f.failed:
+			summary.Errors++
+		case f.hashed:
+			summary.Hashed++
+			summary.HashedBytes += f.size
+		case f.sampled:
+			summary.Sampled++
+		default:
+			summary.Reused++
+		}
+	}
+
+	// Hashes are keyed by modification time and hence are never used
+	// again once a file is modified or deleted.
+	summary.Pruned, err = pruneHashes(ctx, db)
+	return summary, err
+}
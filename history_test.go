@@ -0,0 +1,140 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/file/localfs"
+)
+
+func TestAnalyzeHistory(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	root := filepath.Join(tmpDir, "tree")
+	for _, d := range []string{"sub", "other"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configFor := func(retain string) config.T {
+		cfg, err := config.ParseConfig([]byte(fmt.Sprintf(`- prefix: %v
+  database: %v
+  history:
+    enabled: true
+    retain: %v
+`, root, filepath.Join(tmpDir, "db"), retain)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	internal.LogDir = filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(internal.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig = configFor("24h")
+
+	analyze := func() {
+		alz := &analyzeCmd{}
+		if err := alz.analyzeFS(ctx, localfs.New(), &analyzeFlags{}, []string{root}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := time.Now()
+	analyze()
+	first := time.Now()
+
+	// Delete a directory, create a new one and add a file.
+	if err := os.Remove(filepath.Join(root, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "new"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "b"), []byte("b"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	analyze()
+
+	asOf := func(when time.Time) (prefixes, entries []string) {
+		ctx, _, db, err := internal.OpenPrefixAndDatabaseAsOf(ctx, globalConfig, root, when, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close(ctx)
+		err = db.Scan(ctx, root, func(_ context.Context, k string, v []byte) bool {
+			if !strings.HasPrefix(k, root) {
+				return false
+			}
+			prefixes = append(prefixes, strings.TrimPrefix(k, tmpDir))
+			if k != root {
+				return true
+			}
+			var pi prefixinfo.T
+			if err := pi.UnmarshalBinary(v); err != nil {
+				t.Fatal(err)
+			}
+			for _, fi := range pi.InfoList() {
+				entries = append(entries, fi.Name())
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(entries)
+		return
+	}
+
+	prefixes, entries := asOf(first)
+	if got, want := prefixes, []string{"/tree", "/tree/other", "/tree/sub"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := entries, []string{"a", "other", "sub"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	prefixes, entries = asOf(time.Time{})
+	if got, want := prefixes, []string{"/tree", "/tree/new", "/tree/other"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := entries, []string{"a", "b", "new", "other"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	_, _, _, err := internal.OpenPrefixAndDatabaseAsOf(ctx, globalConfig, root, before, false)
+	if err == nil || !strings.Contains(err.Error(), "history is only available since") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+
+	// All of the retained versions are older than the retention period
+	// for the next run.
+	globalConfig = configFor("1ns")
+	analyze()
+	_, _, _, err = internal.OpenPrefixAndDatabaseAsOf(ctx, globalConfig, root, first, false)
+	if err == nil || !strings.Contains(err.Error(), "history is only available since") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	_, stats, err := dbStats(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Keys["history"], int64(0); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,418 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"html/template"
+	"os"
+	"slices"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/reports"
+	"cloudeng.io/cmd/idu/internal/usernames"
+)
+
+// htmlReportData is embedded, as json, in the html report and is used
+// by the report's javascript to render the treemap and tables.
+type htmlReportData struct {
+	Prefix     string                           `json:"prefix"`
+	Date       time.Time                        `json:"date"`
+	Expression string                           `json:"expression"`
+	Units      string                           `json:"units"`
+	TopN       int                              `json:"top_n"`
+	Totals     reports.MergedStats              `json:"totals"`
+	Tree       *reports.Subtree                 `json:"tree"`
+	Prefixes   []reports.MergedStats            `json:"prefixes"`
+	Users      []reports.MergedStats            `json:"users"`
+	Groups     []reports.MergedStats            `json:"groups"`
+	PerUser    map[string][]reports.MergedStats `json:"per_user"`
+	PerGroup   map[string][]reports.MergedStats `json:"per_group"`
+}
+
+type htmlReports struct{}
+
+func (hr *htmlReports) generateReports(rf *generateReportsFlags, filenames *reportFilenames, stats statsFileFormat) error {
+	sdb := stats.Stats
+	topN := rf.HTML
+	data := htmlReportData{
+		Prefix:     stats.Prefix,
+		Date:       stats.Date,
+		Expression: stats.Expression,
+		Units:      globalFlags.Units,
+		TopN:       topN,
+		Totals: reports.MergedStats{
+			Prefix:      sdb.Prefix.Prefix,
+			Bytes:       sdb.Prefix.TotalBytes,
+			Storage:     sdb.Prefix.TotalStorageBytes,
+			Files:       sdb.Prefix.TotalFiles,
+			Prefixes:    sdb.Prefix.TotalPrefixes,
+			PrefixBytes: sdb.Prefix.TotalPrefixBytes,
+		},
+		Tree:     pruneSubtree(sdb.Subtrees, topN),
+		Prefixes: hr.prefixes(sdb.Prefix, topN),
+		Users:    hr.ids(sdb.ByUser, topN, usernames.Manager.NameForUID),
+		Groups:   hr.ids(sdb.ByGroup, topN, usernames.Manager.NameForGID),
+		PerUser:  hr.perID(sdb.PerUser, topN, usernames.Manager.NameForUID),
+		PerGroup: hr.perID(sdb.PerGroup, topN, usernames.Manager.NameForGID),
+	}
+	out := &bytes.Buffer{}
+	if err := htmlReportTemplate.Execute(out, data); err != nil {
+		return err
+	}
+	return os.WriteFile(filenames.summary("usage-report"), out.Bytes(), 0660) //nolint:gosec
+}
+
+// sortByBytes sorts the union of the top n entries for each metric, as
+// returned by Heaps.Merge, so that the report's tables can be sorted
+// by any of those metrics.
+func sortByBytes(ms []reports.MergedStats) []reports.MergedStats {
+	slices.SortFunc(ms, func(a, b reports.MergedStats) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(a.Prefix, b.Prefix), cmp.Compare(a.ID, b.ID))
+	})
+	return ms
+}
+
+func (hr *htmlReports) prefixes(h *reports.Heaps[string], n int) []reports.MergedStats {
+	ms := []reports.MergedStats{}
+	for prefix, v := range h.Merge(n) {
+		v.Prefix = prefix
+		ms = append(ms, v)
+	}
+	return sortByBytes(ms)
+}
+
+func (hr *htmlReports) ids(h *reports.Heaps[int64], n int, nameForID func(int64) string) []reports.MergedStats {
+	ms := []reports.MergedStats{}
+	if h == nil {
+		return ms
+	}
+	for id, v := range h.Merge(n) {
+		v.ID = id
+		v.IDName = nameForID(id)
+		ms = append(ms, v)
+	}
+	return sortByBytes(ms)
+}
+
+func (hr *htmlReports) perID(s reports.PerIDStats, n int, nameForID func(int64) string) map[string][]reports.MergedStats {
+	per := map[string][]reports.MergedStats{}
+	for id, h := range s.ByPrefix {
+		per[nameForID(id)] = hr.prefixes(h, n)
+	}
+	return per
+}
+
+// pruneSubtree returns a copy of st that retains at most n children
+// for every prefix; the totals of the prefixes that are dropped remain
+// included in those of their parent.
+func pruneSubtree(st *reports.Subtree, n int) *reports.Subtree {
+	if st == nil {
+		return nil
+	}
+	pruned := *st
+	pruned.Children = nil
+	for _, c := range st.Children[:min(n, len(st.Children))] {
+		pruned.Children = append(pruned.Children, pruneSubtree(c, n))
+	}
+	return &pruned
+}
+
+var htmlReportTemplate = template.Must(template.New("html").Parse(htmlReport))
+
+// htmlReport is a single, self-contained, html file that does not
+// load any external scripts, stylesheets or fonts so that it can be
+// viewed offline.
+const htmlReport = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Filesystem Usage for {{.Prefix}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 1.5em; color: #222; }
+h1 { font-size: 1.4em; margin-bottom: 0.2em; }
+h2 { font-size: 1.15em; margin-top: 1.6em; }
+.sub { color: #666; margin-top: 0; }
+.note { color: #666; font-size: 0.9em; }
+.totals td { padding: 0.15em 1em 0.15em 0; }
+#crumbs a { cursor: pointer; color: #0645ad; text-decoration: underline; }
+#treemap { position: relative; width: 100%; height: 480px; border: 1px solid #999; overflow: hidden; }
+#treemap div { position: absolute; box-sizing: border-box; border: 1px solid #fff; overflow: hidden;
+  font-size: 11px; line-height: 1.2; padding: 2px; color: #fff; }
+#treemap div.zoom { cursor: zoom-in; }
+#treemap div:hover { filter: brightness(1.15); }
+table.sortable { border-collapse: collapse; margin-top: 0.5em; }
+table.sortable th, table.sortable td { padding: 0.2em 0.7em; border-bottom: 1px solid #ddd; }
+table.sortable th { cursor: pointer; background: #f3f3f3; user-select: none; }
+table.sortable td.n { text-align: right; font-variant-numeric: tabular-nums; }
+label { margin-right: 1em; }
+</style>
+</head>
+<body>
+<h1>Filesystem Usage for <span id="prefix"></span></h1>
+<p class="sub" id="subtitle"></p>
+<table class="totals" id="totals"></table>
+
+<h2>Usage by subtree</h2>
+<p class="note">Click on a prefix to zoom in and on the path above the map to zoom out.
+The map includes all users and groups.</p>
+<div id="crumbs"></div>
+<div id="treemap"></div>
+
+<h2>Top prefixes</h2>
+<p>
+<label>User <select id="user-filter"><option value="">all users</option></select></label>
+<label>Group <select id="group-filter"><option value="">all groups</option></select></label>
+</p>
+<p class="note">Each table contains the top entries for every column, hence a zero means
+that an entry is not amongst the top entries for that column.</p>
+<p class="note" id="prefixes-note"></p>
+<div id="prefixes"></div>
+
+<h2>Top users</h2>
+<div id="users"></div>
+
+<h2>Top groups</h2>
+<div id="groups"></div>
+
+<script type="application/json" id="data">{{.}}</script>
+<script>
+"use strict";
+const data = JSON.parse(document.getElementById("data").textContent);
+
+function fmtBytes(n) {
+  const base = data.units === "binary" ? 1024 : 1000;
+  const units = data.units === "binary" ?
+    ["B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"] : ["B", "KB", "MB", "GB", "TB", "PB", "EB"];
+  let i = 0;
+  while (Math.abs(n) >= base && i < units.length - 1) { n /= base; i++; }
+  return (i === 0 ? n.toString() : n.toFixed(2)) + " " + units[i];
+}
+
+function fmtCount(n) { return n.toLocaleString(); }
+
+function el(tag, text) {
+  const e = document.createElement(tag);
+  if (text !== undefined) { e.textContent = text; }
+  return e;
+}
+
+function renderTotals() {
+  document.getElementById("prefix").textContent = data.prefix;
+  let sub = "as of " + new Date(data.date).toLocaleString();
+  if (data.expression) { sub += " for " + data.expression; }
+  document.getElementById("subtitle").textContent = sub;
+  const t = document.getElementById("totals");
+  for (const [k, v] of [["Bytes", fmtBytes(data.totals.bytes)], ["Storage bytes", fmtBytes(data.totals.storage ?? 0)],
+    ["Files", fmtCount(data.totals.files)], ["Prefixes", fmtCount(data.totals.prefixes)]]) {
+    const tr = t.insertRow();
+    tr.insertCell().textContent = k;
+    tr.insertCell().textContent = v;
+  }
+}
+
+// Treemap, laid out using the squarified algorithm.
+
+function squarify(items, x, y, w, h, out) {
+  if (items.length === 0) { return; }
+  const total = items.reduce((s, i) => s + i.area, 0);
+  if (total <= 0) { return; }
+  const short = Math.min(w, h);
+  let row = [], rowArea = 0, worst = Infinity, i = 0;
+  for (; i < items.length; i++) {
+    const a = rowArea + items[i].area;
+    const r = row.concat([items[i]]);
+    const side = a / short;
+    const wr = Math.max(...r.map(it => Math.max(side * side / it.area, it.area / (side * side))));
+    if (wr > worst) { break; }
+    row = r; rowArea = a; worst = wr;
+  }
+  const side = rowArea / short;
+  let off = 0;
+  for (const it of row) {
+    const len = it.area / side;
+    if (w >= h) {
+      out.push({ item: it, x: x, y: y + off, w: side, h: len });
+    } else {
+      out.push({ item: it, x: x + off, y: y, w: len, h: side });
+    }
+    off += len;
+  }
+  if (w >= h) {
+    squarify(items.slice(i), x + side, y, w - side, h, out);
+  } else {
+    squarify(items.slice(i), x, y + side, w, h - side, out);
+  }
+}
+
+function color(i, depth) {
+  const hue = (i * 47) % 360;
+  return "hsl(" + hue + ", 55%, " + (38 + 8 * depth) + "%)";
+}
+
+let path = [];
+
+function renderCrumbs() {
+  const c = document.getElementById("crumbs");
+  c.textContent = "";
+  path.forEach((n, i) => {
+    if (i > 0) { c.append(" / "); }
+    if (i === path.length - 1) {
+      c.append(el("b", n.Name));
+      return;
+    }
+    const a = el("a", n.Name);
+    a.onclick = () => { path = path.slice(0, i + 1); renderTreemap(); };
+    c.append(a);
+  });
+  c.append(" (" + fmtBytes(path[path.length - 1].Bytes) + ")");
+}
+
+function renderTreemap() {
+  const tm = document.getElementById("treemap");
+  tm.textContent = "";
+  if (!data.tree) {
+    tm.style.height = "auto";
+    tm.append(el("p", "Subtree totals are not available, recompute the stats using 'idu stats compute --subtree-depth' to include them."));
+    return;
+  }
+  if (path.length === 0) { path = [data.tree]; }
+  renderCrumbs();
+  const node = path[path.length - 1];
+  const items = (node.Children || []).map(c => ({ node: c, area: c.Bytes }));
+  const other = node.Bytes - items.reduce((s, i) => s + i.area, 0);
+  if (other > 0) {
+    items.push({ node: null, area: other });
+  }
+  const W = tm.clientWidth, H = tm.clientHeight;
+  const scale = node.Bytes > 0 ? W * H / node.Bytes : 0;
+  items.forEach(i => { i.area *= scale; });
+  const rects = [];
+  squarify(items.filter(i => i.area > 0), 0, 0, W, H, rects);
+  rects.forEach((r, i) => {
+    const d = el("div");
+    d.style.left = r.x + "px";
+    d.style.top = r.y + "px";
+    d.style.width = r.w + "px";
+    d.style.height = r.h + "px";
+    const n = r.item.node;
+    if (!n) {
+      d.style.background = "#aaa";
+      d.title = "files in " + node.Name + " and smaller prefixes: " + fmtBytes(other);
+      d.textContent = "other";
+    } else {
+      d.style.background = color(i, Math.min(path.length - 1, 3));
+      d.title = n.Name + "\n" + fmtBytes(n.Bytes) + "\n" + fmtCount(n.Files) + " files, " + fmtCount(n.Prefixes) + " prefixes";
+      d.textContent = n.Name + " " + fmtBytes(n.Bytes);
+      if (n.Children && n.Children.length > 0) {
+        d.className = "zoom";
+        d.onclick = () => { path.push(n); renderTreemap(); };
+      }
+    }
+    tm.append(d);
+  });
+}
+
+// Sortable tables.
+
+function renderTable(id, rows, columns) {
+  const div = document.getElementById(id);
+  div.textContent = "";
+  if (!rows || rows.length === 0) {
+    div.append(el("p", "none"));
+    return;
+  }
+  const table = el("table");
+  table.className = "sortable";
+  const head = table.createTHead().insertRow();
+  const body = table.createTBody();
+  let sortBy = columns.findIndex(c => c.key === "bytes"), desc = true;
+  // Zero values are omitted from the json.
+  const value = (r, c) => r[c.key] ?? (c.fmt ? 0 : "");
+  const fill = () => {
+    const col = columns[sortBy];
+    const sorted = rows.slice().sort((a, b) => {
+      const x = value(a, col), y = value(b, col);
+      const c = typeof x === "string" ? x.localeCompare(y) : x - y;
+      return desc ? -c : c;
+    });
+    body.textContent = "";
+    for (const r of sorted) {
+      const tr = body.insertRow();
+      for (const c of columns) {
+        const td = tr.insertCell();
+        td.textContent = c.fmt ? c.fmt(value(r, c)) : value(r, c);
+        if (c.fmt) { td.className = "n"; }
+      }
+    }
+    head.querySelectorAll("th").forEach((th, i) => {
+      th.textContent = columns[i].label + (i === sortBy ? (desc ? " ▼" : " ▲") : "");
+    });
+  };
+  columns.forEach((c, i) => {
+    const th = el("th", c.label);
+    th.onclick = () => {
+      desc = i === sortBy ? !desc : !!c.fmt;
+      sortBy = i;
+      fill();
+    };
+    head.append(th);
+  });
+  fill();
+  div.append(table);
+}
+
+const sizeColumns = [
+  { key: "bytes", label: "Bytes", fmt: fmtBytes },
+  { key: "storage", label: "Storage", fmt: fmtBytes },
+  { key: "files", label: "Files", fmt: fmtCount },
+];
+
+const prefixColumns = [{ key: "prefix", label: "Prefix" }].concat(sizeColumns,
+  [{ key: "prefixes", label: "Sub-prefixes", fmt: fmtCount }]);
+
+function renderPrefixes() {
+  const user = document.getElementById("user-filter").value;
+  const group = document.getElementById("group-filter").value;
+  let rows = data.prefixes, note = "";
+  if (user && group) {
+    const inGroup = new Set((data.per_group[group] || []).map(r => r.prefix));
+    rows = (data.per_user[user] || []).filter(r => inGroup.has(r.prefix));
+    note = "Usage by user " + user + " within the top prefixes for group " + group + ".";
+  } else if (user) {
+    rows = data.per_user[user];
+    note = "Usage by user " + user + ".";
+  } else if (group) {
+    rows = data.per_group[group];
+    note = "Usage by group " + group + ".";
+  }
+  document.getElementById("prefixes-note").textContent = note;
+  renderTable("prefixes", rows, prefixColumns);
+}
+
+function fillFilter(id, names) {
+  const sel = document.getElementById(id);
+  for (const n of Object.keys(names).sort()) {
+    const o = el("option", n);
+    o.value = n;
+    sel.append(o);
+  }
+  sel.onchange = renderPrefixes;
+}
+
+renderTotals();
+renderTreemap();
+window.addEventListener("resize", renderTreemap);
+fillFilter("user-filter", data.per_user || {});
+fillFilter("group-filter", data.per_group || {});
+renderPrefixes();
+renderTable("users", data.users, [{ key: "name", label: "User" }].concat(sizeColumns));
+renderTable("groups", data.groups, [{ key: "name", label: "Group" }].concat(sizeColumns));
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,144 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/reports"
+	"cloudeng.io/cmd/idu/internal/synthfs"
+)
+
+// generateTestReports generates the reports requested by rf for stats
+// and returns the directory containing them.
+func generateTestReports(t *testing.T, stats statsFileFormat, rf *generateReportsFlags) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(stats); err != nil {
+		t.Fatal(err)
+	}
+	rf.ReportDir = t.TempDir()
+	rc := &reportCmds{statsData: buf.Bytes()}
+	if err := rc.generateReports(context.Background(), rf); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(rf.ReportDir, "latest")
+}
+
+func generateHTMLReport(t *testing.T, stats statsFileFormat, topN int) (string, htmlReportData) {
+	t.Helper()
+	dir := generateTestReports(t, stats, &generateReportsFlags{HTML: topN})
+	contents, err := os.ReadFile(filepath.Join(dir, "usage-report.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(contents)
+	_, embedded, ok := strings.Cut(page, `<script type="application/json" id="data">`)
+	embedded, _, ok2 := strings.Cut(embedded, "</script>")
+	if !ok || !ok2 {
+		t.Fatalf("failed to find the report's data")
+	}
+	var data htmlReportData
+	if err := json.Unmarshal([]byte(embedded), &data); err != nil {
+		t.Fatal(err)
+	}
+	return page, data
+}
+
+func TestHTMLReport(t *testing.T) {
+	ctx := context.Background()
+	sfs := synthfs.New("/synthetic", 3,
+		synthfs.WithShape(2, 8, 10),
+		synthfs.WithUIDs(synthfs.Uniform(1000, 1001, 1002, 1003)))
+	cfg := setupSynthetic(t, sfs)
+	analyzeSynthetic(ctx, t, sfs)
+	all := statsSynthetic(ctx, t, cfg, sfs)
+	stats := statsFileFormat{Prefix: sfs.Root(), Date: time.Now(), Stats: all}
+
+	page, data := generateHTMLReport(t, stats, 5)
+
+	// The report must be viewable offline.
+	for _, external := range []string{"src=", "href=", "@import", "url("} {
+		if strings.Contains(page, external) {
+			t.Errorf("report refers to an external resource: %v", external)
+		}
+	}
+
+	if data.Prefix != sfs.Root() || data.TopN != 5 {
+		t.Errorf("unexpected report: %v, %v", data.Prefix, data.TopN)
+	}
+	if data.Tree == nil {
+		t.Fatal("missing subtrees")
+	}
+	if got, want := data.Tree.Bytes, data.Totals.Bytes; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := data.Tree.Prefixes, data.Totals.Prefixes; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var walk func(st *reports.Subtree, depth int)
+	walk = func(st *reports.Subtree, depth int) {
+		if len(st.Children) > 5 {
+			t.Errorf("%v: too many children: %v", st.Name, len(st.Children))
+		}
+		if depth > 3 {
+			t.Errorf("%v: too deep: %v", st.Name, depth)
+		}
+		var sum int64
+		for _, c := range st.Children {
+			sum += c.Bytes
+			walk(c, depth+1)
+		}
+		if sum > st.Bytes {
+			t.Errorf("%v: children exceed their parent: %v > %v", st.Name, sum, st.Bytes)
+		}
+	}
+	walk(data.Tree, 0)
+
+	if got := len(data.Prefixes); got < 5 {
+		t.Errorf("got %v, want at least 5", got)
+	}
+	// Prefixes are the union of the top prefixes for each metric and
+	// hence may have zero values for some metrics.
+	var prefixBytes int64
+	for _, p := range data.Prefixes {
+		if p.Prefixes > data.Totals.Prefixes {
+			t.Errorf("%v: too many prefixes: %+v", p.Prefix, p)
+		}
+		prefixBytes += p.PrefixBytes
+	}
+	if prefixBytes == 0 {
+		t.Errorf("missing prefix bytes: %v", data.Prefixes)
+	}
+	if got, want := len(data.Users), 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for i := 1; i < len(data.Users); i++ {
+		if data.Users[i].Bytes > data.Users[i-1].Bytes {
+			t.Errorf("users are not in order of bytes: %v", data.Users)
+		}
+	}
+	if got, want := len(data.PerUser), 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(data.Groups) == 0 || len(data.PerGroup) == 0 {
+		t.Errorf("missing groups: %v, %v", data.Groups, data.PerGroup)
+	}
+
+	// Stats computed without subtrees are still reported on.
+	all.Subtrees = nil
+	_, data = generateHTMLReport(t, stats, 5)
+	if data.Tree != nil || len(data.Users) != 4 {
+		t.Errorf("unexpected report: %v, %v", data.Tree, data.Users)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package adaptive_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/adaptive"
+	"cloudeng.io/cmd/idu/internal/config"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := adaptive.NewLimiter(2)
+
+	var inflight, peak atomic.Int64
+	run := func(n int) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := l.Acquire(ctx); err != nil {
+					t.Error(err)
+					return
+				}
+				cur := inflight.Add(1)
+				for {
+					p := peak.Load()
+					if cur <= p || peak.CompareAndSwap(p, cur) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				inflight.Add(-1)
+				l.Release()
+			}()
+		}
+		wg.Wait()
+	}
+	run(20)
+	if got, want := peak.Load(), int64(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	peak.Store(0)
+	l.SetLimit(5)
+	run(50)
+	if got, want := peak.Load(), int64(5); got > want || got < 3 {
+		t.Errorf("got %v, want <= %v", got, want)
+	}
+
+	// A canceled Acquire must not consume any capacity.
+	l.SetLimit(1)
+	if err := l.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.Acquire(cctx); err == nil {
+		t.Errorf("expected an error")
+	}
+	l.Release()
+	if err := l.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	l.Release()
+}
+
+func TestController(t *testing.T) {
+	cfg := config.Adaptive{
+		Enabled:       true,
+		TargetLatency: 10 * time.Millisecond,
+		TargetIOPS:    1000,
+		MaxErrorRate:  0.1,
+		Interval:      time.Second,
+	}
+	c := adaptive.New(cfg, 8, 100)
+	concurrency := func() []int {
+		scans, stats := c.Concurrency()
+		return []int{scans, stats}
+	}
+	expect := func(scans, stats int) {
+		t.Helper()
+		if got, want := concurrency(), []int{scans, stats}; got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	record := func(n int, latency time.Duration, errors int) {
+		for i := 0; i < n; i++ {
+			c.RecordStat(latency, i < errors)
+		}
+	}
+	expect(2, 25)
+
+	// No operations, no change.
+	if _, changed := c.Adjust(time.Second); changed {
+		t.Errorf("unexpected change")
+	}
+
+	// Below all targets.
+	record(100, time.Millisecond, 0)
+	ch, changed := c.Adjust(time.Second)
+	if !changed || ch.Reason != "below targets" {
+		t.Errorf("unexpected change: %v %+v", changed, ch)
+	}
+	expect(3, 35)
+
+	// Latency above target.
+	record(100, 20*time.Millisecond, 0)
+	ch, _ = c.Adjust(time.Second)
+	if got, want := ch.Reason, "latency above target"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ch.MeanStatLatency, 20*time.Millisecond; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	expect(1, 17)
+
+	// IOPS above target.
+	record(2000, time.Millisecond, 0)
+	ch, _ = c.Adjust(time.Second)
+	if got, want := ch.Reason, "iops above target"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	expect(1, 8)
+
+	// IOPS close to the target, no change.
+	record(950, time.Millisecond, 0)
+	if _, changed := c.Adjust(time.Second); changed {
+		t.Errorf("unexpected change")
+	}
+
+	// Error rate above target.
+	record(100, time.Millisecond, 20)
+	ch, _ = c.Adjust(time.Second)
+	if got, want := ch.Reason, "error rate above target"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	expect(1, 4)
+
+	// Concurrency is bounded by the maximums.
+	for i := 0; i < 20; i++ {
+		record(10, time.Millisecond, 0)
+		c.RecordScan(false)
+		c.Adjust(time.Second)
+	}
+	expect(8, 100)
+}
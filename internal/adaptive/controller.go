@@ -0,0 +1,161 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package adaptive provides support for adjusting the number of
+// concurrent filesystem scans and stats according to the observed
+// latency, IOPS and error rate of the filesystem being analyzed.
+package adaptive
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/config"
+)
+
+// Controller adjusts the number of concurrent scans and stats using
+// an additive increase, multiplicative decrease policy: concurrency
+// is halved whenever the error rate, IOPS or mean stat latency exceed
+// their configured targets and is otherwise increased incrementally.
+type Controller struct {
+	cfg                config.Adaptive
+	maxScans, maxStats int
+	scans, stats       *Limiter
+
+	mu      sync.Mutex
+	nstats  int64
+	nscans  int64
+	nerrors int64
+	latency time.Duration
+}
+
+// Change records a change in concurrency and the observations that
+// led to it.
+type Change struct {
+	Reason           string
+	Scans, Stats     int
+	PrevScans        int
+	PrevStats        int
+	MeanStatLatency  time.Duration
+	IOPS             float64
+	ErrorRate        float64
+	ObservedInterval time.Duration
+}
+
+// New returns a new Controller that will allow at most maxScans concurrent
+// scans and maxStats concurrent stats. Concurrency starts at one quarter
+// of these maximums.
+func New(cfg config.Adaptive, maxScans, maxStats int) *Controller {
+	cfg.MinScans, cfg.MinStats = max(cfg.MinScans, 1), max(cfg.MinStats, 1)
+	maxScans, maxStats = max(maxScans, cfg.MinScans), max(maxStats, cfg.MinStats)
+	return &Controller{
+		cfg:      cfg,
+		maxScans: maxScans,
+		maxStats: maxStats,
+		scans:    NewLimiter(max(maxScans/4, cfg.MinScans)),
+		stats:    NewLimiter(max(maxStats/4, cfg.MinStats)),
+	}
+}
+
+// Concurrency returns the current number of concurrent scans and stats
+// allowed.
+func (c *Controller) Concurrency() (scans, stats int) {
+	return c.scans.Limit(), c.stats.Limit()
+}
+
+// Limits returns the maximum number of concurrent scans and stats.
+func (c *Controller) Limits() (scans, stats int) {
+	return c.maxScans, c.maxStats
+}
+
+// RecordStat records the latency and outcome of a stat operation.
+func (c *Controller) RecordStat(latency time.Duration, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nstats++
+	c.latency += latency
+	if failed {
+		c.nerrors++
+	}
+}
+
+// RecordScan records the outcome of a scan operation.
+func (c *Controller) RecordScan(failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nscans++
+	if failed {
+		c.nerrors++
+	}
+}
+
+// Adjust adjusts concurrency based on the operations recorded since the
+// last call to Adjust, which are assumed to have taken place over the
+// specified interval. It returns true, and a description of the change,
+// if concurrency was changed.
+func (c *Controller) Adjust(interval time.Duration) (Change, bool) {
+	c.mu.Lock()
+	nstats, nscans, nerrors, latency := c.nstats, c.nscans, c.nerrors, c.latency
+	c.nstats, c.nscans, c.nerrors, c.latency = 0, 0, 0, 0
+	c.mu.Unlock()
+
+	ops := nstats + nscans
+	if ops == 0 || interval <= 0 {
+		return Change{}, false
+	}
+	ch := Change{
+		IOPS:             float64(nstats) / interval.Seconds(),
+		ErrorRate:        float64(nerrors) / float64(ops),
+		ObservedInterval: interval,
+	}
+	if nstats > 0 {
+		ch.MeanStatLatency = latency / time.Duration(nstats)
+	}
+	ch.PrevScans, ch.PrevStats = c.Concurrency()
+	ch.Scans, ch.Stats = ch.PrevScans, ch.PrevStats
+
+	targetIOPS := float64(c.cfg.TargetIOPS)
+	switch {
+	case ch.ErrorRate > c.cfg.MaxErrorRate:
+		ch.Reason = "error rate above target"
+	case targetIOPS > 0 && ch.IOPS > targetIOPS:
+		ch.Reason = "iops above target"
+	case ch.MeanStatLatency > c.cfg.TargetLatency:
+		ch.Reason = "latency above target"
+	}
+	if len(ch.Reason) > 0 {
+		ch.Scans = max(ch.Scans/2, c.cfg.MinScans)
+		ch.Stats = max(ch.Stats/2, c.cfg.MinStats)
+	} else if targetIOPS == 0 || ch.IOPS < 0.9*targetIOPS {
+		ch.Reason = "below targets"
+		ch.Scans = min(ch.Scans+1, c.maxScans)
+		ch.Stats = min(ch.Stats+max(c.maxStats/10, 1), c.maxStats)
+	}
+	if ch.Scans == ch.PrevScans && ch.Stats == ch.PrevStats {
+		return Change{}, false
+	}
+	c.scans.SetLimit(ch.Scans)
+	c.stats.SetLimit(ch.Stats)
+	return ch, true
+}
+
+// Run calls Adjust at the configured interval until the context is
+// canceled, calling changed for every change in concurrency.
+func (c *Controller) Run(ctx context.Context, changed func(Change)) {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if ch, ok := c.Adjust(now.Sub(last)); ok {
+				changed(ch)
+			}
+			last = now
+		}
+	}
+}
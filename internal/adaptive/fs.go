@@ -0,0 +1,81 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package adaptive
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloudeng.io/file"
+	"cloudeng.io/file/filewalk"
+)
+
+type fsys struct {
+	filewalk.FS
+	c *Controller
+}
+
+// FS returns a filewalk.FS whose scans and stats are limited and
+// observed by the controller. Permission and non-existence errors are
+// not counted as failures since they are not indicative of the filesystem
+// being overloaded.
+func (c *Controller) FS(fs filewalk.FS) filewalk.FS {
+	return &fsys{FS: fs, c: c}
+}
+
+func (f *fsys) failed(err error) bool {
+	return err != nil &&
+		!f.IsPermissionError(err) &&
+		!f.IsNotExist(err) &&
+		!errors.Is(err, context.Canceled)
+}
+
+func (f *fsys) stat(ctx context.Context, path string, fn func(context.Context, string) (file.Info, error)) (file.Info, error) {
+	if err := f.c.stats.Acquire(ctx); err != nil {
+		return file.Info{}, err
+	}
+	start := time.Now()
+	fi, err := fn(ctx, path)
+	f.c.stats.Release()
+	f.c.RecordStat(time.Since(start), f.failed(err))
+	return fi, err
+}
+
+func (f *fsys) Stat(ctx context.Context, path string) (file.Info, error) {
+	return f.stat(ctx, path, f.FS.Stat)
+}
+
+func (f *fsys) Lstat(ctx context.Context, path string) (file.Info, error) {
+	return f.stat(ctx, path, f.FS.Lstat)
+}
+
+func (f *fsys) LevelScanner(path string) filewalk.LevelScanner {
+	return &scanner{LevelScanner: f.FS.LevelScanner(path), fs: f}
+}
+
+type scanner struct {
+	filewalk.LevelScanner
+	fs  *fsys
+	err error
+}
+
+func (s *scanner) Scan(ctx context.Context, n int) bool {
+	if err := s.fs.c.scans.Acquire(ctx); err != nil {
+		s.err = err
+		return false
+	}
+	ok := s.LevelScanner.Scan(ctx, n)
+	s.fs.c.scans.Release()
+	s.fs.c.RecordScan(!ok && s.fs.failed(s.LevelScanner.Err()))
+	return ok
+}
+
+func (s *scanner) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.LevelScanner.Err()
+}
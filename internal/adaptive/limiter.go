@@ -0,0 +1,90 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package adaptive
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// Limiter limits the number of concurrent operations. Unlike a
+// buffered channel used as a semaphore, its limit may be changed
+// whilst it is in use.
+type Limiter struct {
+	mu       sync.Mutex
+	limit    int
+	inflight int
+	waiters  []chan struct{}
+}
+
+// NewLimiter returns a new Limiter that allows up to limit concurrent
+// operations.
+func NewLimiter(limit int) *Limiter {
+	return &Limiter{limit: max(limit, 1)}
+}
+
+// Acquire blocks until an operation may proceed or the context is canceled.
+// Release must be called when an operation, for which Acquire returned nil,
+// is complete.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.inflight < l.limit {
+		l.inflight++
+		l.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	l.waiters = append(l.waiters, ch)
+	l.mu.Unlock()
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if idx := slices.Index(l.waiters, ch); idx >= 0 {
+		l.waiters = slices.Delete(l.waiters, idx, idx+1)
+	} else {
+		// Acquired concurrently with the context being canceled.
+		l.inflight--
+		l.wakeLocked()
+	}
+	return ctx.Err()
+}
+
+// Release releases an operation acquired via Acquire.
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	l.wakeLocked()
+}
+
+func (l *Limiter) wakeLocked() {
+	for l.inflight < l.limit && len(l.waiters) > 0 {
+		ch := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		l.inflight++
+		close(ch)
+	}
+}
+
+// SetLimit changes the number of concurrent operations allowed. If the
+// limit is reduced, operations already in flight are allowed to complete.
+func (l *Limiter) SetLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = max(limit, 1)
+	l.wakeLocked()
+}
+
+// Limit returns the current limit.
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
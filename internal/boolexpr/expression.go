@@ -44,6 +44,13 @@ func NewParser(ctx context.Context, fs filewalk.FS) *boolexpr.Parser {
 		return NewHardlink(ctx, n, v, fs)
 	})
 
+	parser.RegisterOperand("accessed-before", NewAccessedBefore)
+	parser.RegisterOperand("changed-after", NewChangedAfter)
+	parser.RegisterOperand("sparse", NewSparse)
+	parser.RegisterOperand("project", func(n, v string) boolexpr.Operand {
+		return NewProject(n, v, usernames.Manager.ProjectIDForName)
+	})
+
 	return parser
 }
 
@@ -79,6 +86,15 @@ func NewParserTests(ctx context.Context, fs filewalk.FS) *boolexpr.Parser {
 		return NewHardlink(ctx, n, v, fs)
 	})
 
+	parser.RegisterOperand("accessed-before", NewAccessedBefore)
+	parser.RegisterOperand("changed-after", NewChangedAfter)
+	parser.RegisterOperand("sparse", NewSparse)
+	parser.RegisterOperand("project", func(n, v string) boolexpr.Operand {
+		return NewProject(n, v, func(text string) (int64, error) {
+			return strconv.ParseInt(text, 10, 64)
+		})
+	})
+
 	return parser
 }
 
@@ -221,6 +237,21 @@ func (w entryWithXattr) Mode() fs.FileMode {
 	return w.fi.Mode()
 }
 
+func (w entryWithXattr) Allocation() (size, blocks int64) {
+	if !w.fi.Type().IsRegular() {
+		return 0, 0
+	}
+	return w.fi.Size(), w.pi.XAttrInfo(w.fi).Blocks
+}
+
+func (w entryWithXattr) Times() prefixinfo.Times {
+	return w.pi.TimesInfo(w.fi)
+}
+
+func (w entryWithXattr) ProjectID() int64 {
+	return w.pi.ProjectIDInfo(w.fi)
+}
+
 type prefixWithName struct {
 	*prefixinfo.T
 	name string
@@ -101,3 +101,119 @@ func TestHardlinks(t *testing.T) {
 		}
 	}
 }
+
+func TestTimes(t *testing.T) {
+	now := time.Now()
+	old, recent := now.Add(-48*time.Hour), now.Add(-time.Hour)
+	sysInfo := func(access, change time.Time) any {
+		return prefixinfo.XAttrAndTimes{
+			XAttr: file.XAttr{UID: 1, GID: 2},
+			Times: prefixinfo.Times{Access: access, Change: change},
+		}
+	}
+	fi := file.NewInfo("foo", 0, fs.ModeDir, now, sysInfo(old, recent))
+	pi := prefixinfo.New("foo", fi)
+	pi.AppendInfoList(file.InfoList{
+		file.NewInfo("a", 0, 0, now, sysInfo(old, old)),
+		file.NewInfo("b", 0, 0, now, sysInfo(recent, recent)),
+		file.NewInfo("c", 0, 0, now, prefixinfo.NewSysInfo(1, 2, 3, 4, 5)),
+	})
+	yesterday := now.Add(-24 * time.Hour).Format(time.RFC3339)
+
+	for _, tc := range []struct {
+		expr   string
+		prefix bool
+		want   []bool
+	}{
+		{"accessed-before=" + yesterday, true, []bool{true, false, false}},
+		{"changed-after=" + yesterday, true, []bool{false, true, false}},
+		{"accessed-before=" + yesterday + " && changed-after=" + yesterday, true, []bool{false, false, false}},
+	} {
+		matcher := createMatcher(t, nil, tc.expr)
+		if got, want := matcher.Prefix("foo", &pi), tc.prefix; got != want {
+			t.Errorf("%v: got %v, want %v", tc.expr, got, want)
+		}
+		for i, fi := range pi.InfoList() {
+			if got, want := matcher.Entry("foo", &pi, fi), tc.want[i]; got != want {
+				t.Errorf("%v: %v: got %v, want %v", tc.expr, fi.Name(), got, want)
+			}
+		}
+	}
+
+	parser := boolexpr.NewParserTests(context.Background(), nil)
+	for _, expr := range []string{"accessed-before=yesterday", "changed-after=12:00:00"} {
+		if _, err := boolexpr.CreateMatcher(parser, boolexpr.WithEntryExpression(expr)); err == nil {
+			t.Errorf("%v: expected an error", expr)
+		}
+	}
+}
+
+func TestSparse(t *testing.T) {
+	now := time.Now()
+	fi := file.NewInfo("foo", 0, fs.ModeDir, now, prefixinfo.NewSysInfo(1, 2, 3, 4, 5))
+	pi := prefixinfo.New("foo", fi)
+	pi.AppendInfoList(file.InfoList{
+		file.NewInfo("sparse", 4096, 0, now, prefixinfo.NewSysInfo(1, 2, 3, 5, 1)),
+		file.NewInfo("dense", 4096, 0, now, prefixinfo.NewSysInfo(1, 2, 3, 6, 8)),
+		file.NewInfo("dir", 4096, fs.ModeDir, now, prefixinfo.NewSysInfo(1, 2, 3, 7, 0)),
+	})
+	for _, tc := range []struct {
+		expr string
+		want []bool
+	}{
+		{"sparse=true", []bool{true, false, false}},
+		{"sparse=false", []bool{false, true, true}},
+	} {
+		matcher := createMatcher(t, nil, tc.expr)
+		if matcher.Prefix("foo", &pi) {
+			t.Errorf("%v: prefixes are never sparse", tc.expr)
+		}
+		for i, fi := range pi.InfoList() {
+			if got, want := matcher.Entry("foo", &pi, fi), tc.want[i]; got != want {
+				t.Errorf("%v: %v: got %v, want %v", tc.expr, fi.Name(), got, want)
+			}
+		}
+	}
+}
+
+func TestProject(t *testing.T) {
+	now := time.Now()
+	withProject := func(ino uint64, project int64) any {
+		return prefixinfo.XAttrAndTimes{
+			XAttr:     file.XAttr{UID: 1, GID: 2, Device: 3, FileID: ino, Blocks: 1},
+			ProjectID: project,
+		}
+	}
+	fi := file.NewInfo("foo", 0, fs.ModeDir, now, withProject(4, 10))
+	pi := prefixinfo.New("foo", fi)
+	pi.AppendInfoList(file.InfoList{
+		file.NewInfo("a", 1, 0, now, withProject(5, 10)),
+		file.NewInfo("b", 1, 0, now, withProject(6, 11)),
+		file.NewInfo("c", 1, 0, now, withProject(7, 0)),
+	})
+	for _, tc := range []struct {
+		expr   string
+		prefix bool
+		want   []bool
+	}{
+		{"project=10", true, []bool{true, false, false}},
+		{"project=11", false, []bool{false, true, false}},
+		{"project=0", false, []bool{false, false, true}},
+		{"project=10 || project=11", true, []bool{true, true, false}},
+	} {
+		matcher := createMatcher(t, nil, tc.expr)
+		if got, want := matcher.Prefix("foo", &pi), tc.prefix; got != want {
+			t.Errorf("%v: got %v, want %v", tc.expr, got, want)
+		}
+		for i, fi := range pi.InfoList() {
+			if got, want := matcher.Entry("foo", &pi, fi), tc.want[i]; got != want {
+				t.Errorf("%v: %v: got %v, want %v", tc.expr, fi.Name(), got, want)
+			}
+		}
+	}
+
+	parser := boolexpr.NewParserTests(context.Background(), nil)
+	if _, err := boolexpr.CreateMatcher(parser, boolexpr.WithEntryExpression("project=xx")); err == nil {
+		t.Errorf("expected an error")
+	}
+}
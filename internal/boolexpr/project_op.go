@@ -0,0 +1,63 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package boolexpr
+
+import (
+	"fmt"
+	"reflect"
+
+	"cloudeng.io/cmdutil/boolexpr"
+)
+
+// ProjectIfc must be implemented by any values that are used with the
+// project operand.
+type ProjectIfc interface {
+	ProjectID() int64
+}
+
+var projectIfcType = reflect.TypeOf((*ProjectIfc)(nil)).Elem()
+
+type projectOp struct {
+	name, text string
+	id         int64
+	lookup     func(string) (int64, error)
+}
+
+// NewProject returns an operand that matches files and prefixes that
+// belong to the specified project. The supplied lookup function is used
+// to map the operand's value, which may be a name or a numeric ID, to a
+// project ID.
+func NewProject(n, v string, lookup func(string) (int64, error)) boolexpr.Operand {
+	return projectOp{name: n, text: v, lookup: lookup}
+}
+
+func (op projectOp) Prepare() (boolexpr.Operand, error) {
+	id, err := op.lookup(op.text)
+	if err != nil {
+		return op, fmt.Errorf("invalid value for %v: %v: %v", op.name, op.text, err)
+	}
+	op.id = id
+	return op, nil
+}
+
+func (op projectOp) Eval(v any) bool {
+	p, ok := v.(ProjectIfc)
+	if !ok {
+		return false
+	}
+	return p.ProjectID() == op.id
+}
+
+func (op projectOp) Needs(t reflect.Type) bool {
+	return t.Implements(projectIfcType)
+}
+
+func (op projectOp) Document() string {
+	return op.name + "=<project name or id> matches files and prefixes that belong to the specified project, eg. an XFS, ext4 or Lustre project. Project IDs are only available if they were recorded when the database was built."
+}
+
+func (op projectOp) String() string {
+	return op.name + "=" + op.text
+}
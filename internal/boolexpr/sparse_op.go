@@ -0,0 +1,66 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package boolexpr
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/cmdutil/boolexpr"
+)
+
+// AllocationIfc must be implemented by any values that are used with the
+// sparse operand.
+type AllocationIfc interface {
+	// Allocation returns the apparent size of a file and the number of
+	// blocks allocated to it, see prefixinfo.Allocation.
+	Allocation() (size, blocks int64)
+}
+
+var allocationIfcType = reflect.TypeOf((*AllocationIfc)(nil)).Elem()
+
+type sparseOp struct {
+	name, text string
+	sparse     bool
+}
+
+// NewSparse returns an operand that matches files that are, or are not,
+// sparse, ie. that have fewer bytes allocated to them than their
+// apparent size, see prefixinfo.Allocation.
+func NewSparse(n, v string) boolexpr.Operand {
+	return sparseOp{name: n, text: v}
+}
+
+func (op sparseOp) Prepare() (boolexpr.Operand, error) {
+	v, err := strconv.ParseBool(op.text)
+	if err != nil {
+		return op, fmt.Errorf("invalid value for %v: %v, must be true or false", op.name, op.text)
+	}
+	op.sparse = v
+	return op, nil
+}
+
+func (op sparseOp) Eval(v any) bool {
+	a, ok := v.(AllocationIfc)
+	if !ok {
+		return false
+	}
+	_, sparse, _ := prefixinfo.Allocation(a.Allocation())
+	return sparse == op.sparse
+}
+
+func (op sparseOp) Needs(t reflect.Type) bool {
+	return t.Implements(allocationIfcType)
+}
+
+func (op sparseOp) Document() string {
+	return op.name + "=<true|false> matches files that are, or are not, sparse, ie. files that have fewer bytes allocated to them than their size, typically due to holes in the file or to filesystem compression."
+}
+
+func (op sparseOp) String() string {
+	return op.name + "=" + op.text
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package boolexpr
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/cmdutil/boolexpr"
+)
+
+// TimesIfc must be implemented by any values that are used with the
+// accessed-before and changed-after operands.
+type TimesIfc interface {
+	Times() prefixinfo.Times
+}
+
+var timesIfcType = reflect.TypeOf((*TimesIfc)(nil)).Elem()
+
+type timeOp struct {
+	name, text, doc string
+	when            time.Time
+	eval            func(when time.Time, times prefixinfo.Times) bool
+}
+
+func (op timeOp) Prepare() (boolexpr.Operand, error) {
+	// Times without a date are rejected since they would be
+	// compared against year 0.
+	for _, format := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		if t, err := time.Parse(format, op.text); err == nil {
+			op.when = t
+			return op, nil
+		}
+	}
+	return op, fmt.Errorf("invalid time: %v, use one of RFC3339, Date and Time or Date only formats", op.text)
+}
+
+func (op timeOp) Eval(v any) bool {
+	if t, ok := v.(TimesIfc); ok {
+		return op.eval(op.when, t.Times())
+	}
+	return false
+}
+
+func (op timeOp) Needs(t reflect.Type) bool {
+	return t.Implements(timesIfcType)
+}
+
+func (op timeOp) Document() string {
+	return op.name + op.doc
+}
+
+func (op timeOp) String() string {
+	return op.name + "=" + op.text
+}
+
+// NewAccessedBefore returns an operand that matches files and prefixes
+// whose access time is before the specified time. Files or prefixes
+// for which no access time was recorded never match.
+func NewAccessedBefore(n, v string) boolexpr.Operand {
+	return timeOp{
+		name: n,
+		text: v,
+		doc:  "=<time> matches files and prefixes whose recorded access time is before the specified time in time.RFC3339, time.DateTime or time.DateOnly formats. Access times are only available if recorded via the file_times configuration option, in which case every file is restated by every analyze since access times change without the directory containing the file being modified.",
+		eval: func(when time.Time, times prefixinfo.Times) bool {
+			return !times.Access.IsZero() && times.Access.Before(when)
+		},
+	}
+}
+
+// NewChangedAfter returns an operand that matches files and prefixes
+// whose change time is after the specified time. Files or prefixes
+// for which no change time was recorded never match.
+func NewChangedAfter(n, v string) boolexpr.Operand {
+	return timeOp{
+		name: n,
+		text: v,
+		doc:  "=<time> matches files and prefixes whose recorded change time is after the specified time in time.RFC3339, time.DateTime or time.DateOnly formats. Change times are only available if recorded via the file_times configuration option.",
+		eval: func(when time.Time, times prefixinfo.Times) bool {
+			return !times.Change.IsZero() && times.Change.After(when)
+		},
+	}
+}
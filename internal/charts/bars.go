@@ -0,0 +1,46 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package charts
+
+import (
+	"io"
+)
+
+const (
+	barHeight  = 18
+	barSpacing = 6
+	labelWidth = 160
+	valueWidth = 90
+)
+
+// BarChart writes an SVG horizontal bar chart of bars, in the order
+// given, with lengths proportional to their values. The height of the
+// chart is determined by the number of bars.
+func BarChart(w io.Writer, title string, bars []Bar, opts ...Option) error {
+	o := newOptions(opts)
+	height := titleSpace + len(bars)*(barHeight+barSpacing) + barSpacing
+	s := &svg{}
+	s.start(o.width, height, title)
+	var maxValue int64
+	for _, b := range bars {
+		maxValue = max(maxValue, b.Value)
+	}
+	barArea := float64(o.width - labelWidth - valueWidth)
+	y := float64(titleSpace + barSpacing)
+	for i, b := range bars {
+		text := y + barHeight/2 + fontSize/2 - 1
+		s.text(labelWidth-padding*2, text, "end", "#222222", fit(b.Label, labelWidth-padding*4))
+		length := 0.0
+		if maxValue > 0 && b.Value > 0 {
+			length = max(1, barArea*float64(b.Value)/float64(maxValue))
+		}
+		s.rect(labelWidth, y, length, barHeight, palette[i%len(palette)], b.Label+": "+o.format(b.Value))
+		s.text(labelWidth+length+padding*2, text, "start", "#222222", o.format(b.Value))
+		y += barHeight + barSpacing
+	}
+	s.end()
+	_, err := io.WriteString(w, s.String())
+	return err
+}
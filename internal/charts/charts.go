@@ -0,0 +1,131 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package charts renders treemaps and horizontal bar charts as standalone
+// SVG images. The images do not refer to any external fonts, stylesheets
+// or scripts so that they can be embedded in, or linked to from, markdown
+// documents and wikis that accept images but not html.
+package charts
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+// Node is a node in a treemap. The Value of a node should be no smaller
+// than the sum of the Values of its Children; any difference is displayed
+// as an unlabeled area of the node.
+type Node struct {
+	Label    string
+	Value    int64
+	Children []Node
+}
+
+// Bar is a single bar in a bar chart.
+type Bar struct {
+	Label string
+	Value int64
+}
+
+type options struct {
+	width, height int
+	depth         int
+	format        func(int64) string
+}
+
+// Option represents an option for Treemap and BarChart.
+type Option func(o *options)
+
+// WithSize sets the width and height of a treemap, or the width of a bar
+// chart, whose height is determined by the number of bars.
+func WithSize(width, height int) Option {
+	return func(o *options) {
+		o.width, o.height = width, height
+	}
+}
+
+// WithDepth sets the number of levels of a treemap that are displayed,
+// the default is 2.
+func WithDepth(depth int) Option {
+	return func(o *options) {
+		o.depth = depth
+	}
+}
+
+// WithFormatter sets the function used to format values, the default
+// is strconv.FormatInt.
+func WithFormatter(fn func(int64) string) Option {
+	return func(o *options) {
+		o.format = fn
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		width:  800,
+		height: 500,
+		depth:  2,
+		format: func(v int64) string { return strconv.FormatInt(v, 10) },
+	}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	return o
+}
+
+// palette is used for the top level nodes of a treemap and for the
+// bars of a bar chart.
+var palette = []string{
+	"#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f",
+	"#edc948", "#b07aa1", "#ff9da7", "#9c755f", "#bab0ac",
+}
+
+const (
+	fontSize   = 11
+	charWidth  = 6.2 // approximate width of a character at fontSize.
+	titleSize  = 14
+	titleSpace = 24
+)
+
+type svg struct {
+	strings.Builder
+}
+
+func (s *svg) start(width, height int, title string) {
+	fmt.Fprintf(s, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="Helvetica, Arial, sans-serif" font-size="%d">`+"\n",
+		width, height, width, height, fontSize)
+	fmt.Fprintf(s, "<title>%s</title>\n", html.EscapeString(title))
+	fmt.Fprintf(s, `<rect width="%d" height="%d" fill="#ffffff"/>`+"\n", width, height)
+	fmt.Fprintf(s, `<text x="4" y="%d" font-size="%d" font-weight="bold">%s</text>`+"\n",
+		titleSize+2, titleSize, html.EscapeString(title))
+}
+
+func (s *svg) end() {
+	s.WriteString("</svg>\n")
+}
+
+func (s *svg) rect(x, y, w, h float64, fill, tooltip string) {
+	fmt.Fprintf(s, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s" stroke="#ffffff"><title>%s</title></rect>`+"\n",
+		x, y, w, h, fill, html.EscapeString(tooltip))
+}
+
+func (s *svg) text(x, y float64, anchor, fill, text string) {
+	fmt.Fprintf(s, `<text x="%.1f" y="%.1f" text-anchor="%s" fill="%s">%s</text>`+"\n",
+		x, y, anchor, fill, html.EscapeString(text))
+}
+
+// fit truncates text so that it fits within width.
+func fit(text string, width float64) string {
+	n := int(width / charWidth)
+	r := []rune(text)
+	switch {
+	case n <= 1:
+		return ""
+	case len(r) <= n:
+		return text
+	}
+	return string(r[:n-1]) + "…"
+}
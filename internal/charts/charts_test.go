@@ -0,0 +1,174 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package charts_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/charts"
+)
+
+type element struct {
+	name  string
+	attrs map[string]string
+	text  string
+}
+
+// parse parses, and hence validates, an svg image and returns its
+// elements.
+func parse(t *testing.T, data []byte) []*element {
+	t.Helper()
+	var elems []*element
+	var stack []*element
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v: %s", err, data)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			e := &element{name: tok.Name.Local, attrs: map[string]string{}}
+			for _, a := range tok.Attr {
+				e.attrs[a.Name.Local] = a.Value
+			}
+			elems = append(elems, e)
+			stack = append(stack, e)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(tok)
+			}
+		}
+	}
+	if len(elems) == 0 || elems[0].name != "svg" {
+		t.Fatalf("not an svg image: %s", data)
+	}
+	return elems
+}
+
+func attr(t *testing.T, e *element, name string) float64 {
+	t.Helper()
+	v, err := strconv.ParseFloat(e.attrs[name], 64)
+	if err != nil {
+		t.Fatalf("%v: %v: %v", e.name, name, err)
+	}
+	return v
+}
+
+// rects returns the tooltip and area of every rect other than the
+// background.
+func rects(t *testing.T, elems []*element) map[string]float64 {
+	areas := map[string]float64{}
+	for i, e := range elems {
+		if e.name != "rect" || len(e.attrs["x"]) == 0 {
+			continue
+		}
+		title := elems[i+1]
+		if title.name != "title" {
+			t.Fatalf("rect without a title: %v", e.attrs)
+		}
+		areas[title.text] = attr(t, e, "width") * attr(t, e, "height")
+	}
+	return areas
+}
+
+func TestTreemap(t *testing.T) {
+	root := charts.Node{Label: "/root", Value: 1000, Children: []charts.Node{
+		{Label: "a", Value: 500, Children: []charts.Node{
+			{Label: "x", Value: 300}, {Label: "y", Value: 100},
+		}},
+		{Label: "<b&c>", Value: 300},
+		{Label: "d", Value: 100},
+		{Label: "empty", Value: 0},
+	}}
+	var out bytes.Buffer
+	if err := charts.Treemap(&out, "usage", root, charts.WithSize(400, 324)); err != nil {
+		t.Fatal(err)
+	}
+	elems := parse(t, out.Bytes())
+	if got, want := elems[0].attrs["width"], "400"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	areas := rects(t, elems)
+	if len(areas) != 7 {
+		t.Errorf("got %v, want 7 rects", areas)
+	}
+
+	// The top level is drawn in the 400x300 area beneath the title.
+	scale := 400.0 * 300 / 1000
+	for label, value := range map[string]float64{"a: 500": 500, "<b&c>: 300": 300, "d: 100": 100, "/root: other 100": 100} {
+		if got, want := areas[label], value*scale; math.Abs(got-want) > 1 {
+			t.Errorf("%v: got %v, want %v", label, got, want)
+		}
+	}
+	// Children are drawn within their parent, below its label.
+	if got, want := areas["x: 300"], 3*areas["a: other 100"]; math.Abs(got-want) > 1 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if areas["x: 300"] >= 0.6*areas["a: 500"] {
+		t.Errorf("child is too large: %v, %v", areas["x: 300"], areas["a: 500"])
+	}
+	if _, ok := areas["empty: 0"]; ok {
+		t.Errorf("empty nodes should not be drawn")
+	}
+	if !strings.Contains(out.String(), "&lt;b&amp;c&gt;") {
+		t.Errorf("label was not escaped")
+	}
+
+	// Only the top level is drawn with a depth of 1.
+	out.Reset()
+	if err := charts.Treemap(&out, "usage", root, charts.WithDepth(1)); err != nil {
+		t.Fatal(err)
+	}
+	if got := rects(t, parse(t, out.Bytes())); len(got) != 4 {
+		t.Errorf("got %v, want 4 rects", got)
+	}
+}
+
+func TestBarChart(t *testing.T) {
+	bars := []charts.Bar{{"alice", 400}, {"bob", 200}, {"a-very-long-user-name-that-will-not-fit-in-the-label-area", 100}, {"nobody", 0}}
+	var out bytes.Buffer
+	format := func(v int64) string { return strconv.FormatInt(v, 10) + " B" }
+	if err := charts.BarChart(&out, "users", bars, charts.WithSize(500, 0), charts.WithFormatter(format)); err != nil {
+		t.Fatal(err)
+	}
+	elems := parse(t, out.Bytes())
+	var widths []float64
+	var labels []string
+	for i, e := range elems {
+		switch {
+		case e.name == "rect" && len(e.attrs["x"]) > 0:
+			widths = append(widths, attr(t, e, "width"))
+		case e.name == "text" && e.attrs["text-anchor"] == "end":
+			labels = append(labels, elems[i].text)
+		}
+	}
+	if len(widths) != 4 {
+		t.Fatalf("got %v, want 4 bars", widths)
+	}
+	if widths[0] != 2*widths[1] || widths[1] != 2*widths[2] || widths[3] != 0 {
+		t.Errorf("bars are not proportional to their values: %v", widths)
+	}
+	if !strings.HasSuffix(labels[2], "…") || len([]rune(labels[2])) >= len(bars[2].Label) {
+		t.Errorf("long label was not truncated: %v", labels[2])
+	}
+	if !strings.Contains(out.String(), ">400 B<") {
+		t.Errorf("values were not formatted: %s", out.String())
+	}
+	if got, want := attr(t, elems[0], "height"), float64(24+4*24+6); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package charts
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	headerHeight = 15 // space reserved for the label of nodes with children.
+	padding      = 2
+)
+
+type area struct {
+	node  *Node
+	value float64
+}
+
+type layout struct {
+	area
+	x, y, w, h float64
+}
+
+// squarify lays out areas, whose values must sum to w*h and be in
+// decreasing order, within the rectangle at x, y using the squarified
+// treemap algorithm.
+func squarify(areas []area, x, y, w, h float64, out []layout) []layout {
+	for len(areas) > 0 && w > 0 && h > 0 {
+		short := math.Min(w, h)
+		var sum float64
+		worst := math.Inf(1)
+		n := 0
+		for ; n < len(areas); n++ {
+			s := sum + areas[n].value
+			side := s / short
+			r := math.Max(side*side/areas[n].value, areas[0].value/(side*side))
+			if r > worst {
+				break
+			}
+			sum, worst = s, r
+		}
+		side := sum / short
+		offset := 0.0
+		for _, a := range areas[:n] {
+			length := a.value / side
+			if w >= h {
+				out = append(out, layout{a, x, y + offset, side, length})
+			} else {
+				out = append(out, layout{a, x + offset, y, length, side})
+			}
+			offset += length
+		}
+		if w >= h {
+			x, w = x+side, w-side
+		} else {
+			y, h = y+side, h-side
+		}
+		areas = areas[n:]
+	}
+	return out
+}
+
+// Treemap writes an SVG treemap of root, whose children are displayed as
+// nested rectangles with areas proportional to their values. The children
+// of a node are expected to be in decreasing order of value.
+func Treemap(w io.Writer, title string, root Node, opts ...Option) error {
+	o := newOptions(opts)
+	s := &svg{}
+	s.start(o.width, o.height, fmt.Sprintf("%s (%s)", title, o.format(root.Value)))
+	tm := treemap{svg: s, options: o}
+	tm.children(&root, 0, titleSpace, float64(o.width), float64(o.height-titleSpace), 1, "")
+	s.end()
+	_, err := io.WriteString(w, s.String())
+	return err
+}
+
+type treemap struct {
+	*svg
+	options
+}
+
+// children lays out, and draws, the children of n within the specified
+// rectangle.
+func (tm treemap) children(n *Node, x, y, w, h float64, depth int, color string) {
+	if n.Value <= 0 || w <= 0 || h <= 0 {
+		return
+	}
+	scale := w * h / float64(n.Value)
+	areas := make([]area, 0, len(n.Children)+1)
+	var sum int64
+	for i := range n.Children {
+		c := &n.Children[i]
+		if c.Value > 0 {
+			areas = append(areas, area{c, float64(c.Value) * scale})
+			sum += c.Value
+		}
+	}
+	if rest := n.Value - sum; rest > 0 {
+		areas = append(areas, area{nil, float64(rest) * scale})
+	}
+	for i, l := range squarify(areas, x, y, w, h, nil) {
+		if l.node == nil {
+			tm.rect(l.x, l.y, l.w, l.h, "#d9d9d9", n.Label+": other "+tm.format(n.Value-sum))
+			continue
+		}
+		fill := color
+		if depth == 1 {
+			fill = palette[i%len(palette)]
+		}
+		tm.node(l.node, l.x, l.y, l.w, l.h, depth, fill)
+	}
+}
+
+func (tm treemap) node(n *Node, x, y, w, h float64, depth int, fill string) {
+	tooltip := n.Label + ": " + tm.format(n.Value)
+	tm.rect(x, y, w, h, fill, tooltip)
+	label := fit(n.Label+" "+tm.format(n.Value), w-2*padding)
+	if len(n.Children) == 0 || depth >= tm.depth || h < 2*headerHeight {
+		if h >= fontSize+2*padding {
+			tm.text(x+padding, y+fontSize+padding, "start", "#ffffff", label)
+		}
+		return
+	}
+	tm.text(x+padding, y+fontSize+padding, "start", "#ffffff", label)
+	tm.children(n, x+padding, y+headerHeight, w-2*padding, h-headerHeight-padding, depth+1, lighter(fill))
+}
+
+// lighter returns a lighter version of the #rrggbb color c.
+func lighter(c string) string {
+	var r, g, b int
+	if _, err := fmt.Sscanf(c, "#%02x%02x%02x", &r, &g, &b); err != nil {
+		return c
+	}
+	l := func(v int) int { return v + (255-v)/4 }
+	return fmt.Sprintf("#%02x%02x%02x", l(r), l(g), l(b))
+}
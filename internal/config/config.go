@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"cloudeng.io/cmdutil/structdoc"
 	"cloudeng.io/file/diskusage"
@@ -19,6 +20,8 @@ import (
 type Prefix struct {
 	Prefix                   string   `yaml:"prefix" cmd:"the prefix to be analyzed"`
 	Database                 string   `yaml:"database" cmd:"the location of the database to use for this prefix"`
+	DatabaseType             string   `yaml:"database_type" cmd:"the type of database to use for this prefix, either badger or bolt, defaults to badger; memory may be used for testing"`
+	KeyEncoding              string   `yaml:"key_encoding" cmd:"the encoding used for the keys of the prefixes stored in the database, either path, the default, or compact; compact keys are only worth using with bolt databases of deep trees with long paths, since every key includes a 16 byte ID of its parent, badger databases already share the common leading bytes of keys and do not shrink, compact keys are also slower to scan and do not support history, database migrate converts an existing database to the configured encoding"`
 	Separator                string   `yaml:"separator" cmd:"filename separator to use, defaults to /"`
 	ConcurrentScans          int      `yaml:"concurrent_scans" cmd:"maximum number of concurrent scan operations"`
 	ConcurrentStats          int      `yaml:"concurrent_stats" cmd:"maximum number of concurrent stat operations"`
@@ -27,11 +30,293 @@ type Prefix struct {
 	ScanSize                 int      `yaml:"scan_size" cmd:"maximum number of items to fetch from the filesystem in a single operation"`
 	Exclusions               []string `yaml:"exclusions" cmd:"prefixes and files matching these regular expressions will be ignored when building a dataase"`
 	CountHardlinkAsFiles     bool     `yaml:"count_hardlinks_as_files" cmd:"if true, hardlinks will be counted as separate files"`
+	FileTimes                []string `yaml:"file_times" cmd:"additional file times to record, any of access, change or birth; each increases the size of the database, recording access times requires that every file be restated by every analyze, even if its directory is unchanged, and recording birth times may require an additional system call per file"`
+	AnalyzeExpression        string   `yaml:"analyze_expression" cmd:"prefixes matching this expression will be pruned, ie. not analyzed, when building a database; an expression supplied on the command line takes precedence"`
+	ProjectIDs               bool     `yaml:"project_ids" cmd:"if true, record the project ID (eg. XFS, ext4 or Lustre project) for every file and prefix; this requires opening every file and is only supported on Linux"`
 
-	Layout layout `yaml:"layout" cmd:"the filesystem layout to use for calculating raw bytes used"`
+	Layout     layout     `yaml:"layout" cmd:"the filesystem layout to use for calculating raw bytes used"`
+	Adaptive   Adaptive   `yaml:"adaptive" cmd:"adaptive control of the number of concurrent scans and stats"`
+	RateLimit  RateLimit  `yaml:"rate_limit" cmd:"limits on the rate of scan (readdir) and stat operations issued, including the statx and ioctl calls used to obtain birth times and project IDs"`
+	History    History    `yaml:"history" cmd:"retention of prior versions of prefixes so that the database can be queried as of an earlier time"`
+	Replica    Replica    `yaml:"replica" cmd:"publication of a read-only replica of the database at the end of every analyze run so that readers need not wait for analyze to finish"`
+	Encryption Encryption `yaml:"encryption" cmd:"encryption at rest of the database, its replicas and the stats files and export archives created from it"`
 
 	regexps    []*regexp.Regexp
 	calculator diskusage.Calculator
+	times      fileTimes
+}
+
+// The supported database types. MemoryDatabase is intended for tests
+// and benchmarks since its contents are lost when the process exits.
+const (
+	BadgerDatabase = "badger"
+	BoltDatabase   = "bolt"
+	MemoryDatabase = "memory"
+)
+
+// DatabaseTypes returns the supported on-disk database types.
+func DatabaseTypes() []string {
+	return []string{BadgerDatabase, BoltDatabase}
+}
+
+func parseDatabaseType(dbType string) (string, error) {
+	switch dbType := strings.ToLower(dbType); dbType {
+	case "":
+		return BadgerDatabase, nil
+	case BadgerDatabase, BoltDatabase, MemoryDatabase:
+		return dbType, nil
+	}
+	return "", fmt.Errorf("unsupported database type: %q, must be one of %v", dbType, strings.Join(DatabaseTypes(), ", "))
+}
+
+// The supported encodings for the keys of the prefixes stored in a
+// database. PathKeys stores the full path of every prefix whereas
+// CompactKeys stores the ID of its parent and its final component.
+const (
+	PathKeys    = "path"
+	CompactKeys = "compact"
+)
+
+func parseKeyEncoding(enc string) (string, error) {
+	switch enc := strings.ToLower(enc); enc {
+	case "":
+		return PathKeys, nil
+	case PathKeys, CompactKeys:
+		return enc, nil
+	}
+	return "", fmt.Errorf("unsupported key encoding: %q, must be one of %v or %v", enc, PathKeys, CompactKeys)
+}
+
+type fileTimes struct {
+	access, change, birth bool
+}
+
+// TimesToRecord returns the file times, in addition to the modification
+// time, that are to be recorded when analyzing this prefix.
+func (p *Prefix) TimesToRecord() (access, change, birth bool) {
+	return p.times.access, p.times.change, p.times.birth
+}
+
+func parseFileTimes(times []string) (fileTimes, error) {
+	var ft fileTimes
+	for _, t := range times {
+		switch strings.ToLower(t) {
+		case "access":
+			ft.access = true
+		case "change":
+			ft.change = true
+		case "birth":
+			ft.birth = true
+		default:
+			return fileTimes{}, fmt.Errorf("unsupported file time: %v, must be one of access, change or birth", t)
+		}
+	}
+	return ft, nil
+}
+
+// Adaptive configures adaptive control of the number of concurrent scans
+// and stats issued when analyzing a prefix. When enabled, concurrent_scans
+// and concurrent_stats are used as upper bounds.
+type Adaptive struct {
+	Enabled       bool          `yaml:"enabled" cmd:"if true, the number of concurrent scans and stats is adjusted based on the observed stat latency, IOPS and error rate, with concurrent_scans and concurrent_stats used as upper bounds"`
+	TargetLatency time.Duration `yaml:"target_latency" cmd:"concurrency is reduced when the mean stat latency exceeds this value and increased when it is below it, defaults to 10ms"`
+	TargetIOPS    int           `yaml:"target_iops" cmd:"concurrency is reduced when the number of stats per second exceeds this value, zero for no limit"`
+	MaxErrorRate  float64       `yaml:"max_error_rate" cmd:"concurrency is reduced when the fraction of scans and stats that fail, other than for permission or non-existence errors, exceeds this value, defaults to 0.05"`
+	Interval      time.Duration `yaml:"interval" cmd:"how often concurrency is adjusted, defaults to 5s"`
+	MinScans      int           `yaml:"min_scans" cmd:"the minimum number of concurrent scans, defaults to 1"`
+	MinStats      int           `yaml:"min_stats" cmd:"the minimum number of concurrent stats, defaults to 1"`
+}
+
+var (
+	DefaultAdaptiveTargetLatency = 10 * time.Millisecond
+	DefaultAdaptiveMaxErrorRate  = 0.05
+	DefaultAdaptiveInterval      = 5 * time.Second
+)
+
+func (a *Adaptive) setDefaults() error {
+	if a.TargetLatency == 0 {
+		a.TargetLatency = DefaultAdaptiveTargetLatency
+	}
+	if a.MaxErrorRate == 0 {
+		a.MaxErrorRate = DefaultAdaptiveMaxErrorRate
+	}
+	if a.Interval == 0 {
+		a.Interval = DefaultAdaptiveInterval
+	}
+	a.MinScans = max(a.MinScans, 1)
+	a.MinStats = max(a.MinStats, 1)
+	switch {
+	case a.TargetLatency < 0 || a.Interval < 0:
+		return fmt.Errorf("adaptive target_latency and interval must be positive")
+	case a.TargetIOPS < 0:
+		return fmt.Errorf("adaptive target_iops must be zero or positive")
+	case a.MaxErrorRate < 0 || a.MaxErrorRate > 1:
+		return fmt.Errorf("adaptive max_error_rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// RateLimit configures a limit on the number of scan (readdir) and stat
+// operations issued per second. The limit may vary by time of day.
+type RateLimit struct {
+	OpsPerSecond float64        `yaml:"ops_per_second" cmd:"the maximum number of operations per second when no schedule entry applies, zero for no limit"`
+	Burst        int            `yaml:"burst" cmd:"the maximum number of operations that may be issued in a burst, defaults to one tenth of the rate"`
+	Schedule     []RateSchedule `yaml:"schedule" cmd:"rate limits that apply at specific times of day, the first matching entry is used"`
+}
+
+// RateSchedule specifies a rate limit that applies between two times of
+// day, in the local timezone. If End is before Start then the period
+// extends past midnight.
+type RateSchedule struct {
+	Start        string  `yaml:"start" cmd:"the start of the period, in 24 hour HH:MM format"`
+	End          string  `yaml:"end" cmd:"the end of the period, in 24 hour HH:MM format"`
+	OpsPerSecond float64 `yaml:"ops_per_second" cmd:"the maximum number of operations per second during this period, zero for no limit"`
+
+	start, end time.Duration
+}
+
+// Enabled returns true if any rate limit is configured.
+func (r RateLimit) Enabled() bool {
+	return r.OpsPerSecond > 0 || len(r.Schedule) > 0
+}
+
+// RateAt returns the rate limit, in operations per second, that applies
+// at the specified time, zero means no limit.
+func (r RateLimit) RateAt(t time.Time) float64 {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	for _, s := range r.Schedule {
+		if s.start <= s.end {
+			if sinceMidnight >= s.start && sinceMidnight < s.end {
+				return s.OpsPerSecond
+			}
+			continue
+		}
+		if sinceMidnight >= s.start || sinceMidnight < s.end {
+			return s.OpsPerSecond
+		}
+	}
+	return r.OpsPerSecond
+}
+
+func parseTimeOfDay(v string) (time.Duration, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %q, must be in HH:MM format", v)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (r *RateLimit) parse() error {
+	if r.OpsPerSecond < 0 || r.Burst < 0 {
+		return fmt.Errorf("rate_limit ops_per_second and burst must be zero or positive")
+	}
+	for i, s := range r.Schedule {
+		var err error
+		if r.Schedule[i].start, err = parseTimeOfDay(s.Start); err != nil {
+			return err
+		}
+		if r.Schedule[i].end, err = parseTimeOfDay(s.End); err != nil {
+			return err
+		}
+		if s.OpsPerSecond < 0 {
+			return fmt.Errorf("rate_limit schedule ops_per_second must be zero or positive")
+		}
+	}
+	return nil
+}
+
+// History configures the retention of the prior versions of prefixes
+// that are changed or deleted by analyze, so that the database can be
+// queried as it was at an earlier time.
+type History struct {
+	Enabled bool          `yaml:"enabled" cmd:"if true, analyze retains the prior versions of the prefixes that it changes or deletes"`
+	Retain  time.Duration `yaml:"retain" cmd:"how long prior versions are retained for, defaults to 30 days (720h)"`
+}
+
+var DefaultHistoryRetention = 30 * 24 * time.Hour
+
+func (h *History) setDefaults() error {
+	if h.Retain < 0 {
+		return fmt.Errorf("history retain must be zero or positive")
+	}
+	if h.Retain == 0 {
+		h.Retain = DefaultHistoryRetention
+	}
+	return nil
+}
+
+// Replica configures the publication of a read-only replica of the
+// database at the end of every analyze run. When enabled, commands that
+// only query the database use the most recently published replica
+// rather than waiting for a running analyze to release the database.
+type Replica struct {
+	Enabled   bool   `yaml:"enabled" cmd:"if true, analyze publishes a replica of the database when it completes and the find, stats compute and serve commands use it"`
+	Directory string `yaml:"directory" cmd:"the directory that replicas are published to, defaults to the database location with a .replica suffix"`
+	Keep      int    `yaml:"keep" cmd:"the number of published replicas to keep, defaults to 2"`
+}
+
+var DefaultReplicasToKeep = 2
+
+// Encryption configures the key used to encrypt a prefix's database at
+// rest, as well as the stats files and export archives created from it.
+// The key is read from a file or obtained by running a command, such as
+// one that retrieves it from a secrets manager, and must be 16, 24 or 32
+// bytes long, selecting AES-128, AES-192 or AES-256, either as raw bytes
+// or hex encoded. Only badger databases can be encrypted.
+type Encryption struct {
+	KeyFile          string        `yaml:"key_file" cmd:"the file containing the encryption key"`
+	KeyCommand       string        `yaml:"key_command" cmd:"a command, run using sh -c, that writes the encryption key to its standard output; an alternative to key_file"`
+	DataKeyRotation  time.Duration `yaml:"data_key_rotation" cmd:"how often the data keys, which are encrypted using the encryption key and used to encrypt the database itself, are rotated, defaults to 10 days (240h)"`
+	PreviousKeyFiles []string      `yaml:"previous_key_files" cmd:"files containing keys that were previously configured, eg. before database rotate-key was run, which are tried when reading stats files and export archives that cannot be decrypted using the current key"`
+}
+
+var DefaultDataKeyRotation = 10 * 24 * time.Hour
+
+// Enabled returns true if an encryption key is configured.
+func (e Encryption) Enabled() bool {
+	return len(e.KeyFile) > 0 || len(e.KeyCommand) > 0
+}
+
+func (e *Encryption) setDefaults(dbType string) error {
+	e.KeyFile = os.ExpandEnv(e.KeyFile)
+	if len(e.KeyFile) > 0 && len(e.KeyCommand) > 0 {
+		return fmt.Errorf("only one of encryption key_file or key_command may be specified")
+	}
+	for i, f := range e.PreviousKeyFiles {
+		e.PreviousKeyFiles[i] = os.ExpandEnv(f)
+	}
+	if len(e.PreviousKeyFiles) > 0 && !e.Enabled() {
+		return fmt.Errorf("encryption previous_key_files requires that key_file or key_command be specified")
+	}
+	if e.DataKeyRotation < 0 {
+		return fmt.Errorf("encryption data_key_rotation must be zero or positive")
+	}
+	if e.DataKeyRotation == 0 {
+		e.DataKeyRotation = DefaultDataKeyRotation
+	}
+	if e.Enabled() && dbType != BadgerDatabase {
+		return fmt.Errorf("encryption is only supported for %v databases, not %v", BadgerDatabase, dbType)
+	}
+	return nil
+}
+
+func (r *Replica) setDefaults(database string) error {
+	if r.Keep < 0 {
+		return fmt.Errorf("replica keep must be zero or positive")
+	}
+	if r.Keep == 0 {
+		r.Keep = DefaultReplicasToKeep
+	}
+	r.Directory = os.ExpandEnv(r.Directory)
+	if len(r.Directory) == 0 && len(database) > 0 {
+		r.Directory = filepath.Clean(database) + ".replica"
+	}
+	if r.Enabled && len(r.Directory) == 0 {
+		return fmt.Errorf("replica directory must be specified when no database is configured")
+	}
+	return nil
 }
 
 type layout struct {
@@ -96,6 +381,16 @@ func ParseConfig(buf []byte) (T, error) {
 	for i, p := range cfg.Prefixes {
 		cfg.Prefixes[i].Prefix = os.ExpandEnv(p.Prefix)
 		cfg.Prefixes[i].Database = os.ExpandEnv(p.Database)
+		dbType, err := parseDatabaseType(p.DatabaseType)
+		if err != nil {
+			return T{}, err
+		}
+		cfg.Prefixes[i].DatabaseType = dbType
+		keyEnc, err := parseKeyEncoding(p.KeyEncoding)
+		if err != nil {
+			return T{}, err
+		}
+		cfg.Prefixes[i].KeyEncoding = keyEnc
 		for _, e := range p.Exclusions {
 			re, err := regexp.Compile(e)
 			if err != nil {
@@ -108,6 +403,32 @@ func ParseConfig(buf []byte) (T, error) {
 			return T{}, err
 		}
 		cfg.Prefixes[i].calculator = calc
+		times, err := parseFileTimes(p.FileTimes)
+		if err != nil {
+			return T{}, err
+		}
+		cfg.Prefixes[i].times = times
+		if err := cfg.Prefixes[i].Adaptive.setDefaults(); err != nil {
+			return T{}, err
+		}
+		if err := cfg.Prefixes[i].RateLimit.parse(); err != nil {
+			return T{}, err
+		}
+		if err := cfg.Prefixes[i].History.setDefaults(); err != nil {
+			return T{}, err
+		}
+		if err := cfg.Prefixes[i].Replica.setDefaults(cfg.Prefixes[i].Database); err != nil {
+			return T{}, err
+		}
+		if err := cfg.Prefixes[i].Encryption.setDefaults(dbType); err != nil {
+			return T{}, err
+		}
+		if keyEnc == CompactKeys && p.History.Enabled {
+			return T{}, fmt.Errorf("%v: history is not supported with compact keys", cfg.Prefixes[i].Prefix)
+		}
+		if cfg.Prefixes[i].Replica.Enabled && dbType == MemoryDatabase {
+			return T{}, fmt.Errorf("%v: replicas are not supported for in-memory databases", cfg.Prefixes[i].Prefix)
+		}
 		if len(p.Separator) == 0 {
 			cfg.Prefixes[i].Separator = string(filepath.Separator)
 		}
@@ -5,8 +5,11 @@
 package config_test
 
 import (
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"cloudeng.io/cmd/idu/internal/config"
 )
@@ -147,3 +150,304 @@ func TestDocumentation(t *testing.T) {
 		}
 	}
 }
+
+func TestFileTimes(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(`
+- prefix: /tmp
+  file_times: [access, change]
+- prefix: /var
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, change, birth := cfg.Prefixes[0].TimesToRecord()
+	if got, want := []bool{access, change, birth}, []bool{true, true, false}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	access, change, birth = cfg.Prefixes[1].TimesToRecord()
+	if got, want := []bool{access, change, birth}, []bool{false, false, false}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	_, err = config.ParseConfig([]byte(`
+- prefix: /tmp
+  file_times: [modified]
+`))
+	if err == nil || !strings.Contains(err.Error(), "unsupported file time: modified") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(`
+- prefix: /tmp
+  adaptive:
+    enabled: true
+    target_latency: 2ms
+    target_iops: 5000
+    min_stats: 4
+- prefix: /var
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := cfg.Prefixes[0].Adaptive
+	if got, want := a, (config.Adaptive{
+		Enabled:       true,
+		TargetLatency: 2 * time.Millisecond,
+		TargetIOPS:    5000,
+		MaxErrorRate:  config.DefaultAdaptiveMaxErrorRate,
+		Interval:      config.DefaultAdaptiveInterval,
+		MinScans:      1,
+		MinStats:      4,
+	}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got, want := cfg.Prefixes[1].Adaptive.Enabled, false; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	_, err = config.ParseConfig([]byte(`
+- prefix: /tmp
+  adaptive:
+    max_error_rate: 2
+`))
+	if err == nil || !strings.Contains(err.Error(), "max_error_rate must be between 0 and 1") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(`
+- prefix: /tmp
+  rate_limit:
+    ops_per_second: 0
+    schedule:
+      - start: "09:00"
+        end: "17:00"
+        ops_per_second: 2000
+      - start: "22:00"
+        end: "02:30"
+        ops_per_second: 500
+- prefix: /var
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := cfg.Prefixes[0].RateLimit
+	if !rl.Enabled() || cfg.Prefixes[1].RateLimit.Enabled() {
+		t.Errorf("unexpected enabled state")
+	}
+	day := time.Date(2024, 3, 4, 0, 0, 0, 0, time.Local)
+	for _, tc := range []struct {
+		at   time.Duration
+		rate float64
+	}{
+		{0, 500},
+		{2*time.Hour + 29*time.Minute, 500},
+		{2*time.Hour + 30*time.Minute, 0},
+		{9 * time.Hour, 2000},
+		{16*time.Hour + 59*time.Minute, 2000},
+		{17 * time.Hour, 0},
+		{23 * time.Hour, 500},
+	} {
+		if got, want := rl.RateAt(day.Add(tc.at)), tc.rate; got != want {
+			t.Errorf("%v: got %v, want %v", tc.at, got, want)
+		}
+	}
+
+	_, err = config.ParseConfig([]byte(`
+- prefix: /tmp
+  rate_limit:
+    schedule:
+      - start: "9am"
+        end: "17:00"
+`))
+	if err == nil || !strings.Contains(err.Error(), `invalid time of day: "9am"`) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(`
+- prefix: /tmp
+  history:
+    enabled: true
+- prefix: /var
+  history:
+    enabled: true
+    retain: 48h
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Prefixes[0].History, (config.History{Enabled: true, Retain: config.DefaultHistoryRetention}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cfg.Prefixes[1].History.Retain, 48*time.Hour; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	_, err = config.ParseConfig([]byte(`
+- prefix: /tmp
+  history:
+    retain: -1h
+`))
+	if err == nil || !strings.Contains(err.Error(), "history retain must be zero or positive") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestReplica(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(`
+- prefix: /tmp
+  database: /db/tmp
+  replica:
+    enabled: true
+- prefix: /var
+  database: /db/var
+  replica:
+    enabled: true
+    directory: /replicas/var
+    keep: 5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Prefixes[0].Replica, (config.Replica{Enabled: true, Directory: "/db/tmp.replica", Keep: config.DefaultReplicasToKeep}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cfg.Prefixes[1].Replica, (config.Replica{Enabled: true, Directory: "/replicas/var", Keep: 5}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	_, err = config.ParseConfig([]byte(`
+- prefix: /tmp
+  replica:
+    keep: -1
+`))
+	if err == nil || !strings.Contains(err.Error(), "replica keep must be zero or positive") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestDatabaseType(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(`
+- prefix: /tmp
+- prefix: /var
+  database_type: Bolt
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Prefixes[0].DatabaseType, config.BadgerDatabase; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cfg.Prefixes[1].DatabaseType, config.BoltDatabase; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	_, err = config.ParseConfig([]byte(`
+- prefix: /tmp
+  database_type: sqlite
+`))
+	if err == nil || !strings.Contains(err.Error(), "unsupported database type") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	t.Setenv("KEYS", "/keys")
+	cfg, err := config.ParseConfig([]byte(`
+- prefix: /tmp
+  encryption:
+    key_file: $KEYS/tmp
+    previous_key_files: [$KEYS/tmp.old]
+- prefix: /var
+  encryption:
+    key_command: vault read -field=key secret/idu
+    data_key_rotation: 24h
+- prefix: /home
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Prefixes[0].Encryption, (config.Encryption{KeyFile: "/keys/tmp", DataKeyRotation: config.DefaultDataKeyRotation, PreviousKeyFiles: []string{"/keys/tmp.old"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cfg.Prefixes[1].Encryption, (config.Encryption{KeyCommand: "vault read -field=key secret/idu", DataKeyRotation: 24 * time.Hour}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if cfg.Prefixes[2].Encryption.Enabled() {
+		t.Errorf("encryption should not be enabled")
+	}
+
+	for _, tc := range []struct {
+		cfg, err string
+	}{
+		{`
+- prefix: /tmp
+  encryption:
+    key_file: /keys/tmp
+    key_command: cat /keys/tmp
+`, "only one of encryption key_file or key_command may be specified"},
+		{`
+- prefix: /tmp
+  encryption:
+    previous_key_files: [/keys/tmp.old]
+`, "previous_key_files requires that key_file or key_command be specified"},
+		{`
+- prefix: /tmp
+  encryption:
+    key_file: /keys/tmp
+    data_key_rotation: -1h
+`, "encryption data_key_rotation must be zero or positive"},
+		{`
+- prefix: /tmp
+  database_type: bolt
+  encryption:
+    key_file: /keys/tmp
+`, "encryption is only supported for badger databases"},
+	} {
+		_, err := config.ParseConfig([]byte(tc.cfg))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("missing or unexpected error: %v", err)
+		}
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(`
+- prefix: /tmp
+- prefix: /var
+  key_encoding: Compact
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Prefixes[0].KeyEncoding, config.PathKeys; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cfg.Prefixes[1].KeyEncoding, config.CompactKeys; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		cfg, err string
+	}{
+		{`
+- prefix: /tmp
+  key_encoding: interned
+`, "unsupported key encoding"},
+		{`
+- prefix: /tmp
+  key_encoding: compact
+  history:
+    enabled: true
+`, "history is not supported with compact keys"},
+	} {
+		_, err := config.ParseConfig([]byte(tc.cfg))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("missing or unexpected error: %v", err)
+		}
+	}
+}
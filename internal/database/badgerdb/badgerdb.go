@@ -7,6 +7,7 @@ package badgerdb
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -40,6 +41,10 @@ type Options struct {
 	badger.Options
 }
 
+// DefaultIndexCacheSize is the size of the index cache used for encrypted
+// databases if one is not otherwise specified.
+var DefaultIndexCacheSize int64 = 64 << 20
+
 // Database represents a badger database.
 type Database struct {
 	database.Options[Options]
@@ -51,7 +56,7 @@ type Database struct {
 	unlock   func()
 }
 
-// The database is paritioned into 4 'buckets':
+// The database is paritioned into 7 'buckets':
 // 1. inode bucket, keyed by inode and device numbers. This is by far
 //    the largest since it has an entry for every file.
 // 2. the prefix bucket, keyed by prefix. This contains an entry for
@@ -60,17 +65,39 @@ type Database struct {
 //    every log entry, ie. iteration of updates of the database.
 // 4. the error bucket, keyed by timestamp. This contains an entry for
 //    every error encountered in the most recent update of the database.
+// 5. the hash bucket, keyed by device and inode numbers and modification
+//    time. This contains an entry for every file whose contents have
+//    been hashed.
+// 6. the metadata bucket, keyed by name. This contains a small number
+//    of entries that describe the database itself, such as its schema
+//    version.
+// 7. the history bucket, keyed by prefix and the time at which a version
+//    of that prefix was superseded. This contains an entry for every
+//    retained prior version of a prefix, see history.go.
 //
 // Keys are assigned to each bucket by prepending an identifying byte
 // to the key.
 
 const (
-	inodeBucket  = 0xf0
-	prefixBucket = 0xf1
-	logBucket    = 0xf2
-	errorBucket  = 0xf3
+	inodeBucket    = 0xf0
+	prefixBucket   = 0xf1
+	logBucket      = 0xf2
+	errorBucket    = 0xf3
+	hashBucket     = 0xf4
+	metadataBucket = 0xf5
+	historyBucket  = 0xf6
 )
 
+var bucketNames = map[byte]string{
+	inodeBucket:    "inode",
+	prefixBucket:   "prefix",
+	logBucket:      "log",
+	errorBucket:    "error",
+	hashBucket:     "hash",
+	metadataBucket: "metadata",
+	historyBucket:  "history",
+}
+
 var bufPool = sync.Pool{
 	New: func() any {
 		// The Pool's New function should generally only return pointer
@@ -104,6 +131,10 @@ func Open[T Options](location string, opts ...Option) (database.DB, error) {
 		fn(&db.Options)
 	}
 	db.Options.Sub.Options = db.Options.Sub.Options.WithReadOnly(db.Options.ReadOnly)
+	if len(db.Options.Sub.EncryptionKey) > 0 && db.Options.Sub.IndexCacheSize == 0 {
+		// Badger requires an index cache for encrypted databases.
+		db.Options.Sub.Options = db.Options.Sub.Options.WithIndexCacheSize(DefaultIndexCacheSize)
+	}
 
 	lockfile := filepath.Join(location, "applock")
 	db.lock = lockedfile.MutexAt(lockfile)
@@ -121,6 +152,7 @@ func Open[T Options](location string, opts ...Option) (database.DB, error) {
 	osopts := osOptions(db.Options.Sub.Options)
 	bdb, err := badger.Open(osopts)
 	if err != nil {
+		unlock()
 		return nil, err
 	}
 	db.bdb = bdb
@@ -200,6 +232,17 @@ func (db *Database) DeletePrefix(ctx context.Context, prefix string) error {
 	return db.deletePrefix(ctx, kb.Bytes())
 }
 
+func (db *Database) Delete(ctx context.Context, prefix string) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	kb := keyForBucket(prefixBucket, []byte(prefix))
+	defer bufPool.Put(kb)
+	return db.bdb.Update(func(tx *badger.Txn) error {
+		return tx.Delete(kb.Bytes())
+	})
+}
+
 func (db *Database) deleteBatch(prefix []byte) (bool, error) {
 	tx := db.bdb.NewTransaction(true)
 	defer tx.Discard()
@@ -235,6 +278,17 @@ func (db *Database) DeleteErrors(ctx context.Context, prefix string) error {
 	return db.deletePrefix(ctx, kb.Bytes())
 }
 
+func (db *Database) DeleteError(ctx context.Context, key string) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	kb := keyForBucket(errorBucket, []byte(key))
+	defer bufPool.Put(kb)
+	return db.bdb.Update(func(tx *badger.Txn) error {
+		return tx.Delete(kb.Bytes())
+	})
+}
+
 var errScanDone = errors.New("scan done")
 
 func (db *Database) scanFrom(ctx context.Context, bucket byte, prefix []byte, visitor func(ctx context.Context, key string, val []byte) error) error {
@@ -242,7 +296,14 @@ func (db *Database) scanFrom(ctx context.Context, bucket byte, prefix []byte, vi
 	defer bufPool.Put(kb)
 	prefix = kb.Bytes()
 	return db.bdb.View(func(tx *badger.Txn) error {
-		it := tx.NewIterator(badger.DefaultIteratorOptions)
+		// Values are not prefetched since scans, such as those used to
+		// read the children of a prefix with compact keys, are often short
+		// and prefetching copies up to 100 values that are rarely needed,
+		// whereas values that are stored in the LSM tree, as is typically
+		// the case, are cheap to read as they are visited.
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := tx.NewIterator(opts)
 		defer it.Close()
 		if len(prefix) > 0 {
 			it.Seek(prefix)
@@ -347,23 +408,56 @@ func (db *Database) Stream(ctx context.Context, path string, visitor func(ctx co
 	return stream.Orchestrate(ctx)
 }
 
-func (db *Database) LogError(ctx context.Context, key string, when time.Time, detail []byte) error {
-	pl := types.ErrorPayload{
-		When:    when,
-		Key:     key,
-		Payload: detail,
+func (db *Database) LogError(ctx context.Context, pl types.ErrorPayload) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	kb := keyForBucket(errorBucket, []byte(pl.Key))
+	defer bufPool.Put(kb)
+	for {
+		err := db.bdb.Update(func(tx *badger.Txn) error {
+			return db.logError(tx, kb.Bytes(), pl)
+		})
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+}
+
+func (db *Database) logError(tx *badger.Txn, key []byte, pl types.ErrorPayload) error {
+	pl.Attempts = 1
+	if item, err := tx.Get(key); err == nil {
+		var prev types.ErrorPayload
+		if err := item.Value(func(val []byte) error {
+			return types.Decode(val, &prev)
+		}); err == nil {
+			// Errors recorded before attempts were counted will
+			// have a zero attempt count.
+			pl.Attempts = max(prev.Attempts, 1) + 1
+		}
 	}
 	var buf bytes.Buffer
 	if err := types.Encode(&buf, pl); err != nil {
 		return err
 	}
-	kb := keyForBucket(errorBucket, []byte(key))
+	return tx.Set(key, buf.Bytes())
+}
+
+func (db *Database) SetError(ctx context.Context, pl types.ErrorPayload) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := types.Encode(&buf, pl); err != nil {
+		return err
+	}
+	kb := keyForBucket(errorBucket, []byte(pl.Key))
 	defer bufPool.Put(kb)
 	return db.set(ctx, kb.Bytes(), buf.Bytes())
 }
 
 func (db *Database) VisitErrors(ctx context.Context, key string,
-	visitor func(ctx context.Context, key string, when time.Time, detail []byte) bool) error {
+	visitor func(ctx context.Context, pl types.ErrorPayload) bool) error {
 	return db.scanFrom(ctx, errorBucket, []byte(key), func(ctx context.Context, key string, val []byte) error {
 		if key[0] != errorBucket {
 			return errScanDone
@@ -372,13 +466,57 @@ func (db *Database) VisitErrors(ctx context.Context, key string,
 		if err := types.Decode(val, &pl); err != nil {
 			return err
 		}
-		if !visitor(ctx, pl.Key, pl.When, pl.Payload) {
+		if !visitor(ctx, pl) {
 			return errScanDone
 		}
 		return nil
 	})
 }
 
+func (db *Database) CheckRecords(ctx context.Context, visitor func(ctx context.Context, kind, key string, err error) bool) error {
+	var remove [][]byte
+	for _, bucket := range []struct {
+		id     byte
+		kind   string
+		decode func([]byte) error
+	}{
+		{errorBucket, "error", func(v []byte) error {
+			var pl types.ErrorPayload
+			return types.Decode(v, &pl)
+		}},
+		{logBucket, "log", func(v []byte) error {
+			var pl types.LogPayload
+			return types.Decode(v, &pl)
+		}},
+	} {
+		err := db.scanFrom(ctx, bucket.id, nil, func(ctx context.Context, key string, val []byte) error {
+			if key[0] != bucket.id {
+				return errScanDone
+			}
+			if err := bucket.decode(val); err != nil {
+				if visitor(ctx, bucket.kind, key[1:], err) {
+					remove = append(remove, []byte(key))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(remove) == 0 {
+		return nil
+	}
+	return db.bdb.Update(func(tx *badger.Txn) error {
+		for _, k := range remove {
+			if err := tx.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (db *Database) lastKey(prefix byte) ([]byte, error) {
 	var lastKey []byte
 	p := []byte{prefix}
@@ -451,6 +589,106 @@ func (db *Database) VisitLogs(ctx context.Context, start, stop time.Time, visito
 	})
 }
 
+// SetHash stores the content hash of the file identified by key. Hashes
+// are written in batches and hence are not visible until the batch is
+// flushed or the database is closed.
+func (db *Database) SetHash(ctx context.Context, key types.HashKey, hash []byte) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	kb := keyForBucket(hashBucket, key.Bytes())
+	defer bufPool.Put(kb)
+	return db.batch.set(kb.Bytes(), hash)
+}
+
+// GetHash retrieves the content hash, if any, stored for the file
+// identified by key. Nothing is written to buf if there is no such hash.
+func (db *Database) GetHash(ctx context.Context, key types.HashKey, buf *bytes.Buffer) error {
+	kb := keyForBucket(hashBucket, key.Bytes())
+	defer bufPool.Put(kb)
+	return db.get(ctx, kb.Bytes(), buf)
+}
+
+// DeleteHash deletes the content hash, if any, stored for the file
+// identified by key.
+func (db *Database) DeleteHash(ctx context.Context, key types.HashKey) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	kb := keyForBucket(hashBucket, key.Bytes())
+	defer bufPool.Put(kb)
+	return db.bdb.Update(func(tx *badger.Txn) error {
+		return tx.Delete(kb.Bytes())
+	})
+}
+
+// VisitHashes calls visitor for every stored content hash in order of
+// device, inode and modification time.
+func (db *Database) VisitHashes(ctx context.Context, visitor func(ctx context.Context, key types.HashKey, hash []byte) bool) error {
+	return db.scanFrom(ctx, hashBucket, nil, func(ctx context.Context, key string, val []byte) error {
+		if key[0] != hashBucket {
+			return errScanDone
+		}
+		hk, err := types.ParseHashKey([]byte(key[1:]))
+		if err != nil {
+			return err
+		}
+		if !visitor(ctx, hk, val) {
+			return errScanDone
+		}
+		return nil
+	})
+}
+
+func (db *Database) SetMetadata(ctx context.Context, key string, val []byte) error {
+	kb := keyForBucket(metadataBucket, []byte(key))
+	defer bufPool.Put(kb)
+	return db.set(ctx, kb.Bytes(), val)
+}
+
+func (db *Database) GetMetadata(ctx context.Context, key string, buf *bytes.Buffer) error {
+	kb := keyForBucket(metadataBucket, []byte(key))
+	defer bufPool.Put(kb)
+	return db.get(ctx, kb.Bytes(), buf)
+}
+
+func bucketFor(name string) (byte, bool) {
+	for id, n := range bucketNames {
+		if n == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// VisitRecords implements database.DB.
+func (db *Database) VisitRecords(ctx context.Context, visitor func(ctx context.Context, bucket string, key, val []byte) bool) error {
+	return db.scanFrom(ctx, inodeBucket, nil, func(ctx context.Context, key string, val []byte) error {
+		name, ok := bucketNames[key[0]]
+		if !ok {
+			return fmt.Errorf("unknown bucket: %#x", key[0])
+		}
+		if !visitor(ctx, name, []byte(key[1:]), val) {
+			return errScanDone
+		}
+		return nil
+	})
+}
+
+// SetRecord implements database.DB.
+func (db *Database) SetRecord(ctx context.Context, bucket string, key, val []byte) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	id, ok := bucketFor(bucket)
+	if !ok {
+		return fmt.Errorf("unknown bucket: %v", bucket)
+	}
+	kb := keyForBucket(id, key)
+	defer bufPool.Put(kb)
+	return db.batch.set(kb.Bytes(), val)
+}
+
 // Close closes the database.
 func (db *Database) Close(_ context.Context) error {
 	db.unlockMu.Lock()
@@ -466,6 +704,78 @@ func (db *Database) Close(_ context.Context) error {
 	return errs.Err()
 }
 
+// Stats implements database.DB. The sizes reported are those of the
+// LSM tree (.sst files), the value log (.vlog files) and all other files
+// such as the manifest.
+func (db *Database) Stats(ctx context.Context) (database.Stats, error) {
+	stats := database.Stats{
+		Sizes: map[string]int64{"lsm": 0, "vlog": 0, "other": 0},
+		Keys:  map[string]int64{},
+	}
+	for _, name := range bucketNames {
+		stats.Keys[name] = 0
+	}
+	entries, err := os.ReadDir(db.location)
+	if err != nil {
+		return stats, err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".sst":
+			stats.Sizes["lsm"] += info.Size()
+		case ".vlog":
+			stats.Sizes["vlog"] += info.Size()
+		default:
+			stats.Sizes["other"] += info.Size()
+		}
+	}
+	err = db.bdb.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := db.canceled(ctx); err != nil {
+				return err
+			}
+			name, ok := bucketNames[it.Item().Key()[0]]
+			if !ok {
+				name = "unknown"
+			}
+			stats.Keys[name]++
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// Compact implements database.DB. It flattens the LSM tree into a single
+// level and then garbage collects the value log until there is nothing
+// left to reclaim.
+func (db *Database) Compact(ctx context.Context) error {
+	if db.Options.ReadOnly {
+		return fmt.Errorf("%v: cannot compact a database opened in read-only mode", db.location)
+	}
+	if err := db.bdb.Flatten(runtime.NumCPU()); err != nil {
+		return err
+	}
+	for {
+		if err := db.canceled(ctx); err != nil {
+			return err
+		}
+		if err := db.bdb.RunValueLogGC(0.5); err != nil {
+			if err == badger.ErrNoRewrite {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
 func (db *Database) Clear(_ context.Context, logs, errors bool) error {
 	if logs {
 		if err := db.bdb.DropPrefix([]byte{logBucket}); err != nil {
@@ -5,11 +5,17 @@
 package badgerdb_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
+	"cloudeng.io/cmd/idu/internal/database"
 	"cloudeng.io/cmd/idu/internal/database/badgerdb"
+	"cloudeng.io/cmd/idu/internal/database/types"
 	"github.com/dgraph-io/badger/v4"
 )
 
@@ -50,3 +56,114 @@ func TestBatch(t *testing.T) {
 		return true
 	})
 }
+
+func TestCheckRecords(t *testing.T) {
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	db, err := badgerdb.Open(tmpdir, badgerdb.WithBadgerOptions(badger.DefaultOptions(tmpdir).WithLogger(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	if err := db.LogError(ctx, types.ErrorPayload{Key: "/a", When: time.Now(), Payload: []byte("error")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Log(ctx, time.Now(), time.Now(), []byte("log")); err != nil {
+		t.Fatal(err)
+	}
+	// Write undecodable records directly to the log (0xf2) and
+	// error (0xf3) buckets.
+	err = db.(*badgerdb.Database).BadgerDB().Update(func(tx *badger.Txn) error {
+		if err := tx.Set([]byte("\xf2bad-log"), []byte("corrupt")); err != nil {
+			return err
+		}
+		return tx.Set([]byte("\xf3/b"), []byte("corrupt"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(repair bool) []string {
+		var found []string
+		err := db.CheckRecords(ctx, func(_ context.Context, kind, key string, err error) bool {
+			if err == nil {
+				t.Errorf("%v: %v: missing error", kind, key)
+			}
+			found = append(found, kind+":"+key)
+			return repair
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+	want := []string{"error:/b", "log:bad-log"}
+	if got := check(false); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := check(true); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := check(false); len(got) != 0 {
+		t.Errorf("got %v, want none", got)
+	}
+	n := 0
+	if err := db.VisitErrors(ctx, "", func(context.Context, types.ErrorPayload) bool {
+		n++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	open := func(key []byte, opts ...badgerdb.Option) (database.DB, error) {
+		bopts := badger.DefaultOptions(tmpdir).WithLogger(nil).WithEncryptionKey(key)
+		return badgerdb.Open(tmpdir, append(opts, badgerdb.WithBadgerOptions(bopts))...)
+	}
+	db, err := open(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(ctx, "/a", []byte("secret"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := open(newKey, badgerdb.ReadOnly()); !errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := badgerdb.RotateKey(tmpdir, newKey, oldKey, time.Hour); !errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := badgerdb.RotateKey(tmpdir, oldKey, newKey, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open(oldKey, badgerdb.ReadOnly()); !errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db, err = open(newKey, badgerdb.ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	var buf bytes.Buffer
+	if err := db.Get(ctx, "/a", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "secret"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := badgerdb.RotateKey(t.TempDir(), oldKey, newKey, time.Hour); err == nil {
+		t.Errorf("expected an error for a non-existent database")
+	}
+}
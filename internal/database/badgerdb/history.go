@@ -0,0 +1,208 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// History keys are of the form <bucket><prefix>\x00<time> where time is
+// the big-endian unix nanosecond time at which the version was superseded.
+// The \x00 separator ensures that all of the versions of a prefix are
+// ordered before those of any prefix that it is itself a prefix of, and
+// hence that history keys are ordered identically to prefix keys.
+
+func historyKey(prefix string, when time.Time) *bytes.Buffer {
+	kb := keyForBucket(historyBucket, []byte(prefix))
+	kb.WriteByte(0x00)
+	kb.Write(binary.BigEndian.AppendUint64(nil, uint64(when.UnixNano())))
+	return kb
+}
+
+// historyLimit returns a key that is ordered after all of the versions
+// of prefix.
+func historyLimit(prefix string) *bytes.Buffer {
+	kb := keyForBucket(historyBucket, []byte(prefix))
+	kb.WriteByte(0x01)
+	return kb
+}
+
+func parseHistoryKey(key []byte) (prefix string, when time.Time, ok bool) {
+	if len(key) < 10 || key[0] != historyBucket || key[len(key)-9] != 0x00 {
+		return "", time.Time{}, false
+	}
+	ns := binary.BigEndian.Uint64(key[len(key)-8:])
+	return string(key[1 : len(key)-9]), time.Unix(0, int64(ns)), true
+}
+
+// SetHistory implements database.DB.
+func (db *Database) SetHistory(ctx context.Context, prefix string, when time.Time, val []byte) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	kb := historyKey(prefix, when)
+	defer bufPool.Put(kb)
+	return db.bdb.Update(func(tx *badger.Txn) error {
+		_, err := tx.Get(kb.Bytes())
+		if err == nil {
+			return nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+		return tx.Set(kb.Bytes(), bytes.Clone(val))
+	})
+}
+
+// versionAsOf returns the value of the first version of prefix that was
+// superseded after when, ok is false if there is no such version.
+func versionAsOf(it *badger.Iterator, prefix string, when time.Time) (val []byte, ok bool, err error) {
+	kb := historyKey(prefix, when.Add(time.Nanosecond))
+	defer bufPool.Put(kb)
+	it.Seek(kb.Bytes())
+	if !it.Valid() {
+		return nil, false, nil
+	}
+	p, _, valid := parseHistoryKey(it.Item().Key())
+	if !valid || p != prefix {
+		return nil, false, nil
+	}
+	val, err = it.Item().ValueCopy(nil)
+	return val, true, err
+}
+
+// GetAsOf implements database.DB.
+func (db *Database) GetAsOf(ctx context.Context, prefix string, when time.Time, buf *bytes.Buffer) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	return db.bdb.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		val, ok, err := versionAsOf(it, prefix, when)
+		if err != nil {
+			return err
+		}
+		if ok {
+			buf.Write(val)
+			return nil
+		}
+		kb := keyForBucket(prefixBucket, []byte(prefix))
+		defer bufPool.Put(kb)
+		item, err := tx.Get(kb.Bytes())
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			buf.Write(val)
+			return nil
+		})
+	})
+}
+
+// ScanAsOf implements database.DB. It merges the prefix and history
+// buckets, using the first version of each prefix superseded after
+// when, if any, in place of its current value.
+func (db *Database) ScanAsOf(ctx context.Context, key string, when time.Time, visitor func(ctx context.Context, key string, val []byte) bool) error {
+	return db.bdb.View(func(tx *badger.Txn) error {
+		cur := tx.NewIterator(badger.DefaultIteratorOptions)
+		defer cur.Close()
+		hist := tx.NewIterator(badger.DefaultIteratorOptions)
+		defer hist.Close()
+		lookup := tx.NewIterator(badger.DefaultIteratorOptions)
+		defer lookup.Close()
+
+		ckb := keyForBucket(prefixBucket, []byte(key))
+		cur.Seek(ckb.Bytes())
+		bufPool.Put(ckb)
+		hkb := keyForBucket(historyBucket, []byte(key))
+		hist.Seek(hkb.Bytes())
+		bufPool.Put(hkb)
+
+		for {
+			var curKey, histKey string
+			curOK := cur.Valid() && cur.Item().Key()[0] == prefixBucket
+			if curOK {
+				curKey = string(cur.Item().Key()[1:])
+			}
+			var histOK bool
+			if hist.Valid() {
+				histKey, _, histOK = parseHistoryKey(hist.Item().Key())
+			}
+			if !curOK && !histOK {
+				return nil
+			}
+			var k string
+			switch {
+			case !histOK:
+				k = curKey
+			case !curOK:
+				k = histKey
+			default:
+				k = min(curKey, histKey)
+			}
+			var val []byte
+			var ok bool
+			var err error
+			if histOK && histKey == k {
+				if val, ok, err = versionAsOf(lookup, k, when); err != nil {
+					return err
+				}
+				// Skip over all of the versions of k.
+				lkb := historyLimit(k)
+				hist.Seek(lkb.Bytes())
+				bufPool.Put(lkb)
+			}
+			if curOK && curKey == k {
+				if !ok {
+					if val, err = cur.Item().ValueCopy(nil); err != nil {
+						return err
+					}
+				}
+				cur.Next()
+			}
+			if len(val) > 0 && !visitor(ctx, k, val) {
+				return nil
+			}
+			if err := db.canceled(ctx); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// DeleteHistory implements database.DB.
+func (db *Database) DeleteHistory(ctx context.Context, before time.Time) (int64, error) {
+	var keys [][]byte
+	err := db.scanFrom(ctx, historyBucket, nil, func(_ context.Context, key string, _ []byte) error {
+		_, when, ok := parseHistoryKey([]byte(key))
+		if !ok {
+			return errScanDone
+		}
+		if when.Before(before) {
+			keys = append(keys, []byte(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	wb := db.bdb.NewWriteBatch()
+	defer wb.Cancel()
+	for _, k := range keys {
+		if err := wb.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(keys)), wb.Flush()
+}
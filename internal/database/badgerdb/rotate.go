@@ -0,0 +1,46 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"cloudeng.io/os/lockedfile"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// RotateKey changes the encryption key for the encrypted database at
+// location from oldKey to newKey. Badger encrypts the database itself
+// using data keys that are in turn encrypted using the encryption key
+// and stored in its key registry; only the key registry is rewritten
+// and hence rotation is fast regardless of the size of the database.
+// The database must not be in use and RotateKey waits for any current
+// users of it to close it.
+func RotateKey(location string, oldKey, newKey []byte, rotation time.Duration) error {
+	if _, err := os.Stat(filepath.Join(location, badger.KeyRegistryFileName)); err != nil {
+		return fmt.Errorf("%v: not a badger database: %v", location, err)
+	}
+	unlock, err := lockedfile.MutexAt(filepath.Join(location, "applock")).Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	opts := badger.KeyRegistryOptions{
+		Dir:                           location,
+		ReadOnly:                      true,
+		EncryptionKey:                 oldKey,
+		EncryptionKeyRotationDuration: rotation,
+	}
+	kr, err := badger.OpenKeyRegistry(opts)
+	if err != nil {
+		return fmt.Errorf("%v: %w", location, err)
+	}
+	defer kr.Close()
+	opts.EncryptionKey = newKey
+	return badger.WriteKeyRegistry(kr, opts)
+}
@@ -0,0 +1,50 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"cloudeng.io/errors"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Snapshot implements database.DB. The snapshot is created by streaming
+// a backup of the database, as of the time that Snapshot is called, into
+// a newly created badger database at location and hence concurrent
+// updates to this database are not included in it. Any batched writes
+// are committed first and hence Snapshot must not be called concurrently
+// with batched calls to Set.
+func (db *Database) Snapshot(ctx context.Context, location string) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	if err := db.batch.commit(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(location); err == nil {
+		return fmt.Errorf("%v: already exists", location)
+	}
+	opts := db.Options.Sub.Options.WithDir(location).WithValueDir(location).WithReadOnly(false)
+	sdb, err := badger.Open(opts)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := db.bdb.Backup(pw, 0)
+		pw.CloseWithError(err)
+	}()
+	var errs errors.M
+	lerr := sdb.Load(pr, 256)
+	// Unblock the backup if the load failed part way through.
+	pr.CloseWithError(lerr)
+	errs.Append(lerr)
+	errs.Append(sdb.Close())
+	return errs.Err()
+}
@@ -35,3 +35,12 @@ func (wb *writeBatch) set(key, value []byte) error {
 func (wb *writeBatch) flush() error {
 	return wb.batch.Flush()
 }
+
+// commit is like flush except that a new batch is started so that
+// the writeBatch may continue to be used. It must not be called
+// concurrently with set.
+func (wb *writeBatch) commit() error {
+	err := wb.batch.Flush()
+	wb.batch = wb.bdb.NewWriteBatch()
+	return err
+}
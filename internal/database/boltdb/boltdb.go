@@ -0,0 +1,656 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package boltdb provides an implementation of database.DB using bbolt,
+// a pure-Go, single file, B+tree based key/value store. It uses
+// considerably less memory than badger and has no value log to garbage
+// collect, at the cost of slower writes, which makes it better suited to
+// small machines.
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/types"
+	cerrors "cloudeng.io/errors"
+	"cloudeng.io/os/lockedfile"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Option represents a specific option accepted by Open.
+type Option func(o *database.Options[Options])
+
+var ReadOnly = database.ReadOnly[Options]
+var WithTimeout = database.WithTimeout[Options]
+
+// WithBoltOptions specifies the options to be used when opening the
+// database. Note that the ReadOnly and Timeout fields are overridden by
+// the ReadOnly and WithTimeout options.
+func WithBoltOptions(opts bolt.Options) Option {
+	return func(o *database.Options[Options]) {
+		o.Sub.Options = opts
+	}
+}
+
+type Options struct {
+	bolt.Options
+}
+
+// Database represents a bolt database.
+type Database struct {
+	database.Options[Options]
+	location string
+	filename string
+	bdb      *bolt.DB
+	batch    *writeBatch
+	lock     *lockedfile.Mutex
+	unlockMu sync.Mutex
+	unlock   func()
+}
+
+// The database is stored in a single file within the database location
+// and is partitioned into the same 'buckets' as the badger database, see
+// database.Buckets, each of which is stored as a bolt bucket. Keys within
+// each bucket are identical to those used by badger, less the byte that
+// badger uses to identify the bucket.
+
+const dbFilename = "bolt.db"
+
+var (
+	inodeBucket    = []byte("inode")
+	prefixBucket   = []byte("prefix")
+	logBucket      = []byte("log")
+	errorBucket    = []byte("error")
+	hashBucket     = []byte("hash")
+	metadataBucket = []byte("metadata")
+	historyBucket  = []byte("history")
+)
+
+func bucketFor(name string) ([]byte, bool) {
+	for _, b := range [][]byte{inodeBucket, prefixBucket, logBucket, errorBucket, hashBucket, metadataBucket, historyBucket} {
+		if string(b) == name {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// Open opens the specified database. If the database does not exist it will
+// be created.
+func Open[T Options](location string, opts ...Option) (database.DB, error) {
+	if len(location) > 0 && location != "." {
+		if err := os.MkdirAll(location, 0770); err != nil {
+			return nil, err
+		}
+	}
+	db := &Database{
+		location: location,
+		filename: filepath.Join(location, dbFilename),
+	}
+	for _, fn := range opts {
+		fn(&db.Options)
+	}
+	db.Options.Sub.Options.ReadOnly = db.Options.ReadOnly
+	db.Options.Sub.Options.Timeout = db.Options.Timeout
+
+	lockfile := filepath.Join(location, "applock")
+	db.lock = lockedfile.MutexAt(lockfile)
+	var unlock func()
+	var err error
+	if db.Options.ReadOnly {
+		unlock, err = db.lock.RLockCreate()
+	} else {
+		unlock, err = db.lock.Lock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := db.open(); err != nil {
+		unlock()
+		return nil, err
+	}
+	db.unlock = unlock
+	return db, nil
+}
+
+func (db *Database) open() error {
+	bopts := db.Options.Sub.Options
+	bdb, err := bolt.Open(db.filename, 0660, &bopts)
+	if err != nil {
+		return err
+	}
+	if !db.Options.ReadOnly {
+		err := bdb.Update(func(tx *bolt.Tx) error {
+			for _, name := range database.Buckets {
+				if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			bdb.Close()
+			return err
+		}
+	}
+	db.bdb = bdb
+	db.batch = newWriteBatch(bdb)
+	return nil
+}
+
+func (db *Database) BoltDB() *bolt.DB {
+	return db.bdb
+}
+
+func (db *Database) canceled(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		db.batch.flush()
+		return ctx.Err()
+	default:
+		return nil
+	}
+}
+
+func (db *Database) set(ctx context.Context, name, key, val []byte) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(name).Put(key, val)
+	})
+}
+
+func (db *Database) get(ctx context.Context, name, key []byte, buf *bytes.Buffer) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	return db.bdb.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return nil
+		}
+		if val := b.Get(key); val != nil {
+			buf.Grow(len(val))
+			buf.Write(val)
+		}
+		return nil
+	})
+}
+
+func (db *Database) Set(ctx context.Context, prefix string, val []byte, batch bool) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	if batch {
+		return db.batch.set(prefixBucket, []byte(prefix), val)
+	}
+	return db.set(ctx, prefixBucket, []byte(prefix), val)
+}
+
+func (db *Database) Get(ctx context.Context, prefix string, buf *bytes.Buffer) error {
+	return db.get(ctx, prefixBucket, []byte(prefix), buf)
+}
+
+func (db *Database) deletePrefix(ctx context.Context, name, prefix []byte) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(name).Cursor()
+		// Deleting the current item invalidates the cursor's position
+		// and hence the scan is restarted after every deletion.
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *Database) DeletePrefix(ctx context.Context, prefix string) error {
+	return db.deletePrefix(ctx, prefixBucket, []byte(prefix))
+}
+
+func (db *Database) Delete(ctx context.Context, prefix string) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(prefixBucket).Delete([]byte(prefix))
+	})
+}
+
+func (db *Database) DeleteErrors(ctx context.Context, prefix string) error {
+	return db.deletePrefix(ctx, errorBucket, []byte(prefix))
+}
+
+func (db *Database) DeleteError(ctx context.Context, key string) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(errorBucket).Delete([]byte(key))
+	})
+}
+
+var errScanDone = errors.New("scan done")
+
+// scanFrom calls visitor for every key in the named bucket starting at
+// start. The key and value passed to visitor are only valid for the
+// duration of the call.
+func (db *Database) scanFrom(ctx context.Context, name, start []byte, visitor func(ctx context.Context, key, val []byte) error) error {
+	return db.bdb.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		var k, v []byte
+		if len(start) > 0 {
+			k, v = c.Seek(start)
+		} else {
+			k, v = c.First()
+		}
+		for ; k != nil; k, v = c.Next() {
+			if err := visitor(ctx, k, v); err != nil {
+				if err == errScanDone {
+					break
+				}
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+		return nil
+	})
+}
+
+func (db *Database) Scan(ctx context.Context, path string, visitor func(ctx context.Context, key string, val []byte) bool) error {
+	return db.scanFrom(ctx, prefixBucket, []byte(path), func(ctx context.Context, key, val []byte) error {
+		if !visitor(ctx, string(key), val) {
+			return errScanDone
+		}
+		return nil
+	})
+}
+
+// Stream implements database.DB. Unlike badger, bolt does not support
+// concurrent iteration and hence the visitor is never called concurrently.
+func (db *Database) Stream(ctx context.Context, path string, visitor func(ctx context.Context, key string, val []byte)) error {
+	prefix := []byte(path)
+	return db.scanFrom(ctx, prefixBucket, prefix, func(ctx context.Context, key, val []byte) error {
+		if !bytes.HasPrefix(key, prefix) {
+			return errScanDone
+		}
+		visitor(ctx, string(key), val)
+		return nil
+	})
+}
+
+func (db *Database) LogError(ctx context.Context, pl types.ErrorPayload) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(errorBucket)
+		key := []byte(pl.Key)
+		pl.Attempts = 1
+		if val := b.Get(key); val != nil {
+			var prev types.ErrorPayload
+			if err := types.Decode(val, &prev); err == nil {
+				// Errors recorded before attempts were counted will
+				// have a zero attempt count.
+				pl.Attempts = max(prev.Attempts, 1) + 1
+			}
+		}
+		var buf bytes.Buffer
+		if err := types.Encode(&buf, pl); err != nil {
+			return err
+		}
+		return b.Put(key, buf.Bytes())
+	})
+}
+
+func (db *Database) SetError(ctx context.Context, pl types.ErrorPayload) error {
+	var buf bytes.Buffer
+	if err := types.Encode(&buf, pl); err != nil {
+		return err
+	}
+	return db.set(ctx, errorBucket, []byte(pl.Key), buf.Bytes())
+}
+
+func (db *Database) VisitErrors(ctx context.Context, key string,
+	visitor func(ctx context.Context, pl types.ErrorPayload) bool) error {
+	return db.scanFrom(ctx, errorBucket, []byte(key), func(ctx context.Context, _, val []byte) error {
+		var pl types.ErrorPayload
+		if err := types.Decode(val, &pl); err != nil {
+			return err
+		}
+		if !visitor(ctx, pl) {
+			return errScanDone
+		}
+		return nil
+	})
+}
+
+func (db *Database) CheckRecords(ctx context.Context, visitor func(ctx context.Context, kind, key string, err error) bool) error {
+	type record struct {
+		bucket []byte
+		key    []byte
+	}
+	var remove []record
+	for _, b := range []struct {
+		name   []byte
+		kind   string
+		decode func([]byte) error
+	}{
+		{errorBucket, "error", func(v []byte) error {
+			var pl types.ErrorPayload
+			return types.Decode(v, &pl)
+		}},
+		{logBucket, "log", func(v []byte) error {
+			var pl types.LogPayload
+			return types.Decode(v, &pl)
+		}},
+	} {
+		err := db.scanFrom(ctx, b.name, nil, func(ctx context.Context, key, val []byte) error {
+			if err := b.decode(val); err != nil {
+				if visitor(ctx, b.kind, string(key), err) {
+					remove = append(remove, record{b.name, bytes.Clone(key)})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(remove) == 0 {
+		return nil
+	}
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		for _, r := range remove {
+			if err := tx.Bucket(r.bucket).Delete(r.key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *Database) Log(ctx context.Context, start, stop time.Time, detail []byte) error {
+	pl := types.LogPayload{
+		Start:   start,
+		Stop:    stop,
+		Payload: detail,
+	}
+	var buf bytes.Buffer
+	if err := types.Encode(&buf, pl); err != nil {
+		return err
+	}
+	return db.set(ctx, logBucket, []byte(start.Format(time.RFC3339)), buf.Bytes())
+}
+
+func (db *Database) LastLog(ctx context.Context) (start, stop time.Time, detail []byte, err error) {
+	if err := db.canceled(ctx); err != nil {
+		return time.Time{}, time.Time{}, nil, err
+	}
+	var pl types.LogPayload
+	err = db.bdb.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(logBucket)
+		if b == nil {
+			return fmt.Errorf("no log entries")
+		}
+		k, v := b.Cursor().Last()
+		if k == nil {
+			return fmt.Errorf("no log entries")
+		}
+		return types.Decode(v, &pl)
+	})
+	if err != nil {
+		return time.Time{}, time.Time{}, nil, err
+	}
+	return pl.Start, pl.Stop, pl.Payload, nil
+}
+
+func (db *Database) VisitLogs(ctx context.Context, start, stop time.Time, visitor func(ctx context.Context, begin, end time.Time, detail []byte) bool) error {
+	stopKey := []byte(stop.Format(time.RFC3339))
+	return db.scanFrom(ctx, logBucket, []byte(start.Format(time.RFC3339)), func(ctx context.Context, key, val []byte) error {
+		if bytes.Compare(key, stopKey) > 0 {
+			return errScanDone
+		}
+		var pl types.LogPayload
+		if err := types.Decode(val, &pl); err != nil {
+			return err
+		}
+		if !visitor(ctx, pl.Start, pl.Stop, pl.Payload) {
+			return errScanDone
+		}
+		return nil
+	})
+}
+
+func (db *Database) SetHash(ctx context.Context, key types.HashKey, hash []byte) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	return db.batch.set(hashBucket, key.Bytes(), hash)
+}
+
+func (db *Database) GetHash(ctx context.Context, key types.HashKey, buf *bytes.Buffer) error {
+	return db.get(ctx, hashBucket, key.Bytes(), buf)
+}
+
+func (db *Database) DeleteHash(ctx context.Context, key types.HashKey) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(hashBucket).Delete(key.Bytes())
+	})
+}
+
+func (db *Database) VisitHashes(ctx context.Context, visitor func(ctx context.Context, key types.HashKey, hash []byte) bool) error {
+	return db.scanFrom(ctx, hashBucket, nil, func(ctx context.Context, key, val []byte) error {
+		hk, err := types.ParseHashKey(key)
+		if err != nil {
+			return err
+		}
+		if !visitor(ctx, hk, val) {
+			return errScanDone
+		}
+		return nil
+	})
+}
+
+func (db *Database) SetMetadata(ctx context.Context, key string, val []byte) error {
+	return db.set(ctx, metadataBucket, []byte(key), val)
+}
+
+func (db *Database) GetMetadata(ctx context.Context, key string, buf *bytes.Buffer) error {
+	return db.get(ctx, metadataBucket, []byte(key), buf)
+}
+
+// VisitRecords implements database.DB.
+func (db *Database) VisitRecords(ctx context.Context, visitor func(ctx context.Context, bucket string, key, val []byte) bool) error {
+	for _, name := range database.Buckets {
+		done := false
+		err := db.scanFrom(ctx, []byte(name), nil, func(ctx context.Context, key, val []byte) error {
+			if !visitor(ctx, name, key, val) {
+				done = true
+				return errScanDone
+			}
+			return nil
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetRecord implements database.DB.
+func (db *Database) SetRecord(ctx context.Context, bucket string, key, val []byte) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	name, ok := bucketFor(bucket)
+	if !ok {
+		return fmt.Errorf("unknown bucket: %v", bucket)
+	}
+	return db.batch.set(name, key, val)
+}
+
+// Snapshot implements database.DB. The snapshot is a copy of the database
+// file made within a single read transaction and hence concurrent updates
+// to this database are not included in it.
+func (db *Database) Snapshot(ctx context.Context, location string) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	if err := db.batch.flush(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(location); err == nil {
+		return fmt.Errorf("%v: already exists", location)
+	}
+	if err := os.MkdirAll(location, 0770); err != nil {
+		return err
+	}
+	return db.bdb.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(filepath.Join(location, dbFilename), 0660)
+	})
+}
+
+// Close closes the database.
+func (db *Database) Close(_ context.Context) error {
+	db.unlockMu.Lock()
+	defer db.unlockMu.Unlock()
+	if db.unlock == nil {
+		return nil
+	}
+	var errs cerrors.M
+	errs.Append(db.batch.flush())
+	errs.Append(db.bdb.Close())
+	db.unlock()
+	db.unlock = nil
+	return errs.Err()
+}
+
+// Stats implements database.DB. The sizes reported are those of the
+// bolt database file and all other files such as the lock file.
+func (db *Database) Stats(ctx context.Context) (database.Stats, error) {
+	stats := database.Stats{
+		Sizes: map[string]int64{"data": 0, "other": 0},
+		Keys:  map[string]int64{},
+	}
+	for _, name := range database.Buckets {
+		stats.Keys[name] = 0
+	}
+	entries, err := os.ReadDir(db.location)
+	if err != nil {
+		return stats, err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if entry.Name() == dbFilename {
+			stats.Sizes["data"] += info.Size()
+			continue
+		}
+		stats.Sizes["other"] += info.Size()
+	}
+	err = db.bdb.View(func(tx *bolt.Tx) error {
+		for _, name := range database.Buckets {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if b := tx.Bucket([]byte(name)); b != nil {
+				stats.Keys[name] = int64(b.Stats().KeyN)
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// compactionTxSize is the maximum size of each of the transactions
+// used to copy the database when compacting it.
+const compactionTxSize = 64 * 1024 * 1024
+
+// Compact implements database.DB. Bolt never shrinks its database file,
+// instead the free pages left by deleted values are reused, and hence
+// the database is compacted by copying it to a new file that then
+// replaces the original.
+func (db *Database) Compact(ctx context.Context) error {
+	if db.Options.ReadOnly {
+		return fmt.Errorf("%v: cannot compact a database opened in read-only mode", db.location)
+	}
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	if err := db.batch.flush(); err != nil {
+		return err
+	}
+	tmp := db.filename + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0660, &bolt.Options{})
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, db.bdb, compactionTxSize); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := db.bdb.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, db.filename); err != nil {
+		return err
+	}
+	return db.open()
+}
+
+func (db *Database) Clear(ctx context.Context, logs, errors bool) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		for _, b := range []struct {
+			name  []byte
+			clear bool
+		}{{logBucket, logs}, {errorBucket, errors}} {
+			if !b.clear {
+				continue
+			}
+			if err := tx.DeleteBucket(b.name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(b.name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package boltdb_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/boltdb"
+)
+
+func countPrefixes(t *testing.T, db database.DB) int {
+	n := 0
+	err := db.Scan(context.Background(), "", func(context.Context, string, []byte) bool {
+		n++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	db, err := boltdb.Open(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1003; i++ {
+				if err := db.Set(ctx, fmt.Sprintf("/%v/%08v", g, i), []byte(fmt.Sprintf("%08v", i)), true); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = boltdb.Open(tmpdir, boltdb.ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	if got, want := countPrefixes(t, db), 4*1003; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	db, err := boltdb.Open(filepath.Join(tmpdir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	for i := 0; i < 10; i++ {
+		if err := db.Set(ctx, fmt.Sprintf("/%02v", i), []byte("v"), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := filepath.Join(tmpdir, "snapshot")
+	// Pending batched writes are included in the snapshot.
+	if err := db.Snapshot(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Snapshot(ctx, snapshot); err == nil {
+		t.Errorf("expected an error for an existing snapshot")
+	}
+	// Writes made after the snapshot are not.
+	if err := db.Set(ctx, "/10", []byte("v"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	sdb, err := boltdb.Open(snapshot, boltdb.ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close(ctx)
+	if got, want := countPrefixes(t, sdb), 10; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := countPrefixes(t, db), 11; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// History keys are of the form <prefix>\x00<time>, as for badger, where
+// time is the big-endian unix nanosecond time at which the version was
+// superseded.
+
+func historyKey(prefix string, when time.Time) []byte {
+	k := make([]byte, 0, len(prefix)+9)
+	k = append(k, prefix...)
+	k = append(k, 0x00)
+	return binary.BigEndian.AppendUint64(k, uint64(when.UnixNano()))
+}
+
+// historyLimit returns a key that is ordered after all of the versions
+// of prefix.
+func historyLimit(prefix string) []byte {
+	return append([]byte(prefix), 0x01)
+}
+
+func parseHistoryKey(key []byte) (prefix string, when time.Time, ok bool) {
+	if len(key) < 9 || key[len(key)-9] != 0x00 {
+		return "", time.Time{}, false
+	}
+	ns := binary.BigEndian.Uint64(key[len(key)-8:])
+	return string(key[:len(key)-9]), time.Unix(0, int64(ns)), true
+}
+
+// SetHistory implements database.DB.
+func (db *Database) SetHistory(ctx context.Context, prefix string, when time.Time, val []byte) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		key := historyKey(prefix, when)
+		if b.Get(key) != nil {
+			return nil
+		}
+		return b.Put(key, bytes.Clone(val))
+	})
+}
+
+// versionAsOf returns the value of the first version of prefix that was
+// superseded after when, ok is false if there is no such version.
+func versionAsOf(c *bolt.Cursor, prefix string, when time.Time) (val []byte, ok bool) {
+	k, v := c.Seek(historyKey(prefix, when.Add(time.Nanosecond)))
+	if k == nil {
+		return nil, false
+	}
+	if p, _, valid := parseHistoryKey(k); !valid || p != prefix {
+		return nil, false
+	}
+	return bytes.Clone(v), true
+}
+
+// GetAsOf implements database.DB.
+func (db *Database) GetAsOf(ctx context.Context, prefix string, when time.Time, buf *bytes.Buffer) error {
+	if err := db.canceled(ctx); err != nil {
+		return err
+	}
+	return db.bdb.View(func(tx *bolt.Tx) error {
+		if hb := tx.Bucket(historyBucket); hb != nil {
+			if val, ok := versionAsOf(hb.Cursor(), prefix, when); ok {
+				buf.Write(val)
+				return nil
+			}
+		}
+		if pb := tx.Bucket(prefixBucket); pb != nil {
+			buf.Write(pb.Get([]byte(prefix)))
+		}
+		return nil
+	})
+}
+
+// ScanAsOf implements database.DB. It merges the prefix and history
+// buckets, using the first version of each prefix superseded after
+// when, if any, in place of its current value.
+func (db *Database) ScanAsOf(ctx context.Context, key string, when time.Time, visitor func(ctx context.Context, key string, val []byte) bool) error {
+	return db.bdb.View(func(tx *bolt.Tx) error {
+		pb, hb := tx.Bucket(prefixBucket), tx.Bucket(historyBucket)
+		if pb == nil || hb == nil {
+			return nil
+		}
+		cur, hist, lookup := pb.Cursor(), hb.Cursor(), hb.Cursor()
+		ck, cv := cur.Seek([]byte(key))
+		hk, _ := hist.Seek([]byte(key))
+		for {
+			var histKey string
+			histOK := false
+			if hk != nil {
+				histKey, _, histOK = parseHistoryKey(hk)
+			}
+			curOK := ck != nil
+			if !curOK && !histOK {
+				return nil
+			}
+			var k string
+			switch {
+			case !histOK:
+				k = string(ck)
+			case !curOK:
+				k = histKey
+			default:
+				k = min(string(ck), histKey)
+			}
+			var val []byte
+			var ok bool
+			if histOK && histKey == k {
+				val, ok = versionAsOf(lookup, k, when)
+				// Skip over all of the versions of k.
+				hk, _ = hist.Seek(historyLimit(k))
+			}
+			if curOK && string(ck) == k {
+				if !ok {
+					val = cv
+				}
+				ck, cv = cur.Next()
+			}
+			if len(val) > 0 && !visitor(ctx, k, val) {
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// DeleteHistory implements database.DB.
+func (db *Database) DeleteHistory(ctx context.Context, before time.Time) (int64, error) {
+	var keys [][]byte
+	err := db.scanFrom(ctx, historyBucket, nil, func(_ context.Context, key, _ []byte) error {
+		_, when, ok := parseHistoryKey(key)
+		if !ok {
+			return errScanDone
+		}
+		if when.Before(before) {
+			keys = append(keys, bytes.Clone(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = db.bdb.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return int64(len(keys)), err
+}
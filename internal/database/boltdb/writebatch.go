@@ -0,0 +1,71 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"slices"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// maxBatchRecords is the number of records that are accumulated before
+// being written to the database in a single transaction.
+const maxBatchRecords = 1000
+
+type batchRecord struct {
+	bucket, key, val []byte
+}
+
+// writeBatch accumulates writes so that they may be written in a single
+// transaction, since every bolt transaction that writes to the database
+// must wait for that write to be synced to disk.
+type writeBatch struct {
+	mu      sync.Mutex
+	bdb     *bolt.DB
+	pending []batchRecord
+}
+
+func newWriteBatch(bdb *bolt.DB) *writeBatch {
+	return &writeBatch{bdb: bdb}
+}
+
+func (wb *writeBatch) set(bucket, key, value []byte) error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	wb.pending = append(wb.pending, batchRecord{
+		bucket: bucket,
+		key:    slices.Clone(key),
+		val:    slices.Clone(value),
+	})
+	if len(wb.pending) < maxBatchRecords {
+		return nil
+	}
+	return wb.flushLocked()
+}
+
+// flush writes all pending records to the database. Unlike badger's
+// write batches, the writeBatch may continue to be used after a flush.
+func (wb *writeBatch) flush() error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	return wb.flushLocked()
+}
+
+func (wb *writeBatch) flushLocked() error {
+	if len(wb.pending) == 0 {
+		return nil
+	}
+	err := wb.bdb.Update(func(tx *bolt.Tx) error {
+		for _, r := range wb.pending {
+			if err := tx.Bucket(r.bucket).Put(r.key, r.val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	wb.pending = wb.pending[:0]
+	return err
+}
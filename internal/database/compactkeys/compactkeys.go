@@ -0,0 +1,420 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package compactkeys provides an implementation of database.DB that
+// stores the keys of the prefix bucket in a compact form, as the ID of
+// their parent prefix followed by their final path component, rather than
+// as full paths, using any other implementation of database.DB to store
+// them. This reduces the size of databases for deep trees with long paths
+// since the leading components of every path are no longer repeated in
+// each of the keys stored beneath them. However, since every compact key
+// includes the 16 byte ID of its parent, the saving is only worthwhile for
+// databases, such as bolt, that store every key in full. Databases, such
+// as badger, that already share the common leading bytes of adjacent keys
+// gain little or nothing and may even grow.
+//
+// The ID of a prefix is derived from a hash of its full path and hence
+// can be computed without any lookups. However, since the full path of
+// a prefix can no longer be recovered from its stored key alone, every
+// ancestor of a stored prefix must itself be stored so that the keys can
+// be enumerated by walking the tree from its root. Ancestors that are not
+// otherwise stored, eg. those above the prefix being analyzed, are stored
+// as placeholders with empty values that are never returned by Get, Scan
+// or Stream. Consequently empty values cannot be stored using Set.
+//
+// Scan and Stream visit keys in the same order, and with the same
+// semantics, as for full path keys but do so by walking the tree and hence
+// require a lookup per stored prefix rather than a single sequential scan.
+//
+// The retained versions of prefixes, ie. history, are not supported.
+package compactkeys
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/database"
+)
+
+// Marker is the first byte of every compact key and can never be the
+// first byte of a full path key. It allows keys of both forms to coexist
+// in the same database, for example, whilst it is being migrated.
+const Marker = "\x00"
+
+// idSize is the number of bytes of the hash of a prefix's path that are
+// used as its ID.
+const idSize = 16
+
+type id [idSize]byte
+
+// topID is the ID of the notional parent of keys that do not contain
+// a separator, such as the empty key that is the parent of /usr for
+// unix paths.
+var topID id
+
+func pathID(path string) id {
+	sum := sha256.Sum256([]byte(path))
+	var i id
+	copy(i[:], sum[:idSize])
+	return i
+}
+
+func childPrefix(dir id) string {
+	return Marker + string(dir[:])
+}
+
+// scanBatchSize is the number of children of a prefix that are read from
+// the underlying database at a time when walking the tree.
+const scanBatchSize = 256
+
+// maxKnown is the number of prefixes recorded as known to be stored before
+// the oldest are forgotten.
+const maxKnown = 64 * 1024
+
+// ErrHistoryNotSupported is returned by the methods that store or query
+// the retained versions of prefixes.
+var ErrHistoryNotSupported = errors.New("history is not supported for databases that use compact keys")
+
+// DB is a database.DB that stores the keys of the prefix bucket in compact
+// form in the database.DB that it embeds, all other methods are passed
+// through to the embedded database unchanged.
+type DB struct {
+	database.DB
+	sep string
+
+	mu sync.Mutex
+	// known and prev record the IDs of the prefixes that are known to
+	// be stored and hence whose ancestors need not be checked. When known
+	// grows too large it replaces prev, so that the most recently stored
+	// prefixes are always remembered.
+	known, prev map[id]struct{}
+}
+
+// New returns a DB that stores compact keys, using separator to split
+// keys into path components, in db.
+func New(db database.DB, separator string) *DB {
+	return &DB{
+		DB:    db,
+		sep:   separator,
+		known: map[id]struct{}{},
+	}
+}
+
+// split returns the parent ID and final component of key and the string
+// that all of the keys of its siblings start with.
+func (db *DB) split(key string) (parent id, base, name string) {
+	idx := strings.LastIndex(key, db.sep)
+	if idx < 0 {
+		return topID, "", key
+	}
+	return pathID(key[:idx]), key[:idx+len(db.sep)], key[idx+len(db.sep):]
+}
+
+// Key returns the compact form of key.
+func (db *DB) Key(key string) string {
+	parent, _, name := db.split(key)
+	return childPrefix(parent) + name
+}
+
+func (db *DB) isKnown(i id) bool {
+	if _, ok := db.known[i]; ok {
+		return true
+	}
+	_, ok := db.prev[i]
+	return ok
+}
+
+func (db *DB) setKnown(i id) {
+	if len(db.known) >= maxKnown {
+		db.prev, db.known = db.known, map[id]struct{}{}
+	}
+	db.known[i] = struct{}{}
+}
+
+// forget records that the prefixes with the specified IDs, or all
+// prefixes if none are specified, are no longer stored.
+func (db *DB) forget(ids ...id) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(ids) == 0 {
+		db.prev, db.known = nil, map[id]struct{}{}
+		return
+	}
+	for _, i := range ids {
+		delete(db.known, i)
+		delete(db.prev, i)
+	}
+}
+
+// ensureParents stores a placeholder for each ancestor of key that is not
+// already stored. key is recorded as known before it is stored so that
+// a placeholder can never replace a value that has been written via a
+// batch that has yet to be committed.
+func (db *DB) ensureParents(ctx context.Context, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.setKnown(pathID(key))
+	var buf bytes.Buffer
+	for {
+		idx := strings.LastIndex(key, db.sep)
+		if idx < 0 {
+			return nil
+		}
+		key = key[:idx]
+		pid := pathID(key)
+		if db.isKnown(pid) {
+			return nil
+		}
+		ck := db.Key(key)
+		buf.Reset()
+		if err := db.DB.Get(ctx, ck, &buf); err != nil {
+			return err
+		}
+		if buf.Len() > 0 {
+			db.setKnown(pid)
+			return nil
+		}
+		if err := db.DB.Set(ctx, ck, nil, false); err != nil {
+			return err
+		}
+		db.setKnown(pid)
+	}
+}
+
+// Set implements database.DB. val must not be empty.
+func (db *DB) Set(ctx context.Context, prefix string, val []byte, batch bool) error {
+	if err := db.ensureParents(ctx, prefix); err != nil {
+		return err
+	}
+	return db.DB.Set(ctx, db.Key(prefix), val, batch)
+}
+
+// Get implements database.DB.
+func (db *DB) Get(ctx context.Context, prefix string, buf *bytes.Buffer) error {
+	return db.DB.Get(ctx, db.Key(prefix), buf)
+}
+
+type child struct {
+	name string
+	val  []byte
+}
+
+// children calls visitor for each of the children of the prefix with
+// the specified ID in name order, starting at from. The children are read
+// in batches so that visitor may itself read from the database.
+func (db *DB) children(ctx context.Context, dir id, from string, visitor func(name string, val []byte) bool) error {
+	prefix := childPrefix(dir)
+	start := prefix + from
+	for {
+		batch := make([]child, 0, scanBatchSize)
+		err := db.DB.Scan(ctx, start, func(_ context.Context, key string, val []byte) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			batch = append(batch, child{name: key[len(prefix):], val: bytes.Clone(val)})
+			return len(batch) < scanBatchSize
+		})
+		if err != nil {
+			return err
+		}
+		for _, c := range batch {
+			if !visitor(c.name, c.val) {
+				return nil
+			}
+		}
+		if len(batch) < scanBatchSize {
+			return nil
+		}
+		start = prefix + batch[len(batch)-1].name + "\x00"
+	}
+}
+
+// Scan implements database.DB.
+func (db *DB) Scan(ctx context.Context, key string, visitor func(ctx context.Context, key string, val []byte) bool) error {
+	_, err := db.scan(ctx, topID, "", key, visitor)
+	return err
+}
+
+// scan visits, in key order, every key that is greater than or equal to
+// start and is stored beneath the prefix with the specified ID, all of
+// whose keys start with base. It returns false if the visitor asked
+// for the scan to stop.
+//
+// Within a prefix, a child is visited as the key base+name and the
+// keys stored beneath it all start with base+name+separator, so the
+// children and the subtrees beneath them are visited in the order of
+// those strings. The children are read in name order and hence in order
+// themselves, but a subtree may need to be visited after some of the
+// children that follow the one it is beneath, eg. a/b sorts after a-c,
+// so the subtrees are kept in order until all of the keys that precede
+// them have been visited.
+func (db *DB) scan(ctx context.Context, dir id, base, start string, visitor func(ctx context.Context, key string, val []byte) bool) (bool, error) {
+	subtreeRelevant := func(path string) bool {
+		st := path + db.sep
+		return st >= start || strings.HasPrefix(start, st)
+	}
+	var pending []string
+	push := func(path string) {
+		idx, _ := slices.BinarySearchFunc(pending, path, func(a, b string) int {
+			return strings.Compare(a+db.sep, b+db.sep)
+		})
+		pending = slices.Insert(pending, idx, path)
+	}
+	visitPending := func(before string, all bool) (bool, error) {
+		for len(pending) > 0 && (all || pending[0]+db.sep < before) {
+			path := pending[0]
+			pending = pending[1:]
+			if ok, err := db.scan(ctx, pathID(path), path+db.sep, start, visitor); !ok || err != nil {
+				return ok, err
+			}
+		}
+		return true, nil
+	}
+	// Only the children whose names are greater than or equal to the
+	// first byte of the remainder of start, or are empty, can be
+	// relevant since any other child, and every key beneath it, sorts
+	// before start.
+	from := ""
+	if rel, ok := strings.CutPrefix(start, base); ok && len(rel) > 0 {
+		from = rel[:1]
+		if subtreeRelevant(base) {
+			push(base)
+		}
+	}
+	cont := true
+	var verr error
+	err := db.children(ctx, dir, from, func(name string, val []byte) bool {
+		path := base + name
+		if cont, verr = visitPending(path, false); !cont || verr != nil {
+			return false
+		}
+		if len(val) > 0 && path >= start {
+			if cont = visitor(ctx, path, val); !cont {
+				return false
+			}
+		}
+		if subtreeRelevant(path) {
+			push(path)
+		}
+		return true
+	})
+	if err != nil || verr != nil || !cont {
+		return cont, errors.Join(err, verr)
+	}
+	return visitPending("", true)
+}
+
+// Stream implements database.DB. The visitor is never called concurrently.
+func (db *DB) Stream(ctx context.Context, prefix string, visitor func(ctx context.Context, key string, val []byte)) error {
+	return db.Scan(ctx, prefix, func(ctx context.Context, key string, val []byte) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		visitor(ctx, key, val)
+		return true
+	})
+}
+
+func (db *DB) hasChildren(ctx context.Context, path string) (bool, error) {
+	found := false
+	err := db.children(ctx, pathID(path), "", func(string, []byte) bool {
+		found = true
+		return false
+	})
+	return found, err
+}
+
+// Delete implements database.DB. A placeholder is retained for a prefix
+// that has keys stored beneath it.
+func (db *DB) Delete(ctx context.Context, prefix string) error {
+	found, err := db.hasChildren(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if found {
+		return db.DB.Set(ctx, db.Key(prefix), nil, false)
+	}
+	db.forget(pathID(prefix))
+	return db.DB.Delete(ctx, db.Key(prefix))
+}
+
+// DeletePrefix implements database.DB. All of the keys that start with
+// prefix are the children of its parent whose names start with its final
+// component, and the keys stored beneath them.
+func (db *DB) DeletePrefix(ctx context.Context, prefix string) error {
+	if len(prefix) == 0 {
+		db.forget()
+		return db.DB.DeletePrefix(ctx, Marker)
+	}
+	parent, base, name := db.split(prefix)
+	matched, err := db.childNames(ctx, parent, name)
+	if err != nil {
+		return err
+	}
+	for _, m := range matched {
+		if err := db.DB.Delete(ctx, childPrefix(parent)+m); err != nil {
+			return err
+		}
+		if err := db.deleteBeneath(ctx, base+m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// childNames returns the names of the children of the prefix with the
+// specified ID that start with prefix.
+func (db *DB) childNames(ctx context.Context, dir id, prefix string) ([]string, error) {
+	var names []string
+	err := db.children(ctx, dir, prefix, func(name string, _ []byte) bool {
+		if !strings.HasPrefix(name, prefix) {
+			return false
+		}
+		names = append(names, name)
+		return true
+	})
+	return names, err
+}
+
+func (db *DB) deleteBeneath(ctx context.Context, path string) error {
+	dir := pathID(path)
+	db.forget(dir)
+	names, err := db.childNames(ctx, dir, "")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := db.deleteBeneath(ctx, path+db.sep+name); err != nil {
+			return err
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return db.DB.DeletePrefix(ctx, childPrefix(dir))
+}
+
+// SetHistory implements database.DB, it always returns
+// ErrHistoryNotSupported.
+func (db *DB) SetHistory(context.Context, string, time.Time, []byte) error {
+	return ErrHistoryNotSupported
+}
+
+// GetAsOf implements database.DB, it always returns
+// ErrHistoryNotSupported.
+func (db *DB) GetAsOf(context.Context, string, time.Time, *bytes.Buffer) error {
+	return ErrHistoryNotSupported
+}
+
+// ScanAsOf implements database.DB, it always returns
+// ErrHistoryNotSupported.
+func (db *DB) ScanAsOf(context.Context, string, time.Time, func(ctx context.Context, key string, val []byte) bool) error {
+	return ErrHistoryNotSupported
+}
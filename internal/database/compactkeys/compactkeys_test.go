@@ -0,0 +1,215 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package compactkeys_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/compactkeys"
+	"cloudeng.io/cmd/idu/internal/database/memdb"
+)
+
+func open(t *testing.T, location string) database.DB {
+	t.Cleanup(func() { memdb.Remove(location) })
+	db, err := memdb.Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newDatabases returns a database that uses full path keys, which is used
+// as the oracle, and one that uses compact keys.
+func newDatabases(t *testing.T) (oracle database.DB, compact *compactkeys.DB) {
+	dir := t.TempDir()
+	return open(t, filepath.Join(dir, "oracle")), compactkeys.New(open(t, filepath.Join(dir, "compact")), "/")
+}
+
+func scan(t *testing.T, db database.DB, start string, n int) []string {
+	var found []string
+	err := db.Scan(context.Background(), start, func(_ context.Context, key string, val []byte) bool {
+		found = append(found, key+"="+string(val))
+		return n < 0 || len(found) < n
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func stream(t *testing.T, db database.DB, prefix string) []string {
+	var found []string
+	err := db.Stream(context.Background(), prefix, func(_ context.Context, key string, val []byte) {
+		found = append(found, key+"="+string(val))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(found)
+	return found
+}
+
+// trickyKeys includes keys whose order differs from that of a depth first
+// traversal of the tree, eg. /a/b sorts after /a-c, keys that do not
+// contain a separator, empty components and trailing separators.
+var trickyKeys = []string{
+	"/", "/a", "/a/b", "/a/b/c", "/a-c", "/a-c/x", "/a.b", "/a/b-c", "/a/b.c/d",
+	"/a0", "/a/", "/a//b", "//", "/b", "/b/a", "/b/a/b/c/d/e", "/ab", "/ab/c",
+	"nosep", "nosep-x", "rel/ative", "rel-ative", "/\x01", "/\xff/a", "/z",
+	"/usr/local/bin", "/usr/local", "/usr/lib", "/usr/lib64", "/usr/lib/x",
+}
+
+func compareAll(t *testing.T, oracle, compact database.DB, keys []string) {
+	t.Helper()
+	ctx := context.Background()
+	if got, want := scan(t, compact, "", -1), scan(t, oracle, "", -1); !reflect.DeepEqual(got, want) {
+		t.Fatalf("scan: got %v, want %v", got, want)
+	}
+	starts := append(slices.Clone(keys), "", "/", "/a/b/", "/a/a", "/a0/", "/c", "/\x00", "/a\x00", "0", "~", "/a/b/c/d")
+	for _, k := range keys {
+		starts = append(starts, k[:len(k)/2], k+"\x00", k+"/", k+"0")
+	}
+	for _, start := range starts {
+		for _, n := range []int{-1, 1, 3} {
+			if got, want := scan(t, compact, start, n), scan(t, oracle, start, n); !reflect.DeepEqual(got, want) {
+				t.Fatalf("scan from %q (%v): got %v, want %v", start, n, got, want)
+			}
+		}
+		if got, want := stream(t, compact, start), stream(t, oracle, start); !reflect.DeepEqual(got, want) {
+			t.Fatalf("stream %q: got %v, want %v", start, got, want)
+		}
+	}
+	for _, k := range starts {
+		var got, want bytes.Buffer
+		if err := compact.Get(ctx, k, &got); err != nil {
+			t.Fatal(err)
+		}
+		if err := oracle.Get(ctx, k, &want); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("get %q: got %q, want %q", k, got.String(), want.String())
+		}
+	}
+}
+
+func set(t *testing.T, dbs []database.DB, key, val string) {
+	for _, db := range dbs {
+		if err := db.Set(context.Background(), key, []byte(val), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTrickyKeys(t *testing.T) {
+	ctx := context.Background()
+	oracle, compact := newDatabases(t)
+	dbs := []database.DB{oracle, compact}
+	for i, k := range trickyKeys {
+		set(t, dbs, k, fmt.Sprintf("v%v", i))
+	}
+	compareAll(t, oracle, compact, trickyKeys)
+
+	// Every key stored in the underlying database is compact.
+	err := compact.DB.Scan(ctx, "", func(_ context.Context, key string, _ []byte) bool {
+		if !strings.HasPrefix(key, compactkeys.Marker) {
+			t.Errorf("%q is not a compact key", key)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"/a/b", "/usr/lib", "/", "nosep", "/notthere"} {
+		for _, db := range dbs {
+			if err := db.Delete(ctx, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		compareAll(t, oracle, compact, trickyKeys)
+	}
+	for _, p := range []string{"/a/b", "/a-", "/usr/lib", "/b/a/b/c/d/e", "rel", "/notthere", "/a"} {
+		for _, db := range dbs {
+			if err := db.DeletePrefix(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		compareAll(t, oracle, compact, trickyKeys)
+	}
+
+	// Keys can be stored again beneath prefixes that have been deleted.
+	set(t, dbs, "/a/b/c", "again")
+	set(t, dbs, "/usr/lib/y", "again")
+	compareAll(t, oracle, compact, trickyKeys)
+
+	for _, db := range dbs {
+		if err := db.DeletePrefix(ctx, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compareAll(t, oracle, compact, trickyKeys)
+	if got := scan(t, compact.DB, "", -1); len(got) != 0 {
+		t.Errorf("got %v, want an empty database", got)
+	}
+
+	if err := compact.SetHistory(ctx, "/a", time.Now(), nil); err != compactkeys.ErrHistoryNotSupported {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRandomTrees(t *testing.T) {
+	ctx := context.Background()
+	seed := time.Now().UnixNano()
+	rnd := rand.New(rand.NewSource(seed))
+	components := []string{"a", "b", "a-b", "a.b", "ab", "", "z", "\x01", "0"}
+	randomKey := func() string {
+		var sb strings.Builder
+		for range rnd.Intn(5) + 1 {
+			sb.WriteString("/")
+			sb.WriteString(components[rnd.Intn(len(components))])
+		}
+		return sb.String()
+	}
+	for i := 0; i < 20; i++ {
+		oracle, compact := newDatabases(t)
+		dbs := []database.DB{oracle, compact}
+		var keys []string
+		for j := 0; j < 200; j++ {
+			k := randomKey()
+			keys = append(keys, k)
+			set(t, dbs, k, fmt.Sprintf("%v", j))
+			switch rnd.Intn(10) {
+			case 0:
+				p := randomKey()
+				p = p[:rnd.Intn(len(p)+1)]
+				for _, db := range dbs {
+					if err := db.DeletePrefix(ctx, p); err != nil {
+						t.Fatal(err)
+					}
+				}
+			case 1:
+				k := keys[rnd.Intn(len(keys))]
+				for _, db := range dbs {
+					if err := db.Delete(ctx, k); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+		t.Logf("seed: %v", seed)
+		compareAll(t, oracle, compact, keys)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"context"
+	"slices"
+)
+
+// Copy copies every record stored in src to dst, which may be of a
+// different type, and returns the number of records copied from each
+// bucket. dst must be closed before the copied records can be relied
+// upon, see SetRecord.
+func Copy(ctx context.Context, dst, src DB) (map[string]int64, error) {
+	counts := map[string]int64{}
+	for _, b := range Buckets {
+		counts[b] = 0
+	}
+	var err error
+	verr := src.VisitRecords(ctx, func(ctx context.Context, bucket string, key, val []byte) bool {
+		if err = dst.SetRecord(ctx, bucket, slices.Clone(key), slices.Clone(val)); err != nil {
+			return false
+		}
+		counts[bucket]++
+		return true
+	})
+	if err != nil {
+		return counts, err
+	}
+	return counts, verr
+}
@@ -17,6 +17,10 @@ import (
 
 	"cloudeng.io/cmd/idu/internal/database"
 	"cloudeng.io/cmd/idu/internal/database/badgerdb"
+	"cloudeng.io/cmd/idu/internal/database/boltdb"
+	"cloudeng.io/cmd/idu/internal/database/compactkeys"
+	"cloudeng.io/cmd/idu/internal/database/memdb"
+	"cloudeng.io/cmd/idu/internal/database/types"
 	"github.com/dgraph-io/badger/v4"
 	"golang.org/x/exp/slices"
 )
@@ -38,6 +42,39 @@ func badgerFactory(t *testing.T, dir, _ string, readonly bool) database.DB {
 	return db
 }
 
+func boltFactory(t *testing.T, dir, _ string, readonly bool) database.DB {
+	t.Helper()
+	dbname := filepath.Join(dir, "boltdb")
+	opts := []boltdb.Option{}
+	if readonly {
+		opts = append(opts, boltdb.ReadOnly())
+	}
+	db, err := boltdb.Open(dbname, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func memFactory(t *testing.T, dir, _ string, readonly bool) database.DB {
+	t.Helper()
+	dbname := filepath.Join(dir, "memdb")
+	t.Cleanup(func() { memdb.Remove(dbname) })
+	opts := []memdb.Option{}
+	if readonly {
+		opts = append(opts, memdb.ReadOnly())
+	}
+	db, err := memdb.Open(dbname, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func compactFactory(t *testing.T, dir, prefix string, readonly bool) database.DB {
+	return compactkeys.New(boltFactory(t, dir, prefix, readonly), "/")
+}
+
 type databaseFactory func(t *testing.T, dir, prefix string, readonly bool) database.DB
 
 func populateDatabase(t *testing.T, db database.DB, nItems int) {
@@ -62,7 +99,7 @@ func populateDatabase(t *testing.T, db database.DB, nItems int) {
 	if err := <-ch; err != nil {
 		t.Fatal(err)
 	}
-	_ = db.LogError(ctx, "/a/01", time.Now(), []byte("error"))
+	_ = db.LogError(ctx, types.ErrorPayload{Key: "/a/01", When: time.Now(), Payload: []byte("error")})
 	_ = db.Log(ctx, time.Now(), time.Now(), []byte("log"))
 	db.Close(ctx)
 }
@@ -84,6 +121,9 @@ func validatePopulatedDatabase(t *testing.T, found []string, nItems int) {
 
 func TestScan(t *testing.T) {
 	testScan(t, badgerFactory)
+	testScan(t, boltFactory)
+	testScan(t, memFactory)
+	testScan(t, compactFactory)
 }
 
 func testScan(t *testing.T, factory databaseFactory) {
@@ -165,6 +205,8 @@ func testScan(t *testing.T, factory databaseFactory) {
 
 func TestLogAndClose(t *testing.T) {
 	testLogAndClose(t, badgerFactory)
+	testLogAndClose(t, boltFactory)
+	testLogAndClose(t, memFactory)
 }
 
 func testLogAndClose(t *testing.T, factory databaseFactory) {
@@ -226,6 +268,8 @@ func testLogAndClose(t *testing.T, factory databaseFactory) {
 
 func TestErrors(t *testing.T) {
 	testErrors(t, badgerFactory)
+	testErrors(t, boltFactory)
+	testErrors(t, memFactory)
 }
 
 func testErrors(t *testing.T, factory databaseFactory) {
@@ -242,25 +286,56 @@ func testErrors(t *testing.T, factory databaseFactory) {
 	for i, when := range times {
 		key := fmt.Sprintf("/%02v", i)
 		op := fmt.Sprintf("%02v", i)
-		if err := db.LogError(ctx, key, when, []byte(op)); err != nil {
+		pl := types.ErrorPayload{
+			Key:       key,
+			When:      when,
+			Payload:   []byte(op),
+			Operation: types.OpLstat,
+			Category:  types.ErrorPermission,
+			Errno:     int64(i),
+		}
+		if err := db.LogError(ctx, pl); err != nil {
 			t.Fatal(err)
 		}
 	}
+	// Log the last error again to increment its attempt count.
+	if err := db.LogError(ctx, types.ErrorPayload{Key: "/02", When: t3, Payload: []byte("02"), Attempts: 10}); err != nil {
+		t.Fatal(err)
+	}
 
-	match := func(i int, _ string, when time.Time, detail []byte) {
-		if got, want := when, times[i]; !got.Equal(want) {
+	match := func(i int, pl types.ErrorPayload) {
+		if got, want := pl.When, times[i]; !got.Equal(want) {
 			t.Errorf("got %v, want %v", got, want)
 		}
 		op := fmt.Sprintf("%02v", i)
-		if got, want := detail, []byte(op); !bytes.Equal(got, want) {
+		if got, want := pl.Payload, []byte(op); !bytes.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		attempts := int64(1)
+		if i == 2 {
+			attempts = 2
+		}
+		if got, want := pl.Attempts, attempts; got != want {
+			t.Errorf("%v: got %v, want %v", pl.Key, got, want)
+		}
+		if i == 2 {
+			return
+		}
+		if got, want := pl.Operation, types.OpLstat; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := pl.Category, types.ErrorPermission; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := pl.Errno, int64(i); got != want {
 			t.Errorf("got %v, want %v", got, want)
 		}
 	}
 
 	entries := 1
 	err := db.VisitErrors(ctx, "/01",
-		func(_ context.Context, key string, when time.Time, detail []byte) bool {
-			match(entries, key, when, detail)
+		func(_ context.Context, pl types.ErrorPayload) bool {
+			match(entries, pl)
 			entries++
 			return true
 		})
@@ -275,8 +350,8 @@ func testErrors(t *testing.T, factory databaseFactory) {
 func visitAllErrors(ctx context.Context, t *testing.T, db database.DB) []string {
 	keys := map[string]struct{}{}
 	err := db.VisitErrors(ctx, "",
-		func(_ context.Context, key string, _ time.Time, _ []byte) bool {
-			keys[key] = struct{}{}
+		func(_ context.Context, pl types.ErrorPayload) bool {
+			keys[pl.Key] = struct{}{}
 			return true
 		})
 	if err != nil {
@@ -292,6 +367,8 @@ func visitAllErrors(ctx context.Context, t *testing.T, db database.DB) []string
 
 func TestErrorsDelete(t *testing.T) {
 	testErrorsDelete(t, badgerFactory)
+	testErrorsDelete(t, boltFactory)
+	testErrorsDelete(t, memFactory)
 }
 
 func testErrorsDelete(t *testing.T, factory databaseFactory) {
@@ -305,7 +382,7 @@ func testErrorsDelete(t *testing.T, factory databaseFactory) {
 	for i := 0; i < 100; i++ {
 		op := fmt.Sprintf("%02v", i)
 		prefix := fmt.Sprintf("/%v/%v", i/10, i%10)
-		if err := db.LogError(ctx, prefix, now, []byte(op)); err != nil {
+		if err := db.LogError(ctx, types.ErrorPayload{Key: prefix, When: now, Payload: []byte(op)}); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -333,10 +410,42 @@ func testErrorsDelete(t *testing.T, factory databaseFactory) {
 			n++
 		}
 	}
+
+	// DeleteError only deletes the exact key.
+	if err := db.DeleteError(ctx, "/2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteError(ctx, "/2/3"); err != nil {
+		t.Fatal(err)
+	}
+	keys = visitAllErrors(ctx, t, db)
+	if got, want := len(keys), 89; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if slices.Contains(keys, "/2/3") {
+		t.Errorf("/2/3 was not deleted")
+	}
+
+	// SetError records the payload as is.
+	if err := db.SetError(ctx, types.ErrorPayload{Key: "/2/4", Attempts: 7}); err != nil {
+		t.Fatal(err)
+	}
+	err := db.VisitErrors(ctx, "/2/4", func(_ context.Context, pl types.ErrorPayload) bool {
+		if got, want := pl.Attempts, int64(7); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestDelete(t *testing.T) {
 	testDelete(t, badgerFactory)
+	testDelete(t, boltFactory)
+	testDelete(t, memFactory)
+	testDelete(t, compactFactory)
 }
 
 func testDelete(t *testing.T, factory databaseFactory) {
@@ -382,10 +491,27 @@ func testDelete(t *testing.T, factory databaseFactory) {
 		t.Fatal(err)
 	}
 
+	// Delete only deletes the exact key.
+	if err := db.Delete(ctx, "/02"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := scan(), left; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := db.Delete(ctx, "/020"); err != nil {
+		t.Fatal(err)
+	}
+	left = slices.Delete(left, 10, 11)
+	if got, want := scan(), left; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
 }
 
 func TestExists(t *testing.T) {
 	testExists(t, badgerFactory)
+	testExists(t, boltFactory)
+	testExists(t, memFactory)
+	testExists(t, compactFactory)
 }
 
 func testExists(t *testing.T, factory databaseFactory) {
@@ -403,3 +529,366 @@ func testExists(t *testing.T, factory databaseFactory) {
 		t.Errorf("got %v, want nil", k)
 	}
 }
+
+func TestHashes(t *testing.T) {
+	testHashes(t, badgerFactory)
+	testHashes(t, boltFactory)
+	testHashes(t, memFactory)
+}
+
+func testHashes(t *testing.T, factory databaseFactory) {
+	ctx := context.Background()
+	prefix := "/filesytem-prefix"
+	tmpdir := t.TempDir()
+	db := factory(t, tmpdir, prefix, false)
+
+	now := time.Now()
+	key := types.HashKey{Device: 1, Inode: 2, ModTime: now}
+	if err := db.SetHash(ctx, key, []byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(ctx, "/a", []byte("a"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	db = factory(t, tmpdir, prefix, true)
+	defer func() { db.Close(ctx) }()
+
+	get := func(key types.HashKey) string {
+		var buf bytes.Buffer
+		if err := db.GetHash(ctx, key, &buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	if got, want := get(key), "hash"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The hash must not be used once the file has been modified.
+	if got, want := get(types.HashKey{Device: 1, Inode: 2, ModTime: now.Add(time.Second)}), ""; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := get(types.HashKey{Device: 2, Inode: 2, ModTime: now}), ""; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Hashes must not be visible as prefixes.
+	keys := []string{}
+	err := db.Scan(ctx, "", func(_ context.Context, k string, _ []byte) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := keys, []string{"/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var visited []types.HashKey
+	err = db.VisitHashes(ctx, func(_ context.Context, k types.HashKey, hash []byte) bool {
+		if got, want := string(hash), "hash"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		visited = append(visited, k)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(visited), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := visited[0].Bytes(), key.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	db = factory(t, tmpdir, prefix, false)
+	if err := db.DeleteHash(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(key), ""; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStatsAndCompact(t *testing.T) {
+	testStatsAndCompact(t, badgerFactory)
+	testStatsAndCompact(t, boltFactory)
+	testStatsAndCompact(t, memFactory)
+}
+
+func testStatsAndCompact(t *testing.T, factory databaseFactory) {
+	ctx := context.Background()
+	prefix := "/filesytem-prefix"
+	tmpdir := t.TempDir()
+	populateDatabase(t, factory(t, tmpdir, prefix, false), 100)
+
+	db := factory(t, tmpdir, prefix, true)
+	stats, err := db.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Keys, map[string]int64{"inode": 0, "prefix": 200, "log": 1, "error": 1, "hash": 0, "metadata": 0, "history": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if stats.Size() == 0 {
+		t.Errorf("zero size database")
+	}
+	if err := db.Compact(ctx); err == nil {
+		t.Errorf("expected an error compacting a read-only database")
+	}
+	db.Close(ctx)
+
+	db = factory(t, tmpdir, prefix, false)
+	defer db.Close(ctx)
+	if err := db.DeletePrefix(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = db.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Keys["prefix"], int64(100); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	testMetadata(t, badgerFactory)
+	testMetadata(t, boltFactory)
+	testMetadata(t, memFactory)
+}
+
+func testMetadata(t *testing.T, factory databaseFactory) {
+	ctx := context.Background()
+	prefix := "/filesytem-prefix"
+	tmpdir := t.TempDir()
+	db := factory(t, tmpdir, prefix, false)
+	var buf bytes.Buffer
+	if err := db.GetMetadata(ctx, "version", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.Len(), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := db.SetMetadata(ctx, "version", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(ctx, "version", []byte("prefix"), false); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(ctx)
+
+	db = factory(t, tmpdir, prefix, true)
+	defer db.Close(ctx)
+	if err := db.GetMetadata(ctx, "version", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "1"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Metadata must not be visible as a prefix.
+	var keys []string
+	if err := db.Scan(ctx, "", func(_ context.Context, key string, _ []byte) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := keys, []string{"version"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	stats, err := db.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Keys["metadata"], int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	testHistory(t, badgerFactory)
+	testHistory(t, boltFactory)
+	testHistory(t, memFactory)
+}
+
+func testHistory(t *testing.T, factory databaseFactory) {
+	ctx := context.Background()
+	prefix := "/filesytem-prefix"
+	db := factory(t, t.TempDir(), prefix, false)
+	defer db.Close(ctx)
+
+	set := func(k, v string) {
+		if err := db.Set(ctx, k, []byte(v), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	retain := func(k string, when time.Time) {
+		var buf bytes.Buffer
+		if err := db.Get(ctx, k, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetHistory(ctx, k, when, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scan := func(when time.Time) []string {
+		var kv []string
+		err := db.ScanAsOf(ctx, "", when, func(_ context.Context, k string, v []byte) bool {
+			kv = append(kv, k+"="+string(v))
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return kv
+	}
+	get := func(k string, when time.Time) string {
+		var buf bytes.Buffer
+		if err := db.GetAsOf(ctx, k, when, &buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	run0 := time.Now()
+	run1 := run0.Add(time.Hour)
+	run2 := run1.Add(time.Hour)
+	set("/a", "a0")
+	set("/a/b", "b0")
+	set("/a/c", "c0")
+
+	// run1 changes /a, deletes /a/b and creates /a/bb and /a/b0.
+	retain("/a", run1)
+	set("/a", "a1")
+	retain("/a/b", run1)
+	if err := db.Delete(ctx, "/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"/a/bb", "/a/b0"} {
+		retain(k, run1)
+		set(k, k[3:]+"1")
+	}
+	// Only the first version retained for a given run is kept.
+	retain("/a", run1)
+
+	// run2 changes /a again.
+	retain("/a", run2)
+	set("/a", "a2")
+
+	between := run1.Add(-time.Minute)
+	if got, want := scan(between), []string{"/a=a0", "/a/b=b0", "/a/c=c0"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := scan(run1), []string{"/a=a1", "/a/b0=b01", "/a/bb=bb1", "/a/c=c0"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := scan(run2), []string{"/a=a2", "/a/b0=b01", "/a/bb=bb1", "/a/c=c0"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, tc := range []struct {
+		key  string
+		when time.Time
+		val  string
+	}{
+		{"/a", between, "a0"},
+		{"/a", run1, "a1"},
+		{"/a", run2, "a2"},
+		{"/a/b", between, "b0"},
+		{"/a/b", run1, ""},
+		{"/a/bb", between, ""},
+		{"/a/bb", run2, "bb1"},
+		{"/a/c", between, "c0"},
+	} {
+		if got, want := get(tc.key, tc.when), tc.val; got != want {
+			t.Errorf("%v @ %v: got %v, want %v", tc.key, tc.when, got, want)
+		}
+	}
+
+	n, err := db.DeleteHistory(ctx, run2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, int64(4); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := scan(run1), []string{"/a=a1", "/a/b0=b01", "/a/bb=bb1", "/a/c=c0"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	stats, err := db.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Keys["history"], int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	testCopy(t, badgerFactory, boltFactory)
+	testCopy(t, boltFactory, badgerFactory)
+	testCopy(t, memFactory, boltFactory)
+	testCopy(t, badgerFactory, memFactory)
+}
+
+func testCopy(t *testing.T, srcFactory, dstFactory databaseFactory) {
+	ctx := context.Background()
+	prefix := "/filesytem-prefix"
+	tmpdir := t.TempDir()
+	populateDatabase(t, srcFactory(t, tmpdir, prefix, false), 10)
+	src := srcFactory(t, tmpdir, prefix, false)
+	defer src.Close(ctx)
+	if err := src.SetMetadata(ctx, "version", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetHistory(ctx, "/a/01", time.Now(), []byte("a1-prev")); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetHash(ctx, types.HashKey{Device: 1, Inode: 2, ModTime: time.Now()}, []byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	src.Close(ctx)
+	src = srcFactory(t, tmpdir, prefix, true)
+
+	records := func(db database.DB) []string {
+		var recs []string
+		err := db.VisitRecords(ctx, func(_ context.Context, bucket string, key, val []byte) bool {
+			recs = append(recs, fmt.Sprintf("%v:%q=%q", bucket, key, val))
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return recs
+	}
+
+	dstDir := t.TempDir()
+	dst := dstFactory(t, dstDir, prefix, false)
+	counts, err := database.Copy(ctx, dst, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := counts, map[string]int64{"inode": 0, "prefix": 20, "log": 1, "error": 1, "hash": 1, "metadata": 1, "history": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	dst = dstFactory(t, dstDir, prefix, true)
+	defer dst.Close(ctx)
+	if got, want := records(dst), records(src); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	src.Close(ctx)
+}
@@ -8,6 +8,8 @@ import (
 	"bytes"
 	"context"
 	"time"
+
+	"cloudeng.io/cmd/idu/internal/database/types"
 )
 
 // ReadOnly requests that the database is opened in read-only mode.
@@ -31,6 +33,30 @@ type Options[T any] struct {
 	Sub       T
 }
 
+// Stats describes the storage used by a database and the number of keys
+// stored in each of its buckets.
+type Stats struct {
+	// Sizes is the on-disk size, in bytes, of each component of the
+	// database, eg. the LSM tree and the value log for badger.
+	Sizes map[string]int64
+	// Keys is the number of keys stored in each bucket, eg. prefix,
+	// log or error.
+	Keys map[string]int64
+}
+
+// Size returns the total on-disk size of the database.
+func (s Stats) Size() int64 {
+	var total int64
+	for _, size := range s.Sizes {
+		total += size
+	}
+	return total
+}
+
+// Buckets lists the names of the buckets, ie. partitions of the key
+// space, that every database is divided into.
+var Buckets = []string{"inode", "prefix", "log", "error", "hash", "metadata", "history"}
+
 // DB represents a database.
 type DB interface {
 	// Set stores the value associated with prefix. If batch is true then
@@ -45,9 +71,17 @@ type DB interface {
 	// DeletePrefix deletes all keys that have the specified prefix.
 	DeletePrefix(ctx context.Context, prefix string) error
 
+	// Delete deletes the value, if any, stored for exactly the
+	// specified prefix.
+	Delete(ctx context.Context, prefix string) error
+
 	// DeleteErrors deletes all errors that have the specified prefix.
 	DeleteErrors(ctx context.Context, prefix string) error
 
+	// DeleteError deletes the error, if any, recorded for exactly the
+	// specified key.
+	DeleteError(ctx context.Context, key string) error
+
 	// Scan can be used to iterate over all keys in the database starting at
 	// the specified key.
 	Scan(ctx context.Context, key string, visitor func(ctx context.Context, key string, val []byte) bool) error
@@ -69,13 +103,95 @@ type DB interface {
 	VisitLogs(ctx context.Context, start, stop time.Time,
 		visitor func(ctx context.Context, begin, end time.Time, detail []byte) bool) error
 
-	// LogError records an error.
-	LogError(ctx context.Context, key string, when time.Time, detail []byte) error
+	// LogError records an error. The Attempts field of the supplied
+	// payload is ignored, instead it is set to one more than that of
+	// any error already recorded for the same key, or to one otherwise.
+	LogError(ctx context.Context, pl types.ErrorPayload) error
+
+	// SetError records pl exactly as supplied, including its Attempts
+	// field, replacing any error already recorded for the same key. It is
+	// intended for restoring errors rather than recording new ones.
+	SetError(ctx context.Context, pl types.ErrorPayload) error
 
 	// VisitErrors calls visitor for every error starting at key. The
 	// visitor func should return false if it wants to stop the iteration over
 	// errors.
-	VisitErrors(ctx context.Context, key string, visitor func(ctx context.Context, key string, when time.Time, val []byte) bool) error
+	VisitErrors(ctx context.Context, key string, visitor func(ctx context.Context, pl types.ErrorPayload) bool) error
+
+	// SetHash stores the content hash of the file identified by key.
+	SetHash(ctx context.Context, key types.HashKey, hash []byte) error
+
+	// GetHash retrieves the content hash, if any, stored for the file
+	// identified by key, storing it in the supplied bytes.Buffer.
+	GetHash(ctx context.Context, key types.HashKey, buf *bytes.Buffer) error
+
+	// DeleteHash deletes the content hash, if any, stored for the file
+	// identified by key.
+	DeleteHash(ctx context.Context, key types.HashKey) error
+
+	// VisitHashes calls visitor for every stored content hash. The
+	// visitor func should return false if it wants to stop the iteration
+	// over hashes.
+	VisitHashes(ctx context.Context, visitor func(ctx context.Context, key types.HashKey, hash []byte) bool) error
+
+	// SetMetadata stores a value that describes the database itself,
+	// such as its schema version, rather than any of its contents.
+	SetMetadata(ctx context.Context, key string, val []byte) error
+
+	// GetMetadata retrieves the metadata value, if any, stored for key,
+	// storing it in the supplied bytes.Buffer.
+	GetMetadata(ctx context.Context, key string, buf *bytes.Buffer) error
+
+	// SetHistory retains val as the version of prefix that was superseded
+	// at the specified time; an empty val records that prefix did not
+	// exist before then. Only the first version retained for a given
+	// prefix and time is kept.
+	SetHistory(ctx context.Context, prefix string, when time.Time, val []byte) error
+
+	// GetAsOf is like Get except that it retrieves the value that was
+	// associated with prefix at the specified time, using the retained
+	// versions of prefix.
+	GetAsOf(ctx context.Context, prefix string, when time.Time, buf *bytes.Buffer) error
+
+	// ScanAsOf is like Scan except that it visits the prefixes, and their
+	// values, that were stored at the specified time.
+	ScanAsOf(ctx context.Context, key string, when time.Time, visitor func(ctx context.Context, key string, val []byte) bool) error
+
+	// DeleteHistory deletes all retained versions that were superseded
+	// before the specified time and returns the number deleted.
+	DeleteHistory(ctx context.Context, before time.Time) (int64, error)
+
+	// CheckRecords decodes every error and log record, calling visitor
+	// with the kind of record ("error" or "log"), its key and the decoding
+	// error for each one that cannot be decoded. Records for which
+	// the visitor returns true are deleted.
+	CheckRecords(ctx context.Context, visitor func(ctx context.Context, kind, key string, err error) bool) error
+
+	// Stats returns the storage used by the database and the number of
+	// keys stored in each of its buckets.
+	Stats(ctx context.Context) (Stats, error)
+
+	// Compact reclaims the storage used by deleted and overwritten
+	// values. The database must not have been opened in read-only mode.
+	Compact(ctx context.Context) error
+
+	// VisitRecords calls visitor for every record stored in the database
+	// with the name of the bucket it is stored in, see Buckets, and its
+	// key and value, in bucket and then key order. The key and value
+	// are only valid for the duration of the call to visitor. The visitor
+	// func should return false if it wants to stop the iteration.
+	VisitRecords(ctx context.Context, visitor func(ctx context.Context, bucket string, key, val []byte) bool) error
+
+	// SetRecord stores a record, as returned by VisitRecords, exactly as
+	// supplied. It is intended for copying records between databases and
+	// its writes may be batched and hence are only guaranteed to be stored
+	// once the database is closed.
+	SetRecord(ctx context.Context, bucket string, key, val []byte) error
+
+	// Snapshot writes a consistent copy of the database to location,
+	// which must not already exist, that can subsequently be opened
+	// independently of this database, typically in read-only mode.
+	Snapshot(ctx context.Context, location string) error
 
 	// Clear clears all of the log or error entries.
 	Clear(ctx context.Context, logs, errors bool) error
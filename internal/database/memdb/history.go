@@ -0,0 +1,152 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package memdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+// History keys are of the form <prefix>\x00<time>, as for badger and bolt,
+// where time is the big-endian unix nanosecond time at which the version
+// was superseded.
+
+func historyKey(prefix string, when time.Time) string {
+	k := make([]byte, 0, len(prefix)+9)
+	k = append(k, prefix...)
+	k = append(k, 0x00)
+	return string(binary.BigEndian.AppendUint64(k, uint64(when.UnixNano())))
+}
+
+func parseHistoryKey(key string) (prefix string, when time.Time, ok bool) {
+	if len(key) < 9 || key[len(key)-9] != 0x00 {
+		return "", time.Time{}, false
+	}
+	ns := binary.BigEndian.Uint64([]byte(key[len(key)-8:]))
+	return key[:len(key)-9], time.Unix(0, int64(ns)), true
+}
+
+// SetHistory implements database.DB.
+func (db *Database) SetHistory(ctx context.Context, prefix string, when time.Time, val []byte) error {
+	if err := db.check(ctx, true); err != nil {
+		return err
+	}
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+	b := db.store.buckets[historyBucket]
+	key := historyKey(prefix, when)
+	if !b.Has(record{key: key}) {
+		b.ReplaceOrInsert(record{key: key, val: bytes.Clone(val)})
+	}
+	return nil
+}
+
+// GetAsOf implements database.DB.
+func (db *Database) GetAsOf(ctx context.Context, prefix string, when time.Time, buf *bytes.Buffer) error {
+	found := false
+	err := db.scanFrom(ctx, historyBucket, historyKey(prefix, when.Add(time.Nanosecond)), func(r record) bool {
+		if p, _, ok := parseHistoryKey(r.key); ok && p == prefix {
+			buf.Write(r.val)
+			found = true
+		}
+		return false
+	})
+	if err != nil || found {
+		return err
+	}
+	return db.Get(ctx, prefix, buf)
+}
+
+// version is the value of a prefix as of a given time, found is false if
+// no version was superseded after that time, in which case the current
+// value, if any, applies.
+type version struct {
+	prefix string
+	val    []byte
+	found  bool
+}
+
+// versionsAsOf returns the versions of every prefix, starting at key, that
+// has retained history, in prefix order.
+func (db *Database) versionsAsOf(ctx context.Context, key string, when time.Time) ([]version, error) {
+	var versions []version
+	err := db.scanFrom(ctx, historyBucket, key, func(r record) bool {
+		p, superseded, ok := parseHistoryKey(r.key)
+		if !ok {
+			return true
+		}
+		if n := len(versions); n == 0 || versions[n-1].prefix != p {
+			versions = append(versions, version{prefix: p})
+		}
+		// Versions are ordered by time and hence the first one to have
+		// been superseded after when is the one that applies.
+		if v := &versions[len(versions)-1]; !v.found && superseded.After(when) {
+			v.val, v.found = r.val, true
+		}
+		return true
+	})
+	return versions, err
+}
+
+// ScanAsOf implements database.DB. It merges the prefix and history
+// buckets, using the first version of each prefix superseded after
+// when, if any, in place of its current value.
+func (db *Database) ScanAsOf(ctx context.Context, key string, when time.Time, visitor func(ctx context.Context, key string, val []byte) bool) error {
+	versions, err := db.versionsAsOf(ctx, key, when)
+	if err != nil {
+		return err
+	}
+	visit := func(k string, val []byte) bool {
+		return len(val) == 0 || visitor(ctx, k, val)
+	}
+	i, more := 0, true
+	err = db.scanFrom(ctx, prefixBucket, key, func(r record) bool {
+		for ; i < len(versions) && versions[i].prefix < r.key; i++ {
+			if more = visit(versions[i].prefix, versions[i].val); !more {
+				return false
+			}
+		}
+		val := r.val
+		if i < len(versions) && versions[i].prefix == r.key {
+			if versions[i].found {
+				val = versions[i].val
+			}
+			i++
+		}
+		more = visit(r.key, val)
+		return more
+	})
+	if err != nil || !more {
+		return err
+	}
+	for ; i < len(versions); i++ {
+		if !visit(versions[i].prefix, versions[i].val) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// DeleteHistory implements database.DB.
+func (db *Database) DeleteHistory(ctx context.Context, before time.Time) (int64, error) {
+	var keys []string
+	err := db.scanFrom(ctx, historyBucket, "", func(r record) bool {
+		if _, when, ok := parseHistoryKey(r.key); ok && when.Before(before) {
+			keys = append(keys, r.key)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		if err := db.delete(ctx, historyBucket, k); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(keys)), nil
+}
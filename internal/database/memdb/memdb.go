@@ -0,0 +1,527 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package memdb provides an in-memory implementation of database.DB that
+// is intended for tests and benchmarks. Databases are identified by their
+// location, as for the on-disk implementations, and live until they are
+// removed or the process exits; opening the same location again, from
+// within the same process, returns a database that shares its contents
+// with any other opened for that location.
+package memdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/types"
+	"github.com/google/btree"
+)
+
+// Option represents a specific option accepted by Open.
+type Option func(o *database.Options[Options])
+
+var ReadOnly = database.ReadOnly[Options]
+var WithTimeout = database.WithTimeout[Options]
+
+// Options is empty since there are no options specific to the in-memory
+// database, it exists for consistency with the other implementations.
+type Options struct{}
+
+type record struct {
+	key string
+	val []byte
+}
+
+func lessRecord(a, b record) bool {
+	return a.key < b.key
+}
+
+// btreeDegree is the degree of the btrees used to store each bucket.
+const btreeDegree = 32
+
+type bucket = btree.BTreeG[record]
+
+// Each of the buckets listed in database.Buckets is stored as a separate
+// btree using the same keys as the bolt database.
+const (
+	prefixBucket   = "prefix"
+	logBucket      = "log"
+	errorBucket    = "error"
+	hashBucket     = "hash"
+	metadataBucket = "metadata"
+	historyBucket  = "history"
+)
+
+func newBucket() *bucket {
+	return btree.NewG(btreeDegree, lessRecord)
+}
+
+// store holds the contents of a database, one btree per bucket, keyed
+// by the bucket names in database.Buckets.
+type store struct {
+	mu      sync.RWMutex
+	buckets map[string]*bucket
+}
+
+func newStore() *store {
+	s := &store{buckets: map[string]*bucket{}}
+	for _, name := range database.Buckets {
+		s.buckets[name] = newBucket()
+	}
+	return s
+}
+
+var registry = struct {
+	sync.Mutex
+	stores map[string]*store
+}{stores: map[string]*store{}}
+
+// Remove discards the database, if any, stored at location.
+func Remove(location string) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.stores, location)
+}
+
+// Exists returns true if there is a database stored at location.
+func Exists(location string) bool {
+	registry.Lock()
+	defer registry.Unlock()
+	_, ok := registry.stores[location]
+	return ok
+}
+
+// Database represents an in-memory database.
+type Database struct {
+	database.Options[Options]
+	location string
+	store    *store
+	closedMu sync.Mutex
+	closed   bool
+}
+
+// Open opens the in-memory database stored at location. If the database
+// does not exist it will be created, unless it is being opened in
+// read-only mode in which case an error is returned.
+func Open[T Options](location string, opts ...Option) (database.DB, error) {
+	db := &Database{location: location}
+	for _, fn := range opts {
+		fn(&db.Options)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	s, ok := registry.stores[location]
+	if !ok {
+		if db.Options.ReadOnly {
+			return nil, fmt.Errorf("%v: in-memory database does not exist", location)
+		}
+		s = newStore()
+		registry.stores[location] = s
+	}
+	db.store = s
+	return db, nil
+}
+
+// check returns an error if the context is canceled, the database is closed
+// or if write is true and the database was opened in read-only mode.
+func (db *Database) check(ctx context.Context, write bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.closedMu.Lock()
+	closed := db.closed
+	db.closedMu.Unlock()
+	if closed {
+		return fmt.Errorf("%v: database is closed", db.location)
+	}
+	if write && db.Options.ReadOnly {
+		return fmt.Errorf("%v: database was opened in read-only mode", db.location)
+	}
+	return nil
+}
+
+func (db *Database) set(ctx context.Context, name, key string, val []byte) error {
+	if err := db.check(ctx, true); err != nil {
+		return err
+	}
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+	db.store.buckets[name].ReplaceOrInsert(record{key: key, val: bytes.Clone(val)})
+	return nil
+}
+
+func (db *Database) get(ctx context.Context, name, key string, buf *bytes.Buffer) error {
+	if err := db.check(ctx, false); err != nil {
+		return err
+	}
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+	if r, ok := db.store.buckets[name].Get(record{key: key}); ok {
+		buf.Write(r.val)
+	}
+	return nil
+}
+
+func (db *Database) delete(ctx context.Context, name, key string) error {
+	if err := db.check(ctx, true); err != nil {
+		return err
+	}
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+	db.store.buckets[name].Delete(record{key: key})
+	return nil
+}
+
+// snapshot returns a copy-on-write clone of the named bucket so that it
+// can be iterated over without holding a lock, and hence allows visitors
+// to access the database.
+func (db *Database) snapshot(name string) *bucket {
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+	return db.store.buckets[name].Clone()
+}
+
+// scanFrom calls visitor for every record in the named bucket starting
+// at start until the visitor returns false or the context is canceled.
+func (db *Database) scanFrom(ctx context.Context, name, start string, visitor func(r record) bool) error {
+	if err := db.check(ctx, false); err != nil {
+		return err
+	}
+	db.snapshot(name).AscendGreaterOrEqual(record{key: start}, func(r record) bool {
+		return visitor(r) && ctx.Err() == nil
+	})
+	return ctx.Err()
+}
+
+func (db *Database) Set(ctx context.Context, prefix string, val []byte, _ bool) error {
+	return db.set(ctx, prefixBucket, prefix, val)
+}
+
+func (db *Database) Get(ctx context.Context, prefix string, buf *bytes.Buffer) error {
+	return db.get(ctx, prefixBucket, prefix, buf)
+}
+
+func (db *Database) deletePrefix(ctx context.Context, name, prefix string) error {
+	if err := db.check(ctx, true); err != nil {
+		return err
+	}
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+	b := db.store.buckets[name]
+	var keys []string
+	b.AscendGreaterOrEqual(record{key: prefix}, func(r record) bool {
+		if !strings.HasPrefix(r.key, prefix) {
+			return false
+		}
+		keys = append(keys, r.key)
+		return true
+	})
+	for _, k := range keys {
+		b.Delete(record{key: k})
+	}
+	return nil
+}
+
+func (db *Database) DeletePrefix(ctx context.Context, prefix string) error {
+	return db.deletePrefix(ctx, prefixBucket, prefix)
+}
+
+func (db *Database) Delete(ctx context.Context, prefix string) error {
+	return db.delete(ctx, prefixBucket, prefix)
+}
+
+func (db *Database) DeleteErrors(ctx context.Context, prefix string) error {
+	return db.deletePrefix(ctx, errorBucket, prefix)
+}
+
+func (db *Database) DeleteError(ctx context.Context, key string) error {
+	return db.delete(ctx, errorBucket, key)
+}
+
+func (db *Database) Scan(ctx context.Context, path string, visitor func(ctx context.Context, key string, val []byte) bool) error {
+	return db.scanFrom(ctx, prefixBucket, path, func(r record) bool {
+		return visitor(ctx, r.key, r.val)
+	})
+}
+
+// Stream implements database.DB. The visitor is never called concurrently.
+func (db *Database) Stream(ctx context.Context, path string, visitor func(ctx context.Context, key string, val []byte)) error {
+	return db.scanFrom(ctx, prefixBucket, path, func(r record) bool {
+		if !strings.HasPrefix(r.key, path) {
+			return false
+		}
+		visitor(ctx, r.key, r.val)
+		return true
+	})
+}
+
+func (db *Database) LogError(ctx context.Context, pl types.ErrorPayload) error {
+	if err := db.check(ctx, true); err != nil {
+		return err
+	}
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+	b := db.store.buckets[errorBucket]
+	pl.Attempts = 1
+	if r, ok := b.Get(record{key: pl.Key}); ok {
+		var prev types.ErrorPayload
+		if err := types.Decode(r.val, &prev); err == nil {
+			pl.Attempts = max(prev.Attempts, 1) + 1
+		}
+	}
+	var buf bytes.Buffer
+	if err := types.Encode(&buf, pl); err != nil {
+		return err
+	}
+	b.ReplaceOrInsert(record{key: pl.Key, val: buf.Bytes()})
+	return nil
+}
+
+func (db *Database) SetError(ctx context.Context, pl types.ErrorPayload) error {
+	var buf bytes.Buffer
+	if err := types.Encode(&buf, pl); err != nil {
+		return err
+	}
+	return db.set(ctx, errorBucket, pl.Key, buf.Bytes())
+}
+
+func (db *Database) VisitErrors(ctx context.Context, key string,
+	visitor func(ctx context.Context, pl types.ErrorPayload) bool) error {
+	var err error
+	serr := db.scanFrom(ctx, errorBucket, key, func(r record) bool {
+		var pl types.ErrorPayload
+		if err = types.Decode(r.val, &pl); err != nil {
+			return false
+		}
+		return visitor(ctx, pl)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func (db *Database) CheckRecords(ctx context.Context, visitor func(ctx context.Context, kind, key string, err error) bool) error {
+	for _, b := range []struct {
+		name   string
+		decode func([]byte) error
+	}{
+		{errorBucket, func(v []byte) error {
+			var pl types.ErrorPayload
+			return types.Decode(v, &pl)
+		}},
+		{logBucket, func(v []byte) error {
+			var pl types.LogPayload
+			return types.Decode(v, &pl)
+		}},
+	} {
+		var remove []string
+		err := db.scanFrom(ctx, b.name, "", func(r record) bool {
+			if err := b.decode(r.val); err != nil {
+				if visitor(ctx, b.name, r.key, err) {
+					remove = append(remove, r.key)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range remove {
+			if err := db.delete(ctx, b.name, k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *Database) Log(ctx context.Context, start, stop time.Time, detail []byte) error {
+	pl := types.LogPayload{
+		Start:   start,
+		Stop:    stop,
+		Payload: detail,
+	}
+	var buf bytes.Buffer
+	if err := types.Encode(&buf, pl); err != nil {
+		return err
+	}
+	return db.set(ctx, logBucket, start.Format(time.RFC3339), buf.Bytes())
+}
+
+func (db *Database) LastLog(ctx context.Context) (start, stop time.Time, detail []byte, err error) {
+	if err := db.check(ctx, false); err != nil {
+		return time.Time{}, time.Time{}, nil, err
+	}
+	db.store.mu.RLock()
+	r, ok := db.store.buckets[logBucket].Max()
+	db.store.mu.RUnlock()
+	if !ok {
+		return time.Time{}, time.Time{}, nil, fmt.Errorf("no log entries")
+	}
+	var pl types.LogPayload
+	if err := types.Decode(r.val, &pl); err != nil {
+		return time.Time{}, time.Time{}, nil, err
+	}
+	return pl.Start, pl.Stop, pl.Payload, nil
+}
+
+func (db *Database) VisitLogs(ctx context.Context, start, stop time.Time, visitor func(ctx context.Context, begin, end time.Time, detail []byte) bool) error {
+	stopKey := stop.Format(time.RFC3339)
+	var err error
+	serr := db.scanFrom(ctx, logBucket, start.Format(time.RFC3339), func(r record) bool {
+		if r.key > stopKey {
+			return false
+		}
+		var pl types.LogPayload
+		if err = types.Decode(r.val, &pl); err != nil {
+			return false
+		}
+		return visitor(ctx, pl.Start, pl.Stop, pl.Payload)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func (db *Database) SetHash(ctx context.Context, key types.HashKey, hash []byte) error {
+	return db.set(ctx, hashBucket, string(key.Bytes()), hash)
+}
+
+func (db *Database) GetHash(ctx context.Context, key types.HashKey, buf *bytes.Buffer) error {
+	return db.get(ctx, hashBucket, string(key.Bytes()), buf)
+}
+
+func (db *Database) DeleteHash(ctx context.Context, key types.HashKey) error {
+	return db.delete(ctx, hashBucket, string(key.Bytes()))
+}
+
+func (db *Database) VisitHashes(ctx context.Context, visitor func(ctx context.Context, key types.HashKey, hash []byte) bool) error {
+	var err error
+	serr := db.scanFrom(ctx, hashBucket, "", func(r record) bool {
+		var hk types.HashKey
+		if hk, err = types.ParseHashKey([]byte(r.key)); err != nil {
+			return false
+		}
+		return visitor(ctx, hk, r.val)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func (db *Database) SetMetadata(ctx context.Context, key string, val []byte) error {
+	return db.set(ctx, metadataBucket, key, val)
+}
+
+func (db *Database) GetMetadata(ctx context.Context, key string, buf *bytes.Buffer) error {
+	return db.get(ctx, metadataBucket, key, buf)
+}
+
+// VisitRecords implements database.DB.
+func (db *Database) VisitRecords(ctx context.Context, visitor func(ctx context.Context, bucket string, key, val []byte) bool) error {
+	for _, name := range database.Buckets {
+		done := false
+		err := db.scanFrom(ctx, name, "", func(r record) bool {
+			if !visitor(ctx, name, []byte(r.key), r.val) {
+				done = true
+			}
+			return !done
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetRecord implements database.DB.
+func (db *Database) SetRecord(ctx context.Context, bucket string, key, val []byte) error {
+	if _, ok := db.store.buckets[bucket]; !ok {
+		return fmt.Errorf("unknown bucket: %v", bucket)
+	}
+	return db.set(ctx, bucket, string(key), val)
+}
+
+// Snapshot implements database.DB. The snapshot is another in-memory
+// database, stored at location, that shares no state with this one.
+func (db *Database) Snapshot(ctx context.Context, location string) error {
+	if err := db.check(ctx, false); err != nil {
+		return err
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.stores[location]; ok {
+		return fmt.Errorf("%v: already exists", location)
+	}
+	s := &store{buckets: map[string]*bucket{}}
+	for _, name := range database.Buckets {
+		s.buckets[name] = db.snapshot(name)
+	}
+	registry.stores[location] = s
+	return nil
+}
+
+// Close implements database.DB. Closing the database does not discard
+// its contents, use Remove to do so.
+func (db *Database) Close(_ context.Context) error {
+	db.closedMu.Lock()
+	defer db.closedMu.Unlock()
+	db.closed = true
+	return nil
+}
+
+// Stats implements database.DB. The single size reported, "memory", is
+// the total size of the keys and values stored, which underestimates
+// the memory actually used.
+func (db *Database) Stats(ctx context.Context) (database.Stats, error) {
+	stats := database.Stats{
+		Sizes: map[string]int64{"memory": 0},
+		Keys:  map[string]int64{},
+	}
+	for _, name := range database.Buckets {
+		stats.Keys[name] = 0
+		err := db.scanFrom(ctx, name, "", func(r record) bool {
+			stats.Keys[name]++
+			stats.Sizes["memory"] += int64(len(r.key) + len(r.val))
+			return true
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// Compact implements database.DB. The storage used by deleted and
+// overwritten values is reclaimed by the garbage collector and hence
+// there is nothing to do.
+func (db *Database) Compact(ctx context.Context) error {
+	if db.Options.ReadOnly {
+		return fmt.Errorf("%v: cannot compact a database opened in read-only mode", db.location)
+	}
+	return db.check(ctx, true)
+}
+
+func (db *Database) Clear(ctx context.Context, logs, errors bool) error {
+	if err := db.check(ctx, true); err != nil {
+		return err
+	}
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+	if logs {
+		db.store.buckets[logBucket] = newBucket()
+	}
+	if errors {
+		db.store.buckets[errorBucket] = newBucket()
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package memdb_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/memdb"
+)
+
+func countPrefixes(t *testing.T, db database.DB) int {
+	n := 0
+	err := db.Scan(context.Background(), "", func(context.Context, string, []byte) bool {
+		n++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestShared(t *testing.T) {
+	ctx := context.Background()
+	location := t.Name()
+	defer memdb.Remove(location)
+
+	if _, err := memdb.Open(location, memdb.ReadOnly()); err == nil {
+		t.Errorf("expected an error opening a non-existent database in read-only mode")
+	}
+	db, err := memdb.Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1003; i++ {
+				if err := db.Set(ctx, fmt.Sprintf("/%v/%08v", g, i), []byte("v"), true); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(ctx, "/x", []byte("v"), false); err == nil {
+		t.Errorf("expected an error writing to a closed database")
+	}
+
+	rdb, err := memdb.Open(location, memdb.ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close(ctx)
+	if got, want := countPrefixes(t, rdb), 4*1003; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := rdb.Set(ctx, "/x", []byte("v"), false); err == nil {
+		t.Errorf("expected an error writing to a read-only database")
+	}
+
+	memdb.Remove(location)
+	if memdb.Exists(location) {
+		t.Errorf("%v: database was not removed", location)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	location, snapshot := t.Name(), t.Name()+"-snapshot"
+	defer memdb.Remove(location)
+	defer memdb.Remove(snapshot)
+	db, err := memdb.Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	for i := 0; i < 10; i++ {
+		if err := db.Set(ctx, fmt.Sprintf("/%02v", i), []byte("v"), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Snapshot(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Snapshot(ctx, snapshot); err == nil {
+		t.Errorf("expected an error for an existing snapshot")
+	}
+	// Writes made after the snapshot are not visible in it, and scans
+	// may write to the database being scanned.
+	err = db.Scan(ctx, "", func(ctx context.Context, key string, _ []byte) bool {
+		if err := db.Set(ctx, key+"/x", []byte("v"), false); err != nil {
+			t.Fatal(err)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sdb, err := memdb.Open(snapshot, memdb.ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close(ctx)
+	if got, want := countPrefixes(t, sdb), 10; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := countPrefixes(t, db), 20; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -6,14 +6,47 @@ package types
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"time"
 )
 
+// ErrorCategory is used to classify errors.
+type ErrorCategory string
+
+const (
+	ErrorPermission ErrorCategory = "permission"
+	ErrorNotExist   ErrorCategory = "not-exist"
+	ErrorIO         ErrorCategory = "io"
+	ErrorTimeout    ErrorCategory = "timeout"
+	ErrorOther      ErrorCategory = "other"
+)
+
+// ErrorCategories lists all of the supported error categories.
+var ErrorCategories = []ErrorCategory{
+	ErrorPermission, ErrorNotExist, ErrorIO, ErrorTimeout, ErrorOther}
+
+// Operations that may fail and hence be recorded in an ErrorPayload.
+const (
+	OpLstat   = "lstat"
+	OpReaddir = "readdir"
+	OpXAttr   = "xattr"
+	OpDB      = "db"
+)
+
+// ErrorPayload represents an error recorded in the database. Payload
+// contains the text of the error. Errors recorded before Operation,
+// Category, Errno and Attempts were introduced will have zero values
+// for them.
 type ErrorPayload struct {
-	When    time.Time
-	Key     string
-	Payload []byte
+	When      time.Time
+	Key       string
+	Payload   []byte
+	Operation string        // the operation that failed, eg. OpLstat.
+	Category  ErrorCategory // the category of the error.
+	Errno     int64         // the system error number, if any.
+	Attempts  int64         // the number of times this error has been recorded.
 }
 
 type StatsPayload struct {
@@ -26,6 +59,37 @@ type LogPayload struct {
 	Payload     []byte
 }
 
+// HashKey identifies the contents of a file by its device and inode
+// numbers and its modification time so that a content hash stored for
+// a file is only used for as long as that file is not modified.
+type HashKey struct {
+	Device, Inode uint64
+	ModTime       time.Time
+}
+
+// Bytes returns the encoded form of the key used to store the hash, which
+// orders keys by device, inode and then modification time.
+func (k HashKey) Bytes() []byte {
+	var buf [24]byte
+	binary.BigEndian.PutUint64(buf[0:], k.Device)
+	binary.BigEndian.PutUint64(buf[8:], k.Inode)
+	binary.BigEndian.PutUint64(buf[16:], uint64(k.ModTime.UnixNano()))
+	return buf[:]
+}
+
+// ParseHashKey is the inverse of HashKey.Bytes. Modification times are
+// returned in the local timezone.
+func ParseHashKey(buf []byte) (HashKey, error) {
+	if len(buf) != 24 {
+		return HashKey{}, fmt.Errorf("invalid hash key length: %v", len(buf))
+	}
+	return HashKey{
+		Device:  binary.BigEndian.Uint64(buf[0:]),
+		Inode:   binary.BigEndian.Uint64(buf[8:]),
+		ModTime: time.Unix(0, int64(binary.BigEndian.Uint64(buf[16:]))),
+	}, nil
+}
+
 func Decode[T any](buf []byte, v *T) error {
 	dec := gob.NewDecoder(bytes.NewReader(buf))
 	return dec.Decode(v)
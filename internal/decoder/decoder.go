@@ -0,0 +1,135 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package decoder provides support for decoding the binary encodings used
+// by idu such that truncated or corrupt data results in an error rather
+// than a panic.
+package decoder
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// T decodes values from a byte slice. Once an error is encountered all
+// subsequent calls return zero values and Err returns that first error.
+type T struct {
+	name string
+	data []byte
+	size int
+	err  error
+}
+
+// New returns a decoder for data, name is used as a prefix for all
+// error messages, eg. PrefixInfo.
+func New(name string, data []byte) *T {
+	return &T{name: name, data: data, size: len(data)}
+}
+
+// Err returns the first error encountered, if any.
+func (d *T) Err() error {
+	return d.err
+}
+
+// Remaining returns the data that has not yet been decoded.
+func (d *T) Remaining() []byte {
+	return d.data
+}
+
+// Failf records an error, unless one has already been recorded.
+func (d *T) Failf(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%v: offset %v: %v", d.name, d.size-len(d.data), fmt.Sprintf(format, args...))
+		d.data = nil
+	}
+}
+
+// Skip discards the next n bytes, which must have been decoded
+// by some other means.
+func (d *T) Skip(n int) {
+	if d.err != nil {
+		return
+	}
+	if n < 0 || n > len(d.data) {
+		d.Failf("invalid skip of %v bytes with %v remaining", n, len(d.data))
+		return
+	}
+	d.data = d.data[n:]
+}
+
+// Varint decodes a signed variable length integer.
+func (d *T) Varint(what string) int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.Failf("invalid or truncated %v", what)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// Uvarint decodes an unsigned variable length integer.
+func (d *T) Uvarint(what string) uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.Failf("invalid or truncated %v", what)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// Length decodes the number of elements in a list that is encoded as
+// an unsigned variable length integer. Since every element requires at
+// least one byte, lengths that exceed the remaining data are rejected
+// so that corrupt data cannot lead to excessive allocations.
+func (d *T) Length(what string) int {
+	l := d.Uvarint(what)
+	if d.err != nil {
+		return 0
+	}
+	if l > uint64(len(d.data)) {
+		d.Failf("invalid %v: %v exceeds the %v bytes remaining", what, l, len(d.data))
+		return 0
+	}
+	return int(l)
+}
+
+// Byte decodes a single byte.
+func (d *T) Byte(what string) byte {
+	b := d.Bytes(1, what)
+	if d.err != nil {
+		return 0
+	}
+	return b[0]
+}
+
+// Uint32 decodes a little endian uint32.
+func (d *T) Uint32(what string) uint32 {
+	b := d.Bytes(4, what)
+	if d.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// Bytes returns the next n bytes.
+func (d *T) Bytes(n int64, what string) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > int64(len(d.data)) {
+		d.Failf("invalid or truncated %v: %v bytes required, %v remaining", what, n, len(d.data))
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
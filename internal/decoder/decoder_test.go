@@ -0,0 +1,64 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package decoder_test
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/decoder"
+)
+
+func TestDecoder(t *testing.T) {
+	var data []byte
+	data = binary.AppendVarint(data, -3)
+	data = binary.AppendUvarint(data, 2)
+	data = append(data, 'a', 'b')
+	data = binary.LittleEndian.AppendUint32(data, 42)
+
+	d := decoder.New("test", data)
+	if got, want := d.Varint("v"), int64(-3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	l := d.Length("l")
+	if got, want := string(d.Bytes(int64(l), "b")), "ab"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := d.Uint32("u"), uint32(42); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(d.Remaining()), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Every truncation must result in an error, not a panic.
+	for i := range data {
+		d := decoder.New("test", data[:i])
+		d.Varint("v")
+		d.Bytes(int64(d.Length("l")), "b")
+		d.Uint32("u")
+		if d.Err() == nil {
+			t.Errorf("%v: expected an error", i)
+		}
+	}
+
+	// Lengths may not exceed the remaining data.
+	d = decoder.New("test", binary.AppendUvarint(nil, 1<<40))
+	if got := d.Length("list"); got != 0 {
+		t.Errorf("got %v, want 0", got)
+	}
+	if err := d.Err(); err == nil || !strings.Contains(err.Error(), "test: offset 6: invalid list") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	// Only the first error is recorded.
+	d.Failf("another error")
+	if err := d.Err(); !strings.Contains(err.Error(), "invalid list") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
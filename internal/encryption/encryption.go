@@ -0,0 +1,301 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package encryption provides support for obtaining the keys used to
+// encrypt databases at rest and for encrypting the files, such as stats
+// files and export archives, that are created from them.
+//
+// Files are encrypted using AES-GCM as a sequence of independently
+// authenticated chunks so that arbitrarily large files can be encrypted
+// and decrypted as streams. The nonce for each chunk is formed from a
+// random prefix, chosen for each file, the chunk's sequence number and
+// a flag that marks the final chunk so that chunks cannot be reordered,
+// dropped or appended to, and a file cannot be truncated, without
+// detection.
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"cloudeng.io/cmd/idu/internal/config"
+)
+
+// Key returns the encryption key specified by cfg, reading it from the
+// configured file or running the configured command to obtain it.
+func Key(ctx context.Context, cfg config.Encryption) ([]byte, error) {
+	var buf []byte
+	var err error
+	switch {
+	case len(cfg.KeyFile) > 0:
+		buf, err = os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key: %v", err)
+		}
+	case len(cfg.KeyCommand) > 0:
+		cmd := exec.CommandContext(ctx, "sh", "-c", cfg.KeyCommand)
+		cmd.Stderr = os.Stderr
+		buf, err = cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to run encryption key command: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("no encryption key is configured")
+	}
+	return ParseKey(buf)
+}
+
+// PreviousKeys returns the keys contained in the previous key files
+// specified by cfg, in the order that they are configured.
+func PreviousKeys(cfg config.Encryption) ([][]byte, error) {
+	keys := make([][]byte, 0, len(cfg.PreviousKeyFiles))
+	for _, f := range cfg.PreviousKeyFiles {
+		buf, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read previous encryption key: %v", err)
+		}
+		key, err := ParseKey(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", f, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// ParseKey returns the key contained in buf, which is either hex encoded,
+// with optional leading and trailing white space, or the raw key itself.
+// The key must be 16, 24 or 32 bytes long.
+func ParseKey(buf []byte) ([]byte, error) {
+	if key, err := hex.DecodeString(string(bytes.TrimSpace(buf))); err == nil && validKeySize(len(key)) {
+		return key, nil
+	}
+	if validKeySize(len(buf)) {
+		return buf, nil
+	}
+	return nil, fmt.Errorf("encryption keys must be 16, 24 or 32 bytes long, either raw or hex encoded")
+}
+
+func validKeySize(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
+
+// Magic is the sequence of bytes that every encrypted file starts with.
+const Magic = "idu-encrypted-v1\n"
+
+const (
+	chunkSize   = 64 * 1024
+	prefixSize  = 7
+	nonceSize   = prefixSize + 4 + 1
+	headerSize  = len(Magic) + prefixSize
+	chunkHeader = 4 // the big-endian length of the encrypted chunk.
+	finalChunk  = 1
+)
+
+// IsEncrypted returns true if buf, the first bytes of a file, indicates
+// that the file is encrypted.
+func IsEncrypted(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(Magic))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, nonceSize)
+}
+
+func nonce(prefix []byte, seq uint32, final bool) []byte {
+	n := make([]byte, nonceSize)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[prefixSize:], seq)
+	if final {
+		n[nonceSize-1] = finalChunk
+	}
+	return n
+}
+
+type writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	seq    uint32
+	buf    []byte
+	closed bool
+}
+
+// NewWriter returns a writer that encrypts everything written to it using
+// key, writing the encrypted data to w. The returned writer must be closed
+// to write the final chunk; closing it does not close w.
+func NewWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(Magic), prefix...)); err != nil {
+		return nil, err
+	}
+	return &writer{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (ew *writer) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, fmt.Errorf("write to closed encryption writer")
+	}
+	n := 0
+	for len(p) > 0 {
+		if len(ew.buf) == chunkSize {
+			if err := ew.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(ew.buf[len(ew.buf):chunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (ew *writer) flush(final bool) error {
+	if ew.seq == ^uint32(0) {
+		return fmt.Errorf("too much data to encrypt")
+	}
+	sealed := ew.aead.Seal(nil, nonce(ew.prefix, ew.seq, final), ew.buf, nil)
+	var hdr [chunkHeader + 1]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(sealed)))
+	if final {
+		hdr[chunkHeader] = finalChunk
+	}
+	if _, err := ew.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := ew.w.Write(sealed); err != nil {
+		return err
+	}
+	ew.seq++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+// Close writes any buffered data as the final chunk.
+func (ew *writer) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	return ew.flush(true)
+}
+
+type reader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	seq    uint32
+	buf    []byte
+	done   bool
+}
+
+// ErrDecryption is returned when a file cannot be decrypted, either because
+// the wrong key is being used or because the file has been modified.
+var ErrDecryption = errors.New("failed to decrypt, either the key is incorrect or the data is corrupt")
+
+// NewReader returns a reader that decrypts the data, written by a writer
+// returned by NewWriter, that is read from r using key.
+func NewReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, hdr); err != nil || !IsEncrypted(hdr) {
+		return nil, fmt.Errorf("not an encrypted file")
+	}
+	return &reader{r: r, aead: aead, prefix: hdr[len(Magic):]}, nil
+}
+
+// NewReaderForKeys is like NewReader except that it tries each of keys
+// in turn and uses the first one that successfully decrypts the first
+// chunk of data read from r.
+func NewReaderForKeys(r io.Reader, keys ...[]byte) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, headerSize+chunkHeader+1+chunkSize+16)
+	hdr, err := br.Peek(headerSize + chunkHeader + 1)
+	if err != nil || !IsEncrypted(hdr) {
+		return nil, fmt.Errorf("not an encrypted file")
+	}
+	size := int(binary.BigEndian.Uint32(hdr[headerSize:]))
+	if size > chunkSize+16 {
+		return nil, ErrDecryption
+	}
+	first, err := br.Peek(len(hdr) + size)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted data is truncated: %w", io.ErrUnexpectedEOF)
+	}
+	final := hdr[headerSize+chunkHeader] == finalChunk
+	for _, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		sealed := first[len(hdr):]
+		if _, err := aead.Open(nil, nonce(hdr[len(Magic):headerSize], 0, final), sealed, nil); err == nil {
+			return NewReader(br, key)
+		}
+	}
+	return nil, ErrDecryption
+}
+
+func (er *reader) Read(p []byte) (int, error) {
+	for len(er.buf) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		if err := er.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, er.buf)
+	er.buf = er.buf[n:]
+	return n, nil
+}
+
+func (er *reader) next() error {
+	var hdr [chunkHeader + 1]byte
+	if _, err := io.ReadFull(er.r, hdr[:]); err != nil {
+		return fmt.Errorf("encrypted data is truncated: %w", io.ErrUnexpectedEOF)
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > chunkSize+uint32(er.aead.Overhead()) {
+		return ErrDecryption
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(er.r, sealed); err != nil {
+		return fmt.Errorf("encrypted data is truncated: %w", io.ErrUnexpectedEOF)
+	}
+	final := hdr[chunkHeader] == finalChunk
+	plain, err := er.aead.Open(sealed[:0], nonce(er.prefix, er.seq, final), sealed, nil)
+	if err != nil {
+		return ErrDecryption
+	}
+	er.seq++
+	er.buf = plain
+	er.done = final
+	return nil
+}
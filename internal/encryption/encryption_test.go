@@ -0,0 +1,162 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package encryption_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/encryption"
+)
+
+func newKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, key, plain []byte) []byte {
+	var buf bytes.Buffer
+	wr, err := encryption.NewWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in odd sized pieces to exercise the buffering.
+	for p := plain; len(p) > 0; {
+		n := min(len(p), 1000)
+		if _, err := wr.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := wr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(key, encrypted []byte) ([]byte, error) {
+	rd, err := encryption.NewReader(bytes.NewReader(encrypted), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(rd)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := newKey(t)
+	for _, size := range []int{0, 1, 64*1024 - 1, 64 * 1024, 64*1024 + 1, 200*1024 + 7} {
+		plain := make([]byte, size)
+		_, _ = rand.Read(plain)
+		encrypted := encrypt(t, key, plain)
+		if !encryption.IsEncrypted(encrypted) {
+			t.Errorf("%v: not marked as encrypted", size)
+		}
+		// Short plain texts may occur in the cipher text by chance.
+		if size > 16 && bytes.Contains(encrypted, plain) {
+			t.Errorf("%v: contains the plain text", size)
+		}
+		got, err := decrypt(key, encrypted)
+		if err != nil {
+			t.Fatalf("%v: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%v: round trip failed", size)
+		}
+		rd, err := encryption.NewReaderForKeys(bytes.NewReader(encrypted), newKey(t), key)
+		if err != nil {
+			t.Fatalf("%v: %v", size, err)
+		}
+		if got, err = io.ReadAll(rd); err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%v: round trip with multiple keys failed: %v", size, err)
+		}
+	}
+	if encryption.IsEncrypted([]byte("plain text")) {
+		t.Errorf("plain text is marked as encrypted")
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key := newKey(t)
+	plain := bytes.Repeat([]byte("0123456789"), 20*1024)
+	encrypted := encrypt(t, key, plain)
+
+	if _, err := decrypt(newKey(t), encrypted); !errors.Is(err, encryption.ErrDecryption) {
+		t.Errorf("wrong key: unexpected error: %v", err)
+	}
+	if _, err := encryption.NewReaderForKeys(bytes.NewReader(encrypted), newKey(t)); !errors.Is(err, encryption.ErrDecryption) {
+		t.Errorf("wrong keys: unexpected error: %v", err)
+	}
+
+	modified := bytes.Clone(encrypted)
+	modified[len(modified)/2] ^= 0x1
+	if _, err := decrypt(key, modified); !errors.Is(err, encryption.ErrDecryption) {
+		t.Errorf("modified: unexpected error: %v", err)
+	}
+
+	// Truncation anywhere, including at a chunk boundary, must be detected.
+	chunk := 64*1024 + 16 + 5
+	for _, n := range []int{len(encrypted) - 1, len(encrypted) / 2, len(encryption.Magic) + 7 + chunk} {
+		if _, err := decrypt(key, encrypted[:n]); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("truncated to %v: unexpected error: %v", n, err)
+		}
+	}
+
+	if _, err := decrypt(key, plain); err == nil {
+		t.Errorf("expected an error for an unencrypted file")
+	}
+}
+
+func TestKey(t *testing.T) {
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	key := newKey(t)
+	raw := filepath.Join(tmpdir, "raw")
+	hexed := filepath.Join(tmpdir, "hex")
+	short := filepath.Join(tmpdir, "short")
+	if err := os.WriteFile(raw, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(hexed, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(short, []byte("too short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []config.Encryption{
+		{KeyFile: raw},
+		{KeyFile: hexed},
+		{KeyCommand: "cat " + hexed},
+	} {
+		got, err := encryption.Key(ctx, cfg)
+		if err != nil {
+			t.Errorf("%+v: %v", cfg, err)
+			continue
+		}
+		if !bytes.Equal(got, key) {
+			t.Errorf("%+v: got the wrong key", cfg)
+		}
+	}
+	for _, cfg := range []config.Encryption{
+		{},
+		{KeyFile: short},
+		{KeyFile: filepath.Join(tmpdir, "missing")},
+		{KeyCommand: "exit 1"},
+	} {
+		if _, err := encryption.Key(ctx, cfg); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+}
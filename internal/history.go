@@ -0,0 +1,229 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+)
+
+// historySinceKey is the metadata key for the earliest time for which
+// the database can be queried using the retained versions of prefixes.
+const historySinceKey = "history-since"
+
+// HistorySince returns the earliest time for which db can be queried
+// as of, or the zero time if no history has been retained.
+func HistorySince(ctx context.Context, db database.DB) (time.Time, error) {
+	var buf bytes.Buffer
+	if err := db.GetMetadata(ctx, historySinceKey, &buf); err != nil {
+		return time.Time{}, err
+	}
+	if buf.Len() == 0 {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, buf.String())
+}
+
+func setHistorySince(ctx context.Context, db database.DB, since time.Time) error {
+	return db.SetMetadata(ctx, historySinceKey, []byte(since.Format(time.RFC3339Nano)))
+}
+
+// historyScanDB is a ScanDB that retains the prior versions of the
+// prefixes that are changed or deleted, tagged with the time of the
+// analyze run.
+type historyScanDB struct {
+	scanDB
+	run    time.Time
+	retain time.Duration
+	first  bool // the first run for which history is retained.
+}
+
+// NewHistoryScanDB is like NewScanDB except that the prior versions of the
+// prefixes that are changed or deleted are retained, as per cfg.History,
+// and tagged with run, which should be the start time of the analyze run
+// as recorded in its log entry. Versions that are older than the configured
+// retention period are deleted when the database is closed via LogAndClose.
+func NewHistoryScanDB(ctx context.Context, cfg config.Prefix, run time.Time) (ScanDB, error) {
+	db, err := OpenDatabase(ctx, cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	since, err := HistorySince(ctx, db)
+	first := since.IsZero()
+	if err == nil && first {
+		// The prefixes stored before this run were not retained.
+		err = setHistorySince(ctx, db, run)
+	}
+	if err != nil {
+		db.Close(ctx)
+		return nil, err
+	}
+	return &historyScanDB{
+		scanDB: scanDB{db: db, replica: cfg.Replica},
+		run:    run,
+		retain: cfg.History.Retain,
+		first:  first,
+	}, nil
+}
+
+// retainVersion records the current value of key, which is empty if the
+// prefix does not exist, as having been superseded by this run. Nothing
+// is recorded for the first run since the database cannot be queried
+// as of any earlier time.
+func (sdb *historyScanDB) retainVersion(ctx context.Context, key string) error {
+	if sdb.first {
+		return nil
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	if err := sdb.db.Get(ctx, key, buf); err != nil {
+		return err
+	}
+	return sdb.db.SetHistory(ctx, key, sdb.run, buf.Bytes())
+}
+
+func (sdb *historyScanDB) SetPrefixInfo(ctx context.Context, key string, unchanged bool, pi *prefixinfo.T) error {
+	if unchanged {
+		return nil
+	}
+	if err := sdb.retainVersion(ctx, key); err != nil {
+		return err
+	}
+	return sdb.scanDB.SetPrefixInfo(ctx, key, unchanged, pi)
+}
+
+func (sdb *historyScanDB) DeletePrefix(ctx context.Context, prefix string) error {
+	if sdb.first {
+		return sdb.scanDB.DeletePrefix(ctx, prefix)
+	}
+	var keys []string
+	err := sdb.db.Scan(ctx, prefix, func(_ context.Context, key string, _ []byte) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := sdb.retainVersion(ctx, k); err != nil {
+			return err
+		}
+	}
+	return sdb.scanDB.DeletePrefix(ctx, prefix)
+}
+
+func (sdb *historyScanDB) LogAndClose(ctx context.Context, start, stop time.Time, detail []byte) error {
+	if _, err := PruneHistory(ctx, sdb.db, start.Add(-sdb.retain)); err != nil {
+		sdb.db.Close(ctx)
+		return err
+	}
+	return sdb.scanDB.LogAndClose(ctx, start, stop, detail)
+}
+
+// PruneHistory deletes the versions of prefixes that were superseded
+// before the specified time, after which the database can no longer be
+// queried as of an earlier time.
+func PruneHistory(ctx context.Context, db database.DB, before time.Time) (int64, error) {
+	since, err := HistorySince(ctx, db)
+	if err != nil || since.IsZero() || !since.Before(before) {
+		return 0, err
+	}
+	// Record the new limit first so that an interrupted prune can never
+	// allow for incorrect queries.
+	if err := setHistorySince(ctx, db, before); err != nil {
+		return 0, err
+	}
+	return db.DeleteHistory(ctx, before)
+}
+
+// asOfDB is a read-only view of a database.DB as it was at a given time.
+type asOfDB struct {
+	database.DB
+	when time.Time
+}
+
+// AsOf returns a view of db as it was at the specified time, using the
+// versions of prefixes retained by analyze when history is enabled. Only
+// the prefixes, and not logs, errors or hashes, are available as of the
+// specified time and the returned database must only be used for reading.
+// An error is returned if the database cannot be queried as of the
+// specified time.
+func AsOf(ctx context.Context, db database.DB, when time.Time) (database.DB, error) {
+	since, err := HistorySince(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if since.IsZero() {
+		return nil, fmt.Errorf("no history has been retained for this database")
+	}
+	if when.Before(since) {
+		return nil, fmt.Errorf("history is only available since %v", since.Format(time.RFC3339))
+	}
+	return &asOfDB{DB: db, when: when}, nil
+}
+
+func (db *asOfDB) Get(ctx context.Context, prefix string, buf *bytes.Buffer) error {
+	return db.DB.GetAsOf(ctx, prefix, db.when, buf)
+}
+
+func (db *asOfDB) Scan(ctx context.Context, key string, visitor func(ctx context.Context, key string, val []byte) bool) error {
+	return db.DB.ScanAsOf(ctx, key, db.when, visitor)
+}
+
+// Stream is implemented using ScanAsOf and hence the visitor is never
+// called concurrently.
+func (db *asOfDB) Stream(ctx context.Context, prefix string, visitor func(ctx context.Context, key string, val []byte)) error {
+	return db.DB.ScanAsOf(ctx, prefix, db.when, func(ctx context.Context, key string, val []byte) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		visitor(ctx, key, val)
+		return true
+	})
+}
+
+// OpenPrefixAndDatabaseAsOf is like OpenPrefixAndDatabase, with readonly
+// set to true, except that the database is viewed as it was at the
+// specified time, see AsOf. The current database is used if when is zero.
+// If replica is set then the database is opened using
+// OpenReplicaOrDatabase.
+func OpenPrefixAndDatabaseAsOf(ctx context.Context, all config.T, prefix string, when time.Time, replica bool) (context.Context, config.Prefix, database.DB, error) {
+	ctx, cfg, db, err := openPrefixAndDatabase(ctx, all, prefix, replica)
+	if err != nil || when.IsZero() {
+		return ctx, cfg, db, err
+	}
+	adb, err := AsOf(ctx, db, when)
+	if err != nil {
+		db.Close(ctx)
+		return ctx, cfg, nil, fmt.Errorf("%v: %v", cfg.Database, err)
+	}
+	return ctx, cfg, adb, nil
+}
+
+func openPrefixAndDatabase(ctx context.Context, all config.T, prefix string, replica bool) (context.Context, config.Prefix, database.DB, error) {
+	if !replica {
+		return OpenPrefixAndDatabase(ctx, all, prefix, true)
+	}
+	ctx, cfg, err := LookupPrefix(ctx, all, prefix)
+	if err != nil {
+		return ctx, config.Prefix{}, nil, err
+	}
+	db, err := OpenReplicaOrDatabase(ctx, cfg)
+	if err != nil {
+		return ctx, config.Prefix{}, nil, fmt.Errorf("failed to open database for %v in %v: %v", cfg.Prefix, cfg.Database, err)
+	}
+	return ctx, cfg, db, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/compactkeys"
+)
+
+// The metadata keys for the encoding used for the keys of the stored
+// prefixes and, for compact keys, the separator used to split them.
+const (
+	keyEncodingKey  = "key-encoding"
+	keySeparatorKey = "key-separator"
+)
+
+// KeyEncoding returns the key encoding, and separator, recorded for db.
+// Databases for which no encoding is recorded use full path keys.
+func KeyEncoding(ctx context.Context, db database.DB) (encoding, separator string, err error) {
+	var buf bytes.Buffer
+	if err := db.GetMetadata(ctx, keyEncodingKey, &buf); err != nil {
+		return "", "", err
+	}
+	encoding = buf.String()
+	if len(encoding) == 0 {
+		return config.PathKeys, "", nil
+	}
+	buf.Reset()
+	if err := db.GetMetadata(ctx, keySeparatorKey, &buf); err != nil {
+		return "", "", err
+	}
+	return encoding, buf.String(), nil
+}
+
+func setKeyEncoding(ctx context.Context, db database.DB, encoding, separator string) error {
+	if err := db.SetMetadata(ctx, keySeparatorKey, []byte(separator)); err != nil {
+		return err
+	}
+	return db.SetMetadata(ctx, keyEncodingKey, []byte(encoding))
+}
+
+func isEmpty(ctx context.Context, db database.DB) (bool, error) {
+	empty := true
+	err := db.Scan(ctx, "", func(context.Context, string, []byte) bool {
+		empty = false
+		return false
+	})
+	return empty, err
+}
+
+// withKeyEncoding returns db such that it uses the key encoding recorded
+// for it. Newly created, ie. empty, databases are stamped with the
+// encoding configured for the prefix, whereas existing databases must be
+// converted to it using MigrateKeyEncoding.
+func withKeyEncoding(ctx context.Context, db database.DB, cfg config.Prefix, readonly bool) (database.DB, error) {
+	encoding, separator, err := KeyEncoding(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if encoding == config.PathKeys && cfg.KeyEncoding == config.CompactKeys && !readonly {
+		empty, err := isEmpty(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		if empty {
+			encoding, separator = config.CompactKeys, cfg.Separator
+			if err := setKeyEncoding(ctx, db, encoding, separator); err != nil {
+				return nil, err
+			}
+		}
+	}
+	switch encoding {
+	case config.PathKeys:
+		return db, nil
+	case config.CompactKeys:
+		return compactkeys.New(db, separator), nil
+	}
+	return nil, fmt.Errorf("unsupported key encoding: %q", encoding)
+}
+
+// MigrateKeyEncoding converts db, as returned by OpenDatabase, to use the
+// specified key encoding, and separator for compact keys. Prefixes are
+// read and converted in batches of batchSize and each prefix is deleted
+// only once it has been stored using the new encoding so that an
+// interrupted migration can be safely resumed, although the database
+// should not otherwise be used until the migration has completed.
+// Progress, if not nil, is called after each batch. The encoding of the
+// database before the migration is returned.
+func MigrateKeyEncoding(ctx context.Context, db database.DB, encoding, separator string, batchSize int, progress func(MigrationProgress)) (string, error) {
+	if batchSize <= 0 {
+		return "", fmt.Errorf("invalid batch size: %v", batchSize)
+	}
+	raw := db
+	if cdb, ok := db.(*compactkeys.DB); ok {
+		raw = cdb.DB
+	}
+	from, fromSep, err := KeyEncoding(ctx, raw)
+	if err != nil {
+		return "", err
+	}
+	switch encoding {
+	case config.PathKeys:
+		if from == config.PathKeys {
+			return from, nil
+		}
+		return from, toPathKeys(ctx, raw, fromSep, batchSize, progress)
+	case config.CompactKeys:
+		if from == config.CompactKeys && fromSep != separator {
+			return from, fmt.Errorf("database uses compact keys with separator %q, not %q", fromSep, separator)
+		}
+		return from, toCompactKeys(ctx, raw, separator, batchSize, progress)
+	}
+	return from, fmt.Errorf("unsupported key encoding: %q", encoding)
+}
+
+// toCompactKeys converts every full path key, all of which sort after
+// any compact key, to a compact key. The encoding is recorded first so
+// that a resumed migration will find the compact keys already converted.
+func toCompactKeys(ctx context.Context, raw database.DB, separator string, batchSize int, progress func(MigrationProgress)) error {
+	if err := setKeyEncoding(ctx, raw, config.CompactKeys, separator); err != nil {
+		return err
+	}
+	cdb := compactkeys.New(raw, separator)
+	mp := MigrationProgress{Migration: Migration{Description: "convert to compact keys"}}
+	batch := make([]migrationRecord, 0, batchSize)
+	for {
+		batch = batch[:0]
+		err := raw.Scan(ctx, "\x01", func(_ context.Context, key string, val []byte) bool {
+			batch = append(batch, migrationRecord{key: key, val: bytes.Clone(val)})
+			return len(batch) < batchSize
+		})
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, r := range batch {
+			mp.Scanned++
+			if err := cdb.Set(ctx, r.key, r.val, false); err != nil {
+				return fmt.Errorf("%v: %v", r.key, err)
+			}
+			if err := raw.Delete(ctx, r.key); err != nil {
+				return fmt.Errorf("%v: %v", r.key, err)
+			}
+			mp.Updated++
+		}
+		if progress != nil {
+			progress(mp)
+		}
+	}
+}
+
+// toPathKeys converts every compact key to a full path key. The compact
+// keys are only deleted, and the encoding recorded, once all of them
+// have been converted.
+func toPathKeys(ctx context.Context, raw database.DB, separator string, batchSize int, progress func(MigrationProgress)) error {
+	cdb := compactkeys.New(raw, separator)
+	mp := MigrationProgress{Migration: Migration{Description: "convert to path keys"}}
+	next := ""
+	batch := make([]migrationRecord, 0, batchSize)
+	for {
+		batch = batch[:0]
+		err := cdb.Scan(ctx, next, func(_ context.Context, key string, val []byte) bool {
+			batch = append(batch, migrationRecord{key: key, val: bytes.Clone(val)})
+			return len(batch) < batchSize
+		})
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, r := range batch {
+			mp.Scanned++
+			if err := raw.Set(ctx, r.key, r.val, false); err != nil {
+				return fmt.Errorf("%v: %v", r.key, err)
+			}
+			mp.Updated++
+		}
+		if progress != nil {
+			progress(mp)
+		}
+		next = batch[len(batch)-1].key + "\x00"
+	}
+	if err := raw.DeletePrefix(ctx, compactkeys.Marker); err != nil {
+		return err
+	}
+	return setKeyEncoding(ctx, raw, config.PathKeys, "")
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package internal_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/compactkeys"
+)
+
+func scanAll(t *testing.T, db database.DB) []string {
+	var keys []string
+	err := db.Scan(context.Background(), "", func(_ context.Context, key string, val []byte) bool {
+		keys = append(keys, key+"="+string(val))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func rawKeys(t *testing.T, db database.DB) (compact, path int) {
+	if cdb, ok := db.(*compactkeys.DB); ok {
+		db = cdb.DB
+	}
+	err := db.Scan(context.Background(), "", func(_ context.Context, key string, _ []byte) bool {
+		if strings.HasPrefix(key, compactkeys.Marker) {
+			compact++
+		} else {
+			path++
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func keyEncoding(t *testing.T, db database.DB) string {
+	enc, _, err := internal.KeyEncoding(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc
+}
+
+func TestKeyEncoding(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	cfg := config.Prefix{Prefix: "/a", Database: filepath.Join(tmpDir, "db"), DatabaseType: config.BoltDatabase, Separator: "/"}
+
+	open := func(cfg config.Prefix) database.DB {
+		db, err := internal.OpenDatabase(ctx, cfg, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	db := open(cfg)
+	for _, k := range []string{"/a", "/a/b", "/a-c", "/a/b/c", "/a/d", "/a.e/f"} {
+		if err := db.Set(ctx, k, []byte(k), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := scanAll(t, db)
+	db.Close(ctx)
+
+	// Existing databases retain their encoding until migrated.
+	cfg.KeyEncoding = config.CompactKeys
+	db = open(cfg)
+	if got, want := keyEncoding(t, db), config.PathKeys; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	from, err := internal.MigrateKeyEncoding(ctx, db, config.CompactKeys, "/", 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := from, config.PathKeys; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	db.Close(ctx)
+
+	db = open(cfg)
+	if got, want := keyEncoding(t, db), config.CompactKeys; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := scanAll(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The compact keys include placeholders for the root and /a.e.
+	if compact, path := rawKeys(t, db); compact != len(want)+2 || path != 0 {
+		t.Errorf("got %v compact and %v path keys", compact, path)
+	}
+
+	// An interrupted migration, simulated by storing a path key, can be
+	// resumed.
+	if err := db.(*compactkeys.DB).DB.Set(ctx, "/a/g", []byte("/a/g"), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := internal.MigrateKeyEncoding(ctx, db, config.CompactKeys, "/", 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, path := rawKeys(t, db); path != 0 {
+		t.Errorf("got %v path keys", path)
+	}
+	want = scanAll(t, db)
+	if got := fmt.Sprintf("%v", want); !strings.Contains(got, "/a/g=/a/g") {
+		t.Errorf("%v does not contain /a/g", got)
+	}
+
+	var progress []internal.MigrationProgress
+	if _, err := internal.MigrateKeyEncoding(ctx, db, config.PathKeys, "/", 4, func(mp internal.MigrationProgress) {
+		progress = append(progress, mp)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := progress[len(progress)-1].Updated, int64(len(want)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	db.Close(ctx)
+
+	cfg.KeyEncoding = config.PathKeys
+	db = open(cfg)
+	if got, want := keyEncoding(t, db), config.PathKeys; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := scanAll(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if compact, _ := rawKeys(t, db); compact != 0 {
+		t.Errorf("got %v compact keys", compact)
+	}
+	db.Close(ctx)
+
+	// Newly created databases use the configured encoding.
+	cfg.KeyEncoding = config.CompactKeys
+	cfg.Database = filepath.Join(tmpDir, "new")
+	db = open(cfg)
+	defer db.Close(ctx)
+	if _, ok := db.(*compactkeys.DB); !ok {
+		t.Errorf("new database does not use compact keys")
+	}
+	if _, err := internal.MigrateKeyEncoding(ctx, db, config.CompactKeys, "\\", 4, nil); err == nil || !strings.Contains(err.Error(), "separator") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/types"
+)
+
+// NestedPrefixes returns the configured prefixes, other than cfg, that are
+// the same as, or contained within, prefix. Since cfg is the longest
+// configured prefix for prefix, as returned by LookupPrefix, these are
+// the prefixes that have their own databases and whose contents are
+// hence missing from that of cfg.
+func NestedPrefixes(all config.T, cfg config.Prefix, prefix string) []config.Prefix {
+	var nested []config.Prefix
+	for _, p := range all.Prefixes {
+		if p.Prefix != cfg.Prefix && withinPrefix(p.Prefix, prefix, cfg.Separator) {
+			nested = append(nested, p)
+		}
+	}
+	return nested
+}
+
+// withinPrefix returns true if path is the same as, or is contained
+// within, prefix.
+func withinPrefix(path, prefix, sep string) bool {
+	if path == prefix {
+		return true
+	}
+	if !strings.HasSuffix(prefix, sep) {
+		prefix += sep
+	}
+	return strings.HasPrefix(path, prefix)
+}
+
+// OpenNestedDatabases is like OpenPrefixAndDatabaseAsOf except that the
+// returned database also contains the prefixes stored in the databases
+// for all of the NestedPrefixes of prefix, so that they can be queried
+// as a single logical tree. Every key is read from the database of the
+// longest prefix that contains it so that a subtree stored in more than
+// one database, eg. because the outer prefix was analyzed on its own, is
+// only visited once. Prefixes and errors are composed in this way and
+// hashes are visited once per file, but logs and metadata are those of
+// the database for prefix and the as-of methods are not composed.
+func OpenNestedDatabases(ctx context.Context, all config.T, prefix string, when time.Time, replica bool) (context.Context, config.Prefix, database.DB, error) {
+	ctx, cfg, db, err := OpenPrefixAndDatabaseAsOf(ctx, all, prefix, when, replica)
+	if err != nil {
+		return ctx, cfg, nil, err
+	}
+	nested := NestedPrefixes(all, cfg, prefix)
+	if len(nested) == 0 {
+		return ctx, cfg, db, nil
+	}
+	ndb := &nestedDB{
+		DB:       db,
+		sep:      cfg.Separator,
+		prefixes: []string{cfg.Prefix},
+		dbs:      []database.DB{db},
+	}
+	for _, p := range nested {
+		_, _, pdb, err := OpenPrefixAndDatabaseAsOf(ctx, all, p.Prefix, when, replica)
+		if err != nil {
+			ndb.Close(ctx)
+			return ctx, cfg, nil, fmt.Errorf("nested prefix %v: %v", p.Prefix, err)
+		}
+		ndb.prefixes = append(ndb.prefixes, p.Prefix)
+		ndb.dbs = append(ndb.dbs, pdb)
+	}
+	return ctx, cfg, ndb, nil
+}
+
+// nestedDB is a read-only view of the databases for a prefix, stored
+// first, and its nested prefixes.
+type nestedDB struct {
+	database.DB
+	sep      string
+	prefixes []string
+	dbs      []database.DB
+}
+
+// owner returns the index of the database that key is read from, ie.
+// that of the longest nested prefix that contains it, or the outermost
+// database if there is none.
+func (ndb *nestedDB) owner(key string) int {
+	owner := 0
+	for i := 1; i < len(ndb.prefixes); i++ {
+		if withinPrefix(key, ndb.prefixes[i], ndb.sep) && len(ndb.prefixes[i]) > len(ndb.prefixes[owner]) {
+			owner = i
+		}
+	}
+	return owner
+}
+
+// skip returns the key at which a scan of database i, that has just
+// encountered key which is owned by database o, should be resumed.
+// The entire subtree of o's prefix is skipped if it is nested within
+// that of i since all of it is owned by o, or a database nested within o.
+func (ndb *nestedDB) skip(key string, i, o int) string {
+	next := key + "\x00"
+	if o == 0 || !withinPrefix(ndb.prefixes[o], ndb.prefixes[i], ndb.sep) {
+		return next
+	}
+	prefix := ndb.prefixes[o]
+	if key == prefix && !strings.HasSuffix(prefix, ndb.sep) {
+		return next
+	}
+	if !strings.HasSuffix(prefix, ndb.sep) {
+		prefix += ndb.sep
+	}
+	if end := prefixEnd(prefix); len(end) > 0 {
+		return end
+	}
+	return next
+}
+
+// prefixEnd returns the smallest key that sorts after every key with the
+// specified prefix, or the empty string if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+const nestedScanBatch = 256
+
+type nestedCursor[T any] struct {
+	index int
+	next  string
+	keys  []string
+	vals  []T
+	done  bool
+}
+
+// nestedScanner scans the keys, and their values, of a single database
+// starting at key.
+type nestedScanner[T any] func(ctx context.Context, db database.DB, key string, visitor func(key string, val T) bool) error
+
+// fill reads the next batch of keys owned by the cursor's database.
+func fill[T any](ctx context.Context, ndb *nestedDB, c *nestedCursor[T], scan nestedScanner[T]) error {
+	for len(c.keys) == 0 && !c.done {
+		stopped, resume := false, ""
+		err := scan(ctx, ndb.dbs[c.index], c.next, func(key string, val T) bool {
+			if o := ndb.owner(key); o != c.index {
+				stopped, resume = true, ndb.skip(key, c.index, o)
+				return false
+			}
+			c.keys = append(c.keys, key)
+			c.vals = append(c.vals, val)
+			c.next = key + "\x00"
+			stopped = len(c.keys) == nestedScanBatch
+			return !stopped
+		})
+		if err != nil {
+			return err
+		}
+		if len(resume) > 0 {
+			c.next = resume
+		}
+		c.done = !stopped
+	}
+	return nil
+}
+
+// merge merges the keys, in order, owned by each of the databases.
+func merge[T any](ctx context.Context, ndb *nestedDB, key string, scan nestedScanner[T], visitor func(key string, val T) bool) error {
+	cursors := make([]*nestedCursor[T], len(ndb.dbs))
+	for i := range ndb.dbs {
+		cursors[i] = &nestedCursor[T]{index: i, next: key}
+	}
+	for {
+		var first *nestedCursor[T]
+		for _, c := range cursors {
+			if err := fill(ctx, ndb, c, scan); err != nil {
+				return err
+			}
+			if len(c.keys) > 0 && (first == nil || c.keys[0] < first.keys[0]) {
+				first = c
+			}
+		}
+		if first == nil {
+			return nil
+		}
+		if !visitor(first.keys[0], first.vals[0]) {
+			return nil
+		}
+		first.keys, first.vals = first.keys[1:], first.vals[1:]
+	}
+}
+
+// Scan merges the keys, in order, owned by each of the databases.
+func (ndb *nestedDB) Scan(ctx context.Context, key string, visitor func(ctx context.Context, key string, val []byte) bool) error {
+	return merge(ctx, ndb, key, func(ctx context.Context, db database.DB, key string, visitor func(string, []byte) bool) error {
+		return db.Scan(ctx, key, func(_ context.Context, key string, val []byte) bool {
+			return visitor(key, bytes.Clone(val))
+		})
+	}, func(key string, val []byte) bool {
+		return visitor(ctx, key, val)
+	})
+}
+
+// Stream streams each of the databases in turn.
+func (ndb *nestedDB) Stream(ctx context.Context, prefix string, visitor func(ctx context.Context, key string, val []byte)) error {
+	for i, db := range ndb.dbs {
+		err := db.Stream(ctx, prefix, func(ctx context.Context, key string, val []byte) {
+			if ndb.owner(key) == i {
+				visitor(ctx, key, val)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ndb *nestedDB) Get(ctx context.Context, prefix string, buf *bytes.Buffer) error {
+	return ndb.dbs[ndb.owner(prefix)].Get(ctx, prefix, buf)
+}
+
+// VisitErrors merges the errors, in key order, owned by each of the
+// databases.
+func (ndb *nestedDB) VisitErrors(ctx context.Context, key string, visitor func(ctx context.Context, pl types.ErrorPayload) bool) error {
+	return merge(ctx, ndb, key, func(ctx context.Context, db database.DB, key string, visitor func(string, types.ErrorPayload) bool) error {
+		return db.VisitErrors(ctx, key, func(_ context.Context, pl types.ErrorPayload) bool {
+			return visitor(pl.Key, pl)
+		})
+	}, func(_ string, pl types.ErrorPayload) bool {
+		return visitor(ctx, pl)
+	})
+}
+
+// VisitHashes visits the hashes stored in each of the databases, skipping
+// those for files already visited.
+func (ndb *nestedDB) VisitHashes(ctx context.Context, visitor func(ctx context.Context, key types.HashKey, hash []byte) bool) error {
+	seen := map[string]struct{}{}
+	for _, db := range ndb.dbs {
+		more := true
+		err := db.VisitHashes(ctx, func(ctx context.Context, key types.HashKey, hash []byte) bool {
+			k := string(key.Bytes())
+			if _, ok := seen[k]; ok {
+				return true
+			}
+			seen[k] = struct{}{}
+			more = visitor(ctx, key, hash)
+			return more
+		})
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ndb *nestedDB) Close(ctx context.Context) error {
+	var err error
+	for _, db := range ndb.dbs {
+		if cerr := db.Close(ctx); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package internal_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database/memdb"
+	"cloudeng.io/cmd/idu/internal/database/types"
+)
+
+func TestNestedDatabases(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	var all config.T
+	contents := map[string][]string{
+		// /a/b/y and /a/b/c/z are stale copies of the nested subtrees.
+		"/a":     {"/a", "/a/x", "/a/b", "/a/b/y", "/a/b-c", "/a/b.d", "/a/b/c/z", "/a/ba"},
+		"/a/b":   {"/a/b", "/a/b/y", "/a/b/c", "/a/b/c/z", "/a/b/d"},
+		"/a/b/c": {"/a/b/c", "/a/b/c/q", "/a/b/c/r"},
+		"/z":     {"/z", "/z/a"},
+	}
+	for _, p := range []string{"/a", "/a/b", "/a/b/c", "/z"} {
+		location := filepath.Join(tmpDir, p)
+		t.Cleanup(func() { memdb.Remove(location) })
+		cfg := config.Prefix{Prefix: p, Database: location, DatabaseType: config.MemoryDatabase, Separator: "/"}
+		all.Prefixes = append(all.Prefixes, cfg)
+		db, err := internal.OpenDatabase(ctx, cfg, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range contents[p] {
+			if err := db.Set(ctx, k, []byte(p), false); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.LogError(ctx, types.ErrorPayload{When: time.Now(), Key: k, Payload: []byte(p)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.SetHash(ctx, types.HashKey{Device: 1, Inode: uint64(len(p))}, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetHash(ctx, types.HashKey{Device: 1, Inode: 100}, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+		db.Close(ctx)
+	}
+
+	if got, want := internal.NestedPrefixes(all, all.Prefixes[0], "/a"), all.Prefixes[1:3]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := internal.NestedPrefixes(all, all.Prefixes[1], "/a/b/c/q"); len(got) != 0 {
+		t.Errorf("got %v, want none", got)
+	}
+
+	_, cfg, db, err := internal.OpenNestedDatabases(ctx, all, "/a", time.Time{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	if got, want := cfg.Prefix, "/a"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Each key is read from the longest prefix that contains it.
+	merged := []string{
+		"/a=/a", "/a/b=/a/b", "/a/b-c=/a", "/a/b.d=/a", "/a/b/c=/a/b/c", "/a/b/c/q=/a/b/c",
+		"/a/b/c/r=/a/b/c", "/a/b/d=/a/b", "/a/b/y=/a/b", "/a/ba=/a", "/a/x=/a",
+	}
+	matching := func(match func(key string) bool) []string {
+		var kvs []string
+		for _, kv := range merged {
+			if k, _, _ := strings.Cut(kv, "="); match(k) {
+				kvs = append(kvs, kv)
+			}
+		}
+		return kvs
+	}
+	if got, want := scanAll(t, db), merged; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Scans may start, and stop, anywhere.
+	for i, start := range []string{"/a/b/", "/a/b/c/q", "/a/b.", "/a/b/c/s"} {
+		for _, n := range []int{1, 2, 100} {
+			var got []string
+			err := db.Scan(ctx, start, func(_ context.Context, key string, val []byte) bool {
+				got = append(got, key+"="+string(val))
+				return len(got) < n
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := matching(func(k string) bool { return k >= start })
+			want = want[:min(n, len(want))]
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%v: %v: got %v, want %v", i, n, got, want)
+			}
+		}
+	}
+
+	var streamed []string
+	err = db.Stream(ctx, "/a/b", func(_ context.Context, key string, val []byte) {
+		streamed = append(streamed, key+"="+string(val))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(streamed)
+	want := matching(func(k string) bool { return strings.HasPrefix(k, "/a/b") })
+	slices.Sort(want)
+	if got := streamed; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// /a/b/c/z is only stored in databases that do not own it.
+	for k, want := range map[string]string{"/a/x": "/a", "/a/b/y": "/a/b", "/a/b/c/z": "", "/a/b-c": "/a", "/a/b/c/q": "/a/b/c"} {
+		var buf bytes.Buffer
+		if err := db.Get(ctx, k, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != want {
+			t.Errorf("%v: got %q, want %q", k, got, want)
+		}
+	}
+
+	var errs []string
+	err = db.VisitErrors(ctx, "", func(_ context.Context, pl types.ErrorPayload) bool {
+		errs = append(errs, pl.Key+"="+string(pl.Payload))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(errs)
+	want = slices.Sorted(slices.Values(merged))
+	if got := errs; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	hashes := map[uint64]int{}
+	err = db.VisitHashes(ctx, func(_ context.Context, key types.HashKey, _ []byte) bool {
+		hashes[key.Inode]++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(hashes), "map[2:1 4:1 6:1 100:1]"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Prefixes without nested prefixes are opened as usual.
+	_, _, zdb, err := internal.OpenNestedDatabases(ctx, all, "/z", time.Time{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zdb.Close(ctx)
+	if got, want := scanAll(t, zdb), []string{"/z=/z", "/z/a=/z"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package prefixinfo
+
+// StatBlockSize is the size, in bytes, of the blocks counted by
+// file.XAttr.Blocks, ie. the st_blocks field returned by stat.
+const StatBlockSize = 512
+
+// OverAllocationSlack is the number of bytes by which the storage
+// allocated to a file may exceed its apparent size before it is
+// considered to be over-allocated. Filesystems allocate storage in
+// units of their block or record size and hence some excess
+// allocation is to be expected for all files.
+var OverAllocationSlack int64 = 64 * 1024
+
+// Allocation returns the number of bytes allocated to store a file of
+// the specified apparent size and number of blocks (see StatBlockSize).
+// A file is sparse if fewer bytes are allocated than its apparent size,
+// which is typically the result of holes in the file or of the
+// filesystem compressing its contents. A file is over-allocated if the
+// bytes allocated exceed its apparent size by more than
+// OverAllocationSlack, typically the result of preallocation.
+func Allocation(size, blocks int64) (allocated int64, sparse, overAllocated bool) {
+	allocated = blocks * StatBlockSize
+	return allocated, allocated < size, allocated-size > OverAllocationSlack
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package prefixinfo
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Encoding describes a version of the binary encoding used by T. The
+// version is stored as the first byte of every encoded T. Each version
+// extends the previous one and AppendBinary uses the oldest, non-deprecated,
+// version that can represent the information being encoded so as to
+// minimize storage requirements.
+type Encoding struct {
+	Version     byte
+	Description string
+	Times       bool // access, change and birth times are encoded.
+	ProjectIDs  bool // project IDs are encoded.
+	// Deprecated encodings can be decoded but are no longer written,
+	// records that use them should be migrated.
+	Deprecated bool
+}
+
+var encodings = []Encoding{
+	{Version: 0x1, Description: "original encoding, decoded identically to 0x2", Deprecated: true},
+	{Version: 0x2, Description: "sizes, modes, ownership, modification times and entries"},
+	{Version: 0x3, Description: "0x2 with access, change and birth times", Times: true},
+	{Version: 0x4, Description: "0x3 with project IDs", Times: true, ProjectIDs: true},
+}
+
+// Encodings returns all of the supported encodings, oldest first.
+func Encodings() []Encoding {
+	return slices.Clone(encodings)
+}
+
+// LookupEncoding returns the Encoding for the specified version.
+func LookupEncoding(version byte) (Encoding, bool) {
+	for _, e := range encodings {
+		if e.Version == version {
+			return e, true
+		}
+	}
+	return Encoding{}, false
+}
+
+// EncodingOf returns the Encoding used for data, as created by
+// MarshalBinary or AppendBinary, without decoding it.
+func EncodingOf(data []byte) (Encoding, error) {
+	if len(data) == 0 {
+		return Encoding{}, fmt.Errorf("PrefixInfo: insufficient data")
+	}
+	e, ok := LookupEncoding(data[0])
+	if !ok {
+		return Encoding{}, fmt.Errorf("PrefixInfo: unsupported version of binary encoding: %#x, supported versions are %#x..%#x", data[0], encodings[0].Version, encodings[len(encodings)-1].Version)
+	}
+	return e, nil
+}
+
+// encodingFor returns the encoding to be used for pi.
+func (pi *T) encodingFor() Encoding {
+	times := pi.timesMask() != 0
+	projects := pi.projectID != 0 || len(pi.projectMap) > 0
+	for _, e := range encodings {
+		if e.Deprecated || (times && !e.Times) || (projects && !e.ProjectIDs) {
+			continue
+		}
+		return e
+	}
+	return encodings[len(encodings)-1]
+}
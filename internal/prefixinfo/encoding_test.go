@@ -0,0 +1,85 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package prefixinfo_test
+
+import (
+	"io/fs"
+	"math/rand"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/file"
+)
+
+func TestEncodings(t *testing.T) {
+	encs := prefixinfo.Encodings()
+	for i, e := range encs {
+		if got, want := e.Version, byte(i+1); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		le, ok := prefixinfo.LookupEncoding(e.Version)
+		if !ok || le != e {
+			t.Errorf("%v: got %v, want %v", e.Version, le, e)
+		}
+	}
+	if _, ok := prefixinfo.LookupEncoding(0); ok {
+		t.Errorf("version 0 should not be supported")
+	}
+	for _, data := range [][]byte{nil, {0x0}, {encs[len(encs)-1].Version + 1}} {
+		if _, err := prefixinfo.EncodingOf(data); err == nil {
+			t.Errorf("%v: expected an error", data)
+		}
+		var pi prefixinfo.T
+		if err := pi.UnmarshalBinary(data); err == nil {
+			t.Errorf("%v: expected an error", data)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	modTime := time.Now().Truncate(0)
+	dir := file.NewInfo("dir", 1, 0700|fs.ModeDir, modTime,
+		prefixinfo.XAttrAndTimes{
+			XAttr:     file.XAttr{UID: 1, GID: 2, Device: 1, FileID: 10, Blocks: 1},
+			Times:     prefixinfo.Times{Access: modTime},
+			ProjectID: 3,
+		})
+	pi := prefixinfo.New("dir", dir)
+	pi.AppendInfoList(file.InfoList{
+		newInfoWithProject("a", modTime, 1, 11, 3),
+		newInfoWithProject("b", modTime, 4, 12, 5),
+	})
+	buf, err := pi.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := prefixinfo.EncodingOf(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !enc.Times || !enc.ProjectIDs || enc.Deprecated {
+		t.Errorf("unexpected encoding: %+v", enc)
+	}
+
+	// Truncated data must always result in an error.
+	for i := range buf {
+		var npi prefixinfo.T
+		if err := npi.UnmarshalBinary(buf[:i]); err == nil {
+			t.Errorf("%v: expected an error", i)
+		}
+	}
+
+	// Corrupt data must never result in a panic.
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < 10000; i++ {
+		data := append([]byte{}, buf...)
+		for j := 0; j < 1+rnd.Intn(4); j++ {
+			data[1+rnd.Intn(len(data)-1)] = byte(rnd.Intn(256))
+		}
+		var npi prefixinfo.T
+		_ = npi.UnmarshalBinary(data)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"math/bits"
 	"strings"
+
+	"cloudeng.io/cmd/idu/internal/decoder"
 )
 
 // idMap is a bit map of file positions for a given id. They are used
@@ -35,20 +37,14 @@ func (idm idMap) appendBinary(buf *bytes.Buffer) {
 	}
 }
 
-func (idm *idMap) decodeBinary(data []byte) ([]byte, error) {
-	uid, n := binary.Varint(data)
-	data = data[n:]
-	idm.ID = uid
-	l, n := binary.Uvarint(data)
-	data = data[n:]
-	if l > 0 {
+func (idm *idMap) decode(d *decoder.T) {
+	idm.ID = d.Varint("id map id")
+	if l := d.Length("id map length"); l > 0 {
 		idm.Pos = make([]uint64, l)
 		for i := range idm.Pos {
-			idm.Pos[i], n = binary.Uvarint(data)
-			data = data[n:]
+			idm.Pos[i] = d.Uvarint("id map position")
 		}
 	}
-	return data, nil
 }
 
 type idMaps []idMap
@@ -75,16 +71,18 @@ func (idms idMaps) appendBinary(buf *bytes.Buffer) {
 }
 
 func (idms *idMaps) decodeBinary(data []byte) ([]byte, error) {
-	var n int
-	l, n := binary.Uvarint(data)
-	data = data[n:]
-	if l > 0 {
+	d := decoder.New("PrefixInfo", data)
+	idms.decode(d)
+	return d.Remaining(), d.Err()
+}
+
+func (idms *idMaps) decode(d *decoder.T) {
+	if l := d.Length("number of id maps"); l > 0 {
 		*idms = make([]idMap, l)
 		for i := range *idms {
-			data, _ = (*idms)[i].decodeBinary(data)
+			(*idms)[i].decode(d)
 		}
 	}
-	return data, nil
 }
 
 func (idms idMaps) idMapFor(id int64) int {
@@ -11,6 +11,7 @@ import (
 	"io/fs"
 	"time"
 
+	"cloudeng.io/cmd/idu/internal/decoder"
 	"cloudeng.io/file"
 )
 
@@ -25,16 +26,21 @@ type T struct {
 	size       int64
 	mode       fs.FileMode
 	modTime    time.Time
+	times      Times
 	entries    file.InfoList // files and prefixes only
 	inodes     []uint64
 	blocks     []int64
+	entryTimes []Times // nil unless times are recorded for any entry
+	projectID  int64
 	userIDMap  idMaps
 	groupIDMap idMaps
+	projectMap idMaps
 	finalized  bool
 }
 
 // New creates a new PrefixInfo for the supplied file.Info. It assumes that
-// the supplied file.Info contains a file.XAttr in its Sys() value.
+// the supplied file.Info contains a file.XAttr or XAttrAndTimes in its
+// Sys() value.
 func New(_ string, info file.Info) T {
 	pi := T{
 		size:    info.Size(),
@@ -46,6 +52,10 @@ func New(_ string, info file.Info) T {
 		pi.xattr = v
 	case *file.XAttr:
 		pi.xattr = *v
+	case XAttrAndTimes:
+		pi.xattr, pi.times, pi.projectID = v.XAttr, v.Times, v.ProjectID
+	case *XAttrAndTimes:
+		pi.xattr, pi.times, pi.projectID = v.XAttr, v.Times, v.ProjectID
 	default:
 		panic(fmt.Sprintf("invalid system information: %T", v))
 	}
@@ -100,6 +110,31 @@ func (pi T) XAttrInfo(fi file.Info) file.XAttr {
 	return pi.xAttrFromSys(fi.Sys())
 }
 
+// Times returns the access, change and birth times recorded for the
+// prefix itself.
+func (pi T) Times() Times {
+	return pi.times
+}
+
+// TimesInfo returns the access, change and birth times recorded for
+// the supplied file.Info, which must be one of the entries in this
+// prefix.
+func (pi T) TimesInfo(fi file.Info) Times {
+	return timesFromSys(fi.Sys())
+}
+
+// ProjectID returns the project ID recorded for the prefix itself, zero
+// if none was recorded.
+func (pi T) ProjectID() int64 {
+	return pi.projectID
+}
+
+// ProjectIDInfo returns the project ID recorded for the supplied
+// file.Info, which must be one of the entries in this prefix.
+func (pi T) ProjectIDInfo(fi file.Info) int64 {
+	return projectIDFromSys(fi.Sys())
+}
+
 // Info returns the list of file.Info's available for this prefix.
 // NOTE that these may contain directories, ie. entries for which
 // IsDir is true.
@@ -149,9 +184,11 @@ func (pi *T) AppendBinary(buf *bytes.Buffer) error {
 		return err
 	}
 
+	enc := pi.encodingFor()
+	mask := pi.timesMask()
 	var storage [128]byte
 	data := storage[:0]
-	data = append(data, 0x2)                          // version
+	data = append(data, enc.Version)                  // version
 	data = binary.AppendVarint(data, pi.size)         // size
 	data = binary.AppendVarint(data, pi.xattr.Blocks) // nblocks
 	data = binary.AppendVarint(data, pi.xattr.UID)    // user id
@@ -184,74 +221,133 @@ func (pi *T) AppendBinary(buf *bytes.Buffer) error {
 	for _, blk := range pi.blocks {
 		data = binary.AppendVarint(data, blk) // blocks
 	}
-	_, err = buf.Write(data)
-	return err
+	if enc.Times {
+		data = append(data, byte(mask))                               // times mask
+		data = pi.times.appendBinary(data, mask)                      // prefix times
+		data = binary.AppendUvarint(data, uint64(len(pi.entryTimes))) // entry times
+		for _, t := range pi.entryTimes {
+			data = t.appendBinary(data, mask)
+		}
+	}
+	if enc.ProjectIDs {
+		data = binary.AppendVarint(data, pi.projectID) // project id
+	}
+	if _, err = buf.Write(data); err != nil {
+		return err
+	}
+	if enc.ProjectIDs {
+		pi.projectMap.appendBinary(buf) // project id map
+	}
+	return nil
 }
 
-func (pi *T) UnmarshalBinary(data []byte) error {
-	if len(data) == 0 {
-		return fmt.Errorf("PrefixInfo: insufficient data")
+func (pi *T) timesMask() timesMask {
+	mask := pi.times.mask()
+	for _, t := range pi.entryTimes {
+		mask |= t.mask()
 	}
-	version := data[0]
+	return mask
+}
 
-	if version != 0x1 && version != 0x2 {
-		return fmt.Errorf("PrefixInfo: invalid version of binary encoding: got %x, want %x..%x", data[0], 01, 02)
+func (pi *T) decodeTimes(d *decoder.T) {
+	mask := timesMask(d.Byte("times mask"))
+	pi.times.decode(d, mask)
+	l := d.Length("number of entry times")
+	if d.Err() != nil {
+		return
 	}
-	var n int
-	data = data[1:]                  // version
-	pi.size, n = binary.Varint(data) // size
-	data = data[n:]
-
-	pi.xattr.Blocks, n = binary.Varint(data) // nblocks
-	data = data[n:]
-
-	uid, n := binary.Varint(data) // userid
-	data = data[n:]
-
-	gid, n := binary.Varint(data) // groupid
-	data = data[n:]
-	pi.xattr.UID, pi.xattr.GID = uid, gid
-
-	pi.mode = fs.FileMode(binary.LittleEndian.Uint32(data)) // filemode
-	data = data[4:]
-	ts, n := binary.Varint(data) // modtime
-	data = data[n:]
-	if err := pi.modTime.UnmarshalBinary(data[0:ts]); err != nil { // time
-		return err
+	if l != 0 && l != len(pi.entries) {
+		d.Failf("invalid number of entry times: %v", l)
+		return
+	}
+	if l == 0 {
+		return
+	}
+	pi.entryTimes = make([]Times, l)
+	for i := range pi.entryTimes {
+		pi.entryTimes[i].decode(d, mask)
 	}
-	data = data[ts:]
+}
 
-	var err error
+func (pi *T) decodeProjectIDs(d *decoder.T) {
+	pi.projectID = d.Varint("project id")
+	pi.projectMap.decode(d)
+}
 
-	data, err = pi.userIDMap.decodeBinary(data) // user id maps
+// UnmarshalBinary decodes data created by MarshalBinary or AppendBinary
+// using any of the supported encodings, see Encodings. An error is
+// returned for truncated or otherwise invalid data.
+func (pi *T) UnmarshalBinary(data []byte) error {
+	enc, err := EncodingOf(data)
 	if err != nil {
 		return err
 	}
-	data, err = pi.groupIDMap.decodeBinary(data) // group id maps
-	if err != nil {
+	d := decoder.New("PrefixInfo", data)
+	d.Skip(1)                             // version
+	pi.size = d.Varint("size")            // size
+	pi.xattr.Blocks = d.Varint("nblocks") // nblocks
+	pi.xattr.UID = d.Varint("user id")    // userid
+	pi.xattr.GID = d.Varint("group id")   // groupid
+
+	pi.mode = fs.FileMode(d.Uint32("filemode")) // filemode
+	ts := d.Varint("modtime length")            // modtime
+	if mt := d.Bytes(ts, "modtime"); d.Err() == nil {
+		if err := pi.modTime.UnmarshalBinary(mt); err != nil { // time
+			return fmt.Errorf("PrefixInfo: invalid modtime: %v", err)
+		}
+	}
+
+	pi.userIDMap.decode(d)  // user id maps
+	pi.groupIDMap.decode(d) // group id maps
+	if err := d.Err(); err != nil {
 		return err
 	}
-	pi.entries, data, err = file.DecodeBinaryInfoList(data) // files
+	rest, err := decodeInfoList(d.Remaining(), &pi.entries) // files
 	if err != nil {
 		return err
 	}
-	pi.xattr.Device, n = binary.Uvarint(data)
-	data = data[n:]
-	pi.xattr.FileID, n = binary.Uvarint(data)
-	data = data[n:]
+	d = decoder.New("PrefixInfo", rest)
+	pi.xattr.Device = d.Uvarint("device")
+	pi.xattr.FileID = d.Uvarint("inode")
 	pi.inodes = make([]uint64, len(pi.entries))
 	for i := range pi.inodes {
-		pi.inodes[i], n = binary.Uvarint(data)
-		data = data[n:]
+		pi.inodes[i] = d.Uvarint("inode")
 	}
 	pi.blocks = make([]int64, len(pi.entries))
 	for i := range pi.blocks {
-		pi.blocks[i], n = binary.Varint(data)
-		data = data[n:]
+		pi.blocks[i] = d.Varint("blocks")
+	}
+	if enc.Times {
+		pi.decodeTimes(d)
+	}
+	if enc.ProjectIDs {
+		pi.decodeProjectIDs(d)
+	}
+	if err := d.Err(); err != nil {
+		return err
 	}
 	return pi.finalizeOnUnmarshal()
 }
 
+// decodeInfoList decodes a file.InfoList, which is encoded by an external
+// package, checking the number of entries before they are allocated and
+// converting any panic caused by invalid data into an error.
+func decodeInfoList(data []byte, entries *file.InfoList) (rest []byte, err error) {
+	if l, n := binary.Varint(data); n <= 0 || l < 0 || l > int64(len(data)-n) {
+		return nil, fmt.Errorf("PrefixInfo: invalid number of entries")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("PrefixInfo: invalid entries: %v", r)
+		}
+	}()
+	*entries, rest, err = file.DecodeBinaryInfoList(data)
+	if err != nil {
+		err = fmt.Errorf("PrefixInfo: invalid entries: %v", err)
+	}
+	return
+}
+
 func newIDMapIfNeeded(idms *idMaps, id int64, n int) int {
 	if mi := idms.idMapFor(id); mi >= 0 {
 		return mi
@@ -263,11 +359,19 @@ func newIDMapIfNeeded(idms *idMaps, id int64, n int) int {
 func (pi *T) createIDMapsAndInodes() error {
 	prefixUserMap := newIDMap(pi.xattr.UID, len(pi.entries))
 	prefixGroupMap := newIDMap(pi.xattr.GID, len(pi.entries))
+	prefixProjectMap := newIDMap(pi.projectID, len(pi.entries))
 
 	pi.inodes = make([]uint64, len(pi.entries))
 	pi.blocks = make([]int64, len(pi.entries))
+	pi.entryTimes = nil
 	for i, file := range pi.entries {
 		xattr := pi.xAttrFromSys(file.Sys())
+		if t := timesFromSys(file.Sys()); !t.IsZero() {
+			if pi.entryTimes == nil {
+				pi.entryTimes = make([]Times, len(pi.entries))
+			}
+			pi.entryTimes[i] = t
+		}
 		if pi.xattr.UID == xattr.UID {
 			prefixUserMap.set(i)
 		} else {
@@ -280,6 +384,12 @@ func (pi *T) createIDMapsAndInodes() error {
 			mi := newIDMapIfNeeded(&pi.groupIDMap, xattr.GID, len(pi.entries))
 			pi.groupIDMap[mi].set(i)
 		}
+		if project := projectIDFromSys(file.Sys()); pi.projectID == project {
+			prefixProjectMap.set(i)
+		} else {
+			mi := newIDMapIfNeeded(&pi.projectMap, project, len(pi.entries))
+			pi.projectMap[mi].set(i)
+		}
 		pi.inodes[i] = xattr.FileID
 		pi.blocks[i] = xattr.Blocks
 	}
@@ -290,6 +400,9 @@ func (pi *T) createIDMapsAndInodes() error {
 	if len(pi.groupIDMap) > 0 {
 		pi.groupIDMap = append([]idMap{prefixGroupMap}, pi.groupIDMap...)
 	}
+	if len(pi.projectMap) > 0 {
+		pi.projectMap = append([]idMap{prefixProjectMap}, pi.projectMap...)
+	}
 	return nil
 }
 
@@ -299,13 +412,16 @@ func (pi *T) validateSingleIDMaps(idms idMaps) error {
 		if _, ok := ids[idm.ID]; ok {
 			return fmt.Errorf("duplicate id: %v", idm.ID)
 		}
+		if len(idm.Pos) != len(pi.entries)/64+1 {
+			return fmt.Errorf("id %v: invalid map size: %v", idm.ID, len(idm.Pos))
+		}
 		ids[idm.ID] = struct{}{}
 	}
 	return nil
 }
 
 func (pi *T) validateIDMaps() error {
-	if pi.userIDMap == nil && pi.groupIDMap == nil {
+	if pi.userIDMap == nil && pi.groupIDMap == nil && pi.projectMap == nil {
 		return nil
 	}
 	if err := pi.validateSingleIDMaps(pi.userIDMap); err != nil {
@@ -314,6 +430,9 @@ func (pi *T) validateIDMaps() error {
 	if err := pi.validateSingleIDMaps(pi.groupIDMap); err != nil {
 		return fmt.Errorf("group id maps: %v", err)
 	}
+	if err := pi.validateSingleIDMaps(pi.projectMap); err != nil {
+		return fmt.Errorf("project id maps: %v", err)
+	}
 	for i := range pi.entries {
 		if pi.userIDMap != nil {
 			if _, ok := pi.userIDMap.idForPos(i); !ok {
@@ -325,15 +444,35 @@ func (pi *T) validateIDMaps() error {
 				return fmt.Errorf("missing group id for file %v", i)
 			}
 		}
+		if pi.projectMap != nil {
+			if _, ok := pi.projectMap.idForPos(i); !ok {
+				return fmt.Errorf("missing project id for file %v", i)
+			}
+		}
 	}
 	return nil
 }
 
+func (pi *T) entryTimesFor(i int) *Times {
+	if pi.entryTimes == nil {
+		return nil
+	}
+	return &pi.entryTimes[i]
+}
+
+func (pi *T) fsOnlyFor(i int) fsOnly {
+	project := pi.projectID
+	if len(pi.projectMap) > 0 {
+		project, _ = pi.projectMap.idForPos(i)
+	}
+	return fsOnly{pi.inodes[i], pi.blocks[i], pi.entryTimesFor(i), project}
+}
+
 func (pi *T) finalizePerFileInfo() {
 	if len(pi.userIDMap) == 0 && len(pi.groupIDMap) == 0 {
 		// All files have the same info as the prefix.
 		for i := range pi.entries {
-			(&pi.entries[i]).SetSys(fsOnly{pi.inodes[i], pi.blocks[i]})
+			(&pi.entries[i]).SetSys(pi.fsOnlyFor(i))
 		}
 		return
 	}
@@ -347,7 +486,7 @@ func (pi *T) finalizePerFileInfo() {
 			gid, _ = pi.groupIDMap.idForPos(i)
 		}
 		(&pi.entries[i]).SetSys(idAndFS{
-			uid: uid, gid: gid, fsOnly: fsOnly{pi.inodes[i], pi.blocks[i]}})
+			uid: uid, gid: gid, fsOnly: pi.fsOnlyFor(i)})
 	}
 
 }
@@ -416,30 +555,29 @@ func (s *idmapScanner) Info() file.Info {
 // UserIDScan returns an IDSanner for the supplied user id. It can
 // only be used after Finalize has been called.
 func (pi *T) UserIDScan(id int64) (IDSanner, error) {
-	return pi.newIDScan(id, true, pi.userIDMap)
+	return pi.newIDScan(id, pi.xattr.UID, "user", pi.userIDMap)
 }
 
 // GroupIDScan returns an IDSanner for the supplied group id.
 func (pi *T) GroupIDScan(id int64) (IDSanner, error) {
-	return pi.newIDScan(id, false, pi.groupIDMap)
+	return pi.newIDScan(id, pi.xattr.GID, "group", pi.groupIDMap)
+}
+
+// ProjectIDScan returns an IDSanner for the supplied project id.
+func (pi *T) ProjectIDScan(id int64) (IDSanner, error) {
+	return pi.newIDScan(id, pi.projectID, "project", pi.projectMap)
 }
 
-func (pi *T) newIDScan(id int64, userID bool, idms idMaps) (IDSanner, error) {
+func (pi *T) newIDScan(id, prefixID int64, kind string, idms idMaps) (IDSanner, error) {
 	if !pi.finalized {
 		return nil, fmt.Errorf("prefix info not finalized")
 	}
 	idm := idms.idMapFor(id)
 	if idm < 0 {
-		if userID && id == pi.xattr.UID {
-			return &nullScanner{entries: pi.entries}, nil
-		}
-		if !userID && id == pi.xattr.GID {
+		if id == prefixID {
 			return &nullScanner{entries: pi.entries}, nil
 		}
-		if userID {
-			return nil, fmt.Errorf("no such user id: %v", id)
-		}
-		return nil, fmt.Errorf("no such group id: %v", id)
+		return nil, fmt.Errorf("no such %v id: %v", kind, id)
 	}
 	return &idmapScanner{sc: newIDMapScanner(idms[idm]), entries: pi.entries}, nil
 }
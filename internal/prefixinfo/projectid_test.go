@@ -0,0 +1,94 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package prefixinfo_test
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/file"
+)
+
+func newInfoWithProject(name string, modTime time.Time, uid int64, ino uint64, project int64) file.Info {
+	return file.NewInfo(name, 1, 0600, modTime,
+		prefixinfo.XAttrAndTimes{
+			XAttr:     file.XAttr{UID: uid, GID: 2, Device: 1, FileID: ino, Blocks: 1},
+			ProjectID: project,
+		})
+}
+
+func scanProjects(t *testing.T, pi *prefixinfo.T, id int64) []string {
+	sc, err := pi.ProjectIDScan(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scanFilesByID(sc)
+}
+
+func TestProjectIDs(t *testing.T) {
+	modTime := time.Now().Truncate(0)
+	for _, tc := range []struct {
+		prefix   int64
+		projects []int64
+		version  byte
+	}{
+		{0, []int64{0, 0, 0}, 0x2},
+		{10, []int64{10, 10, 10}, 0x4},
+		{0, []int64{0, 11, 0}, 0x4},
+		{10, []int64{10, 11, 12}, 0x4},
+	} {
+		dir := file.NewInfo("dir", 1, 0700|fs.ModeDir, modTime,
+			prefixinfo.XAttrAndTimes{
+				XAttr:     file.XAttr{UID: 1, GID: 2, Device: 1, FileID: 10, Blocks: 1},
+				ProjectID: tc.prefix,
+			})
+		pi := prefixinfo.New("dir", dir)
+		// Use a different uid for the last file to exercise both
+		// of the internal per-file representations.
+		pi.AppendInfoList(file.InfoList{
+			newInfoWithProject("a", modTime, 1, 11, tc.projects[0]),
+			newInfoWithProject("b", modTime, 1, 12, tc.projects[1]),
+			newInfoWithProject("c", modTime, 3, 13, tc.projects[2]),
+		})
+
+		buf, err := pi.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := buf[0], tc.version; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+
+		for _, fn := range []prefixinfo.RoundTripper{
+			prefixinfo.GobRoundTrip, prefixinfo.BinaryRoundTrip,
+		} {
+			npi := fn(t, &pi)
+			if got, want := npi.ProjectID(), tc.prefix; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			byProject := map[int64][]string{}
+			for i, fi := range npi.InfoList() {
+				if got, want := npi.ProjectIDInfo(fi), tc.projects[i]; got != want {
+					t.Errorf("%v: got %v, want %v", fi.Name(), got, want)
+				}
+				byProject[tc.projects[i]] = append(byProject[tc.projects[i]], fi.Name())
+			}
+			for id, want := range byProject {
+				if got := scanProjects(t, &npi, id); !reflect.DeepEqual(got, want) {
+					t.Errorf("project %v: got %v, want %v", id, got, want)
+				}
+			}
+			if _, err := npi.ProjectIDScan(1000); err == nil || err.Error() != "no such project id: 1000" {
+				t.Errorf("missing or unexpected error: %v", err)
+			}
+			if got, want := npi.XAttrInfo(npi.InfoList()[2]).UID, int64(3); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		}
+	}
+}
@@ -6,6 +6,8 @@ package prefixinfo
 
 import (
 	"encoding/binary"
+
+	"cloudeng.io/cmd/idu/internal/decoder"
 )
 
 type Stats struct {
@@ -33,26 +35,26 @@ func (s *Stats) MarshalBinary() (data []byte, err error) {
 	return s.AppendBinary(make([]byte, 0, 100)), nil
 }
 
-func (s *Stats) DecodeBinary(data []byte) []byte {
-	var n int
-	id, n := binary.Uvarint(data)
-	data = data[n:]
-	s.ID = uint32(id)
-	s.Files, n = binary.Varint(data)
-	data = data[n:]
-	s.Bytes, n = binary.Varint(data)
-	data = data[n:]
-	s.StorageBytes, n = binary.Varint(data)
-	data = data[n:]
-	s.PrefixBytes, n = binary.Varint(data)
-	data = data[n:]
-	s.Prefixes, n = binary.Varint(data)
-	return data[n:]
+// DecodeBinary decodes a Stats created by AppendBinary and returns the
+// remaining data.
+func (s *Stats) DecodeBinary(data []byte) ([]byte, error) {
+	d := decoder.New("Stats", data)
+	s.decode(d)
+	return d.Remaining(), d.Err()
+}
+
+func (s *Stats) decode(d *decoder.T) {
+	s.ID = uint32(d.Uvarint("id"))
+	s.Files = d.Varint("files")
+	s.Bytes = d.Varint("bytes")
+	s.StorageBytes = d.Varint("storage bytes")
+	s.PrefixBytes = d.Varint("prefix bytes")
+	s.Prefixes = d.Varint("prefixes")
 }
 
 func (s *Stats) UnmarshalBinary(data []byte) error {
-	s.DecodeBinary(data)
-	return nil
+	_, err := s.DecodeBinary(data)
+	return err
 }
 
 func (sl StatsList) AppendBinary(data []byte) []byte {
@@ -67,18 +69,19 @@ func (sl StatsList) MarshalBinary() (data []byte, err error) {
 	return sl.AppendBinary(make([]byte, 0, 100)), nil
 }
 
-func (sl *StatsList) DecodeBinary(data []byte) []byte {
-	var n int
-	l, n := binary.Uvarint(data)
-	data = data[n:]
+// DecodeBinary decodes a StatsList created by AppendBinary and returns
+// the remaining data.
+func (sl *StatsList) DecodeBinary(data []byte) ([]byte, error) {
+	d := decoder.New("StatsList", data)
+	l := d.Length("number of stats")
 	*sl = make([]Stats, l)
 	for i := range *sl {
-		data = (*sl)[i].DecodeBinary(data)
+		(*sl)[i].decode(d)
 	}
-	return data
+	return d.Remaining(), d.Err()
 }
 
 func (sl *StatsList) UnmarshalBinary(data []byte) error {
-	sl.DecodeBinary(data)
-	return nil
+	_, err := sl.DecodeBinary(data)
+	return err
 }
@@ -0,0 +1,117 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package prefixinfo
+
+import (
+	"encoding/binary"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/decoder"
+	"cloudeng.io/file"
+)
+
+// Times represents the access, change and birth times for a file or
+// prefix. Any of these may be zero if they are not supported by the
+// underlying filesystem or were not requested to be recorded.
+type Times struct {
+	Access time.Time
+	Change time.Time
+	Birth  time.Time
+}
+
+// IsZero returns true if none of the times are set.
+func (t Times) IsZero() bool {
+	return t.Access.IsZero() && t.Change.IsZero() && t.Birth.IsZero()
+}
+
+// XAttrAndTimes may be used as the Sys() value for the file.Info's
+// supplied to New, AppendInfo etc. in order to have the access, change
+// and birth times, and the project ID, stored alongside the file.XAttr
+// information. A ProjectID of zero, the default project, is treated as
+// not being set.
+type XAttrAndTimes struct {
+	file.XAttr
+	Times     Times
+	ProjectID int64
+}
+
+type timesMask uint8
+
+const (
+	accessTime timesMask = 1 << iota
+	changeTime
+	birthTime
+)
+
+func (t Times) mask() timesMask {
+	var m timesMask
+	if !t.Access.IsZero() {
+		m |= accessTime
+	}
+	if !t.Change.IsZero() {
+		m |= changeTime
+	}
+	if !t.Birth.IsZero() {
+		m |= birthTime
+	}
+	return m
+}
+
+func appendTime(data []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return binary.AppendVarint(data, 0)
+	}
+	return binary.AppendVarint(data, t.UnixNano())
+}
+
+func decodeTime(d *decoder.T) time.Time {
+	if ns := d.Varint("time"); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+func (t Times) appendBinary(data []byte, m timesMask) []byte {
+	if m&accessTime != 0 {
+		data = appendTime(data, t.Access)
+	}
+	if m&changeTime != 0 {
+		data = appendTime(data, t.Change)
+	}
+	if m&birthTime != 0 {
+		data = appendTime(data, t.Birth)
+	}
+	return data
+}
+
+func (t *Times) decode(d *decoder.T, m timesMask) {
+	if m&accessTime != 0 {
+		t.Access = decodeTime(d)
+	}
+	if m&changeTime != 0 {
+		t.Change = decodeTime(d)
+	}
+	if m&birthTime != 0 {
+		t.Birth = decodeTime(d)
+	}
+}
+
+func timesFromSys(v any) Times {
+	switch s := v.(type) {
+	case fsOnly:
+		if s.times != nil {
+			return *s.times
+		}
+	case idAndFS:
+		if s.times != nil {
+			return *s.times
+		}
+	case XAttrAndTimes:
+		return s.Times
+	case *XAttrAndTimes:
+		return s.Times
+	}
+	return Times{}
+}
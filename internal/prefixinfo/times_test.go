@@ -0,0 +1,86 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package prefixinfo_test
+
+import (
+	"io/fs"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/file"
+)
+
+func newInfoWithTimes(name string, modTime time.Time, uid, gid int64, ino uint64, times prefixinfo.Times) file.Info {
+	return file.NewInfo(name, 1, 0600, modTime,
+		prefixinfo.XAttrAndTimes{
+			XAttr: file.XAttr{UID: uid, GID: gid, Device: 1, FileID: ino, Blocks: 1},
+			Times: times,
+		})
+}
+
+func TestTimes(t *testing.T) {
+	modTime := time.Now().Truncate(0)
+	access := modTime.Add(time.Hour)
+	change := modTime.Add(time.Minute)
+	birth := modTime.Add(-time.Hour)
+
+	for _, tc := range []struct {
+		prefix prefixinfo.Times
+		first  prefixinfo.Times
+		second prefixinfo.Times
+	}{
+		{prefixinfo.Times{}, prefixinfo.Times{}, prefixinfo.Times{}},
+		{prefixinfo.Times{Access: access}, prefixinfo.Times{}, prefixinfo.Times{}},
+		{prefixinfo.Times{}, prefixinfo.Times{Access: access, Change: change}, prefixinfo.Times{}},
+		{prefixinfo.Times{Access: access, Change: change, Birth: birth},
+			prefixinfo.Times{Access: access, Change: change},
+			prefixinfo.Times{Access: access, Change: change, Birth: birth}},
+	} {
+		dir := file.NewInfo("dir", 1, 0700|fs.ModeDir, modTime,
+			prefixinfo.XAttrAndTimes{
+				XAttr: file.XAttr{UID: 1, GID: 2, Device: 1, FileID: 10, Blocks: 1},
+				Times: tc.prefix,
+			})
+		pi := prefixinfo.New("dir", dir)
+		// Use a different uid for the second file to exercise both
+		// of the internal per-file representations.
+		pi.AppendInfoList(file.InfoList{
+			newInfoWithTimes("a", modTime, 1, 2, 11, tc.first),
+			newInfoWithTimes("b", modTime, 3, 2, 12, tc.second),
+		})
+
+		buf, err := pi.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		version := byte(0x2)
+		if !tc.prefix.IsZero() || !tc.first.IsZero() || !tc.second.IsZero() {
+			version = 0x3
+		}
+		if got, want := buf[0], version; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+
+		for _, fn := range []prefixinfo.RoundTripper{
+			prefixinfo.GobRoundTrip, prefixinfo.BinaryRoundTrip,
+		} {
+			npi := fn(t, &pi)
+			if got, want := npi.Times(), tc.prefix; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			entries := npi.InfoList()
+			if got, want := npi.TimesInfo(entries[0]), tc.first; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := npi.TimesInfo(entries[1]), tc.second; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := npi.XAttrInfo(entries[1]).UID, int64(3); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		}
+	}
+}
@@ -11,8 +11,10 @@ import (
 )
 
 type fsOnly struct {
-	ino    uint64
-	blocks int64
+	ino     uint64
+	blocks  int64
+	times   *Times
+	project int64
 }
 
 type idAndFS struct {
@@ -40,10 +42,28 @@ func (pi *T) xAttrFromSys(v any) file.XAttr {
 		return *s
 	case file.XAttr:
 		return s
+	case XAttrAndTimes:
+		return s.XAttr
+	case *XAttrAndTimes:
+		return s.XAttr
 	}
 	panic(fmt.Sprintf("unrecognised system information %T", v))
 }
 
+func projectIDFromSys(v any) int64 {
+	switch s := v.(type) {
+	case fsOnly:
+		return s.project
+	case idAndFS:
+		return s.project
+	case XAttrAndTimes:
+		return s.ProjectID
+	case *XAttrAndTimes:
+		return s.ProjectID
+	}
+	return 0
+}
+
 // NewSysInfo is intended to be used by tests.
 func NewSysInfo(uid, gid int64, dev, ino uint64, blocks int64) any {
 	return &file.XAttr{
@@ -0,0 +1,105 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket whose rate may be changed whilst it is in use.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewBucket returns a new Bucket that allows rate operations per second
+// with bursts of up to burst operations. A rate of zero means no limit.
+func NewBucket(rate float64, burst int) *Bucket {
+	b := &Bucket{now: time.Now}
+	b.SetRate(rate, burst)
+	return b
+}
+
+// SetRate changes the rate and burst size of the bucket. If burst is
+// zero, it defaults to one tenth of the rate.
+func (b *Bucket) SetRate(rate float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked()
+	unlimited := b.rate <= 0
+	b.rate = rate
+	b.burst = float64(burst)
+	if burst == 0 {
+		b.burst = rate / 10
+	}
+	b.burst = max(b.burst, 1)
+	if unlimited {
+		// Allow an initial burst when going from no limit to a limit.
+		b.tokens = b.burst
+	}
+	b.tokens = min(b.tokens, b.burst)
+}
+
+// Rate returns the current rate.
+func (b *Bucket) Rate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+func (b *Bucket) refillLocked() {
+	now := b.now()
+	if !b.last.IsZero() && b.rate > 0 {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	}
+	b.last = now
+}
+
+// reserve takes a token from the bucket and returns how long the caller
+// must wait before using it.
+func (b *Bucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refillLocked()
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *Bucket) unreserve() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate > 0 {
+		b.tokens = min(b.tokens+1, b.burst)
+	}
+}
+
+// Wait blocks until an operation may proceed or the context is canceled.
+func (b *Bucket) Wait(ctx context.Context) error {
+	delay := b.reserve()
+	if delay == 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.unreserve()
+		return ctx.Err()
+	}
+}
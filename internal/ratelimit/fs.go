@@ -0,0 +1,63 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"context"
+
+	"cloudeng.io/file"
+	"cloudeng.io/file/filewalk"
+)
+
+type fsys struct {
+	filewalk.FS
+	l *Limiter
+}
+
+// FS returns a filewalk.FS whose Stat, Lstat and directory scan
+// operations are rate limited by the limiter. Each call to the Scan
+// method of a filewalk.LevelScanner counts as a single operation.
+func (l *Limiter) FS(fs filewalk.FS) filewalk.FS {
+	return &fsys{FS: fs, l: l}
+}
+
+func (f *fsys) Stat(ctx context.Context, path string) (file.Info, error) {
+	if err := f.l.Wait(ctx); err != nil {
+		return file.Info{}, err
+	}
+	return f.FS.Stat(ctx, path)
+}
+
+func (f *fsys) Lstat(ctx context.Context, path string) (file.Info, error) {
+	if err := f.l.Wait(ctx); err != nil {
+		return file.Info{}, err
+	}
+	return f.FS.Lstat(ctx, path)
+}
+
+func (f *fsys) LevelScanner(path string) filewalk.LevelScanner {
+	return &scanner{LevelScanner: f.FS.LevelScanner(path), l: f.l}
+}
+
+type scanner struct {
+	filewalk.LevelScanner
+	l   *Limiter
+	err error
+}
+
+func (s *scanner) Scan(ctx context.Context, n int) bool {
+	if err := s.l.Wait(ctx); err != nil {
+		s.err = err
+		return false
+	}
+	return s.LevelScanner.Scan(ctx, n)
+}
+
+func (s *scanner) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.LevelScanner.Err()
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package ratelimit provides support for limiting the rate at which
+// filesystem metadata operations are issued according to a schedule.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/config"
+)
+
+// Applied records a rate limit and the time from which it was applied.
+type Applied struct {
+	From         time.Time `json:"from"`
+	OpsPerSecond float64   `json:"ops_per_second"`
+}
+
+// Limiter limits the rate of operations according to a config.RateLimit,
+// re-evaluating the schedule at most once per second.
+type Limiter struct {
+	cfg      config.RateLimit
+	bucket   *Bucket
+	now      func() time.Time
+	onChange func(Applied)
+
+	mu      sync.Mutex
+	checked time.Time
+	applied []Applied
+}
+
+// Option represents an option to New.
+type Option func(*Limiter)
+
+// WithOnChange sets a function to be called whenever a new rate limit
+// is applied.
+func WithOnChange(fn func(Applied)) Option {
+	return func(l *Limiter) {
+		l.onChange = fn
+	}
+}
+
+// WithClock sets the function used to obtain the current time.
+func WithClock(now func() time.Time) Option {
+	return func(l *Limiter) {
+		l.now = now
+	}
+}
+
+// New returns a new Limiter for the supplied configuration.
+func New(cfg config.RateLimit, opts ...Option) *Limiter {
+	l := &Limiter{cfg: cfg, now: time.Now}
+	for _, fn := range opts {
+		fn(l)
+	}
+	l.bucket = NewBucket(0, cfg.Burst)
+	l.bucket.now = l.now
+	return l
+}
+
+// Wait blocks until an operation may proceed, according to the rate
+// limit that currently applies, or the context is canceled.
+func (l *Limiter) Wait(ctx context.Context) error {
+	l.update()
+	return l.bucket.Wait(ctx)
+}
+
+func (l *Limiter) update() {
+	now := l.now()
+	l.mu.Lock()
+	if !l.checked.IsZero() && now.Sub(l.checked) < time.Second {
+		l.mu.Unlock()
+		return
+	}
+	l.checked = now
+	rate := l.cfg.RateAt(now)
+	if n := len(l.applied); n > 0 && l.applied[n-1].OpsPerSecond == rate {
+		l.mu.Unlock()
+		return
+	}
+	applied := Applied{From: now, OpsPerSecond: rate}
+	l.applied = append(l.applied, applied)
+	l.bucket.SetRate(rate, l.cfg.Burst)
+	l.mu.Unlock()
+	if l.onChange != nil {
+		l.onChange(applied)
+	}
+}
+
+// Applied returns the rate limits that have been applied so far.
+func (l *Limiter) Applied() []Applied {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Applied(nil), l.applied...)
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/ratelimit"
+)
+
+func TestBucket(t *testing.T) {
+	ctx := context.Background()
+	b := ratelimit.NewBucket(1000, 1)
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		if err := b.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if took := time.Since(start); took < 150*time.Millisecond || took > 5*time.Second {
+		t.Errorf("unexpected duration: %v", took)
+	}
+
+	// No limit.
+	b.SetRate(0, 0)
+	start = time.Now()
+	for i := 0; i < 10000; i++ {
+		if err := b.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("unexpected duration: %v", took)
+	}
+
+	// Canceled waits return promptly.
+	b.SetRate(0.001, 1)
+	_ = b.Wait(ctx) // consume the initial burst.
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(cctx); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := config.ParseConfig([]byte(`
+- prefix: /tmp
+  rate_limit:
+    schedule:
+      - start: "09:00"
+        end: "17:00"
+        ops_per_second: 1000000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 4, 8, 0, 0, 0, time.Local)
+	var changes []ratelimit.Applied
+	l := ratelimit.New(cfg.Prefixes[0].RateLimit,
+		ratelimit.WithClock(func() time.Time { return now }),
+		ratelimit.WithOnChange(func(a ratelimit.Applied) { changes = append(changes, a) }))
+
+	for _, tc := range []struct {
+		advance time.Duration
+		changes int
+	}{
+		{0, 1},
+		{time.Hour - 500*time.Millisecond, 1},
+		// The schedule is re-evaluated at most once a second.
+		{time.Hour, 1},
+		{time.Hour + time.Second, 2},
+		{9 * time.Hour, 3},
+	} {
+		now = time.Date(2024, 3, 4, 8, 0, 0, 0, time.Local).Add(tc.advance)
+		if err := l.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(l.Applied()), tc.changes; got != want {
+			t.Errorf("%v: got %v, want %v", tc.advance, got, want)
+		}
+	}
+	applied := l.Applied()
+	for i, want := range []float64{0, 1000000, 0} {
+		if got := applied[i].OpsPerSecond; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+	if got, want := len(changes), 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
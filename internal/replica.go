@@ -0,0 +1,141 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database"
+)
+
+// Replicas are published to directories, named for the time at which
+// they were published, within the configured replica directory. The name
+// of the most recently published replica is recorded in the CURRENT file
+// which is replaced atomically, via a rename, so that readers only ever
+// see complete replicas.
+const (
+	currentReplicaFile = "CURRENT"
+	replicaTimeFormat  = "20060102T150405.000000000Z"
+)
+
+// PublishReplica publishes a replica of db, which must have been opened
+// for writing, to the directory specified by cfg and removes all but the
+// most recent cfg.Keep replicas. It returns the location of the newly
+// published replica.
+func PublishReplica(ctx context.Context, db database.DB, cfg config.Replica) (string, error) {
+	if err := os.MkdirAll(cfg.Directory, 0770); err != nil {
+		return "", err
+	}
+	name := time.Now().UTC().Format(replicaTimeFormat)
+	tmp := filepath.Join(cfg.Directory, "."+name)
+	if err := db.Snapshot(ctx, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	location := filepath.Join(cfg.Directory, name)
+	if err := os.Rename(tmp, location); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	current := filepath.Join(cfg.Directory, currentReplicaFile)
+	if err := os.WriteFile(current+".tmp", []byte(name+"\n"), 0660); err != nil {
+		return "", err
+	}
+	if err := os.Rename(current+".tmp", current); err != nil {
+		return "", err
+	}
+	return location, removeStaleReplicas(cfg.Directory, cfg.Keep)
+}
+
+// removeStaleReplicas removes all but the most recent keep replicas as
+// well as any left over from an interrupted publication. Replicas that
+// are still being read may be removed on systems, such as Unix, that
+// allow open files to be removed since the readers retain access to them.
+func removeStaleReplicas(dir string, keep int) error {
+	published, partial, err := replicaNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range partial {
+		os.RemoveAll(filepath.Join(dir, name))
+	}
+	for len(published) > keep {
+		if err := os.RemoveAll(filepath.Join(dir, published[0])); err != nil {
+			return err
+		}
+		published = published[1:]
+	}
+	return nil
+}
+
+// replicaNames returns the names of the published replicas in dir, oldest
+// first, and of any partially published ones.
+func replicaNames(dir string) (published, partial []string, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(name, ".") {
+			partial = append(partial, name)
+			continue
+		}
+		if _, err := time.Parse(replicaTimeFormat, name); err == nil {
+			published = append(published, name)
+		}
+	}
+	slices.Sort(published)
+	return published, partial, nil
+}
+
+// PublishedReplicas returns the locations of all of the currently
+// published replicas, oldest first.
+func PublishedReplicas(cfg config.Replica) ([]string, error) {
+	published, _, err := replicaNames(cfg.Directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	locations := make([]string, len(published))
+	for i, name := range published {
+		locations[i] = filepath.Join(cfg.Directory, name)
+	}
+	return locations, nil
+}
+
+// LatestReplica returns the location of, and the time of publication of,
+// the most recently published replica. An empty location is returned if
+// no replica has been published.
+func LatestReplica(cfg config.Replica) (string, time.Time, error) {
+	buf, err := os.ReadFile(filepath.Join(cfg.Directory, currentReplicaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", time.Time{}, nil
+		}
+		return "", time.Time{}, err
+	}
+	name := strings.TrimSpace(string(buf))
+	published, err := time.Parse(replicaTimeFormat, name)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	location := filepath.Join(cfg.Directory, name)
+	if _, err := os.Stat(location); err != nil {
+		return "", time.Time{}, err
+	}
+	return location, published, nil
+}
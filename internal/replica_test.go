@@ -0,0 +1,130 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package internal_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/file"
+)
+
+func TestReplica(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	cfg := config.Prefix{
+		Prefix:    "/a",
+		Database:  filepath.Join(tmpDir, "db"),
+		Separator: "/",
+		Replica: config.Replica{
+			Enabled:   true,
+			Directory: filepath.Join(tmpDir, "replica"),
+			Keep:      2,
+		},
+	}
+
+	analyze := func(prefix string) {
+		sdb, err := internal.NewScanDB(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pi := prefixinfo.New(prefix, file.NewInfo(filepath.Base(prefix), 1, 0700, time.Now(), file.XAttr{UID: 1, GID: 2}))
+		if err := sdb.SetPrefixInfo(ctx, prefix, false, &pi); err != nil {
+			t.Fatal(err)
+		}
+		if err := sdb.LogAndClose(ctx, time.Now(), time.Now(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	analyze("/a/0")
+
+	location, published, err := internal.LatestReplica(cfg.Replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(location) == 0 || published.IsZero() {
+		t.Fatalf("no replica was published")
+	}
+
+	// Readers must not wait for a writer that holds the database.
+	wdb, err := internal.OpenDatabase(ctx, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wdb.Set(ctx, "/a/1", []byte("unpublished"), false); err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	rdb, err := internal.OpenReplicaOrDatabase(tctx, cfg)
+	if err != nil {
+		t.Fatalf("failed to open replica while the database is held for writing: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := rdb.Get(ctx, "/a/0", &buf); err != nil || buf.Len() == 0 {
+		t.Errorf("missing published prefix: %v", err)
+	}
+	buf.Reset()
+	if err := rdb.Get(ctx, "/a/1", &buf); err != nil || buf.Len() != 0 {
+		t.Errorf("unexpected unpublished prefix: %v", err)
+	}
+	rdb.Close(ctx)
+	wdb.Close(ctx)
+
+	// Other commands must always use the database itself since only
+	// analyze publishes replicas.
+	pdb, err := internal.OpenDatabase(ctx, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := pdb.Get(ctx, "/a/1", &buf); err != nil || buf.Len() == 0 {
+		t.Errorf("database was not opened: %v", err)
+	}
+	pdb.Close(ctx)
+
+	// Only the most recent replicas are kept.
+	for i := 2; i < 5; i++ {
+		analyze("/a/" + string(rune('0'+i)))
+	}
+	entries, err := os.ReadDir(cfg.Replica.Directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs int
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs++
+		}
+	}
+	if got, want := dirs, 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	latest, _, err := internal.LatestReplica(cfg.Replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == location {
+		t.Errorf("replica was not republished")
+	}
+	rdb, err = internal.OpenReplicaOrDatabase(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close(ctx)
+	for _, k := range []string{"/a/0", "/a/1", "/a/4"} {
+		buf.Reset()
+		if err := rdb.Get(ctx, k, &buf); err != nil || buf.Len() == 0 {
+			t.Errorf("%v: missing from replica: %v", k, err)
+		}
+	}
+}
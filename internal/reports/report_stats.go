@@ -5,6 +5,8 @@
 package reports
 
 import (
+	"time"
+
 	"cloudeng.io/algo/container/heap"
 	"cloudeng.io/cmd/idu/internal/boolexpr"
 	"cloudeng.io/cmd/idu/internal/prefixinfo"
@@ -24,11 +26,16 @@ type Heaps[T comparable] struct {
 	TotalPrefixBytes              int64
 	TotalHardlinks                int64
 	TotalHardlinkDirs             int64
+	TotalSparseFiles              int64
+	TotalSparseSavings            int64
+	TotalOverAllocatedFiles       int64
+	TotalOverAllocatedBytes       int64
 	Bytes                         *heap.MinMax[int64, T]
 	StorageBytes                  *heap.MinMax[int64, T]
 	PrefixBytes                   *heap.MinMax[int64, T]
 	Files                         *heap.MinMax[int64, T]
 	Prefixes                      *heap.MinMax[int64, T]
+	SparseSavings                 *heap.MinMax[int64, T]
 }
 
 // PerIDStats is a collection of statistics on a per user/group basis.
@@ -41,29 +48,43 @@ type PerIDStats struct {
 // AllStats is a collection of statistics for a given prefix and includes:
 // - the top N values for each statistic by prefix
 // - the total for each statistic
-// - the top N values for/per each statistic by user/group
-// - the topN user/groups by each statistic
+// - the top N values for/per each statistic by user/group/project
+// - the topN user/groups/projects by each statistic
+// - a histogram of the access ages of all files
+// - optionally, the totals for every subtree down to a given depth
+//
+// PerProject and ByProject will be empty if no project IDs were recorded
+// and ByProject will be nil for stats computed before project IDs
+// were supported. Subtrees will be nil unless TrackSubtrees was called
+// and for stats computed before subtrees were supported.
 type AllStats struct {
-	MaxN     int
-	Prefix   *Heaps[string]
-	PerUser  PerIDStats
-	PerGroup PerIDStats
-	ByUser   *Heaps[int64]
-	ByGroup  *Heaps[int64]
+	MaxN       int
+	Prefix     *Heaps[string]
+	PerUser    PerIDStats
+	PerGroup   PerIDStats
+	PerProject PerIDStats
+	ByUser     *Heaps[int64]
+	ByGroup    *Heaps[int64]
+	ByProject  *Heaps[int64]
+	AccessAges *stats.AgeHistogram
+	Subtrees   *Subtree
 
-	userTotals  map[int64]stats.Totals
-	groupTotals map[int64]stats.Totals
+	userTotals    map[int64]stats.Totals
+	groupTotals   map[int64]stats.Totals
+	projectTotals map[int64]stats.Totals
+	subtrees      *subtrees
 }
 
 func newHeaps[T comparable](prefix string, n int) *Heaps[T] {
 	h := &Heaps[T]{
-		MaxN:         n,
-		Prefix:       prefix,
-		Bytes:        heap.NewMinMax[int64, T](),
-		PrefixBytes:  heap.NewMinMax[int64, T](),
-		Files:        heap.NewMinMax[int64, T](),
-		Prefixes:     heap.NewMinMax[int64, T](),
-		StorageBytes: heap.NewMinMax[int64, T](),
+		MaxN:          n,
+		Prefix:        prefix,
+		Bytes:         heap.NewMinMax[int64, T](),
+		PrefixBytes:   heap.NewMinMax[int64, T](),
+		Files:         heap.NewMinMax[int64, T](),
+		Prefixes:      heap.NewMinMax[int64, T](),
+		StorageBytes:  heap.NewMinMax[int64, T](),
+		SparseSavings: heap.NewMinMax[int64, T](),
 	}
 	return h
 }
@@ -81,6 +102,19 @@ func (h *Heaps[T]) Push(item T, bytes, storageBytes, prefixBytes, files, prefixe
 	h.TotalPrefixes += prefixes
 }
 
+// PushAllocation records the sparse and over-allocated file statistics
+// for item. Only items with non-zero savings are recorded in the
+// SparseSavings heap.
+func (h *Heaps[T]) PushAllocation(item T, t stats.Totals) {
+	if t.SparseSavings > 0 {
+		h.SparseSavings.PushMaxN(t.SparseSavings, item, h.MaxN)
+	}
+	h.TotalSparseFiles += t.SparseFiles
+	h.TotalSparseSavings += t.SparseSavings
+	h.TotalOverAllocatedFiles += t.OverAllocatedFiles
+	h.TotalOverAllocatedBytes += t.OverAllocatedBytes
+}
+
 func PopN[T comparable](heap *heap.MinMax[int64, T], n int) (keys []int64, vals []T) {
 	i := 0
 	for heap.Len() > 0 {
@@ -160,7 +194,7 @@ func (h *Heaps[T]) Merge(n int) map[T]MergedStats {
 	})
 	pbb, pbp := PopN(h.PrefixBytes, n)
 	mergesStats(n, merged, pbb, pbp, func(m MergedStats, v int64) MergedStats {
-		m.Prefixes = v
+		m.PrefixBytes = v
 		return m
 	})
 	return merged
@@ -183,53 +217,77 @@ func (s *PerIDStats) Push(id int64, prefix string, size, storageBytes, prefixByt
 
 func NewAllStats(prefix string, n int) *AllStats {
 	return &AllStats{
-		MaxN:        n,
-		Prefix:      newHeaps[string](prefix, n),
-		PerUser:     newPerIDStats(prefix, n),
-		PerGroup:    newPerIDStats(prefix, n),
-		ByUser:      newHeaps[int64](prefix, n),
-		ByGroup:     newHeaps[int64](prefix, n),
-		userTotals:  map[int64]stats.Totals{},
-		groupTotals: map[int64]stats.Totals{},
+		MaxN:          n,
+		Prefix:        newHeaps[string](prefix, n),
+		PerUser:       newPerIDStats(prefix, n),
+		PerGroup:      newPerIDStats(prefix, n),
+		PerProject:    newPerIDStats(prefix, n),
+		ByUser:        newHeaps[int64](prefix, n),
+		ByGroup:       newHeaps[int64](prefix, n),
+		ByProject:     newHeaps[int64](prefix, n),
+		AccessAges:    stats.NewAgeHistogram(time.Now()),
+		userTotals:    map[int64]stats.Totals{},
+		groupTotals:   map[int64]stats.Totals{},
+		projectTotals: map[int64]stats.Totals{},
 	}
 }
 
-func addToMap(stats map[int64]stats.Totals, id int64, size, storageBytes, prefixBytes, files, prefix, children int64) {
-	s := stats[id]
-	s.Bytes += size
-	s.StorageBytes += storageBytes
-	s.Files += files
-	s.SubPrefixes += children
-	s.PrefixBytes += prefixBytes
-	s.Prefix += prefix
-	stats[id] = s
+func addToMap(stats map[int64]stats.Totals, t stats.Totals) {
+	s := stats[t.ID]
+	s.Bytes += t.Bytes
+	s.StorageBytes += t.StorageBytes
+	s.Files += t.Files
+	s.SubPrefixes += t.SubPrefixes
+	s.PrefixBytes += t.PrefixBytes
+	s.Prefix += t.Prefix
+	s.SparseFiles += t.SparseFiles
+	s.SparseSavings += t.SparseSavings
+	s.OverAllocatedFiles += t.OverAllocatedFiles
+	s.OverAllocatedBytes += t.OverAllocatedBytes
+	stats[t.ID] = s
 }
 
 func (s *AllStats) PushPerUserStats(prefix string, us stats.PerIDTotals) {
 	for _, u := range us {
 		s.PerUser.Push(u.ID, prefix, u.Bytes, u.StorageBytes, u.PrefixBytes, u.Files, u.Prefix, u.SubPrefixes)
-		addToMap(s.userTotals, u.ID, u.Bytes, u.StorageBytes, u.PrefixBytes, u.Files, u.Prefix, u.SubPrefixes)
+		addToMap(s.userTotals, u)
 	}
 }
 
 func (s *AllStats) PushPerGroupStats(prefix string, ug stats.PerIDTotals) {
 	for _, g := range ug {
 		s.PerGroup.Push(g.ID, prefix, g.Bytes, g.StorageBytes, g.PrefixBytes, g.Files, g.Prefix, g.SubPrefixes)
-		addToMap(s.groupTotals, g.ID, g.Bytes, g.StorageBytes, g.PrefixBytes, g.Files, g.Prefix, g.SubPrefixes)
+		addToMap(s.groupTotals, g)
+	}
+}
+
+func (s *AllStats) PushPerProjectStats(prefix string, ps stats.PerIDTotals) {
+	for _, p := range ps {
+		s.PerProject.Push(p.ID, prefix, p.Bytes, p.StorageBytes, p.PrefixBytes, p.Files, p.Prefix, p.SubPrefixes)
+		addToMap(s.projectTotals, p)
 	}
 }
 
 func (s *AllStats) Finalize() {
 	for id, stats := range s.userTotals {
 		s.ByUser.Push(id, stats.Bytes, stats.StorageBytes, stats.PrefixBytes, stats.Files, stats.Prefix, stats.SubPrefixes)
+		s.ByUser.PushAllocation(id, stats)
 	}
 	for id, stats := range s.groupTotals {
 		s.ByGroup.Push(id, stats.Bytes, stats.StorageBytes, stats.PrefixBytes, stats.Files, stats.Prefix, stats.SubPrefixes)
+		s.ByGroup.PushAllocation(id, stats)
+	}
+	for id, stats := range s.projectTotals {
+		s.ByProject.Push(id, stats.Bytes, stats.StorageBytes, stats.PrefixBytes, stats.Files, stats.Prefix, stats.SubPrefixes)
+		s.ByProject.PushAllocation(id, stats)
+	}
+	if s.subtrees != nil {
+		s.Subtrees = s.subtrees.finalize(s.MaxN)
 	}
 }
 
 func (s *AllStats) Update(prefix string, pi prefixinfo.T, calc diskusage.Calculator, matcher boolexpr.Matcher) error {
-	totals, users, groups := stats.ComputeTotals(prefix, &pi, calc, matcher)
+	totals, users, groups, projects := stats.ComputeAllTotals(prefix, &pi, calc, matcher, s.AccessAges)
 	s.Prefix.Push(prefix,
 		totals.Bytes,
 		totals.StorageBytes,
@@ -239,7 +297,12 @@ func (s *AllStats) Update(prefix string, pi prefixinfo.T, calc diskusage.Calcula
 		totals.SubPrefixes)
 	s.Prefix.TotalHardlinks += totals.Hardlinks
 	s.Prefix.TotalHardlinkDirs += totals.HardlinkDirs
+	s.Prefix.PushAllocation(prefix, totals)
 	s.PushPerUserStats(prefix, users)
 	s.PushPerGroupStats(prefix, groups)
+	s.PushPerProjectStats(prefix, projects)
+	if s.subtrees != nil {
+		s.subtrees.update(prefix, totals)
+	}
 	return nil
 }
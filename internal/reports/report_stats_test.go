@@ -441,3 +441,119 @@ func testAllIDs(t *testing.T, pikeys []string, pis []prefixinfo.T, totals testSt
 		}
 	}
 }
+
+func TestMerge(t *testing.T) {
+	h := reports.NewAllStats("test", 5).Prefix
+	h.Push("a", 100, 200, 30, 3, 1, 2)
+	h.Push("b", 400, 800, 50, 5, 1, 7)
+	merged := h.Merge(0)
+	if got, want := merged, map[string]reports.MergedStats{
+		"a": {Bytes: 100, Storage: 200, Files: 3, Prefixes: 2, PrefixBytes: 30},
+		"b": {Bytes: 400, Storage: 800, Files: 5, Prefixes: 7, PrefixBytes: 50},
+	}; !maps.Equal(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestSparseSavings(t *testing.T) {
+	now := time.Now()
+	// Each file is 4096 bytes with 1 block (512 bytes) allocated.
+	pa := createPrefixInfo(1, 2, "a",
+		[]file.Info{newInfo("f0", 4096, 1, 0600, now, 1, 2), newInfo("f1", 4096, 1, 0600, now, 10, 2)})
+	pb := createPrefixInfo(1, 2, "b",
+		[]file.Info{newInfo("f0", 4096, 8, 0600, now, 1, 2), newInfo("f1", 4096, 1, 0600, now, 10, 2)})
+
+	sdb := reports.NewAllStats("test", 5)
+	computeStats(t, sdb, sumSizeAndBlocks{}, []string{"a", "b"},
+		boolexpr.AlwaysMatch(boolexpr.NewParserTests(context.Background(), nil)), pa, pb)
+
+	saving := int64(4096 - 512)
+	if got, want := sdb.Prefix.TotalSparseFiles, int64(3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := sdb.Prefix.TotalSparseSavings, 3*saving; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	compareHeap(t, sdb.Prefix.SparseSavings, 2, []int64{2 * saving, saving}, "a", "b")
+	compareHeap(t, sdb.ByUser.SparseSavings, 2, []int64{2 * saving, saving}, 10, 1)
+}
+
+func TestProjects(t *testing.T) {
+	now := time.Now()
+	withProject := func(name string, size int64, project int64) file.Info {
+		return file.NewInfo(name, size, 0600, now, prefixinfo.XAttrAndTimes{
+			XAttr:     file.XAttr{UID: 1, GID: 2, Blocks: 1},
+			ProjectID: project,
+		})
+	}
+	pa := createPrefixInfo(1, 2, "a",
+		[]file.Info{withProject("f0", 100, 10), withProject("f1", 200, 11)})
+	pb := createPrefixInfo(1, 2, "b",
+		[]file.Info{withProject("f0", 400, 11), withProject("f1", 800, 0)})
+
+	sdb := reports.NewAllStats("test", 5)
+	computeStats(t, sdb, sumSizeAndBlocks{}, []string{"a", "b"},
+		boolexpr.AlwaysMatch(boolexpr.NewParserTests(context.Background(), nil)), pa, pb)
+
+	compareIDs(t, sdb.PerProject.ByPrefix, 10, 11)
+	compareHeap(t, sdb.ByProject.Bytes, 2, []int64{600, 100}, 11, 10)
+	compareHeap(t, sdb.PerProject.ByPrefix[11].Bytes, 2, []int64{400, 200}, "b", "a")
+	compareHeap(t, sdb.PerProject.ByPrefix[10].Bytes, 2, []int64{100}, "a")
+}
+
+func TestSubtrees(t *testing.T) {
+	now := time.Now()
+	files := func(sizes ...int64) []file.Info {
+		var fis []file.Info
+		for i, s := range sizes {
+			fis = append(fis, newInfo(fmt.Sprintf("f%v", i), s, 1, 0600, now, 1, 2))
+		}
+		return fis
+	}
+	keys := []string{"/r", "/r/a", "/r/a/x", "/r/a/x/deep", "/r/a/y", "/r/b", "/r/c"}
+	sizes := [][]int64{{1}, {10}, {100, 100}, {1000}, {20}, {5000}, {2}}
+	var pis []prefixinfo.T
+	for i, k := range keys {
+		pis = append(pis, createPrefixInfo(1, 2, k, files(sizes[i]...)))
+	}
+	match := boolexpr.AlwaysMatch(boolexpr.NewParserTests(context.Background(), nil))
+
+	sdb := reports.NewAllStats("/r", 2)
+	sdb.TrackSubtrees("/", 2)
+	computeStats(t, sdb, sumSizeAndBlocks{}, keys, match, pis...)
+
+	type node struct {
+		name  string
+		bytes int64
+	}
+	var got []node
+	var walk func(indent string, st *reports.Subtree)
+	walk = func(indent string, st *reports.Subtree) {
+		got = append(got, node{indent + st.Name, st.Bytes})
+		for _, c := range st.Children {
+			walk(indent+" ", c)
+		}
+	}
+	walk("", sdb.Subtrees)
+
+	// Each prefix is 3 bytes, /r/a/x/deep is accounted for in /r/a/x
+	// and only the two largest children of each prefix are retained.
+	want := []node{
+		{"/r", 6254}, {" b", 5003}, {" a", 1242}, {"  x", 1206}, {"  y", 23},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := sdb.Subtrees.Bytes, sdb.Prefix.TotalBytes; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := sdb.Subtrees.Prefixes, int64(len(keys)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	sdb = reports.NewAllStats("/r", 2)
+	computeStats(t, sdb, sumSizeAndBlocks{}, keys, match, pis...)
+	if sdb.Subtrees != nil {
+		t.Errorf("unexpected subtrees: %v", sdb.Subtrees)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package reports
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	"cloudeng.io/cmd/idu/stats"
+)
+
+// Subtree records the totals for a prefix and everything beneath it. The
+// totals of a prefix include those of its Children as well as those of
+// its own files and of any children that were not retained.
+type Subtree struct {
+	Name         string
+	Bytes        int64
+	StorageBytes int64
+	Files        int64
+	Prefixes     int64
+	Children     []*Subtree
+}
+
+// subtrees accumulates the totals for the prefixes up to a given depth
+// beneath the root; the totals for deeper prefixes are accumulated in
+// their ancestor at that depth.
+type subtrees struct {
+	root  string
+	sep   string
+	depth int
+	nodes map[string]*Subtree
+}
+
+// TrackSubtrees requests that Update also computes the Subtrees for every
+// prefix up to depth levels beneath the root of s, using sep to split
+// prefixes into their components. It must be called before Update.
+func (s *AllStats) TrackSubtrees(sep string, depth int) {
+	s.subtrees = &subtrees{
+		root:  s.Prefix.Prefix,
+		sep:   sep,
+		depth: depth,
+		nodes: map[string]*Subtree{},
+	}
+}
+
+func (st *subtrees) update(prefix string, totals stats.Totals) {
+	rel, ok := strings.CutPrefix(prefix, st.root)
+	if !ok || (len(rel) > 0 && !strings.HasPrefix(rel, st.sep) && !strings.HasSuffix(st.root, st.sep)) {
+		return
+	}
+	rel = strings.Trim(rel, st.sep)
+	if len(rel) > 0 {
+		if parts := strings.Split(rel, st.sep); len(parts) > st.depth {
+			rel = strings.Join(parts[:st.depth], st.sep)
+		}
+	}
+	node := st.node(rel)
+	node.Bytes += totals.Bytes
+	node.StorageBytes += totals.StorageBytes
+	node.Files += totals.Files
+	node.Prefixes += totals.Prefix
+}
+
+// node returns the node for rel, creating it, and any missing
+// ancestors, as required.
+func (st *subtrees) node(rel string) *Subtree {
+	if n, ok := st.nodes[rel]; ok {
+		return n
+	}
+	parent, name := "", rel
+	if idx := strings.LastIndex(rel, st.sep); idx >= 0 {
+		parent, name = rel[:idx], rel[idx+len(st.sep):]
+	}
+	if len(rel) == 0 {
+		name = st.root
+	}
+	n := &Subtree{Name: name}
+	st.nodes[rel] = n
+	if len(rel) > 0 {
+		p := st.node(parent)
+		p.Children = append(p.Children, n)
+	}
+	return n
+}
+
+// finalize adds the totals of every node's children to it, orders the
+// children by decreasing size and retains at most maxChildren of them.
+func (st *subtrees) finalize(maxChildren int) *Subtree {
+	root := st.node("")
+	var sum func(n *Subtree)
+	sum = func(n *Subtree) {
+		for _, c := range n.Children {
+			sum(c)
+			n.Bytes += c.Bytes
+			n.StorageBytes += c.StorageBytes
+			n.Files += c.Files
+			n.Prefixes += c.Prefixes
+		}
+		slices.SortFunc(n.Children, func(a, b *Subtree) int {
+			return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), strings.Compare(a.Name, b.Name))
+		})
+		if len(n.Children) > maxChildren {
+			n.Children = n.Children[:maxChildren]
+		}
+	}
+	sum(root)
+	return root
+}
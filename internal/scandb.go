@@ -16,6 +16,10 @@ import (
 	"cloudeng.io/cmd/idu/internal/config"
 	"cloudeng.io/cmd/idu/internal/database"
 	"cloudeng.io/cmd/idu/internal/database/badgerdb"
+	"cloudeng.io/cmd/idu/internal/database/boltdb"
+	"cloudeng.io/cmd/idu/internal/database/memdb"
+	"cloudeng.io/cmd/idu/internal/database/types"
+	"cloudeng.io/cmd/idu/internal/encryption"
 	"cloudeng.io/cmd/idu/internal/prefixinfo"
 	"github.com/dgraph-io/badger/v4"
 )
@@ -64,21 +68,65 @@ func badgerdbOptions(readonly bool, opts ...badgerdb.Option) []badgerdb.Option {
 	return opts
 }
 
-func openBadgerDB(_ context.Context, cfg config.Prefix, readonly bool) (database.DB, error) {
+func openBadgerDB(ctx context.Context, cfg config.Prefix, readonly bool) (database.DB, error) {
 	opts := badgerdbOptions(readonly)
 	bopts := badger.DefaultOptions(cfg.Database)
 	bopts = bopts.WithLogger(&badgerLogger{})
 	bopts = bopts.WithLoggingLevel(badger.ERROR)
+	if cfg.Encryption.Enabled() {
+		key, err := encryption.Key(ctx, cfg.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		bopts = bopts.WithEncryptionKey(key)
+		bopts = bopts.WithEncryptionKeyRotationDuration(cfg.Encryption.DataKeyRotation)
+	}
 	opts = append(opts, badgerdb.WithBadgerOptions(bopts))
 	return badgerdb.Open(cfg.Database, opts...)
 }
 
-func UseBadgerDB() {
-	databaseFactory = openBadgerDB
+func openBoltDB(_ context.Context, cfg config.Prefix, readonly bool) (database.DB, error) {
+	var opts []boltdb.Option
+	if readonly {
+		opts = append(opts, boltdb.ReadOnly())
+	}
+	return boltdb.Open(cfg.Database, opts...)
 }
 
-var databaseFactory = openBadgerDB
+func openMemoryDB(_ context.Context, cfg config.Prefix, readonly bool) (database.DB, error) {
+	var opts []memdb.Option
+	if readonly {
+		opts = append(opts, memdb.ReadOnly())
+	}
+	return memdb.Open(cfg.Database, opts...)
+}
+
+var databaseFactories = map[string]func(context.Context, config.Prefix, bool) (database.DB, error){
+	config.BadgerDatabase: openBadgerDB,
+	config.BoltDatabase:   openBoltDB,
+	config.MemoryDatabase: openMemoryDB,
+}
 
+// databaseFactory opens the database using the type of database
+// configured for the prefix, badger is used if none is configured.
+func databaseFactory(ctx context.Context, cfg config.Prefix, readonly bool) (database.DB, error) {
+	dbType := cfg.DatabaseType
+	if len(dbType) == 0 {
+		dbType = config.BadgerDatabase
+	}
+	factory, ok := databaseFactories[dbType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database type: %q", dbType)
+	}
+	return factory(ctx, cfg, readonly)
+}
+
+// OpenDatabase opens the database for the specified prefix. Newly created
+// databases are stamped with the current SchemaVersion, and the configured
+// key encoding, and databases with a newer schema version cannot be opened
+// for writing. The returned database uses the key encoding recorded for
+// it. The database itself is always opened, even if replicas are enabled
+// for the prefix, see OpenReplicaOrDatabase.
 func OpenDatabase(ctx context.Context, cfg config.Prefix, readonly bool) (database.DB, error) {
 	doneCh := make(chan struct {
 		db  database.DB
@@ -96,12 +144,31 @@ func OpenDatabase(ctx context.Context, cfg config.Prefix, readonly bool) (databa
 	for {
 		select {
 		case <-ctx.Done():
+			// The database may still be opened, and hence locked, after
+			// the context is cancelled and must then be closed.
+			go func() {
+				if res := <-doneCh; res.err == nil {
+					res.db.Close(context.Background())
+				}
+			}()
 			return nil, ctx.Err()
 		case res := <-doneCh:
 			if delayed {
 				fmt.Println()
 			}
-			return res.db, res.err
+			if res.err != nil {
+				return nil, res.err
+			}
+			if err := checkSchemaVersion(ctx, res.db, readonly); err != nil {
+				res.db.Close(ctx)
+				return nil, err
+			}
+			db, err := withKeyEncoding(ctx, res.db, cfg, readonly)
+			if err != nil {
+				res.db.Close(ctx)
+				return nil, err
+			}
+			return db, nil
 		case <-time.After(time.Second):
 			fmt.Printf("waiting for database to open: %v: %s\t\t\r", cfg.Database, time.Since(start).Truncate(time.Second))
 			delayed = true
@@ -109,6 +176,37 @@ func OpenDatabase(ctx context.Context, cfg config.Prefix, readonly bool) (databa
 	}
 }
 
+// OpenReplicaOrDatabase opens the most recently published replica of
+// the database for the specified prefix, if replicas are enabled and one
+// has been published, and the database itself, read-only, otherwise. It
+// is intended for commands that only query the database, such as find,
+// stats compute and serve, and that hence need not wait for a running
+// analyze, at the cost of not seeing any changes made since the replica
+// was published. Replicas are only published by analyze runs that
+// complete and hence do not include changes made by any other command.
+// The location that was opened is logged if replicas are enabled.
+func OpenReplicaOrDatabase(ctx context.Context, cfg config.Prefix) (database.DB, error) {
+	if !cfg.Replica.Enabled {
+		return OpenDatabase(ctx, cfg, true)
+	}
+	location, published, err := LatestReplica(cfg.Replica)
+	if err != nil {
+		return nil, err
+	}
+	if len(location) == 0 {
+		Log(ctx, LogProgress, "no replica published, using database",
+			"prefix", cfg.Prefix,
+			"database", cfg.Database)
+		return OpenDatabase(ctx, cfg, true)
+	}
+	Log(ctx, LogProgress, "using replica",
+		"prefix", cfg.Prefix,
+		"replica", location,
+		"published", published)
+	cfg.Database = location
+	return OpenDatabase(ctx, cfg, true)
+}
+
 func OpenPrefixAndDatabase(ctx context.Context, all config.T, prefix string, readonly bool) (context.Context, config.Prefix, database.DB, error) {
 	ctx, cfg, err := LookupPrefix(ctx, all, prefix)
 	if err != nil {
@@ -124,15 +222,20 @@ func OpenPrefixAndDatabase(ctx context.Context, all config.T, prefix string, rea
 type ScanDB interface {
 	GetPrefixInfo(ctx context.Context, key string, pi *prefixinfo.T) (bool, error)
 	SetPrefixInfo(ctx context.Context, key string, unchanged bool, pi *prefixinfo.T) error
-	LogError(ctx context.Context, key string, when time.Time, detail []byte) error
+	LogError(ctx context.Context, pl types.ErrorPayload) error
+	SetError(ctx context.Context, pl types.ErrorPayload) error
 	LogAndClose(ctx context.Context, start, stop time.Time, detail []byte) error
 	DeletePrefix(ctx context.Context, prefix string) error
 	DeleteErrors(ctx context.Context, prefix string) error
+	DeleteError(ctx context.Context, key string) error
+	VisitErrors(ctx context.Context, key string, visitor func(ctx context.Context, pl types.ErrorPayload) bool) error
+	VisitPrefixInfo(ctx context.Context, key string, visitor func(ctx context.Context, key string, pi *prefixinfo.T) bool) error
 	Close(ctx context.Context) error
 }
 
 type scanDB struct {
-	db database.DB
+	db      database.DB
+	replica config.Replica
 }
 
 func NewScanDB(ctx context.Context, cfg config.Prefix) (ScanDB, error) {
@@ -140,19 +243,45 @@ func NewScanDB(ctx context.Context, cfg config.Prefix) (ScanDB, error) {
 	if err != nil {
 		return nil, err
 	}
+	return &scanDB{
+		db:      db,
+		replica: cfg.Replica,
+	}, nil
+}
+
+// NewReadOnlyScanDB is like NewScanDB except that the database is opened
+// in read-only mode and hence only those methods that read from the
+// database may be used.
+func NewReadOnlyScanDB(ctx context.Context, cfg config.Prefix) (ScanDB, error) {
+	db, err := OpenDatabase(ctx, cfg, true)
+	if err != nil {
+		return nil, err
+	}
 	return &scanDB{
 		db: db,
 	}, nil
 }
 
-func (sdb *scanDB) LogError(ctx context.Context, key string, when time.Time, detail []byte) error {
-	return sdb.db.LogError(ctx, key, when, detail)
+func (sdb *scanDB) LogError(ctx context.Context, pl types.ErrorPayload) error {
+	return sdb.db.LogError(ctx, pl)
+}
+
+func (sdb *scanDB) SetError(ctx context.Context, pl types.ErrorPayload) error {
+	return sdb.db.SetError(ctx, pl)
 }
 
+// LogAndClose records the log entry for the run and, if replicas are
+// enabled, publishes a replica of the database before closing it.
 func (sdb *scanDB) LogAndClose(ctx context.Context, start, stop time.Time, detail []byte) error {
 	if err := sdb.db.Log(ctx, start, stop, detail); err != nil {
 		return err
 	}
+	if sdb.replica.Enabled {
+		if _, err := PublishReplica(ctx, sdb.db, sdb.replica); err != nil {
+			sdb.db.Close(ctx)
+			return fmt.Errorf("failed to publish replica to %v: %v", sdb.replica.Directory, err)
+		}
+	}
 	if err := sdb.db.Close(ctx); err != nil {
 		return err
 	}
@@ -167,6 +296,32 @@ func (sdb *scanDB) DeleteErrors(ctx context.Context, prefix string) error {
 	return sdb.db.DeleteErrors(ctx, prefix)
 }
 
+func (sdb *scanDB) DeleteError(ctx context.Context, key string) error {
+	return sdb.db.DeleteError(ctx, key)
+}
+
+func (sdb *scanDB) VisitErrors(ctx context.Context, key string, visitor func(ctx context.Context, pl types.ErrorPayload) bool) error {
+	return sdb.db.VisitErrors(ctx, key, visitor)
+}
+
+// VisitPrefixInfo calls visitor for every stored prefix starting at key.
+// The visitor func should return false if it wants to stop the iteration.
+func (sdb *scanDB) VisitPrefixInfo(ctx context.Context, key string, visitor func(ctx context.Context, key string, pi *prefixinfo.T) bool) error {
+	var err error
+	serr := sdb.db.Scan(ctx, key, func(ctx context.Context, key string, val []byte) bool {
+		var pi prefixinfo.T
+		if err = pi.UnmarshalBinary(val); err != nil {
+			err = fmt.Errorf("%v: %v", key, err)
+			return false
+		}
+		return visitor(ctx, key, &pi)
+	})
+	if serr != nil {
+		return serr
+	}
+	return err
+}
+
 func (sdb *scanDB) GetPrefixInfo(ctx context.Context, key string, pi *prefixinfo.T) (bool, error) {
 	select {
 	case <-ctx.Done():
@@ -0,0 +1,191 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+)
+
+// SchemaVersion is the version of the database schema written by this
+// version of idu. Databases created before schema versions were recorded
+// are treated as version 0.
+const SchemaVersion = 1
+
+const schemaVersionKey = "schema-version"
+
+// Migration upgrades a database from one schema version to the next.
+type Migration struct {
+	From        int
+	Description string
+	// Prefix is called for every stored prefix and returns the value to
+	// be stored in its place, or nil if the prefix needs no changes.
+	Prefix func(key string, val []byte) ([]byte, error)
+}
+
+var migrations = []Migration{
+	{
+		From:        0,
+		Description: "re-encode prefixes stored using deprecated encodings",
+		Prefix:      reencodeDeprecated,
+	},
+}
+
+// Migrations returns the migrations required to upgrade a database from
+// the specified schema version to SchemaVersion.
+func Migrations(from int) []Migration {
+	var ms []Migration
+	for _, m := range migrations {
+		if m.From >= from {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+func reencodeDeprecated(_ string, val []byte) ([]byte, error) {
+	enc, err := prefixinfo.EncodingOf(val)
+	if err != nil {
+		return nil, err
+	}
+	if !enc.Deprecated {
+		return nil, nil
+	}
+	var pi prefixinfo.T
+	if err := pi.UnmarshalBinary(val); err != nil {
+		return nil, err
+	}
+	return pi.MarshalBinary()
+}
+
+// ReadSchemaVersion returns the schema version recorded for db.
+func ReadSchemaVersion(ctx context.Context, db database.DB) (int, error) {
+	var buf bytes.Buffer
+	if err := db.GetMetadata(ctx, schemaVersionKey, &buf); err != nil {
+		return 0, err
+	}
+	if buf.Len() == 0 {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(buf.String())
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version: %q", buf.String())
+	}
+	return v, nil
+}
+
+// WriteSchemaVersion records the schema version for db.
+func WriteSchemaVersion(ctx context.Context, db database.DB, version int) error {
+	return db.SetMetadata(ctx, schemaVersionKey, []byte(strconv.Itoa(version)))
+}
+
+// checkSchemaVersion refuses to open a database written by a newer
+// version of idu for writing and records the current schema version
+// for newly created, ie. empty, databases.
+func checkSchemaVersion(ctx context.Context, db database.DB, readonly bool) error {
+	version, err := ReadSchemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		if readonly {
+			return nil
+		}
+		return fmt.Errorf("database schema version %v is newer than the supported version %v", version, SchemaVersion)
+	}
+	if version != 0 || readonly {
+		return nil
+	}
+	empty, err := isEmpty(ctx, db)
+	if err != nil || !empty {
+		return err
+	}
+	return WriteSchemaVersion(ctx, db, SchemaVersion)
+}
+
+// MigrationProgress is used to report the progress of a migration.
+type MigrationProgress struct {
+	Migration Migration
+	Scanned   int64
+	Updated   int64
+}
+
+// Migrate upgrades db to SchemaVersion by applying each of the required
+// migrations in turn. Prefixes are read and updated in batches of
+// batchSize so that no single transaction spans the entire database.
+// The schema version is recorded after each migration completes so that
+// an interrupted migration can be safely resumed. Progress, if not nil,
+// is called after each batch.
+func Migrate(ctx context.Context, db database.DB, batchSize int, progress func(MigrationProgress)) (from, to int, err error) {
+	if batchSize <= 0 {
+		return 0, 0, fmt.Errorf("invalid batch size: %v", batchSize)
+	}
+	from, err = ReadSchemaVersion(ctx, db)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > SchemaVersion {
+		return from, from, fmt.Errorf("database schema version %v is newer than the supported version %v", from, SchemaVersion)
+	}
+	to = from
+	for _, m := range Migrations(from) {
+		if err := migrate(ctx, db, m, batchSize, progress); err != nil {
+			return from, to, fmt.Errorf("migration from schema version %v failed: %v", m.From, err)
+		}
+		to = m.From + 1
+		if err := WriteSchemaVersion(ctx, db, to); err != nil {
+			return from, to, err
+		}
+	}
+	return from, to, nil
+}
+
+type migrationRecord struct {
+	key string
+	val []byte
+}
+
+func migrate(ctx context.Context, db database.DB, m Migration, batchSize int, progress func(MigrationProgress)) error {
+	mp := MigrationProgress{Migration: m}
+	next := ""
+	batch := make([]migrationRecord, 0, batchSize)
+	for {
+		batch = batch[:0]
+		err := db.Scan(ctx, next, func(_ context.Context, key string, val []byte) bool {
+			batch = append(batch, migrationRecord{key: key, val: bytes.Clone(val)})
+			return len(batch) < batchSize
+		})
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, r := range batch {
+			mp.Scanned++
+			nval, err := m.Prefix(r.key, r.val)
+			if err != nil {
+				return fmt.Errorf("%v: %v", r.key, err)
+			}
+			if nval == nil {
+				continue
+			}
+			if err := db.Set(ctx, r.key, nval, false); err != nil {
+				return err
+			}
+			mp.Updated++
+		}
+		if progress != nil {
+			progress(mp)
+		}
+		// Resume the scan immediately after the last key in this batch.
+		next = batch[len(batch)-1].key + "\x00"
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package internal_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/file"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	cfg := config.Prefix{Prefix: "/a", Database: filepath.Join(tmpDir, "db"), Separator: "/"}
+
+	// A newly created database is stamped with the current version.
+	db, err := internal.OpenDatabase(ctx, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := internal.ReadSchemaVersion(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := version, internal.SchemaVersion; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Simulate a database written by an older version of idu using
+	// the deprecated 0x1 encoding for all but one prefix.
+	pi := prefixinfo.New("/a", file.NewInfo("a", 1, 0700, time.Now(), file.XAttr{UID: 1, GID: 2}))
+	current, err := pi.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deprecated := bytes.Clone(current)
+	deprecated[0] = 0x1
+	for i := 0; i < 5; i++ {
+		val := deprecated
+		if i == 2 {
+			val = current
+		}
+		if err := db.Set(ctx, fmt.Sprintf("/a/%v", i), val, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := internal.WriteSchemaVersion(ctx, db, 0); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(ctx)
+
+	db, err = internal.OpenDatabase(ctx, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var progress []internal.MigrationProgress
+	from, to, err := internal.Migrate(ctx, db, 2, func(mp internal.MigrationProgress) {
+		progress = append(progress, mp)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := from, 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := to, internal.SchemaVersion; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(progress), 3; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := progress[2].Scanned, int64(5); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := progress[2].Updated, int64(4); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	err = db.Scan(ctx, "", func(_ context.Context, key string, val []byte) bool {
+		if !bytes.Equal(val, current) {
+			t.Errorf("%v: was not re-encoded", key)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Migrating again is a no-op.
+	from, to, err = internal.Migrate(ctx, db, 2, nil)
+	if err != nil || from != to {
+		t.Errorf("unexpected migration: %v -> %v: %v", from, to, err)
+	}
+
+	// Databases written by newer versions of idu may only be read.
+	if err := internal.WriteSchemaVersion(ctx, db, internal.SchemaVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(ctx)
+	if _, err := internal.OpenDatabase(ctx, cfg, false); err == nil {
+		t.Errorf("expected an error opening a newer database for writing")
+	}
+	db, err = internal.OpenDatabase(ctx, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close(ctx)
+}
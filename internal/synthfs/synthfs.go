@@ -0,0 +1,523 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package synthfs provides a synthetic, in-memory, implementation of
+// filewalk.FS for tests and benchmarks. The filesystem is generated
+// lazily, and deterministically, from a seed and a set of options that
+// control its shape, the distribution of file sizes, owners and groups,
+// the fraction of files that are hard links and the rate at which errors
+// occur. Since nothing is stored, filesystems with millions of entries
+// can be generated cheaply and every run against the same seed and
+// options sees exactly the same filesystem.
+//
+// The filesystem has a fixed shape: every directory contains the same
+// number of files and every directory above the configured depth the
+// same number of subdirectories. Directories are named d<n> and files
+// f<n>. Symbolic links are not supported.
+package synthfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand/v2"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloudeng.io/file"
+	"cloudeng.io/file/filewalk"
+)
+
+// Distribution is a weighted distribution of integer values, such as
+// user or group IDs.
+type Distribution struct {
+	Values  []int64
+	Weights []float64
+}
+
+// Uniform returns a Distribution in which every value is equally likely.
+func Uniform(values ...int64) Distribution {
+	d := Distribution{Values: values, Weights: make([]float64, len(values))}
+	for i := range d.Weights {
+		d.Weights[i] = 1
+	}
+	return d
+}
+
+// Zipf returns a Distribution of the n values starting at first, in which
+// the k'th value has a weight of 1/k^s, so that a few values account for
+// most of the entries as is typical for the owners of files.
+func Zipf(first int64, n int, s float64) Distribution {
+	d := Distribution{Values: make([]int64, n), Weights: make([]float64, n)}
+	for i := range n {
+		d.Values[i] = first + int64(i)
+		d.Weights[i] = 1 / math.Pow(float64(i+1), s)
+	}
+	return d
+}
+
+func (d Distribution) pick(r *rand.Rand) int64 {
+	var total float64
+	for _, w := range d.Weights {
+		total += w
+	}
+	x := r.Float64() * total
+	for i, w := range d.Weights {
+		if x < w {
+			return d.Values[i]
+		}
+		x -= w
+	}
+	return d.Values[len(d.Values)-1]
+}
+
+type options struct {
+	depth, dirs, files int
+	minSize, maxSize   int64
+	uids, gids         Distribution
+	hardlinks          float64
+	permissionErrors   float64
+	notExistErrors     float64
+	pathErrors         map[string]error
+	latency            time.Duration
+	modTime            time.Time
+}
+
+// Option represents an option to New.
+type Option func(o *options)
+
+// WithShape specifies the depth of the directory tree below the root,
+// the number of subdirectories of every directory above that depth and
+// the number of files in every directory. The default is a depth of 3
+// with 4 subdirectories and 10 files per directory.
+func WithShape(depth, dirs, files int) Option {
+	return func(o *options) {
+		o.depth, o.dirs, o.files = depth, dirs, files
+	}
+}
+
+// WithSizes specifies the range of file sizes; sizes are distributed
+// log-uniformly between min and max inclusive. The default is 0 to 1MiB.
+func WithSizes(min, max int64) Option {
+	return func(o *options) {
+		o.minSize, o.maxSize = min, max
+	}
+}
+
+// WithUIDs specifies the distribution of the user IDs of files and
+// directories. The default is a single user ID of 1000.
+func WithUIDs(d Distribution) Option {
+	return func(o *options) {
+		o.uids = d
+	}
+}
+
+// WithGIDs specifies the distribution of the group IDs of files and
+// directories. The default is a single group ID of 1000.
+func WithGIDs(d Distribution) Option {
+	return func(o *options) {
+		o.gids = d
+	}
+}
+
+// WithHardlinks specifies the fraction of files that are hard links.
+// Hard linked files are grouped so that, on average, each underlying
+// file has two names, possibly in different directories. All names
+// for the same file share its inode, size, owner, group and contents.
+func WithHardlinks(fraction float64) Option {
+	return func(o *options) {
+		o.hardlinks = fraction
+	}
+}
+
+// WithPermissionErrors specifies the fraction of directories whose
+// contents cannot be read; scanning them fails with fs.ErrPermission.
+func WithPermissionErrors(rate float64) Option {
+	return func(o *options) {
+		o.permissionErrors = rate
+	}
+}
+
+// WithNotExistErrors specifies the fraction of files that cannot be
+// stat'ed, as if they were deleted while being scanned; Stat and Lstat
+// fail with fs.ErrNotExist.
+func WithNotExistErrors(rate float64) Option {
+	return func(o *options) {
+		o.notExistErrors = rate
+	}
+}
+
+// WithPathError specifies that every operation on pathname fails with
+// err.
+func WithPathError(pathname string, err error) Option {
+	return func(o *options) {
+		if o.pathErrors == nil {
+			o.pathErrors = map[string]error{}
+		}
+		o.pathErrors[path.Clean(pathname)] = err
+	}
+}
+
+// WithLatency specifies the mean latency of every Stat, Lstat and
+// LevelScanner.Scan call; the latency of any given call is uniformly
+// distributed between 0 and twice the mean.
+func WithLatency(mean time.Duration) Option {
+	return func(o *options) {
+		o.latency = mean
+	}
+}
+
+// WithModTime specifies the time that all modification times precede,
+// they are distributed uniformly over the preceding year. The default is
+// the start of 2024 so that modification times do not depend on when
+// the filesystem is generated.
+func WithModTime(t time.Time) Option {
+	return func(o *options) {
+		o.modTime = t
+	}
+}
+
+// FS is a synthetic filewalk.FS.
+type FS struct {
+	options
+	root       string
+	seed       uint64
+	linkGroups uint64
+}
+
+// Device is the device ID reported for all files and directories.
+const Device = 1
+
+// New returns a synthetic filesystem rooted at root whose contents are
+// determined by seed and the supplied options.
+func New(root string, seed uint64, opts ...Option) *FS {
+	sfs := &FS{root: path.Clean(root), seed: seed}
+	sfs.depth, sfs.dirs, sfs.files = 3, 4, 10
+	sfs.minSize, sfs.maxSize = 0, 1024*1024
+	sfs.uids, sfs.gids = Uniform(1000), Uniform(1000)
+	sfs.modTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, fn := range opts {
+		fn(&sfs.options)
+	}
+	_, files := sfs.Counts()
+	sfs.linkGroups = max(uint64(float64(files)*sfs.hardlinks/2), 1)
+	return sfs
+}
+
+// Counts returns the number of directories, including the root, and
+// files in the filesystem.
+func (sfs *FS) Counts() (dirs, files int64) {
+	n := int64(1)
+	for range sfs.depth + 1 {
+		dirs += n
+		n *= int64(sfs.dirs)
+	}
+	return dirs, dirs * int64(sfs.files)
+}
+
+// Root returns the root of the filesystem.
+func (sfs *FS) Root() string {
+	return sfs.root
+}
+
+// entry describes a file or directory, it is derived entirely from its
+// path and the seed.
+type entry struct {
+	name  string
+	dir   bool
+	level int // level of the entry's directory, or of the directory itself.
+}
+
+// lookup parses pathname to determine if it refers to an entry in the
+// filesystem.
+func (sfs *FS) lookup(pathname string) (entry, bool) {
+	if pathname == sfs.root {
+		return entry{name: path.Base(sfs.root), dir: true}, true
+	}
+	rel, ok := strings.CutPrefix(pathname, sfs.root+"/")
+	if sfs.root == "/" {
+		rel, ok = strings.CutPrefix(pathname, "/")
+	}
+	if !ok {
+		return entry{}, false
+	}
+	components := strings.Split(rel, "/")
+	for i, c := range components {
+		last := i == len(components)-1
+		if last && validName(c, 'f', sfs.files) {
+			return entry{name: c, level: i}, true
+		}
+		if i >= sfs.depth || !validName(c, 'd', sfs.dirs) {
+			return entry{}, false
+		}
+		if last {
+			return entry{name: c, dir: true, level: i + 1}, true
+		}
+	}
+	return entry{}, false
+}
+
+func validName(name string, kind byte, n int) bool {
+	if len(name) < 2 || name[0] != kind {
+		return false
+	}
+	i, err := strconv.Atoi(name[1:])
+	return err == nil && i >= 0 && i < n && strconv.Itoa(i) == name[1:]
+}
+
+func (sfs *FS) hash(pathname, salt string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(pathname))
+	h.Write([]byte{0})
+	h.Write([]byte(salt))
+	return h.Sum64()
+}
+
+// rand returns a source of random numbers that is unique to pathname,
+// salt and the seed.
+func (sfs *FS) rand(pathname, salt string) *rand.Rand {
+	return rand.New(rand.NewPCG(sfs.seed, sfs.hash(pathname, salt)))
+}
+
+func (sfs *FS) chance(pathname, salt string, rate float64) bool {
+	return rate > 0 && sfs.rand(pathname, salt).Float64() < rate
+}
+
+func (sfs *FS) sleep(ctx context.Context, pathname, op string) error {
+	if sfs.latency <= 0 {
+		return ctx.Err()
+	}
+	// The delay is not derived from the seed so that repeated calls
+	// for the same path see differing latencies.
+	d := rand.N(2 * sfs.latency)
+	select {
+	case <-ctx.Done():
+		return &fs.PathError{Op: op, Path: pathname, Err: ctx.Err()}
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func (sfs *FS) fileID(pathname string) (id uint64, linked bool) {
+	if sfs.chance(pathname, "hardlink", sfs.hardlinks) {
+		group := sfs.rand(pathname, "group").Uint64N(sfs.linkGroups)
+		// Inode numbers for hard links have their top bit set so that
+		// they never collide with those of other files.
+		return group | 1<<63, true
+	}
+	return sfs.hash(pathname, "inode") &^ (1 << 63), false
+}
+
+func (sfs *FS) info(pathname string, e entry) file.Info {
+	if e.dir {
+		r := sfs.rand(pathname, "attr")
+		return file.NewInfo(e.name, 4096, fs.ModeDir|0755,
+			sfs.modTime.Add(-time.Duration(r.Int64N(int64(365*24*time.Hour)))),
+			file.XAttr{
+				UID:       sfs.uids.pick(r),
+				GID:       sfs.gids.pick(r),
+				Device:    Device,
+				FileID:    sfs.hash(pathname, "inode") &^ (1 << 63),
+				Blocks:    8,
+				Hardlinks: 1,
+			})
+	}
+	id, linked := sfs.fileID(pathname)
+	r := sfs.rand(pathname, "attr")
+	nlinks := uint64(1)
+	if linked {
+		// All of the names of a hard linked file share its attributes.
+		r = sfs.rand(strconv.FormatUint(id, 10), "link")
+		nlinks = 2
+	}
+	size := sfs.size(r)
+	return file.NewInfo(e.name, size, 0644,
+		sfs.modTime.Add(-time.Duration(r.Int64N(int64(365*24*time.Hour)))),
+		file.XAttr{
+			UID:       sfs.uids.pick(r),
+			GID:       sfs.gids.pick(r),
+			Device:    Device,
+			FileID:    id,
+			Blocks:    (size + 511) / 512,
+			Hardlinks: nlinks,
+		})
+}
+
+func (sfs *FS) size(r *rand.Rand) int64 {
+	lo, hi := math.Log1p(float64(sfs.minSize)), math.Log1p(float64(sfs.maxSize))
+	size := int64(math.Expm1(lo + r.Float64()*(hi-lo)))
+	return min(max(size, sfs.minSize), sfs.maxSize)
+}
+
+func (sfs *FS) stat(ctx context.Context, op, pathname string) (file.Info, entry, error) {
+	pathname = path.Clean(pathname)
+	if err := sfs.sleep(ctx, pathname, op); err != nil {
+		return file.Info{}, entry{}, err
+	}
+	if err, ok := sfs.pathErrors[pathname]; ok {
+		return file.Info{}, entry{}, &fs.PathError{Op: op, Path: pathname, Err: err}
+	}
+	e, ok := sfs.lookup(pathname)
+	if !ok || (!e.dir && sfs.chance(pathname, "notexist", sfs.notExistErrors)) {
+		return file.Info{}, entry{}, &fs.PathError{Op: op, Path: pathname, Err: fs.ErrNotExist}
+	}
+	return sfs.info(pathname, e), e, nil
+}
+
+func (sfs *FS) Scheme() string {
+	return "synthetic"
+}
+
+// Open implements fs.FS. The contents of a file are pseudo-random and
+// the same for all names of a hard linked file.
+func (sfs *FS) Open(pathname string) (fs.File, error) {
+	return sfs.OpenCtx(context.Background(), pathname)
+}
+
+func (sfs *FS) OpenCtx(ctx context.Context, pathname string) (fs.File, error) {
+	info, e, err := sfs.stat(ctx, "open", pathname)
+	if err != nil {
+		return nil, err
+	}
+	if e.dir {
+		return nil, &fs.PathError{Op: "open", Path: pathname, Err: errors.New("is a directory, use LevelScanner instead")}
+	}
+	xattr := info.Sys().(file.XAttr)
+	return &contents{info: info, r: rand.New(rand.NewPCG(sfs.seed, xattr.FileID))}, nil
+}
+
+func (sfs *FS) Readlink(_ context.Context, pathname string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: pathname, Err: fmt.Errorf("symbolic links are not supported")}
+}
+
+func (sfs *FS) Stat(ctx context.Context, pathname string) (file.Info, error) {
+	info, _, err := sfs.stat(ctx, "stat", pathname)
+	return info, err
+}
+
+func (sfs *FS) Lstat(ctx context.Context, pathname string) (file.Info, error) {
+	info, _, err := sfs.stat(ctx, "lstat", pathname)
+	return info, err
+}
+
+func (sfs *FS) Join(components ...string) string {
+	return path.Join(components...)
+}
+
+func (sfs *FS) Base(pathname string) string {
+	return path.Base(pathname)
+}
+
+func (sfs *FS) IsPermissionError(err error) bool {
+	return errors.Is(err, fs.ErrPermission)
+}
+
+func (sfs *FS) IsNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+func (sfs *FS) XAttr(_ context.Context, pathname string, fi file.Info) (file.XAttr, error) {
+	if xattr, ok := fi.Sys().(file.XAttr); ok {
+		return xattr, nil
+	}
+	return file.XAttr{}, &fs.PathError{Op: "xattr", Path: pathname, Err: fs.ErrInvalid}
+}
+
+func (sfs *FS) SysXAttr(_ any, merge file.XAttr) any {
+	return merge
+}
+
+// LevelScanner implements filewalk.FS. Directories are listed before
+// files and the contents of a directory for which a permission error
+// is injected cannot be scanned.
+func (sfs *FS) LevelScanner(pathname string) filewalk.LevelScanner {
+	pathname = path.Clean(pathname)
+	s := &scanner{fs: sfs, path: pathname}
+	e, ok := sfs.lookup(pathname)
+	switch {
+	case sfs.pathErrors[pathname] != nil:
+		s.err = &fs.PathError{Op: "open", Path: pathname, Err: sfs.pathErrors[pathname]}
+	case !ok || !e.dir:
+		s.err = &fs.PathError{Op: "open", Path: pathname, Err: fs.ErrNotExist}
+	case sfs.chance(pathname, "permission", sfs.permissionErrors):
+		s.err = &fs.PathError{Op: "open", Path: pathname, Err: fs.ErrPermission}
+	default:
+		if e.level < sfs.depth {
+			s.dirs = sfs.dirs
+		}
+		s.files = sfs.files
+	}
+	return s
+}
+
+type scanner struct {
+	fs          *FS
+	path        string
+	dirs, files int
+	pos, end    int
+	err         error
+}
+
+func (s *scanner) Scan(ctx context.Context, n int) bool {
+	if s.err != nil || s.end >= s.dirs+s.files {
+		return false
+	}
+	if err := s.fs.sleep(ctx, s.path, "scan"); err != nil {
+		s.err = err
+		return false
+	}
+	s.pos = s.end
+	s.end = min(s.pos+max(n, 1), s.dirs+s.files)
+	return true
+}
+
+func (s *scanner) Contents() []filewalk.Entry {
+	c := make([]filewalk.Entry, 0, s.end-s.pos)
+	for i := s.pos; i < s.end; i++ {
+		if i < s.dirs {
+			c = append(c, filewalk.Entry{Name: "d" + strconv.Itoa(i), Type: fs.ModeDir})
+			continue
+		}
+		c = append(c, filewalk.Entry{Name: "f" + strconv.Itoa(i-s.dirs)})
+	}
+	return c
+}
+
+func (s *scanner) Err() error {
+	return s.err
+}
+
+// contents implements fs.File for the contents of a synthetic file.
+type contents struct {
+	info file.Info
+	r    *rand.Rand
+	read int64
+}
+
+func (c *contents) Stat() (fs.FileInfo, error) {
+	return c.info, nil
+}
+
+func (c *contents) Read(buf []byte) (int, error) {
+	remaining := c.info.Size() - c.read
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(buf)), remaining))
+	for i := range n {
+		buf[i] = byte(c.r.Uint32())
+	}
+	c.read += int64(n)
+	return n, nil
+}
+
+func (c *contents) Close() error {
+	return nil
+}
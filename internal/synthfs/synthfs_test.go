@@ -0,0 +1,208 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package synthfs_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/synthfs"
+	"cloudeng.io/file"
+)
+
+type walkResult struct {
+	dirs, files, bytes int64
+	uids               map[int64]int64
+	inodes             map[uint64]int
+	scanErrs, statErrs int
+}
+
+func walk(t *testing.T, sfs *synthfs.FS) walkResult {
+	ctx := context.Background()
+	res := walkResult{uids: map[int64]int64{}, inodes: map[uint64]int{}}
+	var walkDir func(dir string)
+	walkDir = func(dir string) {
+		res.dirs++
+		sc := sfs.LevelScanner(dir)
+		for sc.Scan(ctx, 7) {
+			for _, e := range sc.Contents() {
+				p := sfs.Join(dir, e.Name)
+				if e.IsDir() {
+					walkDir(p)
+					continue
+				}
+				fi, err := sfs.Lstat(ctx, p)
+				if err != nil {
+					if !sfs.IsNotExist(err) && !sfs.IsPermissionError(err) {
+						t.Fatal(err)
+					}
+					res.statErrs++
+					continue
+				}
+				xattr, err := sfs.XAttr(ctx, p, fi)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.files++
+				res.bytes += fi.Size()
+				res.uids[xattr.UID]++
+				res.inodes[xattr.FileID]++
+			}
+		}
+		if err := sc.Err(); err != nil {
+			if !sfs.IsPermissionError(err) {
+				t.Fatal(err)
+			}
+			res.scanErrs++
+		}
+	}
+	walkDir(sfs.Root())
+	return res
+}
+
+func TestShape(t *testing.T) {
+	sfs := synthfs.New("/synth", 1, synthfs.WithShape(3, 3, 5))
+	dirs, files := sfs.Counts()
+	if got, want := dirs, int64(1+3+9+27); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	res := walk(t, sfs)
+	if got, want := res.dirs, dirs; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := res.files, files; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	ctx := context.Background()
+	for _, p := range []string{"/synth/d3", "/synth/d0/d0/d0/d0", "/synth/f5", "/synth/d01", "/other/d0", "/synth/d0/f0/f0"} {
+		if _, err := sfs.Lstat(ctx, p); !sfs.IsNotExist(err) {
+			t.Errorf("%v: expected a not-exist error: %v", p, err)
+		}
+	}
+	fi, err := sfs.Stat(ctx, "/synth/d2/d1/d0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() {
+		t.Errorf("expected a directory")
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	opts := []synthfs.Option{
+		synthfs.WithShape(2, 4, 50),
+		synthfs.WithUIDs(synthfs.Zipf(100, 5, 1.5)),
+		synthfs.WithSizes(10, 1<<30),
+		synthfs.WithHardlinks(0.2),
+	}
+	a := walk(t, synthfs.New("/synth", 42, opts...))
+	b := walk(t, synthfs.New("/synth", 42, opts...))
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("walks with the same seed differ")
+	}
+	c := walk(t, synthfs.New("/synth", 43, opts...))
+	if a.bytes == c.bytes {
+		t.Errorf("walks with different seeds are identical")
+	}
+
+	// The uid distribution is skewed towards the first uid.
+	if a.uids[100] <= a.uids[104] {
+		t.Errorf("uid distribution is not skewed: %v", a.uids)
+	}
+	for uid := range a.uids {
+		if uid < 100 || uid >= 105 {
+			t.Errorf("unexpected uid: %v", uid)
+		}
+	}
+
+	// Roughly 20% of files are hard links, with two names per inode.
+	links := 0
+	for _, n := range a.inodes {
+		if n > 1 {
+			links += n
+		}
+	}
+	if frac := float64(links) / float64(a.files); frac < 0.1 || frac > 0.3 {
+		t.Errorf("unexpected fraction of hard links: %v", frac)
+	}
+}
+
+func TestHardlinks(t *testing.T) {
+	ctx := context.Background()
+	sfs := synthfs.New("/synth", 7, synthfs.WithShape(1, 2, 20), synthfs.WithHardlinks(1))
+	type link struct {
+		path string
+		info file.Info
+	}
+	byInode := map[uint64]link{}
+	for _, d := range []string{"/synth", "/synth/d0", "/synth/d1"} {
+		sc := sfs.LevelScanner(d)
+		for sc.Scan(ctx, 100) {
+			for _, e := range sc.Contents() {
+				if e.IsDir() {
+					continue
+				}
+				p := sfs.Join(d, e.Name)
+				fi, err := sfs.Lstat(ctx, p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				xattr := fi.Sys().(file.XAttr)
+				prev, ok := byInode[xattr.FileID]
+				if !ok {
+					byInode[xattr.FileID] = link{p, fi}
+					continue
+				}
+				// All names of a hard linked file share its attributes
+				// and contents.
+				if prev.info.Size() != fi.Size() || !prev.info.ModTime().Equal(fi.ModTime()) || prev.info.Sys() != fi.Sys() {
+					t.Errorf("%v: attributes differ from those of %v", p, prev.path)
+				}
+				if got, want := readAll(t, sfs, p), readAll(t, sfs, prev.path); !bytes.Equal(got, want) || int64(len(got)) != fi.Size() {
+					t.Errorf("%v: contents differ from those of %v", p, prev.path)
+				}
+			}
+		}
+	}
+	if len(byInode) >= 60 {
+		t.Errorf("no hard links were generated")
+	}
+}
+
+func readAll(t *testing.T, sfs *synthfs.FS, p string) []byte {
+	f, err := sfs.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	sfs := synthfs.New("/synth", 3,
+		synthfs.WithShape(3, 4, 20),
+		synthfs.WithPermissionErrors(0.1),
+		synthfs.WithNotExistErrors(0.05),
+		synthfs.WithPathError("/synth/d1/f3", fs.ErrPermission))
+	res := walk(t, sfs)
+	if res.scanErrs == 0 || res.statErrs == 0 {
+		t.Errorf("expected both scan and stat errors: %+v", res)
+	}
+	_, err := sfs.Lstat(ctx, "/synth/d1/f3")
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package usernames
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ProjectsFile is the file used to map project names to IDs, it has the
+// same format as the /etc/projid file used by XFS, ie. lines of the
+// form <name>:<id>.
+var ProjectsFile = "/etc/projid"
+
+var projects struct {
+	once   sync.Once
+	byName map[string]int64
+	byID   map[int64]string
+}
+
+func loadProjects() {
+	projects.byName = map[string]int64{}
+	projects.byID = map[int64]string{}
+	f, err := os.Open(ProjectsFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		name, id, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		pid, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+		if err != nil {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		projects.byName[name] = pid
+		projects.byID[pid] = name
+	}
+}
+
+// ProjectIDForName returns the project ID for the specified project name
+// or numeric ID.
+func (um *IDManager) ProjectIDForName(name string) (int64, error) {
+	if id, err := strconv.ParseInt(name, 10, 64); err == nil {
+		return id, nil
+	}
+	projects.once.Do(loadProjects)
+	if id, ok := projects.byName[name]; ok {
+		return id, nil
+	}
+	return 0, fmt.Errorf("unknown project: %v", name)
+}
+
+// NameForProjectID returns the name of the specified project ID, or the
+// ID itself if there is no name for it.
+func (um *IDManager) NameForProjectID(id int64) string {
+	projects.once.Do(loadProjects)
+	if name, ok := projects.byID[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", id)
+}
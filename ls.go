@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/database/types"
 )
 
 type logFlags struct {
@@ -21,15 +22,23 @@ type logFlags struct {
 }
 
 type errorFlags struct {
-	Prefix bool `subcmd:"prefix,false,list errors by prefix"`
-	Erase  bool `subcmd:"erase,false,erase the errors rather than displaying them"`
+	Prefix   bool   `subcmd:"prefix,false,list errors by prefix"`
+	Erase    bool   `subcmd:"erase,false,erase the errors rather than displaying them"`
+	Summary  bool   `subcmd:"summary,false,'summarize the errors by category, operation and the prefixes with the most errors'"`
+	TopN     int    `subcmd:"n,20,number of prefixes to display in a summary"`
+	Category string `subcmd:"category,,'only display errors in the specified category, one of permission, not-exist, io, timeout or other'"`
+	JSON     bool   `subcmd:"json,false,display errors in json format"`
 }
 
 type lister struct{}
 
 func (l *lister) errors(ctx context.Context, values interface{}, args []string) error {
 	ef := values.(*errorFlags)
-	ctx, _, db, err := internal.OpenPrefixAndDatabase(ctx, globalConfig, args[0], true)
+	category, err := parseErrorCategory(ef.Category)
+	if err != nil {
+		return err
+	}
+	ctx, cfg, db, err := internal.OpenPrefixAndDatabase(ctx, globalConfig, args[0], true)
 	if err != nil {
 		return err
 	}
@@ -38,11 +47,36 @@ func (l *lister) errors(ctx context.Context, values interface{}, args []string)
 		return db.Clear(ctx, false, true)
 	}
 
-	return db.VisitErrors(ctx, args[0],
-		func(_ context.Context, key string, _ time.Time, detail []byte) bool {
-			fmt.Printf("%s: %s\n", key, detail)
+	summary := newErrorSummary(cfg.Separator)
+	err = db.VisitErrors(ctx, args[0],
+		func(_ context.Context, pl types.ErrorPayload) bool {
+			er := newErrorRecord(pl)
+			switch {
+			case len(category) > 0 && er.Category != category:
+			case ef.Summary:
+				summary.add(er)
+			case ef.JSON:
+				out, _ := json.Marshal(er)
+				fmt.Println(string(out))
+			default:
+				fmt.Println(er.String())
+			}
 			return true
 		})
+	if err != nil || !ef.Summary {
+		return err
+	}
+	summary.finalize(ef.TopN)
+	if ef.JSON {
+		out, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	summary.print(os.Stdout)
+	return nil
 }
 
 func (l *lister) logs(ctx context.Context, values interface{}, args []string) error {
@@ -50,9 +50,9 @@ commands:
     summary: display the syntax for the expression language supported by commands such as analyze, find etc.
 
   - name: analyze
-    summary: analyze the file system to build a database of directory and file metadata.
+    summary: analyze the file system to build a database of directory and file metadata. Prefixes that match the optional expression are pruned and not analyzed. Multiple prefixes may be specified, or all configured prefixes via --all.
     arguments:
-      - <prefix>
+      - <prefix>... <expression>...
 
   - name: logs
     summary: list the log of past operations stored in the database.
@@ -60,7 +60,7 @@ commands:
       - <prefix>
 
   - name: errors
-    summary: list the errors stored in the database
+    summary: list or summarize the errors stored in the database
     arguments:
       - <prefix>
 
@@ -70,6 +70,18 @@ commands:
      - <prefix>
      - <expression>...
 
+  - name: hash
+    summary: compute content hashes for the files in the database whose sizes are the same as that of another file, so that they can be checked for duplicates. A sample of the start and end of each file is hashed first and only files whose samples are the same as that of another file are hashed in their entirety. Hashes are stored in the database and are reused until a file is modified.
+    arguments:
+      - <prefix>
+      - <expression>...
+
+  - name: duplicates
+    summary: display the sets of duplicate files found using the hashes computed by the hash command, the storage wasted by them per user and group, and those that could be replaced by hard links.
+    arguments:
+      - <prefix>
+      - <expression>...
+
   - name: stats
     summary: compute and display statistics from the database.
     commands:
@@ -91,7 +103,7 @@ commands:
     summary: generate and manage reports.
     commands:
       - name: generate
-        summary:  generate reports in a variety of formats, including tsv, json and markdown from the statistics stored in the specified file.
+        summary:  generate reports in a variety of formats, including tsv, json, markdown and a self-contained html report with an interactive treemap, from the statistics stored in the specified file.
         arguments:
           - <filename>
           - ...
@@ -101,6 +113,11 @@ commands:
         arguments:
           - <report-directory>
 
+  - name: serve
+    summary: serve a read-only HTTP/JSON API for the databases of the specified prefixes, or of all configured prefixes if none are specified. The API lists the contents of prefixes, finds prefixes and files that match an expression, and displays logs, errors, stats and reports, see the README for details. Databases are opened for each request and hence a running analyze is only waited for if replicas are not enabled.
+    arguments:
+      - <prefix>...
+
   - name: config
     summary: describe the current configuration.
 
@@ -111,6 +128,41 @@ commands:
       summary: display the location of the database
       arguments:
         - <prefix>
+    - name: info
+      summary: display the on-disk size of the database for the specified prefix and the number of keys in each of its buckets.
+      arguments:
+        - <prefix>
+    - name: compact
+      summary: compact the database for the specified prefix, reclaiming the space used by deleted and overwritten values. The database is locked for exclusive access whilst it is compacted.
+      arguments:
+        - <prefix>
+    - name: export
+      summary: export the database for the specified prefix to a compressed, self-describing, archive that can be imported by other versions of idu and on other systems. Use - to write to stdout. Use --nested to also export the contents of the databases of any configured prefixes nested within the specified prefix.
+      arguments:
+        - <prefix>
+        - <archive>
+    - name: import
+      summary: import an archive created by export into the database for the specified prefix, which must be empty. Use - to read from stdin.
+      arguments:
+        - <prefix>
+        - <archive>
+    - name: fsck
+      summary: check the integrity of the database for the specified prefix, reporting prefixes that cannot be decoded, orphaned prefixes that are no longer reachable from their parents or are excluded, and error and log records that cannot be decoded.
+      arguments:
+        - <prefix>
+    - name: migrate
+      summary: upgrade the database for the specified prefix to the current schema version, and convert it to the configured key encoding, re-encoding records in place in batches. The database is locked for exclusive access whilst it is migrated and an interrupted migration may be safely restarted.
+      arguments:
+        - <prefix>
+    - name: convert
+      summary: copy the database for the specified prefix to a new database of a different type, eg. from badger to bolt, at the specified location, which must be empty. The configuration must then be updated to use the new database.
+      arguments:
+        - <prefix>
+        - <location>
+    - name: rotate-key
+      summary: change the encryption key for the database for the specified prefix, and for all of its published replicas, to the key specified by --new-key-file or --new-key-command. Only the database's key registry is rewritten and hence rotation is fast. The configuration must then be updated to use the new key; stats files and export archives created using the old key must be decrypted using it.
+      arguments:
+        - <prefix>
 `
 
 type GlobalFlags struct {
@@ -120,7 +172,7 @@ type GlobalFlags struct {
 	Verbose     int                   `subcmd:"v,0,lower values show more debugging output"`
 	LogDir      string                `subcmd:"log-dir,,directory to write log files to"`
 	Stderr      bool                  `subcmd:"stderr,false,write log messages to stderr"`
-	HTTP        string                `subcmd:"http,,set to a port to enable http serving of /debug/vars and profiling"`
+	HTTP        string                `subcmd:"http,,'set to a port to enable http serving of /debug/vars and profiling, see the serve command for querying the database over http'"`
 	GCPercent   int                   `subcmd:"gcpercent,50,value to use for runtime/debug.SetGCPercent"`
 }
 
@@ -156,10 +208,27 @@ func cli() *subcmd.CommandSetYAML {
 	findCmds := &findCmds{}
 	cmdSet.Set("find").MustRunner(findCmds.find, &findFlags{})
 
+	hashCmds := &hashCmds{}
+	cmdSet.Set("hash").MustRunner(hashCmds.hash, &hashFlags{})
+
+	duplicatesCmds := &duplicatesCmds{}
+	cmdSet.Set("duplicates").MustRunner(duplicatesCmds.duplicates, &duplicatesFlags{})
+
+	serveCmd := &serveCmd{}
+	cmdSet.Set("serve").MustRunner(serveCmd.serve, &serveFlags{})
+
 	cmdSet.Set("config").MustRunner(configManager, &configFlags{})
 
 	db := &dbCmd{}
 	cmdSet.Set("database", "locate").MustRunner(db.locate, &locateFlags{})
+	cmdSet.Set("database", "info").MustRunner(db.info, &struct{}{})
+	cmdSet.Set("database", "compact").MustRunner(db.compact, &struct{}{})
+	cmdSet.Set("database", "export").MustRunner(db.export, &exportFlags{})
+	cmdSet.Set("database", "import").MustRunner(db.importArchive, &struct{}{})
+	cmdSet.Set("database", "fsck").MustRunner(db.fsck, &fsckFlags{})
+	cmdSet.Set("database", "migrate").MustRunner(db.migrate, &migrateFlags{})
+	cmdSet.Set("database", "convert").MustRunner(db.convert, &convertFlags{})
+	cmdSet.Set("database", "rotate-key").MustRunner(db.rotateKey, &rotateKeyFlags{})
 
 	globals := subcmd.GlobalFlagSet()
 	globals.MustRegisterFlagStruct(&globalFlags, nil, nil)
@@ -220,8 +289,6 @@ func mainWrapper(ctx context.Context, cmdRunner func(ctx context.Context) error)
 		go http.Serve(ln, nil) //nolint:gosec,errcheck
 	}
 
-	internal.UseBadgerDB()
-
 	internal.Verbosity = slog.Level(globalFlags.Verbose)
 	internal.LogDir = globalFlags.LogDir
 	if internal.LogDir == "" {
@@ -55,7 +55,7 @@ func TestHelp(t *testing.T) {
 	out, _ := runIDU("help") // will return exit status 1 for help.
 	base := []string{
 		"analyze disk usage using a database for incremental updates",
-		"errors - list the errors stored in the database",
+		"errors - list or summarize the errors stored in the database",
 		"config - describe the current configuration",
 	}
 	if err := containsAnyOf(out, base...); err != nil {
@@ -72,7 +72,7 @@ func TestHelp(t *testing.T) {
 	out, _ = runIDU("help", "analyze") // will return exit status 1 for help.
 
 	err = containsAnyOf(out, "Usage of command \"analyze\": analyze the file system to build a database of directory and file metadata.",
-		"analyze [--force=false --progress=true --show-defaults=false --slow-scan-duration=10s] <prefix>")
+		"analyze [--all=false --concurrency-budget=0 --dry-run=false --force=false --progress=true --retry-errors=false --show-defaults=false --slow-scan-duration=10s] <prefix>")
 	if err != nil {
 		t.Fatal(err)
 	}
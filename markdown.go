@@ -6,10 +6,15 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"text/template"
 	"time"
 
+	"cloudeng.io/cmd/idu/internal/charts"
 	"cloudeng.io/cmd/idu/internal/reports"
 	"cloudeng.io/cmd/idu/internal/usernames"
 	"cloudeng.io/file/diskusage"
@@ -35,7 +40,8 @@ const mdTOC = `
 ## Contents
 
 * [Totals](#totals)
-* [Top {{.TopN}} prefixes](#top-prefixes)
+{{if .Charts}}* [Charts](#charts)
+{{end}}* [Top {{.TopN}} prefixes](#top-prefixes)
 * [Top {{.TopN}} users](#top-Users)
 * [Top {{.TopN}} groups](#top-Groups)
 
@@ -55,6 +61,14 @@ const mdTotals = `
 
 `
 
+const mdCharts = `
+# <a id=charts></a> Charts for {{.Prefix}}
+
+{{range .Charts}}![{{.Title}}]({{.File}})
+
+{{end}}
+`
+
 const mdPrefixes = `
 # <a id=top-prefixes></a> Top {{.TopN}} prefixes for {{.Prefix}}
 
@@ -92,6 +106,38 @@ const mdPrefixes = `
 
 `
 
+const mdSparse = `
+# <a id=sparse></a> Sparse and over-allocated files for {{.Prefix}}
+
+Sparse files have fewer bytes allocated to them than their apparent size,
+typically due to holes in the file or filesystem compression. Over-allocated
+files have significantly more bytes allocated than their apparent size,
+typically due to preallocation.
+
+| Metric | Value |
+| :--- | ---: |
+| Sparse Files | {{fmtCount .Heaps.TotalSparseFiles}} |
+| Sparse Savings (apparent - allocated) | {{fmtBytes .Heaps.TotalSparseSavings}} |
+| Over-allocated Files | {{fmtCount .Heaps.TotalOverAllocatedFiles}} |
+| Over-allocated Bytes (allocated - apparent) | {{fmtBytes .Heaps.TotalOverAllocatedBytes}} |
+
+{{if .Prefixes}}
+### Top {{.TopN}} prefixes by sparse savings
+| Savings | Prefix |
+| ---: | :--- |
+{{range .Prefixes}}| {{fmtBytes .K}} | {{.V}} |
+{{end}}
+{{end}}
+
+{{if .Users}}
+### Top {{.TopN}} users by sparse savings
+| Savings | User |
+| ---: | :--- |
+{{range .Users}}| {{fmtBytes .K}} | {{fmtUID .V}} |
+{{end}}
+{{end}}
+`
+
 const mdListUsersAndGroups = `
 # Per User Reports - click on a link below
 {{range $idx, $u := .Users}}{{if $idx}}, {{end}}[{{fmtUID .}}](#user-{{.}}){{end}}
@@ -201,9 +247,11 @@ type markdownReports struct {
 	toc       *template.Template
 	lists     *template.Template
 	totals    *template.Template
+	charts    *template.Template
 	prefixes  *template.Template
 	byUsers   *template.Template
 	byGroups  *template.Template
+	sparse    *template.Template
 	perUsers  *template.Template
 	perGroups *template.Template
 }
@@ -216,6 +264,7 @@ func (md *markdownReports) initTemplates() {
 	nameForGID := usernames.Manager.NameForGID
 	md.toc = template.Must(tpl("toc").Parse(mdTOC))
 	md.totals = template.Must(tpl("totals").Parse(mdTotals))
+	md.charts = template.Must(tpl("charts").Parse(mdCharts))
 	md.prefixes = template.Must(tpl("prefixes").Parse(mdPrefixes))
 	md.lists = template.Must(tpl("userGroupLists").Funcs(
 		template.FuncMap{
@@ -231,6 +280,10 @@ func (md *markdownReports) initTemplates() {
 		Funcs(template.FuncMap{"fmtID": nameForGID}).
 		Parse(mdByUsersGroupsTemplate))
 
+	md.sparse = template.Must(tpl("sparse").
+		Funcs(template.FuncMap{"fmtUID": nameForUID}).
+		Parse(mdSparse))
+
 	md.perUsers = template.Must(tpl("users").Funcs(
 		template.FuncMap{"fmtID": nameForUID}).
 		Parse(mdPerUsersGroupsTemplate))
@@ -257,11 +310,13 @@ func (md *markdownReports) generateReports(rf *generateReportsFlags, filenames *
 		Expression string
 		TopN       int
 		When       string
+		Charts     bool
 	}{
 		Prefix:     prefix,
 		Expression: stats.Expression,
 		TopN:       rf.Markdown,
 		When:       when.Format(time.RFC3339),
+		Charts:     rf.Charts,
 	}); err != nil {
 		return err
 	}
@@ -302,10 +357,6 @@ func (md *markdownReports) generateReports(rf *generateReportsFlags, filenames *
 		PrefixBytes:  reports.ZipN(sdb.Prefix.PrefixBytes, rf.Markdown),
 	}
 
-	if err := md.prefixes.Execute(out, byPrefix); err != nil {
-		return err
-	}
-
 	// Largest Users/Groups.
 	byUsers := mdHeap[int64]{
 		Prefix:       prefix,
@@ -318,10 +369,6 @@ func (md *markdownReports) generateReports(rf *generateReportsFlags, filenames *
 		PrefixBytes:  reports.ZipN(sdb.ByUser.PrefixBytes, rf.Markdown),
 	}
 
-	if err := md.byUsers.Execute(out, byUsers); err != nil {
-		return err
-	}
-
 	byGroups := mdHeap[int64]{
 		Prefix:       prefix,
 		TopN:         rf.Markdown,
@@ -333,10 +380,40 @@ func (md *markdownReports) generateReports(rf *generateReportsFlags, filenames *
 		PrefixBytes:  reports.ZipN(sdb.ByGroup.PrefixBytes, rf.Markdown),
 	}
 
+	if rf.Charts {
+		if err := md.writeCharts(out, filenames, stats, byPrefix.Bytes, byUsers.Bytes, byGroups.Bytes); err != nil {
+			return err
+		}
+	}
+
+	if err := md.prefixes.Execute(out, byPrefix); err != nil {
+		return err
+	}
+
+	if err := md.byUsers.Execute(out, byUsers); err != nil {
+		return err
+	}
+
 	if err := md.byGroups.Execute(out, byGroups); err != nil {
 		return err
 	}
 
+	if err := md.sparse.Execute(out, struct {
+		Prefix   string
+		TopN     int
+		Heaps    *reports.Heaps[string]
+		Prefixes []reports.Zipped[string]
+		Users    []reports.Zipped[int64]
+	}{
+		Prefix:   prefix,
+		TopN:     rf.Markdown,
+		Heaps:    sdb.Prefix,
+		Prefixes: reports.ZipN(sdb.Prefix.SparseSavings, rf.Markdown),
+		Users:    reports.ZipN(sdb.ByUser.SparseSavings, rf.Markdown),
+	}); err != nil {
+		return err
+	}
+
 	for _, r := range []struct {
 		label string
 		tpl   *template.Template
@@ -369,3 +446,91 @@ func (md *markdownReports) generateReports(rf *generateReportsFlags, filenames *
 	}
 	return os.WriteFile(filenames.summary("usage-summary"), out.Bytes(), 0660) //nolint:gosec
 }
+
+type mdChart struct {
+	Title string
+	File  string
+}
+
+// writeCharts writes svg charts of the largest subtrees, or of the largest
+// prefixes for stats computed without subtrees, and of the largest users
+// and groups to the report directory and links to them from out.
+func (md *markdownReports) writeCharts(out io.Writer, filenames *reportFilenames, stats statsFileFormat, prefixes []reports.Zipped[string], users, groups []reports.Zipped[int64]) error {
+	format := charts.WithFormatter(func(v int64) string {
+		return strings.TrimSpace(fmtSize(v))
+	})
+	var mdCharts []mdChart
+	write := func(name, title string, render func(io.Writer) error) error {
+		var buf bytes.Buffer
+		if err := render(&buf); err != nil {
+			return err
+		}
+		filename := filenames.chart(name)
+		if err := os.WriteFile(filename, buf.Bytes(), 0660); err != nil { //nolint:gosec
+			return err
+		}
+		mdCharts = append(mdCharts, mdChart{Title: title, File: filepath.Base(filename)})
+		return nil
+	}
+
+	tree := charts.Node{Label: stats.Prefix, Value: stats.Stats.Prefix.TotalBytes}
+	title := fmt.Sprintf("Top %v prefixes by bytes used", len(prefixes))
+	if st := stats.Stats.Subtrees; st != nil {
+		tree = subtreeNode(st, len(prefixes))
+		title = "Bytes used by subtree"
+	} else {
+		for _, p := range prefixes {
+			label := strings.TrimPrefix(p.V, stats.Prefix)
+			if len(label) == 0 {
+				label = p.V
+			}
+			tree.Children = append(tree.Children, charts.Node{Label: label, Value: p.K})
+		}
+	}
+	if err := write("usage-treemap", title, func(w io.Writer) error {
+		return charts.Treemap(w, title, tree, format)
+	}); err != nil {
+		return err
+	}
+
+	for _, ids := range []struct {
+		name, title string
+		ids         []reports.Zipped[int64]
+		nameForID   func(int64) string
+	}{
+		{"usage-users", "Top %v users by bytes used", users, usernames.Manager.NameForUID},
+		{"usage-groups", "Top %v groups by bytes used", groups, usernames.Manager.NameForGID},
+	} {
+		if len(ids.ids) == 0 {
+			continue
+		}
+		bars := make([]charts.Bar, len(ids.ids))
+		for i, id := range ids.ids {
+			bars[i] = charts.Bar{Label: ids.nameForID(id.V), Value: id.K}
+		}
+		title := fmt.Sprintf(ids.title, len(bars))
+		if err := write(ids.name, title, func(w io.Writer) error {
+			return charts.BarChart(w, title, bars, format)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return md.charts.Execute(out, struct {
+		Prefix string
+		Charts []mdChart
+	}{
+		Prefix: stats.Prefix,
+		Charts: mdCharts,
+	})
+}
+
+// subtreeNode converts st to a charts.Node retaining at most n children
+// for every prefix.
+func subtreeNode(st *reports.Subtree, n int) charts.Node {
+	node := charts.Node{Label: st.Name, Value: st.Bytes}
+	for _, c := range st.Children[:min(n, len(st.Children))] {
+		node.Children = append(node.Children, subtreeNode(c, n))
+	}
+	return node
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/synthfs"
+)
+
+func TestMarkdownCharts(t *testing.T) {
+	ctx := context.Background()
+	sfs := synthfs.New("/synthetic", 3,
+		synthfs.WithShape(2, 4, 10),
+		synthfs.WithUIDs(synthfs.Uniform(1000, 1001, 1002)))
+	cfg := setupSynthetic(t, sfs)
+	analyzeSynthetic(ctx, t, sfs)
+	bytesPrinter = func(size int64) (float64, string) { return float64(size), "B" }
+
+	images := regexp.MustCompile(`!\[([^]]+)\]\(([^)]+)\)`)
+	for _, tc := range []struct {
+		subtrees bool
+		charts   bool
+		title    string
+	}{
+		{true, true, "Bytes used by subtree"},
+		{false, true, "Top 5 prefixes by bytes used"},
+		{true, false, ""},
+	} {
+		all := statsSynthetic(ctx, t, cfg, sfs)
+		if !tc.subtrees {
+			all.Subtrees = nil
+		}
+		stats := statsFileFormat{Prefix: sfs.Root(), Date: time.Now(), Stats: all}
+		dir := generateTestReports(t, stats, &generateReportsFlags{Markdown: 5, Charts: tc.charts})
+		md, err := os.ReadFile(filepath.Join(dir, "usage-summary.md"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		links := images.FindAllStringSubmatch(string(md), -1)
+		if !tc.charts {
+			if len(links) != 0 || strings.Contains(string(md), "#charts") {
+				t.Errorf("unexpected charts: %v", links)
+			}
+			continue
+		}
+		if got, want := len(links), 3; got != want {
+			t.Fatalf("got %v, want %v: %v", got, want, links)
+		}
+		if got, want := links[0][1], tc.title; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := links[1][1], "Top 3 users by bytes used"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		// Charts are linked relative to the markdown report and are valid
+		// svg images.
+		for _, l := range links {
+			f, err := os.Open(filepath.Join(dir, l[2]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var svg struct {
+				XMLName xml.Name
+				Rects   []struct{} `xml:"rect"`
+			}
+			err = xml.NewDecoder(f).Decode(&svg)
+			f.Close()
+			if err != nil {
+				t.Fatalf("%v: %v", l[2], err)
+			}
+			if svg.XMLName.Local != "svg" || len(svg.Rects) < 2 {
+				t.Errorf("%v: unexpected image: %v, %v rects", l[2], svg.XMLName, len(svg.Rects))
+			}
+		}
+	}
+}
@@ -8,32 +8,46 @@ import (
 	"context"
 	"os"
 	"runtime"
+	"slices"
 	"sync"
 	"time"
 
 	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/ratelimit"
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
 )
 
 type anaylzeSummary struct {
-	Operation         string        `json:"operation"`
-	Command           string        `json:"command"`
-	Duration          time.Duration `json:"duration"`
-	PrefixesStarted   int64         `json:"prefixes_started"`
-	PrefixesFinished  int64         `json:"prefixes_finished"`
-	SynchronousScans  int64         `json:"synchronous_scans"`
-	SlowScans         int64         `json:"slow_scans"`
-	FSStats           int64         `json:"fs_stats"`
-	FSStatsTotal      int64         `json:"fs_stats_total"`
-	FSStatMeanLatency int64         `json:"fs_stat_mean_latency"`
-	Files             int64         `json:"files"`
-	ParentUnchanged   int64         `json:"parent_unchanged"`
-	ChildrenUnchanged int64         `json:"children_unchanged"`
-	Errors            int64         `json:"errors"`
-	PrefixesDeleted   int64         `json:"prefixes_deleted"`
+	Operation          string              `json:"operation"`
+	Command            string              `json:"command"`
+	Expression         string              `json:"expression,omitempty"`
+	Duration           time.Duration       `json:"duration"`
+	PrefixesStarted    int64               `json:"prefixes_started"`
+	PrefixesFinished   int64               `json:"prefixes_finished"`
+	SynchronousScans   int64               `json:"synchronous_scans"`
+	SlowScans          int64               `json:"slow_scans"`
+	FSStats            int64               `json:"fs_stats"`
+	FSStatsTotal       int64               `json:"fs_stats_total"`
+	FSStatMeanLatency  int64               `json:"fs_stat_mean_latency"`
+	Files              int64               `json:"files"`
+	ParentUnchanged    int64               `json:"parent_unchanged"`
+	ChildrenUnchanged  int64               `json:"children_unchanged"`
+	Errors             int64               `json:"errors"`
+	PrefixesDeleted    int64               `json:"prefixes_deleted"`
+	PrefixesPruned     int64               `json:"prefixes_pruned"`
+	ErrorsRetried      int64               `json:"errors_retried,omitempty"`
+	ErrorsResolved     int64               `json:"errors_resolved,omitempty"`
+	ConcurrencyChanges int64               `json:"concurrency_changes,omitempty"`
+	RateLimits         []ratelimit.Applied `json:"rate_limits,omitempty"`
+	Pruned             []string            `json:"pruned,omitempty"`
+	DryRun             *dryRunChanges      `json:"dry_run,omitempty"`
 }
 
+// maxPrunedRecorded is the maximum number of pruned prefixes that are
+// recorded in the summary for a single run.
+const maxPrunedRecorded = 100
+
 type progressStats struct {
 	numPrefixesStarted, numPrefixesFinished int64
 	numFiles                                int64
@@ -42,6 +56,12 @@ type progressStats struct {
 	numErrors                               int64
 	numSyncScans                            int64
 	numDeleted                              int64
+	numPruned                               int64
+	pruned                                  []string
+	numErrorsRetried, numErrorsResolved     int64
+	numConcurrencyChanges                   int64
+	rateLimits                              []ratelimit.Applied
+	dryRun                                  *dryRunChanges
 	numStatsStarted, numStatsFinished       int64
 	numSlowScans                            int64
 	statsTotalTime                          int64
@@ -91,17 +111,24 @@ func (pt *progressTracker) summarize() anaylzeSummary {
 	cpy := pt.progressStats
 	pt.Unlock()
 	return anaylzeSummary{
-		PrefixesStarted:   cpy.numPrefixesStarted,
-		PrefixesFinished:  cpy.numPrefixesFinished,
-		SynchronousScans:  cpy.numSyncScans,
-		FSStats:           cpy.numStatsFinished,
-		FSStatsTotal:      cpy.statsTotalTime,
-		FSStatMeanLatency: cpy.meanStatLatency(),
-		Files:             cpy.numFiles,
-		ParentUnchanged:   cpy.numParentUnchanged,
-		ChildrenUnchanged: cpy.numChildrenUnchanged,
-		Errors:            cpy.numErrors,
-		PrefixesDeleted:   cpy.numDeleted,
+		PrefixesStarted:    cpy.numPrefixesStarted,
+		PrefixesFinished:   cpy.numPrefixesFinished,
+		SynchronousScans:   cpy.numSyncScans,
+		FSStats:            cpy.numStatsFinished,
+		FSStatsTotal:       cpy.statsTotalTime,
+		FSStatMeanLatency:  cpy.meanStatLatency(),
+		Files:              cpy.numFiles,
+		ParentUnchanged:    cpy.numParentUnchanged,
+		ChildrenUnchanged:  cpy.numChildrenUnchanged,
+		Errors:             cpy.numErrors,
+		PrefixesDeleted:    cpy.numDeleted,
+		PrefixesPruned:     cpy.numPruned,
+		Pruned:             slices.Clone(cpy.pruned),
+		ErrorsRetried:      cpy.numErrorsRetried,
+		ErrorsResolved:     cpy.numErrorsResolved,
+		ConcurrencyChanges: cpy.numConcurrencyChanges,
+		RateLimits:         slices.Clone(cpy.rateLimits),
+		DryRun:             cpy.dryRun,
 	}
 }
 
@@ -142,6 +169,22 @@ func (pt *progressTracker) incErrors() {
 	pt.numErrors++
 }
 
+func (pt *progressTracker) addPruned(prefix string) {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.numPruned++
+	if len(pt.pruned) < maxPrunedRecorded {
+		pt.pruned = append(pt.pruned, prefix)
+	}
+}
+
+func (pt *progressTracker) setRetriedErrors(retried, resolved int64) {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.numErrorsRetried = retried
+	pt.numErrorsResolved = resolved
+}
+
 func (pt *progressTracker) incParentUnchanged() {
 	pt.Lock()
 	defer pt.Unlock()
@@ -154,6 +197,24 @@ func (pt *progressTracker) incChildrenUnchanged() {
 	pt.numChildrenUnchanged++
 }
 
+func (pt *progressTracker) setRateLimits(applied []ratelimit.Applied) {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.rateLimits = applied
+}
+
+func (pt *progressTracker) setDryRun(changes *dryRunChanges) {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.dryRun = changes
+}
+
+func (pt *progressTracker) incConcurrencyChanges() {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.numConcurrencyChanges++
+}
+
 func (pt *progressTracker) incSlowScans() {
 	pt.Lock()
 	defer pt.Unlock()
@@ -192,9 +253,26 @@ func (pt *progressTracker) summary(ctx context.Context) {
 		ifmt.Printf("children unchanged : % 15v\n", cpy.numChildrenUnchanged)
 	}
 	ifmt.Printf("           deleted : % 15v\n", cpy.numDeleted)
+	if cpy.numPruned > 0 {
+		ifmt.Printf("            pruned : % 15v\n", cpy.numPruned)
+	}
 	ifmt.Printf("            errors : % 15v\n", cpy.numErrors)
+	if cpy.numErrorsRetried > 0 {
+		ifmt.Printf("    errors retried : % 15v\n", cpy.numErrorsRetried)
+		ifmt.Printf("   errors resolved : % 15v\n", cpy.numErrorsResolved)
+	}
 	ifmt.Printf("        sync scans : % 15v\n", cpy.numSyncScans)
 	ifmt.Printf("        slow scans : % 15v\n", cpy.numSlowScans)
+	for _, rl := range cpy.rateLimits {
+		rate := "unlimited"
+		if rl.OpsPerSecond > 0 {
+			rate = ifmt.Sprintf("%v ops/s", rl.OpsPerSecond)
+		}
+		ifmt.Printf("        rate limit : % 15v from %v\n", rate, rl.From.Format(time.TimeOnly))
+	}
+	if cpy.numConcurrencyChanges > 0 {
+		ifmt.Printf("concurrency changes: % 14v\n", cpy.numConcurrencyChanges)
+	}
 	ifmt.Printf("          stat ops : % 15v\n", cpy.numStatsFinished)
 	ifmt.Printf("   total stat time : % 15v\n", time.Duration(cpy.statsTotalTime))
 	ifmt.Printf(" mean stat latency : % 15v\n", time.Duration(cpy.meanStatLatency()))
@@ -210,6 +288,7 @@ func (pt progressStats) log(ctx context.Context) {
 		"prefixes started", pt.numPrefixesStarted,
 		"prefixes", pt.numPrefixesFinished,
 		"deleted", pt.numDeleted,
+		"pruned", pt.numPruned,
 		"files", pt.numFiles,
 		"parent_unchanged", pt.numParentUnchanged,
 		"children_unchanged", pt.numChildrenUnchanged,
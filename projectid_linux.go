@@ -0,0 +1,51 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"io/fs"
+	"unsafe"
+
+	"cloudeng.io/file"
+	"golang.org/x/sys/unix"
+)
+
+// fsxattr is struct fsxattr from linux/fs.h.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// fsIOCFSGetXAttr is FS_IOC_FSGETXATTR, ie. _IOR('X', 31, struct fsxattr),
+// which is not defined by x/sys/unix. The direction bits for _IOR vary
+// by architecture and are taken from FS_IOC_GETFLAGS.
+const fsIOCFSGetXAttr = unix.FS_IOC_GETFLAGS&^0x1fffffff | uint(unsafe.Sizeof(fsxattr{}))<<16 | 'X'<<8 | 31
+
+// projectID obtains the project ID for filename using FS_IOC_FSGETXATTR,
+// which is supported by XFS, ext4 and Lustre. Zero is returned for
+// any file that cannot be opened, or for which the ioctl is not
+// supported, as well as for symlinks and devices etc.
+func projectID(filename string, fi file.Info) int64 {
+	if fi.Mode()&(fs.ModeSymlink|fs.ModeDevice|fs.ModeNamedPipe|fs.ModeSocket|fs.ModeIrregular) != 0 {
+		return 0
+	}
+	fd, err := unix.Open(filename, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0
+	}
+	defer unix.Close(fd)
+	var fsx fsxattr
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(fsIOCFSGetXAttr), uintptr(unsafe.Pointer(&fsx))) //nolint:gosec
+	if errno != 0 {
+		return 0
+	}
+	return int64(fsx.projid)
+}
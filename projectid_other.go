@@ -0,0 +1,16 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import (
+	"cloudeng.io/file"
+)
+
+// projectID is not supported on this system.
+func projectID(string, file.Info) int64 {
+	return 0
+}
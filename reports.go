@@ -10,6 +10,7 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -26,7 +27,9 @@ type generateReportsFlags struct {
 	ReportDir string `subcmd:"report-dir,reports,directory to write reports to"`
 	TSV       int    `subcmd:"tsv,100,'generate tsv reports with the requested number of entries, 0 for none'"`
 	Markdown  int    `subcmd:"markdown,20,'generate markdown reports with the requested number of entries, 0 for none'"`
+	Charts    bool   `subcmd:"charts,true,'include svg charts of the largest subtrees, users and groups in markdown reports'"`
 	JSON      int    `subcmd:"json,100,'generate json reports with the requested number of entries, 0 for none'"`
+	HTML      int    `subcmd:"html,0,'generate a self-contained html report with a treemap and tables with the requested number of entries, 0 for none'"`
 }
 
 type reportCmds struct {
@@ -40,7 +43,7 @@ func (rc *reportCmds) generate(ctx context.Context, values interface{}, args []s
 	}
 	errs := &errors.M{}
 	for _, filename := range args {
-		data, err := os.ReadFile(filename)
+		data, err := readStatsFile(ctx, filename)
 		if err != nil {
 			errs.Append(err)
 			continue
@@ -54,6 +57,20 @@ func (rc *reportCmds) generate(ctx context.Context, values interface{}, args []s
 	return errs.Err()
 }
 
+// readStatsFile reads, and if need be decrypts, the contents of a stats file.
+func readStatsFile(ctx context.Context, filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rd, err := decryptingReader(ctx, f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	return io.ReadAll(rd)
+}
+
 // Need to recreate stats for every report as the topN values are
 // removed from the heaps as they are used.
 func (rc *reportCmds) getStats() (statsFileFormat, error) {
@@ -91,13 +108,16 @@ func (rc *reportCmds) reportsFor(rf *generateReportsFlags, suffix string) (*repo
 	case ".md":
 		md := &markdownReports{}
 		return filenames, md.generateReports(rf, filenames, stats)
+	case ".html":
+		hr := &htmlReports{}
+		return filenames, hr.generateReports(rf, filenames, stats)
 	}
 	return nil, fmt.Errorf("unsupported report format: %v", suffix)
 }
 
 func (rc *reportCmds) generateReports(_ context.Context, rf *generateReportsFlags) error {
-	if rf.TSV == 0 && rf.JSON == 0 && rf.Markdown == 0 {
-		return fmt.Errorf("no report requested, please specify one of --tsv, --json or --markdown")
+	if rf.TSV == 0 && rf.JSON == 0 && rf.Markdown == 0 && rf.HTML == 0 {
+		return fmt.Errorf("no report requested, please specify one of --tsv, --json, --markdown or --html")
 	}
 
 	var err error
@@ -111,6 +131,9 @@ func (rc *reportCmds) generateReports(_ context.Context, rf *generateReportsFlag
 	if rf.Markdown > 0 {
 		filenames, err = rc.reportsFor(rf, ".md")
 	}
+	if rf.HTML > 0 {
+		filenames, err = rc.reportsFor(rf, ".html")
+	}
 	if err != nil {
 		return err
 	}
@@ -161,6 +184,10 @@ func (rf *reportFilenames) summary(file string) string {
 	return filepath.Join(rf.rootDir(), file+rf.ext)
 }
 
+func (rf *reportFilenames) chart(file string) string {
+	return filepath.Join(rf.rootDir(), file+".svg")
+}
+
 func (rf *reportFilenames) user(uid int64) string {
 	un := usernames.Manager.NameForUID(uid)
 	return filepath.Join(rf.usersDir(), un+rf.ext)
@@ -225,7 +252,13 @@ func writeReportFiles(sdb *reports.AllStats,
 	if err := os.WriteFile(filenames.summary("group"), groupdata, 0600); err != nil {
 		return err
 	}
-	return nil
+
+	if sdb.ByProject == nil || sdb.ByProject.Bytes.Len() == 0 {
+		return nil
+	}
+	projectMerged := sdb.ByProject.Merge(topN)
+	projectdata := idFormatter(projectMerged, usernames.Manager.NameForProjectID)
+	return os.WriteFile(filenames.summary("project"), projectdata, 0600)
 }
 
 type locateReportsFlags struct {
@@ -0,0 +1,208 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/database/types"
+	"cloudeng.io/file/filewalk"
+)
+
+// errorRetries records the errors logged by a previous analyze of a
+// prefix and determines the prefixes that need to be rescanned in order
+// to retry them. Prefixes that failed are rescanned along with their
+// subtrees, whereas files that failed are retried by rescanning the
+// prefix that contains them, without descending into its subtree.
+// The parents of failed prefixes are also rescanned, without descending
+// into their subtrees, so that their entries for those prefixes are
+// brought up to date.
+type errorRetries struct {
+	sep      string
+	keys     []string
+	subtrees []string
+	parents  map[string]bool
+
+	mu       sync.Mutex
+	relogged map[string]bool
+}
+
+// within returns true if path is the same as, or is contained within, prefix.
+func within(path, prefix, sep string) bool {
+	if path == prefix {
+		return true
+	}
+	if !strings.HasSuffix(prefix, sep) {
+		prefix += sep
+	}
+	return strings.HasPrefix(path, prefix)
+}
+
+func parentOf(path, sep string) string {
+	idx := strings.LastIndex(path, sep)
+	switch {
+	case idx < 0:
+		return path
+	case idx == 0:
+		return sep
+	}
+	return path[:idx]
+}
+
+func newErrorRetries(ctx context.Context, sdb internal.ScanDB, fs filewalk.FS, root, sep string) (*errorRetries, error) {
+	er := &errorRetries{
+		sep:      sep,
+		parents:  map[string]bool{},
+		relogged: map[string]bool{},
+	}
+	err := sdb.VisitErrors(ctx, root, func(_ context.Context, pl types.ErrorPayload) bool {
+		if !strings.HasPrefix(pl.Key, root) {
+			return false
+		}
+		if within(pl.Key, root, sep) {
+			er.keys = append(er.keys, pl.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	subtrees := map[string]bool{}
+	for _, key := range er.keys {
+		if key == root {
+			subtrees[key] = true
+			continue
+		}
+		// Use the current state of the filesystem to determine
+		// whether the error refers to a prefix or a file, since
+		// the error may have prevented it from being recorded in
+		// the database.
+		if fi, err := fs.Lstat(ctx, key); err == nil && fi.IsDir() {
+			subtrees[key] = true
+		}
+		er.parents[parentOf(key, sep)] = true
+	}
+	er.subtrees = collapsePrefixes(subtrees, sep)
+	for p := range er.parents {
+		if !within(p, root, sep) || er.inSubtree(p) {
+			delete(er.parents, p)
+		}
+	}
+	return er, nil
+}
+
+// collapsePrefixes returns the sorted prefixes that are not contained
+// within any of the other prefixes.
+func collapsePrefixes(prefixes map[string]bool, sep string) []string {
+	sorted := make([]string, 0, len(prefixes))
+	for p := range prefixes {
+		sorted = append(sorted, p)
+	}
+	slices.Sort(sorted)
+	var collapsed []string
+	for _, p := range sorted {
+		// A prefix need not immediately follow the prefix that contains
+		// it in sorted order, eg. /a/b-c sorts between /a/b and /a/b/c,
+		// so it must be compared against all of the collapsed prefixes.
+		if _, ok := withinAny(p, collapsed, sep); ok {
+			continue
+		}
+		collapsed = append(collapsed, p)
+	}
+	return collapsed
+}
+
+// withinAny returns the first of prefixes that path is within, if any.
+func withinAny(path string, prefixes []string, sep string) (string, bool) {
+	for _, p := range prefixes {
+		if within(path, p, sep) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func (er *errorRetries) inSubtree(path string) bool {
+	_, ok := withinAny(path, er.subtrees, er.sep)
+	return ok
+}
+
+// roots returns the prefixes to be walked in order to retry all of
+// the errors.
+func (er *errorRetries) roots() []string {
+	roots := slices.Clone(er.subtrees)
+	for p := range er.parents {
+		roots = append(roots, p)
+	}
+	slices.Sort(roots)
+	return roots
+}
+
+// descend returns true if the subtree of prefix is to be rescanned.
+func (er *errorRetries) descend(prefix string) bool {
+	return !er.parents[prefix]
+}
+
+func (er *errorRetries) logged(key string) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	er.relogged[key] = true
+}
+
+// resolved returns the keys of the errors that did not reoccur
+// when retried.
+func (er *errorRetries) resolved() []string {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	var resolved []string
+	for _, k := range er.keys {
+		if !er.relogged[k] {
+			resolved = append(resolved, k)
+		}
+	}
+	return resolved
+}
+
+// errorAttempts records the number of attempts of the errors that were
+// deleted at the start of an analyze run so that the count is retained
+// for those errors that are encountered again.
+type errorAttempts struct {
+	mu       sync.Mutex
+	attempts map[string]int64
+}
+
+func previousAttempts(ctx context.Context, sdb internal.ScanDB, root, sep string) (*errorAttempts, error) {
+	ea := &errorAttempts{attempts: map[string]int64{}}
+	err := sdb.VisitErrors(ctx, root, func(_ context.Context, pl types.ErrorPayload) bool {
+		if !strings.HasPrefix(pl.Key, root) {
+			return false
+		}
+		if within(pl.Key, root, sep) {
+			// Errors recorded before attempts were counted will
+			// have a zero attempt count.
+			ea.attempts[pl.Key] = max(pl.Attempts, 1)
+		}
+		return true
+	})
+	return ea, err
+}
+
+// take returns the number of attempts previously recorded for key, or
+// zero if there were none, the first time it is called for key and zero
+// thereafter since subsequent errors are counted as usual.
+func (ea *errorAttempts) take(key string) int64 {
+	if ea == nil {
+		return 0
+	}
+	ea.mu.Lock()
+	defer ea.mu.Unlock()
+	n := ea.attempts[key]
+	delete(ea.attempts, key)
+	return n
+}
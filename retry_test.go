@@ -0,0 +1,31 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCollapsePrefixes(t *testing.T) {
+	for i, tc := range []struct {
+		prefixes []string
+		want     []string
+	}{
+		{nil, nil},
+		{[]string{"/a"}, []string{"/a"}},
+		{[]string{"/a", "/a/b", "/ab"}, []string{"/a", "/ab"}},
+		{[]string{"/a/b", "/a/b-c", "/a/b/c"}, []string{"/a/b", "/a/b-c"}},
+		{[]string{"/", "/a", "/b/c"}, []string{"/"}},
+	} {
+		prefixes := map[string]bool{}
+		for _, p := range tc.prefixes {
+			prefixes[p] = true
+		}
+		if got, want := collapsePrefixes(prefixes, "/"), tc.want; !slices.Equal(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmdutil"
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+)
+
+// prefixesAndExpression determines the prefixes to be analyzed and the
+// expression to be used. If --all is specified then all of the configured
+// prefixes are analyzed and all of the arguments form the expression.
+// Otherwise the first argument is always a prefix and any subsequent
+// arguments that are existing directories within a configured prefix
+// are also treated as prefixes, the remaining arguments form the expression.
+func (alz *analyzeCmd) prefixesAndExpression(ctx context.Context, fwfs filewalk.FS, af *analyzeFlags, args []string) (prefixes, expr []string, err error) {
+	if af.All {
+		for _, p := range globalConfig.Prefixes {
+			if !slices.Contains(prefixes, p.Prefix) {
+				prefixes = append(prefixes, p.Prefix)
+			}
+		}
+		if len(prefixes) == 0 {
+			return nil, nil, fmt.Errorf("no prefixes are configured")
+		}
+		return prefixes, args, nil
+	}
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("at least one prefix must be specified, or use --all")
+	}
+	prefixes = []string{args[0]}
+	for i, arg := range args[1:] {
+		if !alz.isPrefix(ctx, fwfs, arg) {
+			return prefixes, args[i+1:], nil
+		}
+		if !slices.Contains(prefixes, arg) {
+			prefixes = append(prefixes, arg)
+		}
+	}
+	return prefixes, nil, nil
+}
+
+func (alz *analyzeCmd) isPrefix(ctx context.Context, fwfs filewalk.FS, arg string) bool {
+	if _, _, err := internal.LookupPrefix(ctx, globalConfig, arg); err != nil {
+		return false
+	}
+	fi, err := fwfs.Lstat(ctx, arg)
+	return err == nil && fi.IsDir()
+}
+
+// nestedPrefixes returns the prefixes that are contained within each
+// of the supplied prefixes so that they can be skipped when the prefix
+// that contains them is analyzed, since they will be analyzed in their
+// own right.
+func nestedPrefixes(prefixes []string) map[string][]string {
+	nested := map[string][]string{}
+	for _, p := range prefixes {
+		_, cfg, err := internal.LookupPrefix(context.Background(), globalConfig, p)
+		if err != nil {
+			continue
+		}
+		for _, o := range prefixes {
+			if o != p && within(o, p, cfg.Separator) {
+				nested[p] = append(nested[p], o)
+			}
+		}
+	}
+	return nested
+}
+
+// scanBudget limits the total number of concurrent scans used by
+// concurrently running analyses. An analysis that requires more than
+// the remaining budget waits until all others have completed.
+type scanBudget struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	total   int
+	used    int
+	running int
+}
+
+func newScanBudget(total int) *scanBudget {
+	b := &scanBudget{total: total}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *scanBudget) acquire(ctx context.Context, n int) error {
+	stop := context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.cond.Broadcast()
+	})
+	defer stop()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.running > 0 && b.used+n > b.total {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b.cond.Wait()
+	}
+	b.used += n
+	b.running++
+	return nil
+}
+
+func (b *scanBudget) release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	b.running--
+	b.cond.Broadcast()
+}
+
+type prefixResult struct {
+	prefix   string
+	database string
+	summary  anaylzeSummary
+	err      error
+}
+
+// analyzePrefixes analyzes multiple prefixes subject to the concurrency
+// budget. Analyses of prefixes that share a database are never run
+// concurrently. Only failures to analyze a prefix are returned as errors,
+// filesystem errors encountered during an analysis are recorded in
+// the database as usual.
+func (alz *analyzeCmd) analyzePrefixes(ctx context.Context, fwfs filewalk.FS, af *analyzeFlags, prefixes, expr []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	cmdutil.HandleSignals(func() {
+		cancel()
+		fmt.Printf("waiting for all analyses to finish\n")
+	}, os.Interrupt, os.Kill)
+
+	nested := nestedPrefixes(prefixes)
+	budget := newScanBudget(af.Budget)
+	// Progress is only displayed when analyses are run one at a time.
+	progress := af.Progress && af.Budget == 0
+
+	var dbMu sync.Mutex
+	dbLocks := map[string]*sync.Mutex{}
+	dbLock := func(db string) *sync.Mutex {
+		dbMu.Lock()
+		defer dbMu.Unlock()
+		if _, ok := dbLocks[db]; !ok {
+			dbLocks[db] = &sync.Mutex{}
+		}
+		return dbLocks[db]
+	}
+
+	results := make([]prefixResult, len(prefixes))
+	var wg sync.WaitGroup
+	for i, prefix := range prefixes {
+		results[i].prefix = prefix
+		_, cfg, err := internal.LookupPrefix(ctx, globalConfig, prefix)
+		if err != nil {
+			results[i].err = err
+			continue
+		}
+		results[i].database = cfg.Database
+		wg.Add(1)
+		go func(res *prefixResult) {
+			defer wg.Done()
+			mu := dbLock(cfg.Database)
+			mu.Lock()
+			defer mu.Unlock()
+			// A zero concurrent_scans means that the filewalk default
+			// is used, and hence it must count against the budget.
+			scans := max(1, cmp.Or(cfg.ConcurrentScans, filewalk.DefaultConcurrentScans))
+			if err := budget.acquire(ctx, scans); err != nil {
+				res.err = err
+				return
+			}
+			defer budget.release(scans)
+			fmt.Printf("analyzing %v using database %v\n", res.prefix, res.database)
+			res.summary, res.err = alz.analyzePrefix(ctx, fwfs, af, prefixRun{
+				prefix:   res.prefix,
+				nested:   nested[res.prefix],
+				progress: progress,
+			}, expr)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	printPrefixResults(os.Stdout, results)
+	errs := errors.M{}
+	for _, res := range results {
+		if res.err != nil {
+			errs.Append(fmt.Errorf("%v: %w", res.prefix, res.err))
+		}
+	}
+	return errs.Squash(context.Canceled)
+}
+
+func printPrefixResults(out io.Writer, results []prefixResult) {
+	width := len("prefix")
+	for _, res := range results {
+		width = max(width, len(res.prefix))
+	}
+	fmt.Fprintf(out, "\n%-*s  %12s  %12s  %8s  %10s  %s\n", width, "prefix", "prefixes", "files", "errors", "duration", "status")
+	for _, res := range results {
+		status := "ok"
+		if res.err != nil {
+			status = res.err.Error()
+		}
+		s := res.summary
+		fmt.Fprintf(out, "%-*s  %12s  %12s  %8s  %10s  %s\n", width, res.prefix,
+			fmtCount(s.PrefixesFinished),
+			fmtCount(s.Files),
+			fmtCount(s.Errors),
+			s.Duration.Truncate(time.Second),
+			status)
+	}
+}
@@ -0,0 +1,743 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/boolexpr"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/types"
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/cmd/idu/internal/reports"
+	"cloudeng.io/cmd/idu/internal/usernames"
+	"cloudeng.io/file"
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/file/localfs"
+)
+
+type serveFlags struct {
+	Address  string        `subcmd:"address,localhost:8080,'address to listen on'"`
+	Timeout  time.Duration `subcmd:"timeout,1m,'maximum duration of any single request'"`
+	PageSize int           `subcmd:"page-size,1000,'default, and maximum, number of items returned by a single request'"`
+	StatsDir string        `subcmd:"stats-dir,stats,'directory containing the stats files created by stats compute'"`
+	Nested   bool          `subcmd:"nested,true,'include the prefixes stored in the databases of any served prefixes nested within a requested prefix'"`
+}
+
+type serveCmd struct{}
+
+func (sc *serveCmd) serve(ctx context.Context, values interface{}, args []string) error {
+	sf := values.(*serveFlags)
+	srv, err := newServer(ctx, localfs.New(), globalConfig, sf, args)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", sf.Address)
+	if err != nil {
+		return err
+	}
+	hs := &http.Server{
+		Handler:           srv.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+	for _, p := range srv.served.Prefixes {
+		fmt.Printf("serving: %v\n", p.Prefix)
+	}
+	fmt.Printf("listening on: http://%v/api/\n", ln.Addr())
+	if err := hs.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// server implements a read-only HTTP/JSON API over the databases for
+// a set of configured prefixes. Databases are opened, read-only, for
+// each request so that the server never holds a database open between
+// requests and, when replicas are enabled, never waits for a running
+// analyze.
+type server struct {
+	served   config.T
+	fwfs     filewalk.FS
+	timeout  time.Duration
+	pageSize int
+	statsDir string
+	nested   bool
+}
+
+// newServer returns a server for the configured prefixes that contain
+// each of prefixes, or for all configured prefixes if none are specified.
+func newServer(ctx context.Context, fwfs filewalk.FS, all config.T, sf *serveFlags, prefixes []string) (*server, error) {
+	if sf.PageSize <= 0 {
+		return nil, fmt.Errorf("invalid page size: %v", sf.PageSize)
+	}
+	srv := &server{
+		fwfs:     fwfs,
+		timeout:  sf.Timeout,
+		pageSize: sf.PageSize,
+		statsDir: sf.StatsDir,
+		nested:   sf.Nested,
+	}
+	if len(prefixes) == 0 {
+		srv.served.Prefixes = all.Prefixes
+		return srv, nil
+	}
+	for _, p := range prefixes {
+		_, cfg, err := internal.LookupPrefix(ctx, all, p)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(srv.served.Prefixes, func(s config.Prefix) bool { return s.Prefix == cfg.Prefix }) {
+			srv.served.Prefixes = append(srv.served.Prefixes, cfg)
+		}
+	}
+	return srv, nil
+}
+
+func (srv *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/prefixes", srv.prefixes)
+	mux.HandleFunc("GET /api/prefix", srv.prefix)
+	mux.HandleFunc("GET /api/children", srv.children)
+	mux.HandleFunc("GET /api/find", srv.find)
+	mux.HandleFunc("GET /api/logs", srv.logs)
+	mux.HandleFunc("GET /api/errors", srv.errors)
+	mux.HandleFunc("GET /api/stats", srv.statsFiles)
+	mux.HandleFunc("GET /api/stats/{file}", srv.stats)
+	mux.HandleFunc("GET /api/reports/{file}/{kind}", srv.reports)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if srv.timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), srv.timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// httpError is an error with the HTTP status code to be returned for it.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (he *httpError) Error() string {
+	return he.err.Error()
+}
+
+func badRequest(format string, args ...any) error {
+	return &httpError{status: http.StatusBadRequest, err: fmt.Errorf(format, args...)}
+}
+
+func notFound(format string, args ...any) error {
+	return &httpError{status: http.StatusNotFound, err: fmt.Errorf(format, args...)}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err with the status code for it, timeouts are
+// detected using the request's context since the errors returned when
+// opening databases do not wrap the context's error.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	var he *httpError
+	switch {
+	case errors.As(err, &he):
+		status = he.status
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(r.Context().Err(), context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// page is returned by all of the endpoints that return a list of items,
+// Next is the cursor to be supplied as the after parameter to obtain the
+// next page and is empty for the last page.
+type page[T any] struct {
+	Items []T    `json:"items"`
+	Next  string `json:"next,omitempty"`
+}
+
+// pageParams returns the after and limit parameters for r, limit
+// defaults to, and is capped at, the server's page size.
+func (srv *server) pageParams(r *http.Request) (after string, limit int, err error) {
+	after = r.URL.Query().Get("after")
+	limit = srv.pageSize
+	if l := r.URL.Query().Get("limit"); len(l) > 0 {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			return "", 0, badRequest("invalid limit: %q", l)
+		}
+		limit = min(limit, srv.pageSize)
+	}
+	return after, limit, nil
+}
+
+// open opens the database(s) for the prefix parameter of r, which must
+// be contained within one of the served prefixes.
+func (srv *server) open(r *http.Request) (context.Context, string, config.Prefix, database.DB, error) {
+	ctx := r.Context()
+	prefix := r.URL.Query().Get("prefix")
+	if len(prefix) == 0 || !filepath.IsAbs(prefix) {
+		return ctx, "", config.Prefix{}, nil, badRequest("an absolute prefix must be specified: %q", prefix)
+	}
+	if _, ok := srv.served.ForPrefix(prefix); !ok {
+		return ctx, "", config.Prefix{}, nil, notFound("%v is not served", prefix)
+	}
+	var cfg config.Prefix
+	var db database.DB
+	var err error
+	if srv.nested {
+		ctx, cfg, db, err = internal.OpenNestedDatabases(ctx, srv.served, prefix, time.Time{}, true)
+	} else {
+		ctx, cfg, db, err = internal.OpenPrefixAndDatabaseAsOf(ctx, srv.served, prefix, time.Time{}, true)
+	}
+	return ctx, prefix, cfg, db, err
+}
+
+type servedPrefix struct {
+	Prefix       string `json:"prefix"`
+	Separator    string `json:"separator"`
+	DatabaseType string `json:"database_type,omitempty"`
+}
+
+func (srv *server) prefixes(w http.ResponseWriter, _ *http.Request) {
+	items := make([]servedPrefix, 0, len(srv.served.Prefixes))
+	for _, p := range srv.served.Prefixes {
+		items = append(items, servedPrefix{Prefix: p.Prefix, Separator: p.Separator, DatabaseType: cmp.Or(p.DatabaseType, config.BadgerDatabase)})
+	}
+	writeJSON(w, http.StatusOK, page[servedPrefix]{Items: items})
+}
+
+func getPrefixInfo(ctx context.Context, db database.DB, prefix string) (prefixinfo.T, error) {
+	var pi prefixinfo.T
+	var buf bytes.Buffer
+	if err := db.Get(ctx, prefix, &buf); err != nil {
+		return pi, err
+	}
+	if buf.Len() == 0 {
+		return pi, notFound("%v not found", prefix)
+	}
+	if err := pi.UnmarshalBinary(buf.Bytes()); err != nil {
+		return pi, fmt.Errorf("failed to decode %v: %v", prefix, err)
+	}
+	return pi, nil
+}
+
+// prefixDetail describes a single prefix and the files and directories
+// immediately within it.
+type prefixDetail struct {
+	Prefix string `json:"prefix"`
+	exportedFile
+	Files    int64 `json:"files"`
+	Prefixes int64 `json:"prefixes"`
+	Bytes    int64 `json:"bytes"`
+}
+
+func (srv *server) prefix(w http.ResponseWriter, r *http.Request) {
+	ctx, prefix, _, db, err := srv.open(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer db.Close(ctx)
+	pi, err := getPrefixInfo(ctx, db, prefix)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	pd := prefixDetail{Prefix: prefix, exportedFile: newExportedPrefix(&pi).exportedFile}
+	for _, fi := range pi.InfoList() {
+		if fi.IsDir() {
+			pd.Prefixes++
+			continue
+		}
+		pd.Files++
+		pd.Bytes += fi.Size()
+	}
+	writeJSON(w, http.StatusOK, pd)
+}
+
+// childTotals are the totals for the subtree rooted at a directory, file
+// sizes are the apparent sizes and hard linked files are counted once
+// for every name.
+type childTotals struct {
+	Bytes    int64 `json:"bytes"`
+	Files    int64 `json:"files"`
+	Prefixes int64 `json:"prefixes"`
+}
+
+type child struct {
+	exportedFile
+	Dir    bool         `json:"dir"`
+	Totals *childTotals `json:"totals,omitempty"`
+}
+
+// children lists the files and directories immediately within a prefix,
+// in name order. If the totals parameter is true then the totals for the
+// subtree rooted at every directory in the page are also computed, which
+// requires reading every prefix beneath the requested prefix.
+func (srv *server) children(w http.ResponseWriter, r *http.Request) {
+	after, limit, err := srv.pageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	withTotals, _ := strconv.ParseBool(r.URL.Query().Get("totals"))
+	ctx, prefix, cfg, db, err := srv.open(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer db.Close(ctx)
+	pi, err := getPrefixInfo(ctx, db, prefix)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	entries := pi.InfoList()
+	slices.SortFunc(entries, func(a, b file.Info) int { return strings.Compare(a.Name(), b.Name()) })
+	var resp page[child]
+	resp.Items = []child{}
+	totals := map[string]*childTotals{}
+	for _, fi := range entries {
+		if fi.Name() <= after {
+			continue
+		}
+		if len(resp.Items) == limit {
+			resp.Next = resp.Items[limit-1].Name
+			break
+		}
+		c := child{
+			exportedFile: newExportedFile(fi.Name(), fi.Size(), fi.Mode(), fi.ModTime(), pi.XAttrInfo(fi), pi.TimesInfo(fi), pi.ProjectIDInfo(fi)),
+			Dir:          fi.IsDir(),
+		}
+		if c.Dir && withTotals {
+			c.Totals = &childTotals{}
+			totals[fi.Name()] = c.Totals
+		}
+		resp.Items = append(resp.Items, c)
+	}
+	if len(totals) > 0 {
+		if err := subtreeTotals(ctx, db, prefix, cfg.Separator, totals); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// subtreeTotals accumulates the totals for the subtrees of prefix named
+// in totals.
+func subtreeTotals(ctx context.Context, db database.DB, prefix, sep string, totals map[string]*childTotals) error {
+	if !strings.HasSuffix(prefix, sep) {
+		prefix += sep
+	}
+	var mu sync.Mutex
+	var decodeErr error
+	err := db.Stream(ctx, prefix, func(_ context.Context, k string, v []byte) {
+		if ctx.Err() != nil {
+			return
+		}
+		name, _, _ := strings.Cut(k[len(prefix):], sep)
+		t := totals[name]
+		if t == nil {
+			return
+		}
+		var pi prefixinfo.T
+		if err := pi.UnmarshalBinary(v); err != nil {
+			mu.Lock()
+			decodeErr = fmt.Errorf("failed to decode %v: %v", k, err)
+			mu.Unlock()
+			return
+		}
+		var bytes, files int64
+		for _, fi := range pi.InfoList() {
+			if !fi.IsDir() {
+				files++
+				bytes += fi.Size()
+			}
+		}
+		mu.Lock()
+		t.Prefixes++
+		t.Files += files
+		t.Bytes += bytes
+		mu.Unlock()
+	})
+	return cmp.Or(err, ctx.Err(), decodeErr)
+}
+
+// found is the NDJSON record written for every prefix or file that
+// matches a find request.
+type found struct {
+	Key string `json:"key"`
+	Dir bool   `json:"dir"`
+	exportedFile
+}
+
+// pageEnd is the last NDJSON record written for a find request that
+// either has more results or was terminated by an error.
+type pageEnd struct {
+	Next  string `json:"next,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// find streams the prefixes and files that match the expr parameter as
+// newline delimited JSON. A page ends once at least limit results have
+// been written and the prefix containing the last of them is complete
+// so that after is always the key of a prefix.
+func (srv *server) find(w http.ResponseWriter, r *http.Request) {
+	after, limit, err := srv.pageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	parser := boolexpr.NewParser(r.Context(), srv.fwfs)
+	var expr []string
+	if e := r.URL.Query().Get("expr"); len(e) > 0 {
+		expr = append(expr, e)
+	}
+	match, err := boolexpr.CreateMatcher(parser,
+		boolexpr.WithEmptyEntryValue(true),
+		boolexpr.WithFilewalkFS(srv.fwfs),
+		boolexpr.WithEntryExpression(expr...))
+	if err != nil {
+		writeError(w, r, badRequest("%v", err))
+		return
+	}
+	ctx, prefix, cfg, db, err := srv.open(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer db.Close(ctx)
+	if len(after) > 0 && !strings.HasPrefix(after, prefix) {
+		writeError(w, r, badRequest("after %q is not within prefix %q", after, prefix))
+		return
+	}
+	start := prefix
+	if len(after) > 0 {
+		start = after + "\x00"
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	var end pageEnd
+	n := 0
+	err = db.Scan(ctx, start, func(ctx context.Context, k string, v []byte) bool {
+		if !strings.HasPrefix(k, prefix) {
+			return false
+		}
+		if err := ctx.Err(); err != nil {
+			end.Error = err.Error()
+			return false
+		}
+		var pi prefixinfo.T
+		if err := pi.UnmarshalBinary(v); err != nil {
+			end.Error = fmt.Sprintf("failed to decode %v: %v", k, err)
+			return false
+		}
+		if match.Prefix(k, &pi) {
+			_ = enc.Encode(found{Key: k, Dir: true, exportedFile: newExportedPrefix(&pi).exportedFile})
+			n++
+		}
+		for _, fi := range pi.InfoList() {
+			if fi.IsDir() || !match.Entry(k, &pi, fi) {
+				continue
+			}
+			key := strings.TrimSuffix(k, cfg.Separator) + cfg.Separator + fi.Name()
+			_ = enc.Encode(found{Key: key, exportedFile: newExportedFile(fi.Name(), fi.Size(), fi.Mode(), fi.ModTime(), pi.XAttrInfo(fi), pi.TimesInfo(fi), pi.ProjectIDInfo(fi))})
+			n++
+		}
+		if n >= limit {
+			end.Next = k
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		end.Error = err.Error()
+	}
+	if len(end.Next) > 0 || len(end.Error) > 0 {
+		_ = enc.Encode(end)
+	}
+}
+
+type servedLog struct {
+	Start  time.Time       `json:"start"`
+	Stop   time.Time       `json:"stop"`
+	Detail json.RawMessage `json:"detail,omitempty"`
+}
+
+// logs lists the logs, in order of their start times; after is the
+// start time, in RFC 3339 format, of the last log in the previous page.
+func (srv *server) logs(w http.ResponseWriter, r *http.Request) {
+	after, limit, err := srv.pageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var from time.Time
+	if len(after) > 0 {
+		if from, err = time.Parse(time.RFC3339Nano, after); err != nil {
+			writeError(w, r, badRequest("invalid after: %v", err))
+			return
+		}
+		from = from.Add(time.Nanosecond)
+	}
+	ctx, _, _, db, err := srv.open(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer db.Close(ctx)
+	resp := page[servedLog]{Items: []servedLog{}}
+	err = db.VisitLogs(ctx, from, time.Now(), func(_ context.Context, start, stop time.Time, detail []byte) bool {
+		if len(resp.Items) == limit {
+			resp.Next = resp.Items[limit-1].Start.Format(time.RFC3339Nano)
+			return false
+		}
+		l := servedLog{Start: start, Stop: stop}
+		if json.Valid(detail) {
+			l.Detail = json.RawMessage(slices.Clone(detail))
+		} else if len(detail) > 0 {
+			l.Detail, _ = json.Marshal(string(detail))
+		}
+		resp.Items = append(resp.Items, l)
+		return true
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// errors lists the errors recorded for the prefix, and those beneath
+// it, in key order, optionally restricted to a single category.
+func (srv *server) errors(w http.ResponseWriter, r *http.Request) {
+	after, limit, err := srv.pageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	category, err := parseErrorCategory(r.URL.Query().Get("category"))
+	if err != nil {
+		writeError(w, r, badRequest("%v", err))
+		return
+	}
+	ctx, prefix, _, db, err := srv.open(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer db.Close(ctx)
+	start := prefix
+	if len(after) > 0 {
+		start = after + "\x00"
+	}
+	resp := page[errorRecord]{Items: []errorRecord{}}
+	err = db.VisitErrors(ctx, start, func(_ context.Context, pl types.ErrorPayload) bool {
+		if !strings.HasPrefix(pl.Key, prefix) {
+			return false
+		}
+		er := newErrorRecord(pl)
+		if len(category) > 0 && er.Category != category {
+			return true
+		}
+		if len(resp.Items) == limit {
+			resp.Next = resp.Items[limit-1].Key
+			return false
+		}
+		resp.Items = append(resp.Items, er)
+		return true
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type statsFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// statsFiles lists the stats files in the stats directory in name, and
+// hence date, order.
+func (srv *server) statsFiles(w http.ResponseWriter, r *http.Request) {
+	after, limit, err := srv.pageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	entries, err := os.ReadDir(srv.statsDir)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	resp := page[statsFile]{Items: []statsFile{}}
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ".idustats" || e.Name() <= after {
+			continue
+		}
+		if len(resp.Items) == limit {
+			resp.Next = resp.Items[limit-1].Name
+			break
+		}
+		fi, err := os.Stat(filepath.Join(srv.statsDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		resp.Items = append(resp.Items, statsFile{Name: e.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// loadServedStats loads the named stats file, which must have been
+// computed for a served prefix.
+func (srv *server) loadServedStats(r *http.Request) (string, statsFileFormat, error) {
+	name := r.PathValue("file")
+	if filepath.Base(name) != name || filepath.Ext(name) != ".idustats" {
+		return "", statsFileFormat{}, badRequest("invalid stats file name: %q", name)
+	}
+	stats, err := loadStats(r.Context(), filepath.Join(srv.statsDir, name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", stats, notFound("%v not found", name)
+		}
+		return "", stats, err
+	}
+	if _, ok := srv.served.ForPrefix(stats.Prefix); !ok {
+		return "", stats, notFound("%v not found", name)
+	}
+	return name, stats, nil
+}
+
+type statsSummary struct {
+	Name       string              `json:"name"`
+	Prefix     string              `json:"prefix"`
+	Date       time.Time           `json:"date"`
+	Expression string              `json:"expression,omitempty"`
+	Totals     reports.MergedStats `json:"totals"`
+	AccessAges []accessAge         `json:"access_ages,omitempty"`
+	Reports    []string            `json:"reports"`
+}
+
+type accessAge struct {
+	Age   string `json:"age"`
+	Files int64  `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+var reportKinds = []string{"prefixes", "users", "groups", "projects"}
+
+func (srv *server) stats(w http.ResponseWriter, r *http.Request) {
+	name, stats, err := srv.loadServedStats(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	h := stats.Stats.Prefix
+	resp := statsSummary{
+		Name:       name,
+		Prefix:     stats.Prefix,
+		Date:       stats.Date,
+		Expression: stats.Expression,
+		Totals: reports.MergedStats{
+			Prefix:      h.Prefix,
+			Bytes:       h.TotalBytes,
+			Storage:     h.TotalStorageBytes,
+			Files:       h.TotalFiles,
+			Prefixes:    h.TotalPrefixes,
+			PrefixBytes: h.TotalPrefixBytes,
+		},
+		Reports: reportKinds,
+	}
+	if ages := stats.Stats.AccessAges; ages != nil && ages.Known() {
+		for i := range ages.Files {
+			resp.AccessAges = append(resp.AccessAges, accessAge{Age: ages.Label(i), Files: ages.Files[i], Bytes: ages.Bytes[i]})
+		}
+		resp.AccessAges = append(resp.AccessAges, accessAge{Age: "unknown", Files: ages.UnknownFiles, Bytes: ages.UnknownBytes})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// reports returns the top limit entries, by bytes, for the requested
+// kind of report from the named stats file.
+func (srv *server) reports(w http.ResponseWriter, r *http.Request) {
+	_, limit, err := srv.pageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	kind := r.PathValue("kind")
+	if !slices.Contains(reportKinds, kind) {
+		writeError(w, r, notFound("unknown report %q, use one of %v", kind, strings.Join(reportKinds, ", ")))
+		return
+	}
+	_, stats, err := srv.loadServedStats(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	sdb := stats.Stats
+	var items []reports.MergedStats
+	perID := func(h *reports.Heaps[int64], nameForID func(int64) string) {
+		if h == nil {
+			return
+		}
+		for id, m := range h.Merge(limit) {
+			m.ID, m.IDName = id, nameForID(id)
+			items = append(items, m)
+		}
+	}
+	switch kind {
+	case "prefixes":
+		for p, m := range sdb.Prefix.Merge(limit) {
+			m.Prefix = p
+			items = append(items, m)
+		}
+	case "users":
+		perID(sdb.ByUser, usernames.Manager.NameForUID)
+	case "groups":
+		perID(sdb.ByGroup, usernames.Manager.NameForGID)
+	case "projects":
+		perID(sdb.ByProject, usernames.Manager.NameForProjectID)
+	}
+	slices.SortFunc(items, func(a, b reports.MergedStats) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), strings.Compare(a.Prefix, b.Prefix), cmp.Compare(a.ID, b.ID))
+	})
+	writeJSON(w, http.StatusOK, page[reports.MergedStats]{Items: items[:min(limit, len(items))]})
+}
@@ -0,0 +1,358 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database/types"
+	"cloudeng.io/cmd/idu/internal/reports"
+	"cloudeng.io/cmd/idu/internal/synthfs"
+	"cloudeng.io/file/localfs"
+)
+
+func getJSON(t *testing.T, base, path string, params url.Values, status int, v any) {
+	t.Helper()
+	resp, err := http.Get(base + path + "?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("%v: got status %v, want %v", path, resp.StatusCode, status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("%v: %v", path, err)
+	}
+}
+
+// getPages follows the next cursor of a paged endpoint, returning every
+// item.
+func getPages[T any](t *testing.T, base, path string, params url.Values) (items []T, pages int) {
+	t.Helper()
+	for {
+		var p page[T]
+		getJSON(t, base, path, params, http.StatusOK, &p)
+		items = append(items, p.Items...)
+		pages++
+		if len(p.Next) == 0 {
+			return
+		}
+		params.Set("after", p.Next)
+	}
+}
+
+func TestServe(t *testing.T) {
+	ctx := context.Background()
+	sfs := synthfs.New("/synthetic", 3,
+		synthfs.WithShape(2, 4, 10),
+		synthfs.WithUIDs(synthfs.Uniform(1000, 1001, 1002, 1003)),
+		synthfs.WithHardlinks(0.05),
+		synthfs.WithPermissionErrors(0.1))
+	cfg := setupSynthetic(t, sfs)
+	want := computeSyntheticTotals(t, sfs)
+	analyzeSynthetic(ctx, t, sfs)
+
+	statsDir := t.TempDir()
+	all := statsSynthetic(ctx, t, cfg, sfs)
+	stats := statsFileFormat{Prefix: sfs.Root(), Date: time.Now(), Stats: all}
+	if err := saveStats(ctx, statsDir, "", cfg.Prefixes[0].Encryption, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := newServer(ctx, sfs, cfg, &serveFlags{Timeout: time.Minute, PageSize: 5, StatsDir: statsDir, Nested: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := httptest.NewServer(srv.handler())
+	defer hs.Close()
+	root := url.Values{"prefix": {sfs.Root()}}
+
+	var prefixes page[servedPrefix]
+	getJSON(t, hs.URL, "/api/prefixes", nil, http.StatusOK, &prefixes)
+	if got, want := len(prefixes.Items), 1; got != want || prefixes.Items[0].Prefix != sfs.Root() {
+		t.Errorf("got %v, want %v", prefixes.Items, sfs.Root())
+	}
+
+	var pd prefixDetail
+	getJSON(t, hs.URL, "/api/prefix", root, http.StatusOK, &pd)
+
+	// The totals for every directory, and the files in the root, account
+	// for every file and prefix.
+	params := url.Values{"prefix": {sfs.Root()}, "totals": {"true"}}
+	children, pages := getPages[child](t, hs.URL, "/api/children", params)
+	if pages < 2 {
+		t.Errorf("got %v pages, want more than one", pages)
+	}
+	if got, want := int64(len(children)), pd.Files+pd.Prefixes; got != want {
+		t.Errorf("got %v children, want %v", got, want)
+	}
+	files, dirs := pd.Files, int64(1)
+	for i, c := range children {
+		if i > 0 && c.Name <= children[i-1].Name {
+			t.Errorf("children out of order: %v, %v", children[i-1].Name, c.Name)
+		}
+		if c.Dir {
+			files += c.Totals.Files
+			dirs += c.Totals.Prefixes
+		}
+	}
+	if files != want.files+want.hardlinks || dirs != want.prefixes {
+		t.Errorf("got %v files and %v prefixes, want %v and %v", files, dirs, want.files+want.hardlinks, want.prefixes)
+	}
+
+	// find pages end on prefix boundaries and together contain every
+	// prefix and file exactly once.
+	params = url.Values{"prefix": {sfs.Root()}}
+	seen := map[string]bool{}
+	files, dirs, pages = 0, 0, 0
+	for {
+		resp, err := http.Get(hs.URL + "/api/find?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var end pageEnd
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			var f found
+			if err := json.Unmarshal(sc.Bytes(), &f); err != nil {
+				t.Fatal(err)
+			}
+			if len(f.Key) == 0 {
+				if err := json.Unmarshal(sc.Bytes(), &end); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			if seen[f.Key] {
+				t.Errorf("%v found twice", f.Key)
+			}
+			seen[f.Key] = true
+			if f.Dir {
+				dirs++
+			} else {
+				files++
+			}
+		}
+		resp.Body.Close()
+		pages++
+		if len(end.Error) > 0 {
+			t.Fatal(end.Error)
+		}
+		if len(end.Next) == 0 {
+			break
+		}
+		params.Set("after", end.Next)
+	}
+	if pages < 2 || files != want.files+want.hardlinks || dirs != want.prefixes {
+		t.Errorf("got %v pages, %v files and %v prefixes, want %v and %v", pages, files, dirs, want.files+want.hardlinks, want.prefixes)
+	}
+
+	params = url.Values{"prefix": {sfs.Root()}, "expr": {"type=d"}}
+	resp, err := http.Get(hs.URL + "/api/find?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first found
+	if err := json.NewDecoder(resp.Body).Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !first.Dir || first.Key != sfs.Root() {
+		t.Errorf("unexpected result: %+v", first)
+	}
+
+	errs, _ := getPages[errorRecord](t, hs.URL, "/api/errors", url.Values{"prefix": {sfs.Root()}, "limit": {"2"}})
+	if got, want := len(errs), want.errors; got != want || got == 0 {
+		t.Errorf("got %v errors, want %v", got, want)
+	}
+
+	logs, _ := getPages[servedLog](t, hs.URL, "/api/logs", url.Values{"prefix": {sfs.Root()}})
+	if got, want := len(logs), 1; got != want {
+		t.Errorf("got %v logs, want %v", got, want)
+	}
+
+	statsFiles, _ := getPages[statsFile](t, hs.URL, "/api/stats", url.Values{})
+	if got, want := len(statsFiles), 2; got != want {
+		t.Fatalf("got %v, want %v (a dated file and latest)", statsFiles, want)
+	}
+	var summary statsSummary
+	getJSON(t, hs.URL, "/api/stats/latest.idustats", nil, http.StatusOK, &summary)
+	if summary.Prefix != sfs.Root() || summary.Totals.Files != want.files || summary.Totals.Prefixes != want.prefixes {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+	var users page[reports.MergedStats]
+	getJSON(t, hs.URL, "/api/reports/latest.idustats/users", url.Values{"limit": {"3"}}, http.StatusOK, &users)
+	if len(users.Items) != 3 {
+		t.Fatalf("got %v, want 3 users", users.Items)
+	}
+	for i := 1; i < len(users.Items); i++ {
+		if users.Items[i].Bytes > users.Items[i-1].Bytes {
+			t.Errorf("users are not in order of bytes: %v", users.Items)
+		}
+	}
+
+	var er errorResponse
+	for _, tc := range []struct {
+		path   string
+		params url.Values
+		status int
+	}{
+		{"/api/children", url.Values{"prefix": {"/elsewhere"}}, http.StatusNotFound},
+		{"/api/children", url.Values{"prefix": {"relative"}}, http.StatusBadRequest},
+		{"/api/children", url.Values{"prefix": {sfs.Root()}, "limit": {"x"}}, http.StatusBadRequest},
+		{"/api/prefix", url.Values{"prefix": {sfs.Join(sfs.Root(), "not-there")}}, http.StatusNotFound},
+		{"/api/find", url.Values{"prefix": {sfs.Root()}, "expr": {"(("}}, http.StatusBadRequest},
+		{"/api/errors", url.Values{"prefix": {sfs.Root()}, "category": {"x"}}, http.StatusBadRequest},
+		{"/api/stats/../x.idustats", nil, http.StatusNotFound},
+		{"/api/stats/x.idustats", nil, http.StatusNotFound},
+		{"/api/reports/latest.idustats/x", nil, http.StatusNotFound},
+	} {
+		resp, err := http.Get(hs.URL + tc.path + "?" + tc.params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%v %v: got %v, want %v", tc.path, tc.params, resp.StatusCode, tc.status)
+		}
+	}
+
+	srv.timeout = time.Nanosecond
+	getJSON(t, hs.URL, "/api/children", root, http.StatusGatewayTimeout, &er)
+	if !strings.Contains(er.Error, "deadline") {
+		t.Errorf("unexpected error: %v", er.Error)
+	}
+}
+
+func TestServeTimeoutWhileLocked(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	root := filepath.Join(tmpDir, "tree")
+	if err := os.MkdirAll(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.ParseConfig([]byte(fmt.Sprintf(`- prefix: %v
+  database: %v
+`, root, filepath.Join(tmpDir, "db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = t.TempDir()
+	globalConfig = cfg
+
+	// A writer, such as analyze, holds the database.
+	wdb, err := internal.OpenDatabase(ctx, cfg.Prefixes[0], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := newServer(ctx, localfs.New(), cfg, &serveFlags{Timeout: 100 * time.Millisecond, PageSize: 5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := httptest.NewServer(srv.handler())
+	defer hs.Close()
+	var er errorResponse
+	getJSON(t, hs.URL, "/api/children", url.Values{"prefix": {root}}, http.StatusGatewayTimeout, &er)
+	if err := wdb.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The timed out request opens the database once the writer has
+	// finished with it and must then close it again.
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	for waitingToOpen() {
+		if tctx.Err() != nil {
+			t.Fatal("timed out request is still opening the database")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	wdb, err = internal.OpenDatabase(tctx, cfg.Prefixes[0], false)
+	if err != nil {
+		t.Fatalf("database is still locked: %v", err)
+	}
+	wdb.Close(ctx)
+}
+
+// waitingToOpen returns true if any goroutine is still opening, or
+// closing a cancelled open of, a database.
+func waitingToOpen() bool {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	return bytes.Contains(buf, []byte("internal.OpenDatabase.func"))
+}
+
+func TestServeNestedErrors(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	cfg, err := config.ParseConfig([]byte(fmt.Sprintf(`- prefix: /r
+  database: %[1]v/outer
+  database_type: bolt
+- prefix: /r/home/a
+  database: %[1]v/nested
+  database_type: bolt
+`, tmpDir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = t.TempDir()
+	globalConfig = cfg
+
+	for i, keys := range [][]string{
+		{"/r/home/b", "/r/home/x", "/r/var/y"},
+		{"/r/home/a/w", "/r/home/a/z"},
+	} {
+		db, err := internal.OpenDatabase(ctx, cfg.Prefixes[i], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			if err := db.SetError(ctx, types.ErrorPayload{When: time.Now(), Key: k, Payload: []byte("oops"), Attempts: 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv, err := newServer(ctx, localfs.New(), cfg, &serveFlags{Timeout: time.Minute, PageSize: 1, Nested: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := httptest.NewServer(srv.handler())
+	defer hs.Close()
+
+	// The errors stored in the nested database are merged, in key order,
+	// with those of the outer one.
+	items, pages := getPages[errorRecord](t, hs.URL, "/api/errors", url.Values{"prefix": {"/r/home"}})
+	var keys []string
+	for _, e := range items {
+		keys = append(keys, e.Key)
+	}
+	if got, want := keys, []string{"/r/home/a/w", "/r/home/a/z", "/r/home/b", "/r/home/x"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := pages, 4; got != want {
+		t.Errorf("got %v pages, want %v", got, want)
+	}
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/gob"
 	"fmt"
@@ -16,12 +17,13 @@ import (
 	"time"
 
 	"cloudeng.io/algo/container/heap"
-	"cloudeng.io/cmd/idu/internal"
 	"cloudeng.io/cmd/idu/internal/boolexpr"
+	"cloudeng.io/cmd/idu/internal/config"
 	"cloudeng.io/cmd/idu/internal/database"
 	"cloudeng.io/cmd/idu/internal/prefixinfo"
 	"cloudeng.io/cmd/idu/internal/reports"
 	"cloudeng.io/cmd/idu/internal/usernames"
+	"cloudeng.io/cmd/idu/stats"
 	"cloudeng.io/cmdutil/flags"
 	"cloudeng.io/file/diskusage"
 	"cloudeng.io/file/filewalk"
@@ -35,25 +37,41 @@ type statsFileFormat struct {
 	Stats      *reports.AllStats
 }
 
-func loadStats(filename string) (statsFileFormat, error) {
+func loadStats(ctx context.Context, filename string) (statsFileFormat, error) {
 	var stats statsFileFormat
-	if filename == "-" {
-		if err := gob.NewDecoder(os.Stdin).Decode(&stats); err != nil {
+	in := os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
 			return statsFileFormat{}, err
 		}
-		return stats, nil
+		defer f.Close()
+		in = f
 	}
-	buf, err := os.ReadFile(filename)
+	rd, err := decryptingReader(ctx, in)
 	if err != nil {
-		return statsFileFormat{}, err
+		return statsFileFormat{}, fmt.Errorf("%v: %v", filename, err)
 	}
-	if err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&stats); err != nil {
+	if err := gob.NewDecoder(rd).Decode(&stats); err != nil {
 		return statsFileFormat{}, err
 	}
 	return stats, nil
 }
 
-func saveStats(dir, file string, stats statsFileFormat) error {
+// saveStats writes stats, encrypted if enc is enabled, to file or, if file
+// is not specified, to a dated file in dir.
+func saveStats(ctx context.Context, dir, file string, enc config.Encryption, stats statsFileFormat) error {
+	buf := &bytes.Buffer{}
+	wr, err := encryptingWriter(ctx, enc, buf)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(wr).Encode(stats); err != nil {
+		return err
+	}
+	if err := wr.Close(); err != nil {
+		return err
+	}
 	if len(file) > 0 {
 		out := os.Stdout
 		if file != "-" {
@@ -64,10 +82,7 @@ func saveStats(dir, file string, stats statsFileFormat) error {
 			}
 			defer out.Close()
 		}
-		return gob.NewEncoder(out).Encode(stats)
-	}
-	buf := &bytes.Buffer{}
-	if err := gob.NewEncoder(buf).Encode(stats); err != nil {
+		_, err := out.Write(buf.Bytes())
 		return err
 	}
 	basename := stats.Date.Format(time.DateTime)
@@ -95,13 +110,17 @@ type computeFlags struct {
 	StatsDir  string          `subcmd:"stats-dir,stats,'directory that stats files are written to'"`
 	StatsFile string          `subcmd:"stats-file,,'write stats to the specified file, rather than a directory, use - for stdout'"`
 	Prefix    flags.Repeating `subcmd:"prefix,,'prefix match expression'"`
+	AsOf      flags.Time      `subcmd:"as-of,,'compute stats for the database as it was at the specified time/date, this requires that history be enabled for the prefix'"`
+	Nested    bool            `subcmd:"nested,true,'include the prefixes stored in the databases of any configured prefixes nested within the specified prefix'"`
+	Subtrees  int             `subcmd:"subtree-depth,3,'number of levels beneath the prefix for which subtree totals are computed, as used by html reports, 0 for none'"`
 }
 
 type viewFlags struct {
 	StatsFlags
-	User  string `subcmd:"user,,display stats for the specified user"`
-	Group string `subcmd:"group,,display stats for the specified group"`
-	Info  bool   `subcmd:"info,false,display metadata for the stats file"`
+	User    string `subcmd:"user,,display stats for the specified user"`
+	Group   string `subcmd:"group,,display stats for the specified group"`
+	Project string `subcmd:"project,,display stats for the specified project"`
+	Info    bool   `subcmd:"info,false,display metadata for the stats file"`
 }
 
 func (st *statsCmds) compute(ctx context.Context, values interface{}, args []string) error {
@@ -114,7 +133,8 @@ func (st *statsCmds) computeFS(ctx context.Context, fwfs filewalk.FS, cf *comput
 
 	parser := boolexpr.NewParser(ctx, fwfs)
 
-	ctx, cfg, rdb, err := internal.OpenPrefixAndDatabase(ctx, globalConfig, args[0], true)
+	when := asOf(cf.AsOf)
+	ctx, cfg, rdb, err := openDatabaseAsOf(ctx, args[0], when, cf.Nested, true)
 	if err != nil {
 		return err
 	}
@@ -128,25 +148,28 @@ func (st *statsCmds) computeFS(ctx context.Context, fwfs filewalk.FS, cf *comput
 		return err
 	}
 
-	sdb, err := st.computeStats(ctx, rdb, match, args[0], cfg.Calculator(), cf.ComputeN, cf.Progress)
+	sdb, err := st.computeStats(ctx, rdb, match, args[0], cfg.Calculator(), cf.ComputeN, cfg.Separator, cf.Subtrees, cf.Progress)
 	if err != nil {
 		rdb.Close(ctx)
 		return err
 	}
 	rdb.Close(ctx)
 
-	// Save stats.
+	// Save stats, dated as of the time they were computed for.
 	stats := statsFileFormat{
 		Prefix:     args[0],
-		Date:       time.Now(),
+		Date:       cmp.Or(when, time.Now()),
 		Expression: match.String(),
 		Stats:      sdb,
 	}
-	return saveStats(cf.StatsDir, cf.StatsFile, stats)
+	return saveStats(ctx, cf.StatsDir, cf.StatsFile, cfg.Encryption, stats)
 }
 
-func (st *statsCmds) computeStats(ctx context.Context, db database.DB, match boolexpr.Matcher, prefix string, calc diskusage.Calculator, topN int, progress bool) (*reports.AllStats, error) {
+func (st *statsCmds) computeStats(ctx context.Context, db database.DB, match boolexpr.Matcher, prefix string, calc diskusage.Calculator, topN int, sep string, depth int, progress bool) (*reports.AllStats, error) {
 	sdb := reports.NewAllStats(prefix, topN)
+	if depth > 0 {
+		sdb.TrackSubtrees(sep, depth)
+	}
 	n := 0
 	err := db.Stream(ctx, prefix, func(_ context.Context, k string, v []byte) {
 		if progress && (n != 0 && n%1000 == 0) {
@@ -175,13 +198,19 @@ func (st *statsCmds) computeStats(ctx context.Context, db database.DB, match boo
 	return sdb, err
 }
 
-func (st *statsCmds) view(_ context.Context, values interface{}, args []string) error {
+func (st *statsCmds) view(ctx context.Context, values interface{}, args []string) error {
 	af := values.(*viewFlags)
-	if len(af.User) != 0 && len(af.Group) != 0 {
-		return fmt.Errorf("only one of --user or --group may be specified")
+	n := 0
+	for _, id := range []string{af.User, af.Group, af.Project} {
+		if len(id) != 0 {
+			n++
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("only one of --user, --group or --project may be specified")
 	}
 
-	stats, err := loadStats(args[0])
+	stats, err := loadStats(ctx, args[0])
 	if err != nil {
 		return err
 	}
@@ -197,15 +226,24 @@ func (st *statsCmds) view(_ context.Context, values interface{}, args []string)
 	when := stats.Date
 
 	if len(af.User) != 0 {
-		return st.userOrGroup(af, stats, af.User, usernames.Manager.UIDForName)
+		return st.perID(af, stats, sdb.PerUser, af.User, usernames.Manager.UIDForName, usernames.Manager.NameForUID)
 	}
 
 	if len(af.Group) != 0 {
-		return st.userOrGroup(af, stats, af.Group, usernames.Manager.GIDForName)
+		return st.perID(af, stats, sdb.PerGroup, af.Group, usernames.Manager.GIDForName, usernames.Manager.NameForGID)
+	}
+
+	if len(af.Project) != 0 {
+		return st.perID(af, stats, sdb.PerProject, af.Project, usernames.Manager.ProjectIDForName, usernames.Manager.NameForProjectID)
 	}
 
 	heapFormatter[string]{}.formatTotals(sdb.Prefix, os.Stdout)
 
+	if ages := sdb.AccessAges; ages != nil && ages.Known() {
+		banner(os.Stdout, "=", "Access ages as of: %v\n", ages.When)
+		formatAgeHistogram(ages, os.Stdout)
+	}
+
 	banner(os.Stdout, "=", "Usage by top %v Prefixes as of: %v\n", af.DisplayN, when)
 	heapFormatter[string]{}.formatHeaps(sdb.Prefix, os.Stdout, func(v string) string { return v }, af.DisplayN)
 
@@ -216,11 +254,16 @@ func (st *statsCmds) view(_ context.Context, values interface{}, args []string)
 	banner(os.Stdout, "=", "\nUsage by top %v groups as of: %v\n", af.DisplayN, when)
 	heapFormatter[int64]{}.formatHeaps(sdb.ByGroup, os.Stdout,
 		usernames.Manager.NameForGID, af.DisplayN)
+
+	if sdb.ByProject != nil && sdb.ByProject.Bytes.Len() > 0 {
+		banner(os.Stdout, "=", "\nUsage by top %v projects as of: %v\n", af.DisplayN, when)
+		heapFormatter[int64]{}.formatHeaps(sdb.ByProject, os.Stdout,
+			usernames.Manager.NameForProjectID, af.DisplayN)
+	}
 	return nil
 }
 
-func (st *statsCmds) userOrGroup(af *viewFlags, stats statsFileFormat, name string, mapper func(string) (int64, error)) error {
-	sdb := stats.Stats
+func (st *statsCmds) perID(af *viewFlags, stats statsFileFormat, s reports.PerIDStats, name string, mapper func(string) (int64, error), nameForID func(int64) string) error {
 	when := stats.Date
 
 	id, err := mapper(name)
@@ -229,7 +272,7 @@ func (st *statsCmds) userOrGroup(af *viewFlags, stats statsFileFormat, name stri
 	}
 
 	banner(os.Stdout, "=", "Usage by %v as of: %v\n", name, when)
-	st.formatPerIDStats(sdb.PerUser, os.Stdout, usernames.Manager.NameForUID, map[int64]bool{id: true}, af.DisplayN)
+	st.formatPerIDStats(s, os.Stdout, nameForID, map[int64]bool{id: true}, af.DisplayN)
 	return nil
 }
 
@@ -256,6 +299,10 @@ func (hf heapFormatter[T]) formatHeaps(h *reports.Heaps[T], out io.Writer, value
 	hf.formatHeap(h.Files, out, fmtCount, valueFormatter, n)
 	banner(out, "-", "\nNumber of Prefixes/Directories\n")
 	hf.formatHeap(h.Prefixes, out, fmtCount, valueFormatter, n)
+	if h.SparseSavings != nil && h.SparseSavings.Len() > 0 {
+		banner(out, "-", "\nSparse savings (apparent - allocated bytes)\n")
+		hf.formatHeap(h.SparseSavings, out, fmtSize, valueFormatter, n)
+	}
 }
 
 func (hf heapFormatter[T]) formatTotals(h *reports.Heaps[T], out io.Writer) {
@@ -267,6 +314,19 @@ func (hf heapFormatter[T]) formatTotals(h *reports.Heaps[T], out io.Writer) {
 	fmt.Fprintf(out, "Total:     %v\n", fmtCount(h.TotalFiles+h.TotalPrefixes))
 	fmt.Fprintf(out, "Links:     %v\n", fmtCount(h.TotalHardlinks))
 	fmt.Fprintf(out, "Link dirs: %v\n\n", fmtCount(h.TotalHardlinkDirs))
+	if h.TotalSparseFiles > 0 || h.TotalOverAllocatedFiles > 0 {
+		fmt.Fprintf(out, "Sparse files:         %v\n", fmtCount(h.TotalSparseFiles))
+		fmt.Fprintf(out, "Sparse savings:       %v\n", fmtSize(h.TotalSparseSavings))
+		fmt.Fprintf(out, "Over-allocated files: %v\n", fmtCount(h.TotalOverAllocatedFiles))
+		fmt.Fprintf(out, "Over-allocated bytes: %v\n\n", fmtSize(h.TotalOverAllocatedBytes))
+	}
+}
+
+func formatAgeHistogram(h *stats.AgeHistogram, out io.Writer) {
+	for i := range h.Files {
+		fmt.Fprintf(out, "%-8v: %v files, %v\n", h.Label(i), fmtCount(h.Files[i]), fmtSize(h.Bytes[i]))
+	}
+	fmt.Fprintf(out, "%-8v: %v files, %v\n\n", "unknown", fmtCount(h.UnknownFiles), fmtSize(h.UnknownBytes))
 }
 
 func (st *statsCmds) formatPerIDStats(s reports.PerIDStats, out io.Writer, nameForID func(int64) string, ids map[int64]bool, n int) {
@@ -0,0 +1,96 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package stats
+
+import (
+	"fmt"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// DefaultAgeBuckets are the upper bounds of the buckets used for age
+// histograms by default.
+var DefaultAgeBuckets = []time.Duration{
+	day, 7 * day, 30 * day, 90 * day, 180 * day, 365 * day, 2 * 365 * day, 5 * 365 * day,
+}
+
+// AgeHistogram records the number of files, and their total size, whose
+// age relative to When falls within each of the buckets defined by Bounds.
+// Files and Bytes have one more element than Bounds, with the last
+// element counting all files older than the largest bound. Files
+// for which no time is available are counted by UnknownFiles and
+// UnknownBytes.
+type AgeHistogram struct {
+	When         time.Time
+	Bounds       []time.Duration
+	Files        []int64
+	Bytes        []int64
+	UnknownFiles int64
+	UnknownBytes int64
+}
+
+// NewAgeHistogram returns a new AgeHistogram for ages relative to when,
+// using DefaultAgeBuckets if no bounds are specified. The bounds must
+// be in increasing order.
+func NewAgeHistogram(when time.Time, bounds ...time.Duration) *AgeHistogram {
+	if len(bounds) == 0 {
+		bounds = DefaultAgeBuckets
+	}
+	return &AgeHistogram{
+		When:   when,
+		Bounds: bounds,
+		Files:  make([]int64, len(bounds)+1),
+		Bytes:  make([]int64, len(bounds)+1),
+	}
+}
+
+// Add records a file of the specified size and time. A zero time
+// is recorded as unknown and times after When are treated as having
+// an age of zero.
+func (h *AgeHistogram) Add(t time.Time, bytes int64) {
+	if t.IsZero() {
+		h.UnknownFiles++
+		h.UnknownBytes += bytes
+		return
+	}
+	age := h.When.Sub(t)
+	i := 0
+	for ; i < len(h.Bounds); i++ {
+		if age < h.Bounds[i] {
+			break
+		}
+	}
+	h.Files[i]++
+	h.Bytes[i] += bytes
+}
+
+// Known returns true if any files with a known time have been recorded.
+func (h *AgeHistogram) Known() bool {
+	for _, f := range h.Files {
+		if f > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Label returns a label for the i'th bucket, e.g. "< 7d" or ">= 5y".
+func (h *AgeHistogram) Label(i int) string {
+	if i < len(h.Bounds) {
+		return "< " + fmtAge(h.Bounds[i])
+	}
+	return ">= " + fmtAge(h.Bounds[len(h.Bounds)-1])
+}
+
+func fmtAge(d time.Duration) string {
+	switch {
+	case d%(365*day) == 0:
+		return fmt.Sprintf("%vy", int64(d/(365*day)))
+	case d%day == 0:
+		return fmt.Sprintf("%vd", int64(d/day))
+	}
+	return d.String()
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package stats_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/boolexpr"
+	"cloudeng.io/cmd/idu/internal/prefixinfo"
+	"cloudeng.io/cmd/idu/stats"
+	"cloudeng.io/file"
+)
+
+func TestAgeHistogram(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	h := stats.NewAgeHistogram(now, day, 30*day, 365*day)
+	h.Add(now.Add(-time.Hour), 1)
+	h.Add(now.Add(time.Hour), 2)
+	h.Add(now.Add(-2*day), 4)
+	h.Add(now.Add(-400*day), 8)
+	h.Add(time.Time{}, 16)
+
+	if got, want := h.Files, []int64{2, 1, 0, 1}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := h.Bytes, []int64{3, 4, 0, 8}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := h.UnknownFiles, int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := h.UnknownBytes, int64(16); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	labels := []string{}
+	for i := range h.Files {
+		labels = append(labels, h.Label(i))
+	}
+	if got, want := labels, []string{"< 1d", "< 30d", "< 1y", ">= 1y"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAccessAges(t *testing.T) {
+	now := time.Now()
+	withAccess := func(access time.Time) any {
+		return prefixinfo.XAttrAndTimes{
+			XAttr: file.XAttr{UID: 1, GID: 2, Blocks: 1},
+			Times: prefixinfo.Times{Access: access},
+		}
+	}
+	pi := prefixinfo.New("dir", file.NewInfo("dir", 1, 0700, now, withAccess(now)))
+	pi.AppendInfoList(file.InfoList{
+		file.NewInfo("a", 10, 0600, now, withAccess(now.Add(-time.Hour))),
+		file.NewInfo("b", 20, 0600, now, withAccess(now.Add(-100*24*time.Hour))),
+		file.NewInfo("c", 40, 0600, now, prefixinfo.NewSysInfo(1, 2, 3, 4, 1)),
+	})
+	match := boolexpr.AlwaysMatch(boolexpr.NewParserTests(context.Background(), nil))
+	h := stats.NewAgeHistogram(now)
+	totals, _, _, _ := stats.ComputeAllTotals("dir", &pi, sumSizeAndBlocks{}, match, h)
+	if got, want := totals.Files, int64(3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := h.Bytes, []int64{10, 0, 0, 0, 20, 0, 0, 0, 0}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := h.UnknownBytes, int64(40); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 
 	"cloudeng.io/cmd/idu/internal/boolexpr"
+	"cloudeng.io/cmd/idu/internal/decoder"
 	"cloudeng.io/cmd/idu/internal/prefixinfo"
 	"cloudeng.io/file/diskusage"
 )
@@ -24,13 +25,18 @@ type Totals struct {
 	PrefixBytes  int64 // total size of prefixes
 	Hardlinks    int64 // number of hardlinks
 	HardlinkDirs int64 // number of hardlinks to directories
+
+	SparseFiles        int64 // number of files with fewer bytes allocated than their size
+	SparseSavings      int64 // total of apparent minus allocated bytes for sparse files
+	OverAllocatedFiles int64 // number of over-allocated files, see prefixinfo.Allocation
+	OverAllocatedBytes int64 // total of allocated minus apparent bytes for over-allocated files
 }
 
 type PerIDTotals []Totals
 
 func (t *Totals) AppendBinary(data []byte) []byte {
 	// Add a version etc for windows since IDs will be strings there.
-	data = binary.AppendVarint(data, 0x1) // Version
+	data = binary.AppendVarint(data, 0x2) // Version
 	data = binary.AppendVarint(data, t.ID)
 	data = binary.AppendVarint(data, t.Files)
 	data = binary.AppendVarint(data, t.Bytes)
@@ -40,6 +46,10 @@ func (t *Totals) AppendBinary(data []byte) []byte {
 	data = binary.AppendVarint(data, t.SubPrefixes)
 	data = binary.AppendVarint(data, t.Hardlinks)
 	data = binary.AppendVarint(data, t.HardlinkDirs)
+	data = binary.AppendVarint(data, t.SparseFiles)
+	data = binary.AppendVarint(data, t.SparseSavings)
+	data = binary.AppendVarint(data, t.OverAllocatedFiles)
+	data = binary.AppendVarint(data, t.OverAllocatedBytes)
 	return data
 }
 
@@ -47,37 +57,42 @@ func (t *Totals) MarshalBinary() (data []byte, err error) {
 	return t.AppendBinary(make([]byte, 0, 100)), nil
 }
 
-func (t *Totals) DecodeBinary(data []byte) []byte {
-	var n int
-	ver, n := binary.Varint(data)
-	if ver != 0x1 {
-		panic(fmt.Sprintf("unsupported version: %v", ver))
+// DecodeBinary decodes a Totals created by AppendBinary and returns the
+// remaining data. An error is returned for unsupported versions and for
+// truncated or otherwise invalid data.
+func (t *Totals) DecodeBinary(data []byte) ([]byte, error) {
+	d := decoder.New("Totals", data)
+	t.decode(d)
+	return d.Remaining(), d.Err()
+}
+
+func (t *Totals) decode(d *decoder.T) {
+	ver := d.Varint("version")
+	if d.Err() == nil && ver != 0x1 && ver != 0x2 {
+		d.Failf("unsupported version: %v", ver)
+		return
+	}
+	t.ID = d.Varint("id")
+	t.Files = d.Varint("files")
+	t.Bytes = d.Varint("bytes")
+	t.StorageBytes = d.Varint("storage bytes")
+	t.PrefixBytes = d.Varint("prefix bytes")
+	t.Prefix = d.Varint("prefix")
+	t.SubPrefixes = d.Varint("sub prefixes")
+	t.Hardlinks = d.Varint("hardlinks")
+	t.HardlinkDirs = d.Varint("hardlink dirs")
+	if ver == 0x1 {
+		return
 	}
-	data = data[n:]
-	id, n := binary.Varint(data)
-	data = data[n:]
-	t.ID = id
-	t.Files, n = binary.Varint(data)
-	data = data[n:]
-	t.Bytes, n = binary.Varint(data)
-	data = data[n:]
-	t.StorageBytes, n = binary.Varint(data)
-	data = data[n:]
-	t.PrefixBytes, n = binary.Varint(data)
-	data = data[n:]
-	t.Prefix, n = binary.Varint(data)
-	data = data[n:]
-	t.SubPrefixes, n = binary.Varint(data)
-	data = data[n:]
-	t.Hardlinks, n = binary.Varint(data)
-	data = data[n:]
-	t.HardlinkDirs, n = binary.Varint(data)
-	return data[n:]
+	t.SparseFiles = d.Varint("sparse files")
+	t.SparseSavings = d.Varint("sparse savings")
+	t.OverAllocatedFiles = d.Varint("over allocated files")
+	t.OverAllocatedBytes = d.Varint("over allocated bytes")
 }
 
 func (t *Totals) UnmarshalBinary(data []byte) error {
-	t.DecodeBinary(data)
-	return nil
+	_, err := t.DecodeBinary(data)
+	return err
 }
 
 func (pid PerIDTotals) AppendBinary(data []byte) []byte {
@@ -92,20 +107,21 @@ func (pid PerIDTotals) MarshalBinary() (data []byte, err error) {
 	return pid.AppendBinary(make([]byte, 0, 100)), nil
 }
 
-func (pid *PerIDTotals) DecodeBinary(data []byte) []byte {
-	var n int
-	l, n := binary.Uvarint(data)
-	data = data[n:]
+// DecodeBinary decodes a PerIDTotals created by AppendBinary and returns
+// the remaining data.
+func (pid *PerIDTotals) DecodeBinary(data []byte) ([]byte, error) {
+	d := decoder.New("PerIDTotals", data)
+	l := d.Length("number of totals")
 	*pid = make([]Totals, l)
 	for i := range *pid {
-		data = (*pid)[i].DecodeBinary(data)
+		(*pid)[i].decode(d)
 	}
-	return data
+	return d.Remaining(), d.Err()
 }
 
 func (pid *PerIDTotals) UnmarshalBinary(data []byte) error {
-	pid.DecodeBinary(data)
-	return nil
+	_, err := pid.DecodeBinary(data)
+	return err
 }
 
 func (t Totals) update(bytes, storageBytes int64) Totals {
@@ -115,6 +131,19 @@ func (t Totals) update(bytes, storageBytes int64) Totals {
 	return t
 }
 
+func (t Totals) updateAllocation(bytes, blocks int64) Totals {
+	allocated, sparse, overAllocated := prefixinfo.Allocation(bytes, blocks)
+	if sparse {
+		t.SparseFiles++
+		t.SparseSavings += bytes - allocated
+	}
+	if overAllocated {
+		t.OverAllocatedFiles++
+		t.OverAllocatedBytes += allocated - bytes
+	}
+	return t
+}
+
 func (t Totals) incHardlinks() Totals {
 	t.Hardlinks++
 	return t
@@ -127,6 +156,20 @@ func (t Totals) incSubPrefixes() Totals {
 
 type perID map[int64]Totals
 
+// set and update are used for per-project totals, which ignore
+// project zero, the default project.
+func (pid perID) set(id int64, t Totals) {
+	if id != 0 {
+		pid[id] = t
+	}
+}
+
+func (pid perID) update(id int64, fn func(Totals) Totals) {
+	if id != 0 {
+		pid[id] = fn(pid[id])
+	}
+}
+
 func (pid perID) flatten() PerIDTotals {
 	tl := make(PerIDTotals, 0, len(pid))
 	for id, t := range pid {
@@ -148,6 +191,20 @@ const verbose = false
 //  3. The size of this prefix is included in the totals for the prefix, but
 //     the sizes of prefixes it contains are not.
 func ComputeTotals(prefix string, pi *prefixinfo.T, du diskusage.Calculator, match boolexpr.Matcher) (totals Totals, perUser, perGroup PerIDTotals) {
+	totals, perUser, perGroup, _ = computeTotals(prefix, pi, du, match, nil)
+	return
+}
+
+// ComputeAllTotals is like ComputeTotals but in addition computes
+// per-project totals and records the access time of every file included
+// in the totals in the supplied histogram, if it is not nil. Files in
+// project zero, the default project, are not included in the per-project
+// totals.
+func ComputeAllTotals(prefix string, pi *prefixinfo.T, du diskusage.Calculator, match boolexpr.Matcher, accessAges *AgeHistogram) (totals Totals, perUser, perGroup, perProject PerIDTotals) {
+	return computeTotals(prefix, pi, du, match, accessAges)
+}
+
+func computeTotals(prefix string, pi *prefixinfo.T, du diskusage.Calculator, match boolexpr.Matcher, accessAges *AgeHistogram) (totals Totals, perUser, perGroup, perProject PerIDTotals) {
 	if !match.Prefix(prefix, pi) {
 		return
 	}
@@ -161,9 +218,10 @@ func ComputeTotals(prefix string, pi *prefixinfo.T, du diskusage.Calculator, mat
 	totals.Bytes = pi.Size()
 	totals.StorageBytes = du.Calculate(pi.Size(), xattr.Blocks)
 
-	user, group := make(perID), make(perID)
+	user, group, project := make(perID), make(perID), make(perID)
 	user[xattr.UID] = totals
 	group[xattr.GID] = totals
+	project.set(pi.ProjectID(), totals)
 
 	var blocks int64
 	if verbose {
@@ -178,6 +236,7 @@ func ComputeTotals(prefix string, pi *prefixinfo.T, du diskusage.Calculator, mat
 			totals.SubPrefixes++
 			user[xattr.UID] = user[xattr.UID].incSubPrefixes()
 			group[xattr.GID] = group[xattr.GID].incSubPrefixes()
+			project.update(pi.ProjectID(), Totals.incSubPrefixes)
 			continue
 		}
 		xattr := pi.XAttrInfo(fi)
@@ -185,14 +244,29 @@ func ComputeTotals(prefix string, pi *prefixinfo.T, du diskusage.Calculator, mat
 			totals.Hardlinks++
 			user[xattr.UID] = user[xattr.UID].incHardlinks()
 			group[xattr.GID] = group[xattr.GID].incHardlinks()
+			project.update(pi.ProjectIDInfo(fi), Totals.incHardlinks)
 			continue
 		}
 
 		bytes := fi.Size()
 		storageBytes := du.Calculate(bytes, xattr.Blocks)
-		totals = totals.update(bytes, storageBytes)
-		user[xattr.UID] = user[xattr.UID].update(bytes, storageBytes)
-		group[xattr.GID] = group[xattr.GID].update(bytes, storageBytes)
+		// Only regular files can be sparse or over-allocated, as per the
+		// sparse operand, symlinks, devices etc. have no blocks allocated.
+		regular := fi.Mode().IsRegular()
+		add := func(t Totals) Totals {
+			t = t.update(bytes, storageBytes)
+			if regular {
+				t = t.updateAllocation(bytes, xattr.Blocks)
+			}
+			return t
+		}
+		totals = add(totals)
+		user[xattr.UID] = add(user[xattr.UID])
+		group[xattr.GID] = add(group[xattr.GID])
+		project.update(pi.ProjectIDInfo(fi), add)
+		if accessAges != nil {
+			accessAges.Add(pi.TimesInfo(fi).Access, bytes)
+		}
 
 		if verbose {
 			fmt.Printf("%v\t%v/%v\n", (xattr.Blocks*512)/1024, prefix, fi.Name())
@@ -205,5 +279,5 @@ func ComputeTotals(prefix string, pi *prefixinfo.T, du diskusage.Calculator, mat
 		fmt.Printf("%v\t%v/\n", kb, prefix)
 	}
 
-	return totals, user.flatten(), group.flatten()
+	return totals, user.flatten(), group.flatten(), project.flatten()
 }
@@ -6,9 +6,11 @@ package stats_test
 
 import (
 	"context"
+	"io/fs"
 	"reflect"
 	"slices"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -35,18 +37,18 @@ func TestTotals(t *testing.T) {
 	ug00d, ug10d, ug01d, ug11d, ugOtherd := testutil.TestdataIDCombinationsDirs(modTime, uid, gid, 200)
 
 	perUserStats := []stats.PerIDTotals{
-		{{uid, 2, 1, 1, 4, 8, 1, 0, 0}},
-		{{uid, 1, 1, 1, 2, 4, 1, 0, 0}, {uid + 1, 1, 1, 0, 2, 4, 0, 0, 0}},
-		{{uid, 2, 1, 1, 4, 8, 1, 0, 0}},
-		{{uid, 1, 1, 1, 2, 4, 1, 0, 0}, {uid + 1, 1, 1, 0, 2, 4, 0, 0, 0}},
-		{{uid, 0, 1, 2, 1, 2, 1, 0, 0}, {uid + 1, 2, 0, 0, 3, 6, 0, 0, 0}},
+		{{uid, 2, 1, 1, 4, 8, 1, 0, 0, 0, 0, 0, 0}},
+		{{uid, 1, 1, 1, 2, 4, 1, 0, 0, 0, 0, 0, 0}, {uid + 1, 1, 1, 0, 2, 4, 0, 0, 0, 0, 0, 0, 0}},
+		{{uid, 2, 1, 1, 4, 8, 1, 0, 0, 0, 0, 0, 0}},
+		{{uid, 1, 1, 1, 2, 4, 1, 0, 0, 0, 0, 0, 0}, {uid + 1, 1, 1, 0, 2, 4, 0, 0, 0, 0, 0, 0, 0}},
+		{{uid, 0, 1, 2, 1, 2, 1, 0, 0, 0, 0, 0, 0}, {uid + 1, 2, 0, 0, 3, 6, 0, 0, 0, 0, 0, 0, 0}},
 	}
 	perGroupStats := []stats.PerIDTotals{
-		{{gid, 2, 1, 1, 4, 8, 1, 0, 0}},
-		{{gid, 2, 1, 1, 4, 8, 1, 0, 0}},
-		{{gid, 1, 1, 1, 2, 4, 1, 0, 0}, {gid + 1, 1, 1, 0, 2, 4, 0, 0, 0}},
-		{{gid, 1, 1, 1, 2, 4, 1, 0, 0}, {gid + 1, 1, 1, 0, 2, 4, 0, 0, 0}},
-		{{gid, 0, 1, 2, 1, 2, 1, 0, 0}, {gid + 1, 2, 0, 0, 3, 6, 0, 0, 0}},
+		{{gid, 2, 1, 1, 4, 8, 1, 0, 0, 0, 0, 0, 0}},
+		{{gid, 2, 1, 1, 4, 8, 1, 0, 0, 0, 0, 0, 0}},
+		{{gid, 1, 1, 1, 2, 4, 1, 0, 0, 0, 0, 0, 0}, {gid + 1, 1, 1, 0, 2, 4, 0, 0, 0, 0, 0, 0, 0}},
+		{{gid, 1, 1, 1, 2, 4, 1, 0, 0, 0, 0, 0, 0}, {gid + 1, 1, 1, 0, 2, 4, 0, 0, 0, 0, 0, 0, 0}},
+		{{gid, 0, 1, 2, 1, 2, 1, 0, 0, 0, 0, 0, 0}, {gid + 1, 2, 0, 0, 3, 6, 0, 0, 0, 0, 0, 0, 0}},
 	}
 
 	parser := boolexpr.NewParserTests(context.Background(), nil)
@@ -234,3 +236,108 @@ func TestTotalsMatch(t *testing.T) {
 	}
 	testLens(t, us, gs, 0, 0)
 }
+
+func TestAllocation(t *testing.T) {
+	modTime := time.Now()
+	pi := prefixinfo.New("dir", file.NewInfo("dir", 1, 0700, modTime, prefixinfo.NewSysInfo(1, 2, 3, 4, 1)))
+	pi.AppendInfoList(file.InfoList{
+		// 4096 bytes in 1 block, ie. sparse.
+		file.NewInfo("sparse-u1", 4096, 0600, modTime, prefixinfo.NewSysInfo(1, 2, 3, 5, 1)),
+		file.NewInfo("sparse-u2", 8192, 0600, modTime, prefixinfo.NewSysInfo(2, 2, 3, 6, 2)),
+		file.NewInfo("dense", 4096, 0600, modTime, prefixinfo.NewSysInfo(1, 2, 3, 7, 8)),
+		// 1MiB allocated for a 1 byte file.
+		file.NewInfo("preallocated", 1, 0600, modTime, prefixinfo.NewSysInfo(1, 2, 3, 8, 2048)),
+		// Symlinks, devices etc. have a size, but no blocks allocated
+		// and are neither sparse nor over-allocated.
+		file.NewInfo("symlink", 4096, fs.ModeSymlink|0777, modTime, prefixinfo.NewSysInfo(1, 2, 3, 9, 0)),
+		file.NewInfo("device", 1024, fs.ModeDevice|0600, modTime, prefixinfo.NewSysInfo(2, 2, 3, 10, 0)),
+	})
+	match := boolexpr.AlwaysMatch(boolexpr.NewParserTests(context.Background(), nil))
+	totals, perUser, _ := stats.ComputeTotals("dir", &pi, sumSizeAndBlocks{}, match)
+	if got, want := totals.SparseFiles, int64(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := totals.SparseSavings, int64(4096-512+8192-1024); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := totals.OverAllocatedFiles, int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := totals.OverAllocatedBytes, int64(2048*512-1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	sort.Slice(perUser, func(i, j int) bool { return perUser[i].ID < perUser[j].ID })
+	if got, want := perUser[0].SparseSavings, int64(4096-512); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := perUser[1].SparseSavings, int64(8192-1024); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var decoded stats.Totals
+	buf, _ := totals.MarshalBinary()
+	if err := decoded.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decoded, totals; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProjectTotals(t *testing.T) {
+	modTime := time.Now()
+	withProject := func(ino uint64, blocks, project int64) any {
+		return prefixinfo.XAttrAndTimes{
+			XAttr:     file.XAttr{UID: 1, GID: 2, Device: 3, FileID: ino, Blocks: blocks},
+			ProjectID: project,
+		}
+	}
+	pi := prefixinfo.New("dir", file.NewInfo("dir", 1, 0700, modTime, withProject(4, 1, 10)))
+	pi.AppendInfoList(file.InfoList{
+		file.NewInfo("a", 10, 0600, modTime, withProject(5, 1, 10)),
+		file.NewInfo("b", 20, 0600, modTime, withProject(6, 2, 11)),
+		file.NewInfo("c", 40, 0600, modTime, withProject(7, 4, 0)),
+		file.NewInfo("d", 0, 0700|fs.ModeDir, modTime, withProject(8, 1, 10)),
+	})
+	match := boolexpr.AlwaysMatch(boolexpr.NewParserTests(context.Background(), nil))
+	totals, _, _, perProject := stats.ComputeAllTotals("dir", &pi, sumSizeAndBlocks{}, match, nil)
+	if got, want := totals.Bytes, int64(1+10+20+40); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	sort.Slice(perProject, func(i, j int) bool { return perProject[i].ID < perProject[j].ID })
+	// Project zero is not reported.
+	if got, want := len(perProject), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	p10 := stats.Totals{ID: 10, Prefix: 1, Files: 1, Bytes: 11, StorageBytes: 13, PrefixBytes: 1, SubPrefixes: 1}
+	p11 := stats.Totals{ID: 11, Files: 1, Bytes: 20, StorageBytes: 22}
+	if got, want := perProject[0], p10; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if got, want := perProject[1], p11; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestTotalsDecodeInvalid(t *testing.T) {
+	pid := stats.PerIDTotals{{ID: 1, Files: 2, Bytes: 300}, {ID: 2, Files: 4, SparseFiles: 1}}
+	buf, _ := pid.MarshalBinary()
+	var decoded stats.PerIDTotals
+	if err := decoded.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decoded, pid; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for i := range buf {
+		if err := decoded.UnmarshalBinary(buf[:i]); err == nil {
+			t.Errorf("%v: expected an error for truncated data", i)
+		}
+	}
+
+	var totals stats.Totals
+	err := totals.UnmarshalBinary([]byte{0x6})
+	if err == nil || !strings.Contains(err.Error(), "unsupported version: 3") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2024 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal"
+	"cloudeng.io/cmd/idu/internal/boolexpr"
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/database"
+	"cloudeng.io/cmd/idu/internal/database/memdb"
+	"cloudeng.io/cmd/idu/internal/reports"
+	"cloudeng.io/cmd/idu/internal/synthfs"
+)
+
+// setupSynthetic configures a single prefix for the root of sfs that
+// uses an in-memory database, with any additional configuration supplied
+// as yaml lines.
+func setupSynthetic(t testing.TB, sfs *synthfs.FS, extra ...string) config.T {
+	location := fmt.Sprintf("%v-%p", t.Name(), sfs)
+	t.Cleanup(func() { memdb.Remove(location) })
+	cfg, err := config.ParseConfig([]byte(fmt.Sprintf(`- prefix: %v
+  database: %v
+  database_type: memory
+  concurrent_scans: 4
+  concurrent_stats: 8
+%v`, sfs.Root(), location, strings.Join(extra, ""))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.LogDir = t.TempDir()
+	globalConfig = cfg
+	return cfg
+}
+
+// syntheticTotals walks sfs to compute the totals that analyze and stats
+// are expected to report, with the first name seen for any hard linked
+// file counted as a file and all others as hard links.
+type syntheticTotals struct {
+	prefixes, files, hardlinks, bytes int64
+	userFiles                         map[int64]int64
+	errors                            int
+}
+
+func computeSyntheticTotals(t testing.TB, sfs *synthfs.FS) syntheticTotals {
+	ctx := context.Background()
+	st := syntheticTotals{userFiles: map[int64]int64{}}
+	inodes := map[uint64]bool{}
+	var walk func(dir string)
+	walk = func(dir string) {
+		fi, err := sfs.Lstat(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.prefixes++
+		st.bytes += fi.Size()
+		sc := sfs.LevelScanner(dir)
+		for sc.Scan(ctx, 100) {
+			for _, e := range sc.Contents() {
+				p := sfs.Join(dir, e.Name)
+				if e.IsDir() {
+					walk(p)
+					continue
+				}
+				fi, err := sfs.Lstat(ctx, p)
+				if err != nil {
+					st.errors++
+					continue
+				}
+				xattr, _ := sfs.XAttr(ctx, p, fi)
+				if inodes[xattr.FileID] {
+					st.hardlinks++
+					continue
+				}
+				inodes[xattr.FileID] = true
+				st.files++
+				st.bytes += fi.Size()
+				st.userFiles[xattr.UID]++
+			}
+		}
+		if sc.Err() != nil {
+			st.errors++
+		}
+	}
+	walk(sfs.Root())
+	return st
+}
+
+func analyzeSynthetic(ctx context.Context, t testing.TB, sfs *synthfs.FS) {
+	alz := &analyzeCmd{}
+	if err := alz.analyzeFS(ctx, sfs, &analyzeFlags{}, []string{sfs.Root()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func statsSynthetic(ctx context.Context, t testing.TB, cfg config.T, sfs *synthfs.FS) *reports.AllStats {
+	ctx, pcfg, db, err := internal.OpenPrefixAndDatabase(ctx, cfg, sfs.Root(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	return statsSyntheticDB(ctx, t, db, pcfg, sfs)
+}
+
+func statsSyntheticDB(ctx context.Context, t testing.TB, db database.DB, pcfg config.Prefix, sfs *synthfs.FS) *reports.AllStats {
+	match, err := boolexpr.CreateMatcher(boolexpr.NewParser(ctx, sfs),
+		boolexpr.WithEmptyEntryValue(true),
+		boolexpr.WithFilewalkFS(sfs),
+		boolexpr.WithHardlinkHandling(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &statsCmds{}
+	all, err := st.computeStats(ctx, db, match, sfs.Root(), pcfg.Calculator(), 10, pcfg.Separator, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return all
+}
+
+func TestSynthetic(t *testing.T) {
+	testSynthetic(t)
+}
+
+func TestSyntheticCompactKeys(t *testing.T) {
+	testSynthetic(t, "  key_encoding: compact\n")
+}
+
+func testSynthetic(t *testing.T, extra ...string) {
+	ctx := context.Background()
+	for i, opts := range [][]synthfs.Option{
+		{synthfs.WithShape(3, 5, 20)},
+		{synthfs.WithShape(2, 8, 50),
+			synthfs.WithUIDs(synthfs.Zipf(1000, 10, 1.2)),
+			synthfs.WithGIDs(synthfs.Uniform(10, 20, 30)),
+			synthfs.WithSizes(0, 1<<32),
+			synthfs.WithHardlinks(0.1)},
+		{synthfs.WithShape(3, 4, 10),
+			synthfs.WithHardlinks(0.05),
+			synthfs.WithPermissionErrors(0.05),
+			synthfs.WithNotExistErrors(0.01)},
+	} {
+		sfs := synthfs.New("/synthetic", uint64(i), opts...)
+		cfg := setupSynthetic(t, sfs, extra...)
+		want := computeSyntheticTotals(t, sfs)
+		analyzeSynthetic(ctx, t, sfs)
+
+		ctx, _, db, err := internal.OpenPrefixAndDatabase(ctx, cfg, sfs.Root(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, summary := getLastLog(ctx, t, db)
+		if got, want := summary.PrefixesFinished, want.prefixes; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := summary.Files, want.files+want.hardlinks; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := len(scanErrors(ctx, t, db, sfs, sfs.Root())), want.errors; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		db.Close(ctx)
+
+		all := statsSynthetic(ctx, t, cfg, sfs)
+		h := all.Prefix
+		for _, tc := range []struct {
+			name      string
+			got, want int64
+		}{
+			{"prefixes", h.TotalPrefixes, want.prefixes},
+			{"files", h.TotalFiles, want.files},
+			{"hardlinks", h.TotalHardlinks, want.hardlinks},
+			{"bytes", h.TotalBytes, want.bytes},
+		} {
+			if tc.got != tc.want {
+				t.Errorf("%v: %v: got %v, want %v", i, tc.name, tc.got, tc.want)
+			}
+		}
+		for uid, files := range want.userFiles {
+			if got, want := all.PerUser.ByPrefix[uid].TotalFiles, files; got != want {
+				t.Errorf("%v: uid %v: got %v, want %v", i, uid, got, want)
+			}
+		}
+	}
+}
+
+// firstDir returns the first directory within dir.
+func firstDir(ctx context.Context, t *testing.T, sfs *synthfs.FS, dir string) string {
+	sc := sfs.LevelScanner(dir)
+	for sc.Scan(ctx, 100) {
+		for _, e := range sc.Contents() {
+			if e.IsDir() {
+				return sfs.Join(dir, e.Name)
+			}
+		}
+	}
+	t.Fatalf("no directories in %v: %v", dir, sc.Err())
+	return ""
+}
+
+func TestSyntheticNested(t *testing.T) {
+	ctx := context.Background()
+	sfs := synthfs.New("/synthetic", 1, synthfs.WithShape(3, 4, 10), synthfs.WithHardlinks(0.05))
+	outer := firstDir(ctx, t, sfs, sfs.Root())
+	inner := firstDir(ctx, t, sfs, outer)
+	var extra []string
+	for _, p := range []string{inner, outer} {
+		location := fmt.Sprintf("%v-%v", t.Name(), p)
+		t.Cleanup(func() { memdb.Remove(location) })
+		extra = append(extra, fmt.Sprintf("- prefix: %v\n  database: %v\n  database_type: memory\n  concurrent_scans: 4\n", p, location))
+	}
+	setupSynthetic(t, sfs, extra...)
+	want := computeSyntheticTotals(t, sfs)
+
+	// Analyzing all three prefixes together stores each subtree only in
+	// the database of its own prefix.
+	alz := &analyzeCmd{}
+	if err := alz.analyzeFS(ctx, sfs, &analyzeFlags{}, []string{sfs.Root(), outer, inner}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := func(nested bool) (prefixes, files, bytes int64, exported int64) {
+		ctx, pcfg, db, err := openDatabaseAsOf(ctx, sfs.Root(), time.Time{}, nested, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close(ctx)
+		h := statsSyntheticDB(ctx, t, db, pcfg, sfs).Prefix
+		counts, err := exportDatabase(ctx, db, pcfg, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.TotalPrefixes, h.TotalFiles + h.TotalHardlinks, h.TotalBytes, counts["prefix"]
+	}
+
+	expect := func(msg string) {
+		t.Helper()
+		prefixes, files, bytes, exported := stats(true)
+		if prefixes != want.prefixes || files != want.files+want.hardlinks || bytes != want.bytes || exported != want.prefixes {
+			t.Errorf("%v: got %v prefixes, %v files, %v bytes, %v exported, want %v, %v, %v, %v",
+				msg, prefixes, files, bytes, exported, want.prefixes, want.files+want.hardlinks, want.bytes, want.prefixes)
+		}
+	}
+	expect("together")
+	if prefixes, _, _, _ := stats(false); prefixes >= want.prefixes {
+		t.Errorf("got %v prefixes, want fewer than %v", prefixes, want.prefixes)
+	}
+
+	// Analyzing the root on its own stores the nested subtrees in its
+	// database too, but they must not be counted twice.
+	analyzeSynthetic(ctx, t, sfs)
+	if prefixes, _, _, _ := stats(false); prefixes != want.prefixes {
+		t.Errorf("got %v prefixes, want %v", prefixes, want.prefixes)
+	}
+	expect("standalone")
+}
+
+func BenchmarkAnalyzeSynthetic(b *testing.B) {
+	ctx := context.Background()
+	// 111,111 directories and 1,111,110 files.
+	sfs := synthfs.New("/synthetic", 1,
+		synthfs.WithShape(5, 10, 10),
+		synthfs.WithUIDs(synthfs.Zipf(1000, 100, 1.1)),
+		synthfs.WithHardlinks(0.01))
+	for i := 0; i < b.N; i++ {
+		setupSynthetic(b, sfs)
+		analyzeSynthetic(ctx, b, sfs)
+		memdb.Remove(globalConfig.Prefixes[0].Database)
+	}
+}
+
+func BenchmarkStatsSynthetic(b *testing.B) {
+	ctx := context.Background()
+	sfs := synthfs.New("/synthetic", 1,
+		synthfs.WithShape(4, 10, 20),
+		synthfs.WithUIDs(synthfs.Zipf(1000, 100, 1.1)),
+		synthfs.WithHardlinks(0.01))
+	cfg := setupSynthetic(b, sfs)
+	analyzeSynthetic(ctx, b, sfs)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		statsSynthetic(ctx, b, cfg, sfs)
+	}
+}
+
+// BenchmarkKeyEncoding reports the size of, and the time taken to scan,
+// badger and bolt databases for a synthetic tree with 55,987 directories
+// and 559,870 files using each key encoding. The root is deliberately
+// long, as is typical for shared filesystems.
+func BenchmarkKeyEncoding(b *testing.B) {
+	ctx := context.Background()
+	root := "/projects/shared/engineering/nightly-builds/archive"
+	for _, dbType := range []string{config.BadgerDatabase, config.BoltDatabase} {
+		for _, enc := range []string{config.PathKeys, config.CompactKeys} {
+			b.Run(dbType+"-"+enc, func(b *testing.B) {
+				var size, scanned int64
+				var scanTime time.Duration
+				for i := 0; i < b.N; i++ {
+					sfs := synthfs.New(root, 1, synthfs.WithShape(6, 6, 10))
+					tmpDir := b.TempDir()
+					cfg, err := config.ParseConfig([]byte(fmt.Sprintf(`- prefix: %v
+  database: %v
+  database_type: %v
+  key_encoding: %v
+`, root, filepath.Join(tmpDir, "db"), dbType, enc)))
+					if err != nil {
+						b.Fatal(err)
+					}
+					internal.LogDir = tmpDir
+					globalConfig = cfg
+					analyzeSynthetic(ctx, b, sfs)
+					_, after, err := compactDatabase(ctx, root)
+					if err != nil {
+						b.Fatal(err)
+					}
+					size = after.Size()
+					_, _, db, err := internal.OpenPrefixAndDatabase(ctx, cfg, root, true)
+					if err != nil {
+						b.Fatal(err)
+					}
+					start := time.Now()
+					scanned = 0
+					err = db.Scan(ctx, "", func(context.Context, string, []byte) bool {
+						scanned++
+						return true
+					})
+					scanTime = time.Since(start)
+					db.Close(ctx)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(size), "db-bytes")
+				b.ReportMetric(float64(scanTime.Milliseconds()), "scan-ms")
+				b.ReportMetric(float64(scanned), "prefixes")
+			})
+		}
+	}
+}